@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	cf "github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare"
+)
+
+// adminHandler serves the POST /admin/pause and /admin/resume endpoints, authenticated by the bearer token,
+// which pause and resume the enforcement of the accounts whose token Cloudflare still accepts.
+func adminHandler(token string, cfManagers []*cf.CloudflareAccountManager) http.Handler {
+	setEnforcement := func(enabled bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				log.Warnf("Rejected unauthenticated request to %s from %s", r.URL.Path, r.RemoteAddr)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			active := slices.DeleteFunc(slices.Clone(cfManagers), (*cf.CloudflareAccountManager).AuthFailed)
+			errs := make([]error, len(active))
+			g := errgroup.Group{}
+			for i, cfManager := range active {
+				manager := cfManager
+				g.Go(func() error {
+					if err := manager.SetEnforcement(enabled); err != nil {
+						errs[i] = fmt.Errorf("%w for account %s", err, manager.AccountCfg.Name)
+					}
+					return nil
+				})
+			}
+			_ = g.Wait()
+			if err := errors.Join(errs...); err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			state := "resumed"
+			if !enabled {
+				state = "paused"
+			}
+			fmt.Fprintf(w, "enforcement %s for %d accounts\n", state, len(active))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/admin/pause", setEnforcement(false))
+	mux.Handle("/admin/resume", setEnforcement(true))
+	return mux
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	handler := adminHandler("0123456789abcdef", nil)
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		expected      int
+	}{
+		{name: "pause", method: http.MethodPost, path: "/admin/pause", authorization: "Bearer 0123456789abcdef", expected: http.StatusOK},
+		{name: "resume", method: http.MethodPost, path: "/admin/resume", authorization: "Bearer 0123456789abcdef", expected: http.StatusOK},
+		{name: "no token", method: http.MethodPost, path: "/admin/pause", expected: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, path: "/admin/pause", authorization: "Bearer fedcba9876543210", expected: http.StatusUnauthorized},
+		{name: "not a bearer token", method: http.MethodPost, path: "/admin/pause", authorization: "0123456789abcdef", expected: http.StatusUnauthorized},
+		{name: "get", method: http.MethodGet, path: "/admin/pause", authorization: "Bearer 0123456789abcdef", expected: http.StatusMethodNotAllowed},
+		{name: "unknown endpoint", method: http.MethodPost, path: "/admin/stop", authorization: "Bearer 0123456789abcdef", expected: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d: %s", tt.expected, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// blocklistOrigin is the origin of the imported decisions, which origin_action_overrides can target.
+const blocklistOrigin = "blocklist-import"
+
+// parseBlocklist reads a blocklist: one decision per line, either a bare IP or range, or value,action or
+// value,scope,action. The scope defaults to range for the values with a prefix length and to ip for the
+// others, and the action to ban. Empty lines and the ones starting with # are skipped. The decisions last
+// duration, never expiring if it's 0, and their scenario is name.
+func parseBlocklist(r io.Reader, name string, duration time.Duration) ([]*models.Decision, error) {
+	decisions := make([]*models.Decision, 0)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		columns := strings.Split(line, ",")
+		for i := range columns {
+			columns[i] = strings.TrimSpace(columns[i])
+		}
+		value, scope, action := columns[0], "", ""
+		switch len(columns) {
+		case 1:
+		case 2:
+			action = columns[1]
+		case 3:
+			scope, action = columns[1], columns[2]
+		default:
+			return nil, fmt.Errorf("line %d: expected value,scope,action, got %d columns", lineNumber, len(columns))
+		}
+		if scope == "" {
+			scope = "ip"
+			if strings.Contains(value, "/") {
+				scope = "range"
+			}
+		}
+		if action == "" {
+			action = "ban"
+		}
+		scope = strings.ToLower(scope)
+		if !slices.Contains(supportedScopes, scope) {
+			return nil, fmt.Errorf("line %d: unsupported scope %s, valid choices are %s", lineNumber, scope, strings.Join(supportedScopes, ", "))
+		}
+		switch scope {
+		case "ip":
+			if net.ParseIP(value) == nil {
+				return nil, fmt.Errorf("line %d: invalid IP %s", lineNumber, value)
+			}
+		case "range":
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid range %s", lineNumber, value)
+			}
+		}
+		origin, scenario := blocklistOrigin, name
+		decision := &models.Decision{
+			Value:    &value,
+			Scope:    &scope,
+			Type:     &action,
+			Origin:   &origin,
+			Scenario: &scenario,
+		}
+		if duration > 0 {
+			decision.Duration = ptr.Of(duration.String())
+		}
+		decisions = append(decisions, decision)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+// importBlocklist enforces the decisions of the blocklist file with the infra deployed in every account,
+// without a LAPI stream. The decisions are filtered by type like the ones of the stream. The bouncer must
+// be stopped, its state overwriting the imported decisions, which then last until duration elapses or
+// the next start of the bouncer reconciles the infra with its sources. It's checked with the lock file,
+// which is held during the import for a start to wait for it.
+func importBlocklist(ctx context.Context, conf *cfg.BouncerConfig, path string, duration time.Duration) error {
+	if conf.LockFile == "" {
+		log.Warn("Without lock_file, it can't be checked that the bouncer is stopped, the decisions imported while it runs being lost")
+	} else {
+		if leaderLockHeld(conf.LockFile) {
+			return fmt.Errorf("the bouncer holds the lock of %s, stop it before importing a blocklist", conf.LockFile)
+		}
+		lock, err := acquireLeaderLock(ctx, conf.LockFile, leaderLockRetry)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decisions, err := parseBlocklist(f, filepath.Base(path), duration)
+	if err != nil {
+		return fmt.Errorf("invalid blocklist %s: %w", path, err)
+	}
+	decisions = filterDecisionTypes(normalizeDecisions(decisions), conf.CrowdSecConfig)
+	log.Infof("Importing %d decisions from %s", len(decisions), path)
+
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	g := errgroup.Group{}
+	for _, cfManager := range cfManagers {
+		manager := cfManager
+		g.Go(func() error {
+			if err := manager.ImportDecisions(decisions); err != nil {
+				return fmt.Errorf("unable to import the blocklist: %w for account %s", err, manager.AccountCfg.Name)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	log.Infof("Successfully imported %s", path)
+	return nil
+}
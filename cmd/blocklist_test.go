@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	decisions, err := parseBlocklist(strings.NewReader(`
+# migrated from another WAF
+1.2.3.4
+10.0.0.0/8
+5.6.7.8,captcha
+2001:db8::/32,range,throttle
+cn,country,ban
+ 9.9.9.9 , , captcha
+`), "blocklist.txt", 4*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ip:1.2.3.4:ban",
+		"range:10.0.0.0/8:ban",
+		"ip:5.6.7.8:captcha",
+		"range:2001:db8::/32:throttle",
+		"country:cn:ban",
+		"ip:9.9.9.9:captcha",
+	}
+	if len(decisions) != len(expected) {
+		t.Fatalf("expected %d decisions, got %d", len(expected), len(decisions))
+	}
+	for i, decision := range decisions {
+		if got := *decision.Scope + ":" + *decision.Value + ":" + *decision.Type; got != expected[i] {
+			t.Errorf("decision %d: expected %s, got %s", i, expected[i], got)
+		}
+		if *decision.Origin != blocklistOrigin || *decision.Scenario != "blocklist.txt" || decision.Duration == nil || *decision.Duration != "4h0m0s" {
+			t.Errorf("decision %d: unexpected origin %s, scenario %s or duration", i, *decision.Origin, *decision.Scenario)
+		}
+	}
+
+	for _, tc := range []struct {
+		line   string
+		errMsg string
+	}{
+		{"1.2.3", "line 1: invalid IP 1.2.3"},
+		{"10.0.0.0/33", "line 1: invalid range 10.0.0.0/33"},
+		{"1.2.3.4,session,ban", "line 1: unsupported scope session"},
+		{"1.2.3.4,ip,ban,4h", "line 1: expected value,scope,action, got 4 columns"},
+	} {
+		_, err := parseBlocklist(strings.NewReader(tc.line), "blocklist.txt", 0)
+		if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("%s: expected error %q, got %v", tc.line, tc.errMsg, err)
+		}
+	}
+}
+
+func TestImportBlocklistRequiresStoppedBouncer(t *testing.T) {
+	dir := t.TempDir()
+	conf := &cfg.BouncerConfig{LockFile: filepath.Join(dir, "bouncer.lock")}
+	lock, err := acquireLeaderLock(context.Background(), conf.LockFile, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	err = importBlocklist(context.Background(), conf, filepath.Join(dir, "blocklist.txt"), time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "stop it before importing") {
+		t.Fatalf("expected the import to be refused while the bouncer runs, got %v", err)
+	}
+}
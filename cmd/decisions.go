@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// actionPriority decides which action wins when several sources hold a decision for the same value.
+var actionPriority = map[string]int{
+	"ban":      3,
+	"captcha":  2,
+	"throttle": 1,
+}
+
+// decisionMerger merges the decisions streamed by several LAPIs into a single stream. For each scope
+// and value, only the decision with the strongest action among all the sources is forwarded to the
+// cloudflare managers, and it is only removed once no source has a decision for the value anymore.
+type decisionMerger struct {
+	// active decisions by scope and value, then by source and decision ID
+	active map[string]map[string]*models.Decision
+}
+
+func newDecisionMerger() *decisionMerger {
+	return &decisionMerger{
+		active: make(map[string]map[string]*models.Decision),
+	}
+}
+
+func mergeKey(decision *models.Decision) string {
+	return *decision.Scope + ":" + *decision.Value
+}
+
+func sourceDecisionKey(source string, decision *models.Decision) string {
+	return fmt.Sprintf("%s/%d", source, decision.ID)
+}
+
+// strongestDecision returns the decision with the highest action priority. Ties are broken on the
+// source and decision ID so that the result doesn't depend on map ordering.
+func strongestDecision(decisions map[string]*models.Decision) *models.Decision {
+	var (
+		strongest    *models.Decision
+		strongestKey string
+	)
+	for key, decision := range decisions {
+		if strongest == nil {
+			strongest, strongestKey = decision, key
+			continue
+		}
+		priority, strongestPriority := actionPriority[*decision.Type], actionPriority[*strongest.Type]
+		if priority > strongestPriority || (priority == strongestPriority && key < strongestKey) {
+			strongest, strongestKey = decision, key
+		}
+	}
+	return strongest
+}
+
+// Seed records the active decisions of source without producing any change, for decisions which are
+// already applied.
+func (dm *decisionMerger) Seed(source string, decisions []*models.Decision) {
+	for _, decision := range decisions {
+		dm.add(source, decision)
+	}
+}
+
+// Active returns the strongest decision for every scope and value.
+func (dm *decisionMerger) Active() []*models.Decision {
+	keys := make([]string, 0, len(dm.active))
+	for key := range dm.active {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	decisions := make([]*models.Decision, 0, len(keys))
+	for _, key := range keys {
+		decisions = append(decisions, strongestDecision(dm.active[key]))
+	}
+	return decisions
+}
+
+func (dm *decisionMerger) add(source string, decision *models.Decision) {
+	key := mergeKey(decision)
+	if _, ok := dm.active[key]; !ok {
+		dm.active[key] = make(map[string]*models.Decision)
+	}
+	dm.active[key][sourceDecisionKey(source, decision)] = decision
+}
+
+func (dm *decisionMerger) remove(source string, decision *models.Decision) {
+	key := mergeKey(decision)
+	delete(dm.active[key], sourceDecisionKey(source, decision))
+	if len(dm.active[key]) == 0 {
+		delete(dm.active, key)
+	}
+}
+
+// Merge applies the decisions streamed by source and returns the resulting changes of the merged
+// decisions. When the strongest action for a value changes, the previous decision is deleted and the
+// new one is added, so that the cloudflare managers never keep a stale action.
+func (dm *decisionMerger) Merge(source string, stream *models.DecisionsStreamResponse) *models.DecisionsStreamResponse {
+	before := make(map[string]*models.Decision)
+	touched := make([]string, 0, len(stream.Deleted)+len(stream.New))
+	touch := func(decision *models.Decision) {
+		key := mergeKey(decision)
+		if _, ok := before[key]; ok {
+			return
+		}
+		before[key] = strongestDecision(dm.active[key])
+		touched = append(touched, key)
+	}
+
+	for _, decision := range stream.Deleted {
+		touch(decision)
+		dm.remove(source, decision)
+	}
+	for _, decision := range stream.New {
+		touch(decision)
+		dm.add(source, decision)
+	}
+
+	merged := &models.DecisionsStreamResponse{
+		Deleted: make(models.GetDecisionsResponse, 0),
+		New:     make(models.GetDecisionsResponse, 0),
+	}
+	for _, key := range touched {
+		previous, current := before[key], strongestDecision(dm.active[key])
+		if previous != nil && current != nil && *previous.Type == *current.Type {
+			continue
+		}
+		if previous != nil {
+			merged.Deleted = append(merged.Deleted, previous)
+		}
+		if current != nil {
+			merged.New = append(merged.New, current)
+		}
+	}
+	return merged
+}
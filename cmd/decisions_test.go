@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+func mergerDecision(id int64, value string, action string) *models.Decision {
+	return &models.Decision{
+		ID:    id,
+		Value: PtrTo(value),
+		Scope: PtrTo("ip"),
+		Type:  PtrTo(action),
+	}
+}
+
+func decisionTypes(decisions models.GetDecisionsResponse) []string {
+	types := make([]string, 0, len(decisions))
+	for _, decision := range decisions {
+		types = append(types, *decision.Value+"="+*decision.Type)
+	}
+	return types
+}
+
+func assertDecisions(t *testing.T, what string, got models.GetDecisionsResponse, want ...string) {
+	t.Helper()
+	gotTypes := decisionTypes(got)
+	if len(gotTypes) != len(want) {
+		t.Fatalf("expected %s decisions %v, got %v", what, want, gotTypes)
+	}
+	for i := range want {
+		if gotTypes[i] != want[i] {
+			t.Fatalf("expected %s decisions %v, got %v", what, want, gotTypes)
+		}
+	}
+}
+
+func TestDecisionMerger(t *testing.T) {
+	dm := newDecisionMerger()
+
+	merged := dm.Merge("dc1", &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{mergerDecision(1, "1.2.3.4", "captcha")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted)
+	assertDecisions(t, "new", merged.New, "1.2.3.4=captcha")
+
+	// ban from another source wins over captcha
+	merged = dm.Merge("dc2", &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{mergerDecision(1, "1.2.3.4", "ban")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted, "1.2.3.4=captcha")
+	assertDecisions(t, "new", merged.New, "1.2.3.4=ban")
+
+	// a weaker decision for an already banned value changes nothing
+	merged = dm.Merge("dc1", &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{mergerDecision(2, "1.2.3.4", "throttle")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted)
+	assertDecisions(t, "new", merged.New)
+
+	// removing the ban falls back to the captcha still held by dc1
+	merged = dm.Merge("dc2", &models.DecisionsStreamResponse{
+		Deleted: models.GetDecisionsResponse{mergerDecision(1, "1.2.3.4", "ban")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted, "1.2.3.4=ban")
+	assertDecisions(t, "new", merged.New, "1.2.3.4=captcha")
+
+	// the value is only removed once every source dropped it
+	merged = dm.Merge("dc1", &models.DecisionsStreamResponse{
+		Deleted: models.GetDecisionsResponse{mergerDecision(1, "1.2.3.4", "captcha")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted, "1.2.3.4=captcha")
+	assertDecisions(t, "new", merged.New, "1.2.3.4=throttle")
+
+	merged = dm.Merge("dc1", &models.DecisionsStreamResponse{
+		Deleted: models.GetDecisionsResponse{mergerDecision(2, "1.2.3.4", "throttle")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted, "1.2.3.4=throttle")
+	assertDecisions(t, "new", merged.New)
+
+	if len(dm.Active()) != 0 {
+		t.Fatalf("expected no active decision, got %v", decisionTypes(dm.Active()))
+	}
+}
+
+func TestDecisionMergerSeed(t *testing.T) {
+	dm := newDecisionMerger()
+	dm.Seed("dc1", []*models.Decision{mergerDecision(1, "1.2.3.4", "captcha"), mergerDecision(2, "5.6.7.8", "ban")})
+	dm.Seed("dc2", []*models.Decision{mergerDecision(1, "1.2.3.4", "ban")})
+	assertDecisions(t, "active", dm.Active(), "1.2.3.4=ban", "5.6.7.8=ban")
+
+	// the startup stream of a seeded source doesn't produce any change
+	merged := dm.Merge("dc1", &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{mergerDecision(1, "1.2.3.4", "captcha"), mergerDecision(2, "5.6.7.8", "ban")},
+	})
+	assertDecisions(t, "deleted", merged.Deleted)
+	assertDecisions(t, "new", merged.New)
+}
+
+func TestFilterDecisionTypes(t *testing.T) {
+	decisions := func() []*models.Decision {
+		return []*models.Decision{
+			mergerDecision(1, "1.2.3.4", "ban"),
+			mergerDecision(2, "1.2.3.5", "captcha"),
+			mergerDecision(3, "1.2.3.6", "throttle"),
+		}
+	}
+
+	assertDecisions(t, "unfiltered", filterDecisionTypes(decisions(), cfg.CrowdSecConfig{}),
+		"1.2.3.4=ban", "1.2.3.5=captcha", "1.2.3.6=throttle")
+	assertDecisions(t, "included", filterDecisionTypes(decisions(), cfg.CrowdSecConfig{OnlyIncludeTypes: []string{"ban"}}),
+		"1.2.3.4=ban")
+	assertDecisions(t, "excluded", filterDecisionTypes(decisions(), cfg.CrowdSecConfig{ExcludeTypes: []string{"captcha"}}),
+		"1.2.3.4=ban", "1.2.3.6=throttle")
+
+	// decisions fetched from LAPI for the reconciliation are filtered the same way
+	conf := cfg.CrowdSecConfig{ExcludeTypes: []string{"captcha"}}
+	decision := mergerDecision(4, "1.2.3.7", "Captcha")
+	decision.Origin = PtrTo("crowdsec")
+	if decisionMatchesFilters(decision, conf) {
+		t.Fatal("expected the excluded type to be filtered out whatever its case")
+	}
+	decision.Type = PtrTo("ban")
+	if !decisionMatchesFilters(decision, conf) {
+		t.Fatal("expected the other types to be kept")
+	}
+}
+
+func TestFilterDecisions(t *testing.T) {
+	decision := func(id int64, value string, scenario string, origin string) *models.Decision {
+		d := mergerDecision(id, value, "ban")
+		d.Scenario = PtrTo(scenario)
+		d.Origin = PtrTo(origin)
+		return d
+	}
+	decisions := []*models.Decision{
+		decision(1, "1.2.3.4", "crowdsecurity/ssh-bf", "crowdsec"),
+		decision(2, "1.2.3.5", "crowdsecurity/http-probing", "crowdsec"),
+		decision(3, "1.2.3.6", "manual", "cscli"),
+	}
+
+	assertDecisions(t, "unfiltered", filterDecisions(decisions, cfg.CrowdSecConfig{}),
+		"1.2.3.4=ban", "1.2.3.5=ban", "1.2.3.6=ban")
+	assertDecisions(t, "included scenarios", filterDecisions(decisions, cfg.CrowdSecConfig{IncludeScenariosContaining: []string{"ssh"}}),
+		"1.2.3.4=ban")
+	assertDecisions(t, "excluded scenarios", filterDecisions(decisions, cfg.CrowdSecConfig{ExcludeScenariosContaining: []string{"http"}}),
+		"1.2.3.4=ban", "1.2.3.6=ban")
+	assertDecisions(t, "origins", filterDecisions(decisions, cfg.CrowdSecConfig{OnlyIncludeDecisionsFrom: []string{"cscli"}}),
+		"1.2.3.6=ban")
+}
+
+func TestNormalizeDecisions(t *testing.T) {
+	decision := func(scope string, value string) *models.Decision {
+		return &models.Decision{Value: PtrTo(value), Scope: PtrTo(scope), Type: PtrTo("Ban")}
+	}
+	tests := []struct {
+		scope    string
+		value    string
+		expected string
+	}{
+		{"Ip", "2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"ip", "2001:0db8::0001", "2001:db8::1"},
+		{"ip", "1.2.3.4", "1.2.3.4"},
+		{"ip", "2001:db8::zz", "2001:db8::zz"},
+		{"range", "2001:0DB8:0000::/32", "2001:db8::/32"},
+		{"range", "2001:db8::1/64", "2001:db8::1/64"},
+		{"range", "2001:db8::/129", "2001:db8::/129"},
+		{"country", "FR", "fr"},
+	}
+	for _, tc := range tests {
+		normalized := normalizeDecisions([]*models.Decision{decision(tc.scope, tc.value)})[0]
+		if *normalized.Value != tc.expected || *normalized.Type != "ban" {
+			t.Fatalf("expected %s %s to be normalized to %s, got %s", tc.scope, tc.value, tc.expected, *normalized.Value)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaderLockRetry is how often a standby instance tries to take the lock of the leader.
+const leaderLockRetry = 5 * time.Second
+
+// acquireLeaderLock returns once this instance holds the exclusive lock of path, which makes it the
+// leader of the replicas sharing the file. Until then it stands by, trying every retry to take over the
+// lock which the kernel releases when the leader exits, even if it crashes. The lock is held as long as
+// the returned file is open.
+func acquireLeaderLock(ctx context.Context, path string, retry time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file %s: %w", path, err)
+	}
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+		if !waiting {
+			log.Infof("Another instance holds the lock of %s, standing by until it's released", path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+	// the PID of the leader is only informative, the lock is what matters
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if waiting {
+		log.Infof("Took over the lock of %s, this instance is now the leader", path)
+	} else {
+		log.Infof("Acquired the lock of %s, this instance is the leader", path)
+	}
+	return f, nil
+}
+
+// leaderLockHeld tells whether another instance holds the lock of path.
+func leaderLockHeld(path string) bool {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return errors.Is(syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB), syscall.EWOULDBLOCK)
+}
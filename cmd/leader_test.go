@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLeaderLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouncer.lock")
+	leader, err := acquireLeaderLock(context.Background(), path, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the standby waits as long as the leader holds the lock
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireLeaderLock(ctx, path, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the standby to wait for the lock, got %v", err)
+	}
+
+	// and takes over once it's released
+	leader.Close()
+	standby, err := acquireLeaderLock(context.Background(), path, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby.Close()
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// defaultLocalDBPollInterval is how often the local DB is polled without a valid update_frequency.
+const defaultLocalDBPollInterval = 10 * time.Second
+
+// localDBQuery selects the decisions of the local DB which aren't simulated. CrowdSec expires a decision
+// by moving its until to the past, so the expired ones are skipped once read.
+const localDBQuery = `SELECT id, value, scope, type, origin, scenario, until FROM decisions WHERE simulated = 0`
+
+// localDBSource reads the decisions from the SQLite DB of a local CrowdSec, for the air-gapped deployments
+// which can't reach its LAPI. The DB is polled and its decisions are told apart by their ID, the ones
+// which appeared since the previous poll being added and the ones which disappeared or expired deleted.
+type localDBSource struct {
+	path         string
+	db           *sql.DB
+	conf         cfg.CrowdSecConfig
+	pollInterval time.Duration
+	stream       chan *models.DecisionsStreamResponse
+	// the decisions delivered to stream by ID, only used by Run
+	known map[int64]*models.Decision
+}
+
+// newLocalDBSource opens the local DB of the config read-only.
+func newLocalDBSource(conf cfg.CrowdSecConfig) (*localDBSource, error) {
+	db, err := sql.Open("sqlite", localDBDSN(conf.LocalDBPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the local DB %s: %w", conf.LocalDBPath, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to open the local DB %s: %w", conf.LocalDBPath, err)
+	}
+	pollInterval := defaultLocalDBPollInterval
+	if updateFrequency, err := time.ParseDuration(conf.CrowdsecUpdateFrequencyYAML); err == nil && updateFrequency > 0 {
+		pollInterval = updateFrequency
+	}
+	return &localDBSource{
+		path:         conf.LocalDBPath,
+		db:           db,
+		conf:         conf,
+		pollInterval: pollInterval,
+		stream:       make(chan *models.DecisionsStreamResponse),
+		known:        make(map[int64]*models.Decision),
+	}, nil
+}
+
+// localDBDSN returns the read-only URI of the DB at path, escaped for its ?, # and % not to be read as
+// the query, the fragment or an escape of the URI.
+func localDBDSN(path string) string {
+	dsn := url.URL{Scheme: "file", Path: path, OmitHost: true, RawQuery: "mode=ro&_pragma=busy_timeout(5000)"}
+	return dsn.String()
+}
+
+func (s *localDBSource) Name() string {
+	return s.path
+}
+
+func (s *localDBSource) ActiveDecisions(ctx context.Context) ([]*models.Decision, error) {
+	decisionByID, err := s.activeDecisions(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return normalizeDecisions(sortedDecisions(decisionByID)), nil
+}
+
+// Run polls the local DB every pollInterval. A failed poll is logged and retried on the next one, the DB
+// being locked for a while when CrowdSec writes many decisions at once.
+func (s *localDBSource) Run(ctx context.Context) error {
+	defer s.db.Close()
+	log.Infof("Polling the decisions of the local DB %s every %s", s.path, s.pollInterval)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		changes, err := s.poll(ctx, time.Now())
+		if err != nil {
+			log.Errorf("unable to read the decisions of the local DB %s: %s", s.path, err)
+		} else {
+			select {
+			case s.stream <- changes:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *localDBSource) Stream() <-chan *models.DecisionsStreamResponse {
+	return s.stream
+}
+
+// poll returns the decisions added and deleted since the previous poll, and remembers the active ones.
+func (s *localDBSource) poll(ctx context.Context, now time.Time) (*models.DecisionsStreamResponse, error) {
+	active, err := s.activeDecisions(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	added := make(map[int64]*models.Decision)
+	for id, decision := range active {
+		if _, ok := s.known[id]; !ok {
+			added[id] = decision
+		}
+	}
+	deleted := make(map[int64]*models.Decision)
+	for id, decision := range s.known {
+		if _, ok := active[id]; !ok {
+			deleted[id] = decision
+		}
+	}
+	s.known = active
+	return &models.DecisionsStreamResponse{New: sortedDecisions(added), Deleted: sortedDecisions(deleted)}, nil
+}
+
+// activeDecisions returns the decisions of the local DB active at now which match the filters of the
+// config, by ID. Their duration is the time left until they expire.
+func (s *localDBSource) activeDecisions(ctx context.Context, now time.Time) (map[int64]*models.Decision, error) {
+	rows, err := s.db.QueryContext(ctx, localDBQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	decisionByID := make(map[int64]*models.Decision)
+	for rows.Next() {
+		var (
+			id                                           int64
+			value, scope, decisionType, origin, scenario string
+			until                                        sql.NullTime
+		)
+		if err := rows.Scan(&id, &value, &scope, &decisionType, &origin, &scenario, &until); err != nil {
+			return nil, err
+		}
+		if !until.Valid || !until.Time.After(now) {
+			continue
+		}
+		duration := until.Time.Sub(now).Round(time.Second).String()
+		decision := &models.Decision{
+			ID:       id,
+			Value:    &value,
+			Scope:    &scope,
+			Type:     &decisionType,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Duration: &duration,
+		}
+		if decisionMatchesFilters(decision, s.conf) {
+			decisionByID[id] = decision
+		}
+	}
+	return decisionByID, rows.Err()
+}
+
+// sortedDecisions returns the decisions ordered by ID, for the changes to be applied in the order they
+// were made.
+func sortedDecisions(decisionByID map[int64]*models.Decision) []*models.Decision {
+	return slices.SortedFunc(maps.Values(decisionByID), func(a, b *models.Decision) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+func TestLocalDBSource(t *testing.T) {
+	// the path is escaped in the URI the source opens
+	dir := filepath.Join(t.TempDir(), "data #1 100%")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "crowdsec.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE decisions (
+		id integer PRIMARY KEY AUTOINCREMENT, until datetime, scenario text, type text, scope text,
+		value text, origin text, simulated bool DEFAULT false)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	insert := func(value, scope, decisionType string, until time.Time, simulated bool) {
+		t.Helper()
+		_, err := db.Exec(`INSERT INTO decisions (until, scenario, type, scope, value, origin, simulated) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			until, "crowdsecurity/ssh-bf", decisionType, scope, value, "crowdsec", simulated)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("1.2.3.4", "Ip", "ban", now.Add(time.Hour), false)
+	insert("5.6.7.8", "Ip", "ban", now.Add(-time.Hour), false)
+	insert("9.9.9.9", "Ip", "ban", now.Add(time.Hour), true)
+	insert("alice", "username", "ban", now.Add(time.Hour), false)
+
+	source, err := newLocalDBSource(cfg.CrowdSecConfig{LocalDBPath: path, CrowdsecUpdateFrequencyYAML: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.pollInterval != time.Minute {
+		t.Fatalf("expected the DB to be polled every update_frequency, got %s", source.pollInterval)
+	}
+	active, err := source.ActiveDecisions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || *active[0].Value != "1.2.3.4" || *active[0].Scope != "ip" {
+		t.Fatalf("expected only the active IP decision, got %+v", active)
+	}
+
+	changes, err := source.poll(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.New) != 1 || len(changes.Deleted) != 0 {
+		t.Fatalf("expected the first poll to add the active decision, got %d new and %d deleted", len(changes.New), len(changes.Deleted))
+	}
+
+	// CrowdSec deletes a decision by expiring it
+	if _, err := db.Exec(`UPDATE decisions SET until = ? WHERE value = ?`, now.Add(-time.Minute), "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	insert("10.0.0.0/8", "Range", "captcha", now.Add(time.Hour), false)
+	changes, err = source.poll(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.New) != 1 || *changes.New[0].Value != "10.0.0.0/8" {
+		t.Fatalf("expected the range decision to be added, got %+v", changes.New)
+	}
+	if len(changes.Deleted) != 1 || *changes.Deleted[0].Value != "1.2.3.4" {
+		t.Fatalf("expected the expired decision to be deleted, got %+v", changes.Deleted)
+	}
+}
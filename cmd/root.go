@@ -3,14 +3,21 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
@@ -27,6 +34,7 @@ import (
 	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
 	cf "github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare"
 	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/notify"
 )
 
 const (
@@ -34,8 +42,14 @@ const (
 	name                = "crowdsec-cloudflare-worker-bouncer"
 )
 
+var supportedScopes = []string{"ip", "range", "as", "country"}
+
+// errSIGTERM is returned by HandleSignals on SIGTERM, after which the cleanup is deferred for the grace period.
+var errSIGTERM = errors.New("received SIGTERM")
+
 type metricsHandler struct {
 	cfManagers []*cf.CloudflareAccountManager
+	prefix     string // metrics_prefix the gathered metric names start with
 }
 
 func getLabelValue(labels []*io_prometheus_client.LabelPair, key string) string {
@@ -49,6 +63,15 @@ func getLabelValue(labels []*io_prometheus_client.LabelPair, key string) string
 	return ""
 }
 
+// countSince returns the requests counted since the previous push of a count. A count lower than it was
+// reset, its D1 row having been deleted past d1_retention, and is counted from 0 again.
+func countSince(value float64, previous float64) float64 {
+	if value < previous {
+		return value
+	}
+	return value - previous
+}
+
 func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics, updateInterval time.Duration) {
 	for _, manager := range m.cfManagers {
 		err := manager.UpdateMetrics()
@@ -72,9 +95,11 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 		Items: make([]*models.MetricsDetailItem, 0),
 	})
 
+	// the scenario label isn't sent to crowdsec, active decisions are summed over it
+	activeDecisionItems := make(map[string]*models.MetricsDetailItem)
 	for _, metricFamily := range promMetrics {
 		for _, metric := range metricFamily.GetMetric() {
-			switch metricFamily.GetName() {
+			switch strings.TrimPrefix(metricFamily.GetName(), m.prefix) {
 			case metrics.ActiveDecisionsMetricName:
 				//We send the absolute value, as it makes no sense to try to sum them crowdsec side
 				labels := metric.GetLabel()
@@ -83,8 +108,13 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 				ipType := getLabelValue(labels, "ip_type")
 				account := getLabelValue(labels, "account")
 				remediation := getLabelValue(labels, "remediation")
+				key := origin + ipType + account + remediation
+				if item, ok := activeDecisionItems[key]; ok {
+					*item.Value += value
+					continue
+				}
 				log.Debugf("Sending active decisions for %s %s %s %s| current value: %f", origin, ipType, remediation, account, value)
-				met.Metrics[0].Items = append(met.Metrics[0].Items, &models.MetricsDetailItem{
+				activeDecisionItems[key] = &models.MetricsDetailItem{
 					Name:  ptr.Of("active_decisions"),
 					Value: ptr.Of(value),
 					Labels: map[string]string{
@@ -94,7 +124,8 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 						"remediation": remediation,
 					},
 					Unit: ptr.Of("ip"),
-				})
+				}
+				met.Metrics[0].Items = append(met.Metrics[0].Items, activeDecisionItems[key])
 			case metrics.BlockedRequestMetricName:
 				labels := metric.GetLabel()
 				value := metric.GetGauge().GetValue()
@@ -103,10 +134,10 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 				account := getLabelValue(labels, "account")
 				remediation := getLabelValue(labels, "remediation")
 				key := origin + ipType + account + remediation
-				log.Debugf("Sending dropped bytes for %s %s %s %s %f | current value: %f | previous value: %f\n", origin, ipType, remediation, account, value-metrics.LastBlockedRequestValue[key], value, metrics.LastBlockedRequestValue[key])
+				log.Debugf("Sending dropped bytes for %s %s %s %s %f | current value: %f | previous value: %f\n", origin, ipType, remediation, account, countSince(value, metrics.LastBlockedRequestValue[key]), value, metrics.LastBlockedRequestValue[key])
 				met.Metrics[0].Items = append(met.Metrics[0].Items, &models.MetricsDetailItem{
 					Name:  ptr.Of("dropped"),
-					Value: ptr.Of(value - metrics.LastBlockedRequestValue[key]),
+					Value: ptr.Of(countSince(value, metrics.LastBlockedRequestValue[key])),
 					Labels: map[string]string{
 						"origin":      origin,
 						"ip_type":     ipType,
@@ -122,10 +153,10 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 				ipType := getLabelValue(labels, "ip_type")
 				account := getLabelValue(labels, "account")
 				key := ipType + account
-				log.Debugf("Sending processed packets for %s %s %f | current value: %f | previous value: %f\n", ipType, account, value-metrics.LastProcessedRequestValue[key], value, metrics.LastProcessedRequestValue[key])
+				log.Debugf("Sending processed packets for %s %s %f | current value: %f | previous value: %f\n", ipType, account, countSince(value, metrics.LastProcessedRequestValue[key]), value, metrics.LastProcessedRequestValue[key])
 				met.Metrics[0].Items = append(met.Metrics[0].Items, &models.MetricsDetailItem{
 					Name:  ptr.Of("processed"),
-					Value: ptr.Of(value - metrics.LastProcessedRequestValue[key]),
+					Value: ptr.Of(countSince(value, metrics.LastProcessedRequestValue[key])),
 					Labels: map[string]string{
 						"ip_type": ipType,
 						"account": account,
@@ -138,6 +169,36 @@ func (m *metricsHandler) metricsUpdater(met *models.RemediationComponentsMetrics
 	}
 }
 
+// seedLastValues sets the previous values of the request counts to the ones of a reused D1 DB, so that
+// the requests counted before the restart aren't sent again.
+func (m *metricsHandler) seedLastValues() {
+	for _, manager := range m.cfManagers {
+		if err := manager.UpdateMetrics(); err != nil {
+			log.Errorf("unable to update metrics for account %s: %s", manager.AccountCfg.Name, err)
+		}
+	}
+
+	promMetrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Errorf("unable to gather prometheus metrics: %s", err)
+		return
+	}
+
+	for _, metricFamily := range promMetrics {
+		for _, metric := range metricFamily.GetMetric() {
+			labels := metric.GetLabel()
+			switch strings.TrimPrefix(metricFamily.GetName(), m.prefix) {
+			case metrics.BlockedRequestMetricName:
+				key := getLabelValue(labels, "origin") + getLabelValue(labels, "ip_type") + getLabelValue(labels, "account") + getLabelValue(labels, "remediation")
+				metrics.LastBlockedRequestValue[key] = metric.GetGauge().GetValue()
+			case metrics.ProcessedRequestMetricName:
+				key := getLabelValue(labels, "ip_type") + getLabelValue(labels, "account")
+				metrics.LastProcessedRequestValue[key] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+}
+
 func (m *metricsHandler) computeMetricsHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		for _, manager := range m.cfManagers {
@@ -150,49 +211,397 @@ func (m *metricsHandler) computeMetricsHandler(next http.Handler) http.Handler {
 	})
 }
 
-func cleanUp(managers []*cf.CloudflareAccountManager, c context.CancelFunc, ctx context.Context) {
+// serveMetrics registers the metrics, pushes them to LAPI unless lapiClient is nil and serves them to
+// prometheus if enabled, in goroutines of g running until ctx is done. With seedLastValues, the request
+// counts already in the D1 DB aren't pushed.
+func serveMetrics(ctx context.Context, g *errgroup.Group, conf *cfg.BouncerConfig, cfManagers []*cf.CloudflareAccountManager, lapiClient *apiclient.ApiClient, seedLastValues bool) error {
+	metrics.Register(conf.PrometheusConfig.MetricsPrefix, csbouncer.TotalLAPICalls, csbouncer.TotalLAPIError, metrics.CloudflareAPICallsByAccount, metrics.CloudflareAPICallsByEndpoint, metrics.CloudflareAPIDuration, metrics.CloudflareAPIRateRemaining, metrics.WorkerInfo, metrics.WorkerD1Healthy, metrics.CloudflareAuthFailed, metrics.EnforcementPaused, metrics.TotalKeysByAccount, metrics.ShedDecisions, metrics.LAPIReconnects, metrics.KVPayloadBytes,
+		metrics.TotalActiveDecisions, metrics.TotalBlockedRequests, metrics.TotalProcessedRequests, metrics.SkippedAllowlistedDecisions, metrics.SkippedUnsupportedDecisions, metrics.OtherScopeDecisions,
+		metrics.CloudflareAPIDeprecationWarnings, metrics.ActionFallbacks, metrics.DroppedWorkerTailEvents,
+		metrics.TurnstileRotations, metrics.TurnstileRotationErrors, metrics.TurnstileLastRotation)
+
+	mHandler := metricsHandler{
+		cfManagers: cfManagers,
+		prefix:     conf.PrometheusConfig.MetricsPrefix,
+	}
+	if seedLastValues {
+		mHandler.seedLastValues()
+	}
+
+	// without LAPI, when the decisions are read from the local DB, the usage metrics are only served
+	if lapiClient != nil {
+		metricsProvider, err := csbouncer.NewMetricsProvider(lapiClient, name, mHandler.metricsUpdater, log.StandardLogger())
+		if err != nil {
+			return fmt.Errorf("unable to create metrics provider: %w", err)
+		}
+
+		g.Go(func() error {
+			return metricsProvider.Run(ctx)
+		})
+	}
+
+	if conf.PrometheusConfig.Enabled {
+		g.Go(func() error {
+			http.Handle("/metrics", mHandler.computeMetricsHandler(promhttp.Handler()))
+			return http.ListenAndServe(net.JoinHostPort(conf.PrometheusConfig.ListenAddress, conf.PrometheusConfig.ListenPort), nil)
+		})
+	}
+	return nil
+}
+
+// runMetricsOnly reads the metrics of the infra deployed by another instance of the bouncer and publishes
+// them, without deploying anything nor streaming decisions, until it's stopped.
+func runMetricsOnly(conf *cfg.BouncerConfig, cfManagers []*cf.CloudflareAccountManager, lapiClient *apiclient.ApiClient) error {
+	ag := errgroup.Group{}
+	for _, cfManager := range cfManagers {
+		manager := cfManager
+		ag.Go(func() error {
+			if err := manager.AttachExistingInfra(); err != nil {
+				return fmt.Errorf("unable to find the existing infra: %w for account %s", err, manager.AccountCfg.Name)
+			}
+			return nil
+		})
+	}
+	if err := ag.Wait(); err != nil {
+		return err
+	}
+	log.Info("Reading the metrics of every account without managing its infra")
+
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, manager := range cfManagers {
+		manager.Ctx = ctx
+	}
+	// the requests counted so far are reported by the instance managing the infra
+	if err := serveMetrics(ctx, g, conf, cfManagers, lapiClient, true); err != nil {
+		return err
+	}
+	g.Go(func() error {
+		return HandleSignals(ctx, func() {
+			log.Warn("received SIGHUP, the config can't be reloaded in metrics only mode, restart the bouncer to apply it")
+		})
+	})
+	return g.Wait()
+}
+
+// cleanupGraceCheckInterval is how often a new start is looked for during the cleanup grace period.
+var cleanupGraceCheckInterval = 5 * time.Second
+
+// waitForNewStart waits until deadline for a new start of the bouncer to adopt the infra of the accounts,
+// and returns the ones it didn't adopt. A new start is detected by the lock file it takes over, and by the
+// cleanup deadline it deletes from KV when adopting the infra of an account.
+func waitForNewStart(managers []*cf.CloudflareAccountManager, lockFile string, deadline time.Time) []*cf.CloudflareAccountManager {
+	for {
+		if lockFile != "" && leaderLockHeld(lockFile) {
+			log.Infof("A new start of the bouncer holds the lock of %s, leaving the infra in place", lockFile)
+			return nil
+		}
+		managers = slices.DeleteFunc(managers, (*cf.CloudflareAccountManager).DeferredCleanUpAdopted)
+		if len(managers) == 0 || !time.Now().Before(deadline) {
+			return managers
+		}
+		time.Sleep(min(cleanupGraceCheckInterval, time.Until(deadline)))
+	}
+}
+
+// cleanUp stops the managers and, when cleanupOnExit is set, removes their infra. With a grace period, the
+// lock file is released and the infra is only deleted once the period passed without a new start adopting
+// it. As a restart by systemd only starts the new instance once this one exited, the infra is marked with
+// the deadline of the period, for the next start to adopt it within it and delete it after, when this
+// instance is killed while it waits. Otherwise the infra is left in place with the pending changes of the
+// IP ranges written, and the state of the managers is saved when a cache path is set, so that the next
+// start can reuse it.
+func cleanUp(managers []*cf.CloudflareAccountManager, c context.CancelFunc, ctx context.Context, cachePath string, cleanupOnExit bool, grace time.Duration, lockFile string, lock *os.File, notifier *notify.Notifier) {
 	var g errgroup.Group
 	c()
 	<-ctx.Done()
-	for _, m := range managers {
+	// the infra of the accounts whose token was rejected can't be updated anymore
+	active := slices.DeleteFunc(slices.Clone(managers), (*cf.CloudflareAccountManager).AuthFailed)
+	if !cleanupOnExit || grace > 0 {
+		for _, manager := range active {
+			manager.Ctx = context.Background()
+			if err := manager.FlushIPRanges(); err != nil {
+				log.Errorf("unable to write the last changes of the IP ranges for account %s: %s", manager.AccountCfg.Name, err)
+			}
+		}
+	}
+	if cachePath != "" {
+		for _, manager := range managers {
+			if err := manager.SaveCache(cachePath); err != nil {
+				log.Errorf("unable to save cache for account %s, the infra will be adopted from KV on next start: %s", manager.AccountCfg.Name, err)
+			}
+		}
+		return
+	}
+	if !cleanupOnExit {
+		log.Info("Leaving the infra in place, set cleanup_on_exit or run with -d to delete it")
+		return
+	}
+	if grace > 0 {
+		// the accounts whose cleanup can't be deferred are cleaned up right away
+		deadline := time.Now().Add(grace)
+		deferred := make([]*cf.CloudflareAccountManager, 0, len(active))
+		active = slices.DeleteFunc(active, func(manager *cf.CloudflareAccountManager) bool {
+			manager.Ctx = context.Background()
+			if err := manager.DeferCleanUp(deadline); err != nil {
+				log.Errorf("%s for account %s, deleting its infra now", err, manager.AccountCfg.Name)
+				return false
+			}
+			deferred = append(deferred, manager)
+			return true
+		})
+		// the new start waits for the lock before touching the infra
+		if lock != nil {
+			lock.Close()
+		}
+		active = append(active, waitForNewStart(deferred, lockFile, deadline)...)
+	}
+	for _, m := range active {
 		manager := m
 		manager.Ctx = context.Background()
 		g.Go(func() error {
-			return manager.CleanUpExistingWorkers(false)
+			err := manager.CleanUpExistingWorkers(false)
+			notifier.Notify(notify.EventCleanupCompleted, manager.AccountCfg.Name, err)
+			return err
 		})
 	}
 	if err := g.Wait(); err != nil {
+		notifier.Close()
 		log.Fatal(err)
 	}
 }
 
-func HandleSignals(ctx context.Context) error {
+// accountErr drops the error of a goroutine of an account whose token was rejected, so that the other
+// accounts keep running.
+func accountErr(m *cf.CloudflareAccountManager, err error) error {
+	if err != nil && m.AuthFailed() {
+		return nil
+	}
+	return err
+}
+
+// HandleSignals returns when the bouncer is asked to stop. SIGUSR1 cycles the diff mode of the account
+// managers between off, log and log-only, to inspect what the bouncer does with each batch of decisions.
+// SIGHUP calls reload, to apply the config changes without redeploying the workers.
+func HandleSignals(ctx context.Context, reload func()) error {
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	for {
+		select {
+		case s := <-signalChan:
+			switch s {
+			case syscall.SIGTERM:
+				return errSIGTERM
+			case syscall.SIGINT:
+				return fmt.Errorf("received SIGINT")
+			case syscall.SIGUSR1:
+				mode := (cf.CurrentDiffMode() + 1) % (cf.DiffModeLogOnly + 1)
+				cf.SetDiffMode(mode)
+				log.Infof("received SIGUSR1, decision diff mode is now %s", mode)
+			case syscall.SIGHUP:
+				log.Info("received SIGHUP, reloading config")
+				reload()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
-	select {
-	case s := <-signalChan:
-		switch s {
-		case syscall.SIGTERM:
-			return fmt.Errorf("received SIGTERM")
-		case syscall.SIGINT:
-			return fmt.Errorf("received SIGINT")
+// restartRequiredBy returns which part of the updated config can't be applied without a restart, or an
+// empty string if only the zones of the accounts and the scenario and origin filters changed.
+func restartRequiredBy(current *cfg.BouncerConfig, updated *cfg.BouncerConfig) string {
+	if !reflect.DeepEqual(withoutReloadableFilters(current.CrowdSecConfig), withoutReloadableFilters(updated.CrowdSecConfig)) {
+		return "crowdsec_config"
+	}
+	if !reflect.DeepEqual(current.PrometheusConfig, updated.PrometheusConfig) {
+		return "prometheus"
+	}
+	if current.CachePath != updated.CachePath {
+		return "cache_path"
+	}
+	if current.CleanupOnExit != updated.CleanupOnExit {
+		return "cleanup_on_exit"
+	}
+	if current.LockFile != updated.LockFile {
+		return "lock_file"
+	}
+	if !reflect.DeepEqual(current.CloudflareConfig.API, updated.CloudflareConfig.API) {
+		return "cloudflare_config.api"
+	}
+	// a random decision hashing salt is generated when none is configured
+	currentWorker, updatedWorker := current.CloudflareConfig.Worker, updated.CloudflareConfig.Worker
+	currentWorker.DecisionHashing.Salt, updatedWorker.DecisionHashing.Salt = "", ""
+	if !reflect.DeepEqual(currentWorker, updatedWorker) {
+		return "cloudflare_config.worker"
+	}
+	if len(current.CloudflareConfig.Accounts) != len(updated.CloudflareConfig.Accounts) {
+		return "cloudflare_config.accounts"
+	}
+	for i := range current.CloudflareConfig.Accounts {
+		currentAccount, updatedAccount := current.CloudflareConfig.Accounts[i], updated.CloudflareConfig.Accounts[i]
+		currentAccount.ZoneConfigs, updatedAccount.ZoneConfigs = nil, nil
+		if !reflect.DeepEqual(currentAccount, updatedAccount) {
+			return fmt.Sprintf("account %s", currentAccount.Name)
 		}
-	case <-ctx.Done():
-		return ctx.Err()
 	}
-	return nil
+	return ""
+}
+
+// withoutReloadableFilters blanks the filters of the decisions which are applied locally on top of the
+// stream, and so can change without a restart.
+func withoutReloadableFilters(conf cfg.CrowdSecConfig) cfg.CrowdSecConfig {
+	conf.IncludeScenariosContaining = nil
+	conf.ExcludeScenariosContaining = nil
+	conf.OnlyIncludeDecisionsFrom = nil
+	return conf
+}
+
+// reloadConfig reads the config again and applies the changes to the zones of every account and to the
+// scenario and origin filters of the decisions. Other changes are only applied on restart. It returns the
+// config in use afterwards.
+func reloadConfig(configPath string, current *cfg.BouncerConfig, cfManagers []*cf.CloudflareAccountManager) *cfg.BouncerConfig {
+	updated, err := getConfigFromPath(configPath)
+	if err != nil {
+		log.Errorf("unable to reload config, keeping the current one: %s", err)
+		return current
+	}
+	if part := restartRequiredBy(current, updated); part != "" {
+		log.Errorf("the changes to %s can only be applied by restarting the bouncer, keeping the current config", part)
+		return current
+	}
+	g := errgroup.Group{}
+	for i, m := range cfManagers {
+		manager := m
+		zoneConfigs := updated.CloudflareConfig.Accounts[i].ZoneConfigs
+		g.Go(func() error {
+			if err := manager.ReloadZones(zoneConfigs); err != nil {
+				return fmt.Errorf("unable to reload zones of account %s: %w", manager.AccountCfg.Name, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		log.Errorf("%s, restart the bouncer to apply the config", err)
+		return current
+	}
+	if !reflect.DeepEqual(current.CrowdSecConfig, updated.CrowdSecConfig) {
+		log.Info("Reloaded the decision filters, they apply to the decisions received from now on")
+		log.Warn("LAPI keeps filtering the stream with the filters of the start, the decisions they exclude are only received after a restart")
+	}
+	log.Info("Successfully reloaded config")
+	return updated
 }
 
+// normalizeDecisions lowercases the decisions and writes their IPv6 values in their canonical form, for
+// the KV key of a value to be the same whichever source sent it and however it was written.
 func normalizeDecisions(decisions []*models.Decision) []*models.Decision {
 	for i := range decisions {
 		*decisions[i].Value = strings.ToLower(*decisions[i].Value)
 		*decisions[i].Scope = strings.ToLower(*decisions[i].Scope)
 		*decisions[i].Type = strings.ToLower(*decisions[i].Type)
+		*decisions[i].Value = canonicalIPv6(*decisions[i].Scope, *decisions[i].Value)
 	}
 	return decisions
 }
 
+// canonicalIPv6 returns the canonical form of the IPv6 address, or of the address of the IPv6 range, of
+// an ip or range decision. Other values, and the ones which don't parse, are returned as is.
+func canonicalIPv6(scope string, value string) string {
+	if !strings.Contains(value, ":") {
+		return value
+	}
+	switch scope {
+	case "ip":
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String()
+		}
+	case "range":
+		address, prefix, ok := strings.Cut(value, "/")
+		if _, _, err := net.ParseCIDR(value); err == nil && ok {
+			return net.ParseIP(address).String() + "/" + prefix
+		}
+	}
+	return value
+}
+
+// filterDecisionTypes drops the decisions whose type isn't enforced, which LAPI can't filter out of the stream.
+func filterDecisionTypes(decisions []*models.Decision, conf cfg.CrowdSecConfig) []*models.Decision {
+	if len(conf.OnlyIncludeTypes) == 0 && len(conf.ExcludeTypes) == 0 {
+		return decisions
+	}
+	filtered := make([]*models.Decision, 0, len(decisions))
+	for _, decision := range decisions {
+		if conf.IncludesType(*decision.Type) {
+			filtered = append(filtered, decision)
+		}
+	}
+	return filtered
+}
+
+// filterDecisions drops the new decisions which don't match the filters of the config. The stream is
+// already filtered by LAPI with the ones of the start, this applies the ones reloaded since.
+func filterDecisions(decisions []*models.Decision, conf cfg.CrowdSecConfig) []*models.Decision {
+	filtered := make([]*models.Decision, 0, len(decisions))
+	for _, decision := range decisions {
+		if decisionMatchesFilters(decision, conf) {
+			filtered = append(filtered, decision)
+		}
+	}
+	return filtered
+}
+
+// decisionMatchesFilters applies the filters given to the decision stream to a decision obtained by other means.
+func decisionMatchesFilters(decision *models.Decision, conf cfg.CrowdSecConfig) bool {
+	scope := strings.ToLower(*decision.Scope)
+	if !slices.Contains(supportedScopes, scope) && !slices.Contains(conf.PassThroughScopes, scope) {
+		return false
+	}
+	if len(conf.OnlyIncludeDecisionsFrom) > 0 && !slices.Contains(conf.OnlyIncludeDecisionsFrom, *decision.Origin) {
+		return false
+	}
+	if !conf.IncludesType(*decision.Type) {
+		return false
+	}
+	scenario := ""
+	if decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+	for _, word := range conf.ExcludeScenariosContaining {
+		if strings.Contains(scenario, word) {
+			return false
+		}
+	}
+	if len(conf.IncludeScenariosContaining) == 0 {
+		return true
+	}
+	for _, word := range conf.IncludeScenariosContaining {
+		if strings.Contains(scenario, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchActiveDecisions returns every active decision known by LAPI which the decision stream would deliver.
+func fetchActiveDecisions(ctx context.Context, csLAPI *csbouncer.StreamBouncer, conf cfg.CrowdSecConfig) ([]*models.Decision, error) {
+	resp, _, err := csLAPI.APIClient.Decisions.List(ctx, apiclient.DecisionsListOpts{})
+	if err != nil {
+		return nil, err
+	}
+	decisions := make([]*models.Decision, 0)
+	if resp == nil {
+		return decisions, nil
+	}
+	for _, decision := range *resp {
+		if decisionMatchesFilters(decision, conf) {
+			decisions = append(decisions, decision)
+		}
+	}
+	return normalizeDecisions(decisions), nil
+}
+
 func getConfigFromPath(configPath string) (*cfg.BouncerConfig, error) {
 	configBytes, err := cfg.MergedConfig(configPath)
 	if err != nil {
@@ -203,6 +612,10 @@ func getConfigFromPath(configPath string) (*cfg.BouncerConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse config: %w", err)
 	}
+
+	if err := cfg.CheckConfigPermissions(configPath, conf.StrictPermissions); err != nil {
+		return nil, fmt.Errorf("unable to validate config file permissions: %w", err)
+	}
 	return conf, nil
 }
 
@@ -210,7 +623,7 @@ func CloudflareManagersFromConfig(ctx context.Context, config cfg.CloudflareConf
 	cfManagers := make([]*cf.CloudflareAccountManager, 0, len(config.Accounts))
 	for _, accountCfg := range config.Accounts {
 		cfg := accountCfg
-		manager, err := cf.NewCloudflareManager(ctx, cfg, &config.Worker)
+		manager, err := cf.NewCloudflareManager(ctx, cfg, &config.Worker, &config.API)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create cloudflare manager: %w", err)
 		}
@@ -219,169 +632,644 @@ func CloudflareManagersFromConfig(ctx context.Context, config cfg.CloudflareConf
 	return cfManagers, nil
 }
 
-func Execute(configTokens *string, configOutputPath *string, configPath *string, ver *bool, testConfig *bool, showConfig *bool, deleteOnly *bool, setupOnly *bool) error {
-	if ver != nil && *ver {
+// ExecuteOptions holds the command line options of the bouncer.
+type ExecuteOptions struct {
+	ConfigTokens        string // comma separated tokens to generate config for
+	ConfigOutputPath    string // path to store generated config to
+	ConfigSubdomains    bool   // generate one route per hostname of the zones
+	ConfigPath          string
+	Version             bool
+	VersionJSON         bool // print the version information as json
+	TestConfig          bool
+	ShowConfig          bool
+	DeleteOnly          bool
+	SetupOnly           bool
+	DumpKV              string // path to dump the KV state of every account to
+	ValidateToken       bool   // check the permissions of the token of every account
+	ListResources       string // format, table or json, of the resources managed in every account to list
+	PrintWorkerBindings bool   // print the bindings of the worker of every account without uploading it
+	SmokeTest           bool   // check that the deployed worker of every account enforces a test decision
+	MetricsOnly         bool   // only publish the metrics of the infra deployed by another instance
+	ImportBlocklist     string // path of a blocklist file to enforce with the deployed infra
+	RotateTurnstile     bool   // rotate the turnstile secret keys of the deployed infra
+	DiffConfig          bool   // show what differs between the infra of every account and the config
+	// how long the decisions of ImportBlocklist last, forever if 0
+	ImportDuration time.Duration
+	// how long the infra is left in place on SIGTERM with cleanup_on_exit for a new start to adopt it,
+	// before it's deleted
+	CleanupGrace time.Duration
+}
+
+// versionInfo is the version information printed by -version-json.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	// WorkerScript is the hash of the embedded worker script, as reported by the cloudflare_worker_info metric
+	WorkerScript string `json:"worker_script"`
+}
+
+// printVersionJSON writes the version information to out as json.
+func printVersionJSON(out io.Writer) error {
+	data, err := json.MarshalIndent(versionInfo{
+		Version:      version.Version,
+		Commit:       version.Tag,
+		BuildDate:    version.BuildDate,
+		GoVersion:    runtime.Version(),
+		WorkerScript: cf.WorkerScriptVersion(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+// validateTokens prints the required permissions missing from the token of every account, and returns
+// an error if any account lacks one.
+func validateTokens(ctx context.Context, conf *cfg.BouncerConfig) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tMISSING PERMISSIONS")
+	invalid := 0
+	for _, account := range conf.CloudflareConfig.Accounts {
+		missing, err := cf.ValidateToken(ctx, account, &conf.CloudflareConfig.Worker, &conf.CloudflareConfig.API)
+		switch {
+		case err != nil:
+			invalid++
+			fmt.Fprintf(w, "%s\t%s\n", account.Name, err)
+		case len(missing) > 0:
+			invalid++
+			fmt.Fprintf(w, "%s\t%s\n", account.Name, strings.Join(missing, ", "))
+		default:
+			fmt.Fprintf(w, "%s\t-\n", account.Name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d account(s) have a token lacking required permissions", invalid)
+	}
+	log.Info("all tokens have the required permissions")
+	return nil
+}
+
+// listResources writes the resources managed by the bouncer in every account to out, as a table or as json.
+func listResources(ctx context.Context, conf *cfg.BouncerConfig, format string, out io.Writer) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unsupported resources format %q, expected table or json", format)
+	}
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	allResources := make([]*cf.Resources, 0, len(cfManagers))
+	for _, manager := range cfManagers {
+		resources, err := manager.ListResources()
+		if err != nil {
+			return fmt.Errorf("unable to list resources for account %s: %w", manager.AccountCfg.Name, err)
+		}
+		allResources = append(allResources, resources)
+	}
+	if format == "json" {
+		data, err := json.MarshalIndent(allResources, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tTYPE\tID\tDETAILS")
+	for _, resources := range allResources {
+		for _, script := range resources.Scripts {
+			fmt.Fprintf(w, "%s\tworker\t%s\t-\n", resources.Account, script)
+		}
+		for _, route := range resources.Routes {
+			fmt.Fprintf(w, "%s\troute\t%s\t%s %s -> %s\n", resources.Account, route.ID, route.Zone, route.Pattern, route.Script)
+		}
+		if resources.KVNamespace != nil {
+			fmt.Fprintf(w, "%s\tkv_namespace\t%s\t%d keys\n", resources.Account, resources.KVNamespace.ID, resources.KVNamespace.Keys)
+		}
+		if resources.D1Database != nil {
+			fmt.Fprintf(w, "%s\td1_database\t%s\t-\n", resources.Account, resources.D1Database.ID)
+		}
+		for _, widget := range resources.Widgets {
+			fmt.Fprintf(w, "%s\tturnstile_widget\t%s\t%s\n", resources.Account, widget.SiteKey, strings.Join(widget.Domains, ", "))
+		}
+	}
+	return w.Flush()
+}
+
+// errConfigDrift is returned by diffConfig when the infra of an account differs from the config.
+var errConfigDrift = errors.New("the infra differs from the config")
+
+// diffConfig writes to out what differs between the infra of every account in Cloudflare and the config:
+// + for what the config has and Cloudflare doesn't, - for the other way around. It returns errConfigDrift
+// if anything does, for the command to fail.
+func diffConfig(ctx context.Context, conf *cfg.BouncerConfig, out io.Writer) error {
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	drifted := false
+	for _, manager := range cfManagers {
+		drift, err := manager.DiffConfig()
+		if err != nil {
+			return fmt.Errorf("unable to diff the infra of account %s: %w", manager.AccountCfg.Name, err)
+		}
+		if !drift.Drifted() {
+			fmt.Fprintf(out, "account %s: no drift\n", drift.Account)
+			continue
+		}
+		drifted = true
+		fmt.Fprintf(out, "account %s:\n", drift.Account)
+		for _, route := range drift.MissingRoutes {
+			fmt.Fprintf(out, "  + route %s %s -> %s\n", route.Zone, route.Pattern, route.Script)
+		}
+		for _, route := range drift.UnexpectedRoutes {
+			fmt.Fprintf(out, "  - route %s %s -> %s\n", route.Zone, route.Pattern, route.Script)
+		}
+		switch {
+		case drift.DeployedWorkerVersion == drift.WorkerVersion:
+		case drift.DeployedWorkerVersion == "":
+			fmt.Fprintf(out, "  + worker version %s\n", drift.WorkerVersion)
+		default:
+			fmt.Fprintf(out, "  ~ worker version %s deployed instead of %s\n", drift.DeployedWorkerVersion, drift.WorkerVersion)
+		}
+		for _, domain := range drift.MissingWidgets {
+			fmt.Fprintf(out, "  + turnstile widget for %s\n", domain)
+		}
+		for _, widget := range drift.UnexpectedWidgets {
+			fmt.Fprintf(out, "  - turnstile widget %s for %s\n", widget.SiteKey, strings.Join(widget.Domains, ", "))
+		}
+		if drift.KVKeys == nil {
+			fmt.Fprintln(out, "  + kv namespace")
+		} else {
+			fmt.Fprintf(out, "  kv namespace holds %d keys\n", *drift.KVKeys)
+		}
+	}
+	if drifted {
+		return errConfigDrift
+	}
+	return nil
+}
+
+// printWorkerBindings writes the bindings the worker of every account would be uploaded with to out as json.
+func printWorkerBindings(ctx context.Context, conf *cfg.BouncerConfig, out io.Writer) error {
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	allBindings := make([]*cf.WorkerBindings, 0, len(cfManagers))
+	for _, manager := range cfManagers {
+		bindings, err := manager.WorkerBindings()
+		if err != nil {
+			return fmt.Errorf("unable to resolve worker bindings for account %s: %w", manager.AccountCfg.Name, err)
+		}
+		allBindings = append(allBindings, bindings)
+	}
+	data, err := json.MarshalIndent(allBindings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+// smokeTest writes the outcome of the smoke test of every zone to out, and returns an error if the worker
+// didn't enforce the test decision on any of them.
+func smokeTest(ctx context.Context, conf *cfg.BouncerConfig, client *http.Client, timeout time.Duration, out io.Writer) error {
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tZONE\tURL\tRESULT")
+	failed := 0
+	for _, manager := range cfManagers {
+		results, err := manager.SmokeTest(client, timeout)
+		if err != nil {
+			return fmt.Errorf("unable to smoke test account %s: %w", manager.AccountCfg.Name, err)
+		}
+		for _, result := range results {
+			if result.Passed() {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Account, result.Zone, result.URL, result.Remediation)
+				continue
+			}
+			failed++
+			fmt.Fprintf(w, "%s\t%s\t%s\tfailed: %s\n", result.Account, result.Zone, result.URL, result.Error)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("the worker didn't enforce the test decision on %d zone(s)", failed)
+	}
+	log.Info("the worker enforced the test decision on every zone")
+	return nil
+}
+
+// rotateTurnstile rotates the turnstile secret keys of the zones of every account, and returns an error
+// if any account failed to.
+func rotateTurnstile(ctx context.Context, conf *cfg.BouncerConfig) error {
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	notifier := notify.New(conf.WebhookURL)
+	defer notifier.Close()
+	errs := make([]error, 0)
+	for _, manager := range cfManagers {
+		manager.Notifier = notifier
+		if err := manager.RotateTurnstileSecrets(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to rotate turnstile secret keys for account %s: %w", manager.AccountCfg.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	log.Info("Successfully rotated the turnstile secret keys of every account")
+	return nil
+}
+
+// dumpKV writes the KV state of every account to a JSON file, for debugging.
+func dumpKV(ctx context.Context, conf *cfg.BouncerConfig, dumpPath string) error {
+	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	if err != nil {
+		return err
+	}
+	dumps := make([]*cf.KVDump, 0, len(cfManagers))
+	for _, manager := range cfManagers {
+		if err := manager.ResolveNamespaceID(); err != nil {
+			return fmt.Errorf("account %s: %w", manager.AccountCfg.Name, err)
+		}
+		dump, err := manager.DumpKV()
+		if err != nil {
+			return fmt.Errorf("unable to dump KV for account %s: %w", manager.AccountCfg.Name, err)
+		}
+		dumps = append(dumps, dump)
+	}
+	data, err := json.MarshalIndent(dumps, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the dump contains the turnstile secrets
+	if err := os.WriteFile(dumpPath, data, 0600); err != nil {
+		return err
+	}
+	log.Infof("KV state successfully dumped in %s", dumpPath)
+	return nil
+}
+
+// deployAccount resumes the infra of the account from the cache when possible, or adopts the infra left in
+// place by the previous run, otherwise it deletes the existing infra and deploys it again, unless
+// deleteOnly is set. With cleanup_on_exit, the infra is only adopted with a cleanup grace period, as the
+// previous run then leaves it in place when restarted quickly.
+func deployAccount(manager *cf.CloudflareAccountManager, conf *cfg.BouncerConfig, deleteOnly bool, cleanupGrace time.Duration) error {
+	if conf.CachePath != "" && !deleteOnly {
+		resumed, err := manager.ResumeFromCache(conf.CachePath)
+		if err != nil {
+			return fmt.Errorf("unable to resume from cache: %w for account %s", err, manager.AccountCfg.Name)
+		}
+		if resumed {
+			if conf.WarmUpFromKV {
+				if err := manager.LoadFromKV(); err != nil {
+					return fmt.Errorf("unable to warm up cache from KV: %w for account %s", err, manager.AccountCfg.Name)
+				}
+			}
+			log.Infof("Successfully resumed infra for account %s", manager.AccountCfg.Name)
+			return nil
+		}
+	}
+	// the infra left in place by the previous run is adopted instead of being rebuilt
+	if (!conf.CleanupOnExit || cleanupGrace > 0) && !deleteOnly {
+		adopted, err := manager.AdoptExistingInfra()
+		if err != nil {
+			return fmt.Errorf("unable to adopt existing infra: %w for account %s", err, manager.AccountCfg.Name)
+		}
+		if adopted {
+			log.Infof("Successfully adopted infra for account %s", manager.AccountCfg.Name)
+			return nil
+		}
+	}
+	err := manager.CleanUpExistingWorkers(true)
+	if err != nil {
+		return fmt.Errorf("unable to cleanup existing workers: %w for account %s", err, manager.AccountCfg.Name)
+	}
+	if deleteOnly {
+		return nil
+	}
+	if err := manager.DeployInfra(); err != nil {
+		return fmt.Errorf("unable to deploy infra: %w for account %s", err, manager.AccountCfg.Name)
+	}
+	log.Infof("Successfully deployed infra for account %s", manager.AccountCfg.Name)
+	return nil
+}
+
+func Execute(opts ExecuteOptions) error {
+	if opts.VersionJSON {
+		return printVersionJSON(os.Stdout)
+	}
+	if opts.Version {
 		fmt.Print(version.FullString())
 		return nil
 	}
 
-	if configPath == nil || *configPath == "" {
-		configPath = new(string)
-		*configPath = DEFAULT_CONFIG_PATH
+	if opts.ConfigPath == "" {
+		opts.ConfigPath = DEFAULT_CONFIG_PATH
 	}
 
-	if configTokens != nil && *configTokens != "" {
-		cfgTokenString, err := cfg.ConfigTokens(*configTokens, *configPath)
+	if opts.ConfigTokens != "" {
+		cfgTokenString, err := cfg.ConfigTokens(opts.ConfigTokens, opts.ConfigPath, opts.ConfigSubdomains)
 		if err != nil {
 			return err
 		}
-		if configOutputPath != nil && *configOutputPath != "" {
-			err := os.WriteFile(*configOutputPath, []byte(cfgTokenString), 0664)
+		if opts.ConfigOutputPath != "" {
+			err := os.WriteFile(opts.ConfigOutputPath, []byte(cfgTokenString), 0600)
 			if err != nil {
 				return err
 			}
-			log.Printf("Config successfully generated in %s", *configOutputPath)
+			log.Printf("Config successfully generated in %s", opts.ConfigOutputPath)
 		} else {
 			fmt.Print(cfgTokenString)
 		}
 		return nil
 	}
 
-	conf, err := getConfigFromPath(*configPath)
+	if opts.MetricsOnly && (opts.DeleteOnly || opts.SetupOnly) {
+		return fmt.Errorf("-metrics-only can't be used along with -d or -s")
+	}
+
+	conf, err := getConfigFromPath(opts.ConfigPath)
 	if err != nil {
 		return err
 	}
-	if showConfig != nil && *showConfig {
+	if opts.ShowConfig {
 		fmt.Printf("%+v", conf)
 		return nil
 	}
 
-	csLAPI := &csbouncer.StreamBouncer{
-		APIKey:         conf.CrowdSecConfig.CrowdSecLAPIKey,
-		APIUrl:         conf.CrowdSecConfig.CrowdSecLAPIUrl,
-		TickerInterval: conf.CrowdSecConfig.CrowdsecUpdateFrequencyYAML,
-		UserAgent:      fmt.Sprintf("%s/%s", name, version.String()),
-		Opts: apiclient.DecisionsStreamOpts{
-			Scopes:                 "ip,range,as,country",
-			ScenariosNotContaining: strings.Join(conf.CrowdSecConfig.ExcludeScenariosContaining, ","),
-			ScenariosContaining:    strings.Join(conf.CrowdSecConfig.IncludeScenariosContaining, ","),
-			Origins:                strings.Join(conf.CrowdSecConfig.OnlyIncludeDecisionsFrom, ","),
-		},
-		CertPath: conf.CrowdSecConfig.CertPath,
-		KeyPath:  conf.CrowdSecConfig.KeyPath,
-		CAPath:   conf.CrowdSecConfig.CAPath,
+	if opts.DumpKV != "" {
+		return dumpKV(context.Background(), conf, opts.DumpKV)
 	}
 
-	if (testConfig != nil && *testConfig) || (setupOnly == nil || !*setupOnly) || (deleteOnly == nil || !*deleteOnly) {
-		if err := csLAPI.Init(); err != nil {
-			return fmt.Errorf("unable to initialize crowdsec bouncer: %w", err)
-		}
+	if opts.ListResources != "" {
+		return listResources(context.Background(), conf, opts.ListResources, os.Stdout)
 	}
 
-	if testConfig != nil && *testConfig {
+	if opts.PrintWorkerBindings {
+		return printWorkerBindings(context.Background(), conf, os.Stdout)
+	}
+
+	if opts.SmokeTest {
+		return smokeTest(context.Background(), conf, &http.Client{Timeout: 10 * time.Second}, cf.DefaultSmokeTestTimeout, os.Stdout)
+	}
+
+	if opts.ValidateToken {
+		return validateTokens(context.Background(), conf)
+	}
+
+	if opts.RotateTurnstile {
+		return rotateTurnstile(context.Background(), conf)
+	}
+
+	if opts.DiffConfig {
+		return diffConfig(context.Background(), conf, os.Stdout)
+	}
+
+	if opts.ImportBlocklist != "" {
+		return importBlocklist(context.Background(), conf, opts.ImportBlocklist, opts.ImportDuration)
+	}
+
+	decisionSources, lapiClient, err := newDecisionSources(conf.CrowdSecConfig, opts.TestConfig || !opts.SetupOnly || !opts.DeleteOnly)
+	if err != nil {
+		return err
+	}
+
+	if opts.TestConfig {
 		log.Info("config is valid")
 		return nil
 	}
 
-	rootCtx := context.Background()
-	g, ctx := errgroup.WithContext(rootCtx)
-	cfManagers, err := CloudflareManagersFromConfig(ctx, conf.CloudflareConfig)
+	metrics.SetScenarioLabelLimit(conf.PrometheusConfig.ScenarioLabelLimit)
+
+	// each account is deployed with its own context, so that the failure of one doesn't cancel the API
+	// calls of the others. All of them have to succeed to go on.
+	cfManagers, err := CloudflareManagersFromConfig(context.Background(), conf.CloudflareConfig)
 	if err != nil {
 		return err
 	}
-	for _, cfManager := range cfManagers {
+	notifier := notify.New(conf.WebhookURL)
+	defer notifier.Close()
+	for _, manager := range cfManagers {
+		manager.Notifier = notifier
+		manager.PassThroughScopes = conf.CrowdSecConfig.PassThroughScopes
+	}
+	if opts.MetricsOnly {
+		return runMetricsOnly(conf, cfManagers, lapiClient)
+	}
+	// the standby replicas wait here, before touching the infra, until the leader is gone
+	var lock *os.File
+	if conf.LockFile != "" {
+		lock, err = acquireLeaderLock(context.Background(), conf.LockFile, leaderLockRetry)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+	}
+	deployErrs := make([]error, len(cfManagers))
+	dg := errgroup.Group{}
+	for i, cfManager := range cfManagers {
 		manager := cfManager
-		g.Go(func() error {
-			err := manager.CleanUpExistingWorkers(true)
-			if err != nil {
-				return fmt.Errorf("unable to cleanup existing workers: %w for account %s", err, manager.AccountCfg.Name)
-			}
-			if deleteOnly != nil && *deleteOnly {
-				return nil
-			}
-			if err := manager.DeployInfra(); err != nil {
-				return fmt.Errorf("unable to deploy infra: %w for account %s", err, manager.AccountCfg.Name)
-			}
-			log.Infof("Successfully deployed infra for account %s", manager.AccountCfg.Name)
+		dg.Go(func() error {
+			deployErrs[i] = deployAccount(manager, conf, opts.DeleteOnly, opts.CleanupGrace)
 			return nil
 		})
 	}
-	if err := g.Wait(); err != nil {
+	_ = dg.Wait()
+	for i, err := range deployErrs {
+		if err != nil {
+			notifier.Notify(notify.EventAccountDegraded, cfManagers[i].AccountCfg.Name, err)
+		}
+	}
+	if err := errors.Join(deployErrs...); err != nil {
 		return err
 	}
-	if deleteOnly != nil && *deleteOnly {
+	if opts.DeleteOnly {
 		return nil
 	}
 	log.Info("Successfully deployed infra for all accounts")
-	if setupOnly != nil && *setupOnly {
+
+	if opts.SetupOnly {
 		return nil
 	}
 
-	g, ctx = errgroup.WithContext(context.Background())
+	g, ctx := errgroup.WithContext(context.Background())
 	ctx, cancel := context.WithCancel(ctx)
 	for i, manager := range cfManagers {
-		cfManagers[i].Ctx = ctx
+		// each account is stopped on its own once Cloudflare rejects its token
+		accountCtx, stopAccount := context.WithCancel(ctx)
+		cfManagers[i].Ctx = accountCtx
 		m := manager
+		g.Go(func() error {
+			m.WatchAuth(accountCtx, stopAccount)
+			return nil
+		})
 		g.Go(func() error {
 			if err := m.HandleTurnstile(); err != nil {
-				return fmt.Errorf("unable to handle turnstile: %w", err)
+				return accountErr(m, fmt.Errorf("unable to handle turnstile: %w", err))
+			}
+			return nil
+		})
+		g.Go(func() error {
+			if err := m.WatchNewZones(); err != nil {
+				return accountErr(m, fmt.Errorf("unable to watch new zones: %w", err))
 			}
 			return nil
 		})
+		g.Go(func() error {
+			return accountErr(m, m.WatchZones())
+		})
+		g.Go(func() error {
+			if err := m.TailWorker(); err != nil {
+				return accountErr(m, fmt.Errorf("unable to tail worker: %w", err))
+			}
+			return nil
+		})
+		g.Go(func() error {
+			return accountErr(m, m.FlushIPRangesPeriodically())
+		})
+		g.Go(func() error {
+			return accountErr(m, m.FollowEnforcementSchedules())
+		})
 	}
 
-	defer cleanUp(cfManagers, cancel, ctx)
-
-	g.Go(func() error {
-		return HandleSignals(ctx)
-	})
-
-	g.Go(func() error {
-		csLAPI.Run(ctx)
-		return fmt.Errorf("crowdsec bouncer stopped")
-	})
+	// the grace period only applies when the bouncer is stopped with SIGTERM
+	var terminated atomic.Bool
+	defer func() {
+		grace := time.Duration(0)
+		if terminated.Load() {
+			grace = opts.CleanupGrace
+		}
+		cleanUp(cfManagers, cancel, ctx, conf.CachePath, conf.CleanupOnExit, grace, conf.LockFile, lock, notifier)
+	}()
 
-	mHandler := metricsHandler{
-		cfManagers: cfManagers,
+	merger := newDecisionMerger()
+	activeDecisionsBySource := make([][]*models.Decision, len(decisionSources))
+	for i, source := range decisionSources {
+		activeDecisionsBySource[i], err = source.ActiveDecisions(ctx)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", source.Name(), err)
+			break
+		}
 	}
-
-	metricsProvider, err := csbouncer.NewMetricsProvider(csLAPI.APIClient, name, mHandler.metricsUpdater, log.StandardLogger())
 	if err != nil {
-		return fmt.Errorf("unable to create metrics provider: %w", err)
+		log.Warnf("unable to fetch active decisions, skipping reconciliation: %s", err)
+	} else {
+		for i, decisions := range activeDecisionsBySource {
+			merger.Seed(decisionSources[i].Name(), decisions)
+		}
+		activeDecisions := merger.Active()
+		rg := errgroup.Group{}
+		for _, cfManager := range cfManagers {
+			manager := cfManager
+			rg.Go(func() error {
+				if err := manager.ReconcileDecisions(activeDecisions); err != nil {
+					return fmt.Errorf("unable to reconcile decisions: %w for account %s", err, manager.AccountCfg.Name)
+				}
+				return nil
+			})
+		}
+		if err := rg.Wait(); err != nil {
+			return err
+		}
 	}
 
+	// only the signal handler reads and replaces the reloaded config, the stream loop loads its filters
+	reloadedConf := conf
+	var filters atomic.Pointer[cfg.CrowdSecConfig]
+	filters.Store(&conf.CrowdSecConfig)
 	g.Go(func() error {
-		return metricsProvider.Run(ctx)
+		err := HandleSignals(ctx, func() {
+			reloadedConf = reloadConfig(opts.ConfigPath, reloadedConf, cfManagers)
+			filters.Store(&reloadedConf.CrowdSecConfig)
+		})
+		terminated.Store(errors.Is(err, errSIGTERM))
+		return err
 	})
 
-	prometheus.MustRegister(csbouncer.TotalLAPICalls, csbouncer.TotalLAPIError, metrics.CloudflareAPICallsByAccount, metrics.TotalKeysByAccount,
-		metrics.TotalActiveDecisions, metrics.TotalBlockedRequests, metrics.TotalProcessedRequests)
-	if conf.PrometheusConfig.Enabled {
+	type sourceStream struct {
+		source string
+		stream *models.DecisionsStreamResponse
+	}
+	streams := make(chan sourceStream)
+	for _, decisionSrc := range decisionSources {
+		source := decisionSrc.Name()
+		src := decisionSrc
+		watchdog := newStreamWatchdog(source, conf.CrowdSecConfig.StreamTimeout, time.Now())
 		g.Go(func() error {
-			http.Handle("/metrics", mHandler.computeMetricsHandler(promhttp.Handler()))
-			return http.ListenAndServe(net.JoinHostPort(conf.PrometheusConfig.ListenAddress, conf.PrometheusConfig.ListenPort), nil)
+			return src.Run(ctx)
+		})
+		g.Go(func() error {
+			return watchdog.run(ctx)
+		})
+		g.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case stream := <-src.Stream():
+					if stream == nil {
+						return fmt.Errorf("stream decision from %s is nil", source)
+					}
+					watchdog.received(time.Now())
+					select {
+					case streams <- sourceStream{source: source, stream: stream}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
 		})
 	}
 
+	if conf.PrometheusConfig.AdminToken != "" {
+		http.Handle("/admin/", adminHandler(conf.PrometheusConfig.AdminToken, cfManagers))
+	}
+
+	// Usage metrics are only sent to the first LAPI, as the dropped and processed request counts are
+	// reported as the difference since the last push.
+	if err := serveMetrics(ctx, g, conf, cfManagers, lapiClient, conf.CloudflareConfig.Worker.PreserveD1); err != nil {
+		return err
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			log.Warnf("context done: %s", ctx.Err())
 			return ctx.Err()
-		case streamDecision := <-csLAPI.Stream:
-			if streamDecision == nil {
-				return fmt.Errorf("stream decision is nil")
-			}
-			streamDecision.Deleted = normalizeDecisions(streamDecision.Deleted)
-			streamDecision.New = normalizeDecisions(streamDecision.New)
-			if len(streamDecision.Deleted) > 0 {
-				log.Infof("Received %d deleted decisions", len(streamDecision.Deleted))
+		case sourceStream := <-streams:
+			// filtered out before being merged, so that a dropped type never shadows the action of another source
+			sourceStream.stream.Deleted = filterDecisionTypes(normalizeDecisions(sourceStream.stream.Deleted), conf.CrowdSecConfig)
+			// the deleted decisions are not filtered by scenario or origin, for the ones added before a reload
+			// of the filters to still be deleted
+			sourceStream.stream.New = filterDecisions(normalizeDecisions(sourceStream.stream.New), *filters.Load())
+			if len(sourceStream.stream.Deleted) > 0 {
+				log.Infof("Received %d deleted decisions from %s", len(sourceStream.stream.Deleted), sourceStream.source)
 			}
-			if len(streamDecision.New) > 0 {
-				log.Infof("Received %d new decisions", len(streamDecision.New))
+			if len(sourceStream.stream.New) > 0 {
+				log.Infof("Received %d new decisions from %s", len(sourceStream.stream.New), sourceStream.source)
 			}
+			streamDecision := merger.Merge(sourceStream.source, sourceStream.stream)
 			mg := errgroup.Group{}
 			for _, m := range cfManagers {
+				if m.AuthFailed() {
+					continue
+				}
 				manager := m
 				mg.Go(func() error {
 					if err := manager.ProcessDeletedDecisions(streamDecision.Deleted); err != nil {
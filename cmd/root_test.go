@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -15,7 +16,9 @@ import (
 	"github.com/whuang8/redactrus"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
 	cf "github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare/cftest"
 )
 
 func PtrTo[T any](v T) *T {
@@ -308,7 +311,7 @@ func TestBouncer(t *testing.T) {
 
 	// generate config
 	configPath := "/tmp/crowdsec-cloudflare-worker-bouncer.yaml"
-	if err := Execute(&cloudflareToken, &configPath, nil, nil, nil, nil, nil, nil); err != nil {
+	if err := Execute(ExecuteOptions{ConfigTokens: cloudflareToken, ConfigOutputPath: configPath}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -405,3 +408,108 @@ func TestBouncer(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRestartRequiredByFilters(t *testing.T) {
+	current := &cfg.BouncerConfig{CrowdSecConfig: cfg.CrowdSecConfig{CrowdSecLAPIUrl: "http://localhost:8080/"}}
+
+	updated := *current
+	updated.CrowdSecConfig.IncludeScenariosContaining = []string{"ssh"}
+	updated.CrowdSecConfig.ExcludeScenariosContaining = []string{"http"}
+	updated.CrowdSecConfig.OnlyIncludeDecisionsFrom = []string{"crowdsec", "cscli"}
+	if part := restartRequiredBy(current, &updated); part != "" {
+		t.Fatalf("expected the decision filters to be reloaded without a restart, got %s requiring one", part)
+	}
+
+	updated.CrowdSecConfig.OnlyIncludeTypes = []string{"ban"}
+	if part := restartRequiredBy(current, &updated); part != "crowdsec_config" {
+		t.Fatalf("expected the other changes to crowdsec_config to require a restart, got %q", part)
+	}
+}
+
+func newDeployedManager(t *testing.T) (*cftest.API, *cf.CloudflareAccountManager) {
+	t.Helper()
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:          "account",
+		Name:        "grace-test",
+		Token:       "token",
+		ZoneConfigs: []*cfg.ZoneConfig{{ID: "zone1", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}}},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	return api, m
+}
+
+func TestCleanUpGrace(t *testing.T) {
+	cleanupGraceCheckInterval = time.Millisecond
+
+	t.Run("no new start", func(t *testing.T) {
+		api, m := newDeployedManager(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		start := time.Now()
+		cleanUp([]*cf.CloudflareAccountManager{m}, cancel, ctx, "", true, 50*time.Millisecond, "", nil, nil)
+		if time.Since(start) < 50*time.Millisecond {
+			t.Fatal("expected the cleanup to wait for the grace period")
+		}
+		if _, ok := api.Worker("worker"); ok {
+			t.Fatal("expected the infra to be deleted once the grace period passed")
+		}
+	})
+
+	t.Run("new start holding the lock file", func(t *testing.T) {
+		api, m := newDeployedManager(t)
+		lockFile := filepath.Join(t.TempDir(), "bouncer.lock")
+		lock, err := acquireLeaderLock(context.Background(), lockFile, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the new start stands by until the lock is released
+		started := make(chan *os.File)
+		go func() {
+			newLock, err := acquireLeaderLock(context.Background(), lockFile, time.Millisecond)
+			if err != nil {
+				close(started)
+				return
+			}
+			started <- newLock
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		cleanUp([]*cf.CloudflareAccountManager{m}, cancel, ctx, "", true, time.Minute, lockFile, lock, nil)
+		newLock, ok := <-started
+		if !ok {
+			t.Fatal("expected the new start to take the lock")
+		}
+		defer newLock.Close()
+		if _, ok := api.Worker("worker"); !ok {
+			t.Fatal("expected the infra to be left in place for the new start")
+		}
+	})
+
+	t.Run("new start adopting the infra", func(t *testing.T) {
+		api, m := newDeployedManager(t)
+		go func() {
+			for {
+				if _, ok := api.KVEntries(m.NamespaceID)[cf.CleanupDeadlineKeyName]; ok {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			_, _ = api.DeleteWorkersKVEntries(context.Background(), cloudflare.AccountIdentifier("account"), cloudflare.DeleteWorkersKVEntriesParams{
+				NamespaceID: m.NamespaceID,
+				Keys:        []string{cf.CleanupDeadlineKeyName},
+			})
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		cleanUp([]*cf.CloudflareAccountManager{m}, cancel, ctx, "", true, time.Minute, "", nil, nil)
+		if _, ok := api.Worker("worker"); !ok {
+			t.Fatal("expected the infra adopted by the new start to be left in place")
+		}
+	})
+}
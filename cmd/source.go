@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/crowdsecurity/go-cs-lib/version"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// decisionSource delivers the decisions enforced by the accounts: the stream of a LAPI, or the local DB of
+// CrowdSec in offline mode.
+type decisionSource interface {
+	// Name identifies the source in the logs, and when merging the decisions of several sources.
+	Name() string
+	// ActiveDecisions returns the decisions of the source currently active which match the filters of the
+	// config, to reconcile the accounts with on start.
+	ActiveDecisions(ctx context.Context) ([]*models.Decision, error)
+	// Run delivers the decisions to Stream until ctx is done or the source fails.
+	Run(ctx context.Context) error
+	// Stream receives the decisions added and deleted since the previous delivery, every active decision
+	// being added by the first one.
+	Stream() <-chan *models.DecisionsStreamResponse
+}
+
+// lapiSource streams the decisions of a LAPI.
+type lapiSource struct {
+	name    string
+	bouncer *csbouncer.StreamBouncer
+	conf    cfg.CrowdSecConfig
+}
+
+func (s *lapiSource) Name() string {
+	return s.name
+}
+
+func (s *lapiSource) ActiveDecisions(ctx context.Context) ([]*models.Decision, error) {
+	return fetchActiveDecisions(ctx, s.bouncer, s.conf)
+}
+
+func (s *lapiSource) Run(ctx context.Context) error {
+	s.bouncer.Run(ctx)
+	return fmt.Errorf("crowdsec bouncer for %s stopped", s.name)
+}
+
+func (s *lapiSource) Stream() <-chan *models.DecisionsStreamResponse {
+	return s.bouncer.Stream
+}
+
+// newDecisionSources returns the local DB of the config in offline mode, and its LAPIs otherwise, which
+// are initialized when init is set. It also returns the client of the first LAPI, which the usage metrics
+// are pushed to, nil in offline mode.
+func newDecisionSources(conf cfg.CrowdSecConfig, init bool) ([]decisionSource, *apiclient.ApiClient, error) {
+	if conf.LocalDBPath != "" {
+		source, err := newLocalDBSource(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Warnf("Reading the decisions from the local DB %s, the usage metrics aren't pushed to LAPI", conf.LocalDBPath)
+		return []decisionSource{source}, nil, nil
+	}
+	sources := make([]decisionSource, 0, len(conf.Sources)+1)
+	var lapiClient *apiclient.ApiClient
+	for _, lapi := range conf.LAPISources() {
+		csLAPI := &csbouncer.StreamBouncer{
+			APIKey:         lapi.CrowdSecLAPIKey,
+			APIUrl:         lapi.CrowdSecLAPIUrl,
+			TickerInterval: conf.CrowdsecUpdateFrequencyYAML,
+			UserAgent:      fmt.Sprintf("%s/%s", name, version.String()),
+			Opts: apiclient.DecisionsStreamOpts{
+				Scopes:                 strings.Join(append(slices.Clone(supportedScopes), conf.PassThroughScopes...), ","),
+				ScenariosNotContaining: strings.Join(conf.ExcludeScenariosContaining, ","),
+				ScenariosContaining:    strings.Join(conf.IncludeScenariosContaining, ","),
+				Origins:                strings.Join(conf.OnlyIncludeDecisionsFrom, ","),
+			},
+			CertPath: lapi.CertPath,
+			KeyPath:  lapi.KeyPath,
+			CAPath:   lapi.CAPath,
+		}
+		if init {
+			if err := csLAPI.Init(); err != nil {
+				return nil, nil, fmt.Errorf("unable to initialize crowdsec bouncer for %s: %w", lapi.Name, err)
+			}
+		}
+		if lapiClient == nil {
+			lapiClient = csLAPI.APIClient
+		}
+		sources = append(sources, &lapiSource{name: lapi.Name, bouncer: csLAPI, conf: conf})
+	}
+	return sources, lapiClient, nil
+}
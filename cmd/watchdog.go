@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+// streamWatchdog tracks the decisions streams received from a LAPI, which the stream bouncer polls
+// without telling when the connection drops, to report when the LAPI stops delivering them for longer
+// than the stream timeout and when it delivers them again.
+type streamWatchdog struct {
+	source  string
+	timeout time.Duration
+
+	lock         sync.Mutex
+	lastReceived time.Time
+	disconnected bool
+}
+
+func newStreamWatchdog(source string, timeout time.Duration, now time.Time) *streamWatchdog {
+	return &streamWatchdog{source: source, timeout: timeout, lastReceived: now}
+}
+
+// received records a stream received at now. If the LAPI was considered disconnected, the reconnection
+// is logged and counted, and the time elapsed since the previous stream is returned, 0 otherwise.
+func (w *streamWatchdog) received(now time.Time) time.Duration {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	elapsed := now.Sub(w.lastReceived)
+	w.lastReceived = now
+	if !w.disconnected {
+		return 0
+	}
+	w.disconnected = false
+	log.Infof("Receiving decisions from %s again, after %s without any", w.source, elapsed.Round(time.Second))
+	metrics.LAPIReconnects.WithLabelValues(w.source).Inc()
+	return elapsed
+}
+
+// check considers the LAPI disconnected if no stream was received for longer than the timeout, and
+// tells whether it just did.
+func (w *streamWatchdog) check(now time.Time) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.disconnected || now.Sub(w.lastReceived) <= w.timeout {
+		return false
+	}
+	w.disconnected = true
+	log.Warnf("No decisions received from %s for %s, the LAPI may be unreachable", w.source, w.timeout)
+	return true
+}
+
+// run checks the LAPI every half timeout until the context is done. Without timeout, it doesn't.
+func (w *streamWatchdog) run(ctx context.Context) error {
+	if w.timeout <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(w.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+func TestStreamWatchdog(t *testing.T) {
+	start := time.Now()
+	w := newStreamWatchdog("watchdog-test", time.Minute, start)
+
+	if w.check(start.Add(30*time.Second)) || w.received(start.Add(30*time.Second)) != 0 {
+		t.Fatal("expected the LAPI to be connected")
+	}
+	if !w.check(start.Add(2 * time.Minute)) {
+		t.Fatal("expected the LAPI to be disconnected after the timeout")
+	}
+	// the disconnection is only reported once
+	if w.check(start.Add(3 * time.Minute)) {
+		t.Fatal("expected the disconnection to be reported once")
+	}
+	if elapsed := w.received(start.Add(4 * time.Minute)); elapsed != 210*time.Second {
+		t.Fatalf("expected the LAPI to reconnect after 3m30s, got %s", elapsed)
+	}
+	if count := testutil.ToFloat64(metrics.LAPIReconnects.WithLabelValues("watchdog-test")); count != 1 {
+		t.Fatalf("expected 1 reconnection, got %f", count)
+	}
+	if w.received(start.Add(5*time.Minute)) != 0 {
+		t.Fatal("expected the reconnection to be counted once")
+	}
+}
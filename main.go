@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -11,14 +12,55 @@ import (
 func main() {
 	configTokens := flag.String("g", "", "comma separated tokens to generate config for")
 	configOutputPath := flag.String("o", "", "path to store generated config to")
+	configSubdomains := flag.Bool("subdomains", false, "with -g, generate one route per hostname of the DNS records of each zone")
 	configPath := flag.String("c", "", "path to config file")
 	ver := flag.Bool("version", false, "Display version information and exit")
+	verJSON := flag.Bool("version-json", false, "Display version information, with the hash of the embedded worker script, as json and exit")
 	testConfig := flag.Bool("t", false, "test config and exit")
 	showConfig := flag.Bool("T", false, "show full config (.yaml + .yaml.local) and exit")
 	deleteOnly := flag.Bool("d", false, "delete all the created infra and exit")
 	setupOnly := flag.Bool("s", false, "setup the infra and exit")
+	dumpKV := flag.String("dump-kv", "", "dump the KV state of every account to the provided path and exit")
+	listResources := flag.String("list-resources", "", "list the Cloudflare resources managed by the bouncer in every account as a table or json, and exit")
+	printWorkerBindings := flag.Bool("print-worker-bindings", false, "print the bindings the worker of every account would be uploaded with, without uploading it, and exit")
+	smokeTest := flag.Bool("smoke-test", false, "check that the deployed worker of every account enforces a temporary test decision on the first route of each zone, and exit")
+	metricsOnly := flag.Bool("metrics-only", false, "only publish the metrics of the infra deployed by another instance of the bouncer, without deploying anything nor streaming decisions")
+	importBlocklist := flag.String("import-blocklist", "", "enforce the decisions of a blocklist file, one IP or range per line or value,scope,action, with the deployed infra of every account and exit; the bouncer must be stopped, checked with lock_file, and its next start replaces them with the decisions of its sources")
+	importDuration := flag.Duration("import-duration", 24*time.Hour, "how long the decisions of -import-blocklist last, forever if 0")
+	rotateTurnstile := flag.Bool("rotate-turnstile", false, "rotate the turnstile secret keys of the deployed infra of every account now, invalidating the previous ones, and exit")
+	diffConfig := flag.Bool("diff-config", false, "show what differs between the infra of every account in Cloudflare and the config, and exit with an error if anything does")
+	cleanupGrace := flag.Duration("cleanup-grace", 0, "with cleanup_on_exit, wait this delay on SIGTERM before deleting the infra, leaving it in place for a start within it to adopt, detected with lock_file; when killed before, such as past the systemd TimeoutStopSec, the next start adopts or deletes it")
+	validateToken := flag.Bool("validate-token", false, "check that the token of every account has the required permissions and exit")
 	flag.Parse()
-	err := cmd.Execute(configTokens, configOutputPath, configPath, ver, testConfig, showConfig, deleteOnly, setupOnly)
+	// -g "" would otherwise silently start the bouncer instead of generating a config
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "g" && *configTokens == "" {
+			log.Fatal("-g requires a comma separated list of tokens")
+		}
+	})
+	err := cmd.Execute(cmd.ExecuteOptions{
+		ConfigTokens:        *configTokens,
+		ConfigOutputPath:    *configOutputPath,
+		ConfigSubdomains:    *configSubdomains,
+		ConfigPath:          *configPath,
+		Version:             *ver,
+		VersionJSON:         *verJSON,
+		TestConfig:          *testConfig,
+		ShowConfig:          *showConfig,
+		DeleteOnly:          *deleteOnly,
+		SetupOnly:           *setupOnly,
+		DumpKV:              *dumpKV,
+		ValidateToken:       *validateToken,
+		ListResources:       *listResources,
+		PrintWorkerBindings: *printWorkerBindings,
+		SmokeTest:           *smokeTest,
+		MetricsOnly:         *metricsOnly,
+		ImportBlocklist:     *importBlocklist,
+		ImportDuration:      *importDuration,
+		RotateTurnstile:     *rotateTurnstile,
+		DiffConfig:          *diffConfig,
+		CleanupGrace:        *cleanupGrace,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
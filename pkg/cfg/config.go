@@ -2,9 +2,19 @@ package cfg
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +22,7 @@ import (
 	"github.com/crowdsecurity/go-cs-lib/csstring"
 	"github.com/crowdsecurity/go-cs-lib/yamlpatch"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpguts"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,55 +31,484 @@ var (
 	EmptyConfigError          = fmt.Errorf("empty config")
 )
 
+// Suffixes Cloudflare appends to the default account name, current and legacy.
+var accountNameSuffixes = []string{
+	"'s Account",
+	"’s Account",
+	"'s account",
+	"’s account",
+	"' Account",
+	"’ Account",
+}
+
 type TurnstileConfig struct {
 	Enabled              bool          `yaml:"enabled"`
 	RotateSecretKey      bool          `yaml:"rotate_secret_key"`
 	RotateSecretKeyEvery time.Duration `yaml:"rotate_secret_key_every"`
+	RotateJitter         int           `yaml:"rotate_jitter,omitempty"` // percent of rotate_secret_key_every
 	Mode                 string        `yaml:"mode"`
-	SecretKey            string        `yaml:"-"`
-	SiteKey              string        `yaml:"-"`
+	// ExtraDomains are the hostnames of the zone, like www.example.com or *.example.com, the widget is
+	// valid on besides the domain of the zone.
+	ExtraDomains []string `yaml:"extra_domains,omitempty"`
+	SecretKey    string   `yaml:"-"`
+	SiteKey      string   `yaml:"-"`
+}
+
+// WidgetDomains returns the domains of the turnstile widget of a zone of domain zoneDomain.
+func (t *TurnstileConfig) WidgetDomains(zoneDomain string) []string {
+	return append([]string{zoneDomain}, t.ExtraDomains...)
+}
+
+// ValidateExtraDomains makes sure the extra domains of the widget are within the zone of domain zoneDomain.
+func (t *TurnstileConfig) ValidateExtraDomains(zoneDomain string) error {
+	for _, domain := range t.ExtraDomains {
+		hostname := strings.TrimPrefix(domain, "*.")
+		if hostname != zoneDomain && !strings.HasSuffix(hostname, "."+zoneDomain) {
+			return fmt.Errorf("turnstile extra_domains %s isn't within the zone %s", domain, zoneDomain)
+		}
+	}
+	return nil
+}
+
+// TurnstileRotationConfig holds the rotation settings of the turnstile secret keys applied to the zones of
+// an account which don't set them.
+type TurnstileRotationConfig struct {
+	RotateSecretKeyEvery time.Duration `yaml:"rotate_secret_key_every,omitempty"`
+	RotateJitter         int           `yaml:"rotate_jitter,omitempty"` // percent of rotate_secret_key_every
+}
+
+const defaultRotateSecretKeyEvery = time.Hour * 24 * 7
+
+const defaultZoneCheckInterval = 10 * time.Minute
+
+// Enforcement backends of the ban decisions of IPs.
+const (
+	BackendKV      = "kv"
+	BackendRuleset = "ruleset"
+)
+
+type RateLimitConfig struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+}
+
+// EnforcementScheduleConfig restricts the enforcement of the decisions of a zone to time windows,
+// requests made outside of every window are let through.
+type EnforcementScheduleConfig struct {
+	Timezone string           `yaml:"timezone,omitempty"` // IANA name, UTC if empty
+	Windows  []ScheduleWindow `yaml:"windows"`
+}
+
+type ScheduleWindow struct {
+	Days  []string `yaml:"days,omitempty"` // mon, tue, ..., every day if empty
+	Start string   `yaml:"start"`          // HH:MM, the window spans midnight if end is before start
+	End   string   `yaml:"end"`
+}
+
+var weekdayByName = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Weekdays returns the days the window starts on.
+func (w ScheduleWindow) Weekdays() ([]time.Weekday, error) {
+	days := make([]time.Weekday, 0, len(w.Days))
+	for _, day := range w.Days {
+		weekday, ok := weekdayByName[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("invalid day '%s', valid choices are mon, tue, wed, thu, fri, sat, sun", day)
+		}
+		days = append(days, weekday)
+	}
+	return days, nil
+}
+
+// Minutes returns the start and end of the window in minutes since midnight.
+func (w ScheduleWindow) Minutes() (int, int, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *EnforcementScheduleConfig) validate() error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone '%s': %w", s.Timezone, err)
+	}
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("at least one window is required")
+	}
+	for _, window := range s.Windows {
+		if _, err := window.Weekdays(); err != nil {
+			return err
+		}
+		start, end, err := window.Minutes()
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("window %s-%s is empty", window.Start, window.End)
+		}
+	}
+	return nil
+}
+
+// Covers tells whether the decisions are enforced at t, like the worker does: a window starts on one of
+// its days, and spans midnight when it ends before it starts.
+func (s *EnforcementScheduleConfig) Covers(t time.Time) bool {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+	day, minutes := t.Weekday(), t.Hour()*60+t.Minute()
+	previousDay := (day + 6) % 7
+	for _, window := range s.Windows {
+		days, err := window.Weekdays()
+		if err != nil {
+			continue
+		}
+		start, end, err := window.Minutes()
+		if err != nil {
+			continue
+		}
+		startsOn := func(d time.Weekday) bool { return len(days) == 0 || slices.Contains(days, d) }
+		if start < end {
+			if startsOn(day) && minutes >= start && minutes < end {
+				return true
+			}
+		} else if (startsOn(day) && minutes >= start) || (startsOn(previousDay) && minutes < end) {
+			return true
+		}
+	}
+	return false
 }
 
 type ZoneConfig struct {
-	ID              string          `yaml:"zone_id"`
-	Actions         []string        `yaml:"actions,omitempty"`
-	DefaultAction   string          `yaml:"default_action,omitempty"`
-	RoutesToProtect []string        `yaml:"routes_to_protect,omitempty"`
-	Turnstile       TurnstileConfig `yaml:"turnstile,omitempty"`
-	Domain          string          `yaml:"-"`
+	ID               string                     `yaml:"zone_id"`
+	Actions          []string                   `yaml:"actions,omitempty"`
+	DefaultAction    string                     `yaml:"default_action,omitempty"`
+	RoutesToProtect  []string                   `yaml:"routes_to_protect,omitempty"`
+	ObserveRoutes    []string                   `yaml:"observe_routes,omitempty"` // routes bound to a log-only worker which only counts the requests
+	Turnstile        TurnstileConfig            `yaml:"turnstile,omitempty"`
+	RateLimit        RateLimitConfig            `yaml:"rate_limit,omitempty"`
+	ActionFallback   map[string]string          `yaml:"action_fallback,omitempty"` // action to use for decisions of an unsupported action
+	LogLevel         *log.Level                 `yaml:"log_level,omitempty"`
+	Schedule         *EnforcementScheduleConfig `yaml:"enforcement_schedule,omitempty"`
+	CountryAllowlist []string                   `yaml:"country_allowlist,omitempty"` // ISO 3166 alpha-2 codes of the countries never remediated by a country decision
+	// Status codes of the ban and captcha responses, 403 and 200 if unset, and headers added to both.
+	BanStatusCode     int               `yaml:"ban_status_code,omitempty"`
+	CaptchaStatusCode int               `yaml:"captcha_status_code,omitempty"`
+	ResponseHeaders   map[string]string `yaml:"response_headers,omitempty"`
+	// BanRedirectURL redirects the banned visitors to an external page instead of serving them the ban template.
+	BanRedirectURL string `yaml:"ban_redirect_url,omitempty"`
+	// BanTemplate is the path of the ban template of the zone, overriding the one of the account.
+	BanTemplate string `yaml:"ban_template,omitempty"`
+	// ScenarioActions is the action applied to the decisions of a scenario instead of their own, e.g. a ban
+	// for the scanners and a captcha for the brute-forcers. It requires the worker tag_scenarios.
+	ScenarioActions map[string]string `yaml:"scenario_actions,omitempty"`
+	// ScopeActions is the action applied to the decisions of a scope instead of their own, e.g. a captcha
+	// for whole countries and AS while IPs are banned. The scenario_actions take precedence over it.
+	ScopeActions map[string]string `yaml:"scope_actions,omitempty"`
+	// Enforce set to false lets the requests through, the worker only counting the remediations it would
+	// have applied in the metrics, to observe the effect of the decisions before enforcing them.
+	Enforce *bool  `yaml:"enforce,omitempty"`
+	Domain  string `yaml:"-"`
+}
+
+// Enforces tells whether the worker applies the remediations on the zone, which it does unless enforce
+// is false.
+func (z *ZoneConfig) Enforces() bool {
+	return z.Enforce == nil || *z.Enforce
+}
+
+// HasCustomResponse reports whether the ban or captcha responses of the zone differ from the default ones.
+func (z *ZoneConfig) HasCustomResponse() bool {
+	return z.BanStatusCode != 0 || z.CaptchaStatusCode != 0 || len(z.ResponseHeaders) > 0 || z.BanRedirectURL != ""
+}
+
+// DefaultZoneConfig returns the config used to protect a zone when none is provided: a managed
+// captcha on every route of the zone.
+func DefaultZoneConfig(zoneID string, zoneName string) *ZoneConfig {
+	return &ZoneConfig{
+		ID:            zoneID,
+		Actions:       []string{"captcha"},
+		DefaultAction: "captcha",
+		Turnstile: TurnstileConfig{
+			Enabled:              true,
+			RotateSecretKey:      true,
+			RotateSecretKeyEvery: defaultRotateSecretKeyEvery,
+			Mode:                 "managed",
+		},
+		RoutesToProtect: []string{fmt.Sprintf("*%s/*", zoneName)},
+	}
+}
+
+// AutoProtectConfig makes the bouncer periodically look for zones of the account which aren't in
+// the config, and protect them using the template.
+type AutoProtectConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Interval      time.Duration `yaml:"interval,omitempty"`
+	ExcludedZones []string      `yaml:"excluded_zones,omitempty"` // zone IDs or names never protected automatically
+	// The zone_id of the template is ignored, and "{zone}" in its routes is replaced by the zone name.
+	// Without template, zones are protected like the ones generated with -g.
+	Template *ZoneConfig `yaml:"template,omitempty"`
+}
+
+// Excludes reports whether the zone must never be protected automatically.
+func (c *AutoProtectConfig) Excludes(zoneID string, zoneName string) bool {
+	return stringSliceContains(c.ExcludedZones, zoneID) || stringSliceContains(c.ExcludedZones, zoneName)
+}
+
+// ZoneConfig returns the config used to protect the zone automatically.
+func (c *AutoProtectConfig) ZoneConfig(zoneID string, zoneName string) *ZoneConfig {
+	if c.Template == nil {
+		zone := DefaultZoneConfig(zoneID, zoneName)
+		zone.Domain = zoneName
+		return zone
+	}
+	zone := *c.Template
+	zone.ID = zoneID
+	zone.Domain = zoneName
+	zone.Actions = append([]string{}, c.Template.Actions...)
+	zone.RoutesToProtect = make([]string, 0, len(c.Template.RoutesToProtect))
+	for _, route := range c.Template.RoutesToProtect {
+		zone.RoutesToProtect = append(zone.RoutesToProtect, strings.ReplaceAll(route, "{zone}", zoneName))
+	}
+	if len(zone.RoutesToProtect) == 0 {
+		zone.RoutesToProtect = []string{fmt.Sprintf("*%s/*", zoneName)}
+	}
+	return &zone
 }
 
 type AccountConfig struct {
-	ID          string        `yaml:"id"`
-	BanTemplate string        `yaml:"ban_template"`
-	ZoneConfigs []*ZoneConfig `yaml:"zones"`
-	Token       string        `yaml:"token"`
-	Name        string        `yaml:"account_name"`
+	ID                  string            `yaml:"id"`
+	BanTemplate         string            `yaml:"ban_template"`
+	ZoneConfigs         []*ZoneConfig     `yaml:"zones"`
+	Token               string            `yaml:"token"`
+	Name                string            `yaml:"account_name"`
+	Allowlist           []string          `yaml:"allowlist,omitempty"`
+	ASAllowlist         []string          `yaml:"as_allowlist,omitempty"` // AS numbers never remediated by an AS decision
+	AutoProtectNewZones AutoProtectConfig `yaml:"auto_protect_new_zones,omitempty"`
+	// DisableD1 deploys the worker of the account without the D1 DB it reports its metrics to.
+	DisableD1 bool `yaml:"disable_d1,omitempty"`
+	// MetricsUpdateFrequency is the minimum interval between two queries of the metrics of the account,
+	// the last ones are reported in between. 0 queries them every time they're needed.
+	MetricsUpdateFrequency time.Duration           `yaml:"metrics_update_frequency,omitempty"`
+	TurnstileDefaults      TurnstileRotationConfig `yaml:"turnstile_defaults,omitempty"`
+	// OriginActionOverrides is the action applied to the decisions of an origin instead of their own, e.g.
+	// a ban for the decisions added with cscli. The other origins keep the action of their decisions.
+	OriginActionOverrides map[string]string `yaml:"origin_action_overrides,omitempty"`
+	// MaxKVKeys caps the KV keys of the account. The new decisions which would exceed it are shed, the
+	// lowest-priority first. 0 doesn't cap them.
+	MaxKVKeys int `yaml:"max_kv_keys,omitempty"`
+	// ZoneCheckInterval is the interval between two checks of the existence of the zones of the account,
+	// the ones deleted from it being no longer protected until they reappear.
+	ZoneCheckInterval time.Duration `yaml:"zone_check_interval,omitempty"`
+	// Backend is where the ban decisions of IPs are enforced: BackendKV for the worker to read them from
+	// KV, or BackendRuleset for a WAF custom rule of the zones to block the IPs of a list of the account.
+	// The other decisions are always enforced by the worker.
+	Backend string `yaml:"backend,omitempty"`
+	// UseIPLists enforces the ban decisions of IP ranges with the IP list and custom rule of the ruleset
+	// backend, whatever the backend. Country decisions stay in KV, IP lists only holding IPs and ranges.
+	UseIPLists bool `yaml:"use_ip_lists,omitempty"`
+}
+
+// supportsAction tells whether a zone of the account, or the auto_protect_new_zones template, enforces
+// action or falls back from it to one of its actions.
+func (a *AccountConfig) supportsAction(action string) bool {
+	zones := a.ZoneConfigs
+	if a.AutoProtectNewZones.Enabled && a.AutoProtectNewZones.Template != nil {
+		zones = append(slices.Clip(zones), a.AutoProtectNewZones.Template)
+	}
+	for _, zone := range zones {
+		if _, ok := zone.ActionFallback[action]; ok || stringSliceContains(zone.Actions, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyTurnstileDefaults sets the turnstile rotation settings the zone doesn't set to the ones of the
+// account, the rotation interval defaulting to a week.
+func (a *AccountConfig) ApplyTurnstileDefaults(zone *ZoneConfig) {
+	if zone.Turnstile.RotateSecretKeyEvery == 0 {
+		zone.Turnstile.RotateSecretKeyEvery = a.TurnstileDefaults.RotateSecretKeyEvery
+	}
+	if zone.Turnstile.RotateSecretKeyEvery == 0 {
+		zone.Turnstile.RotateSecretKeyEvery = defaultRotateSecretKeyEvery
+	}
+	if zone.Turnstile.RotateJitter == 0 {
+		zone.Turnstile.RotateJitter = a.TurnstileDefaults.RotateJitter
+	}
+}
+
+// AutoProtectZoneConfig returns the config used to protect the zone automatically. Without template, it
+// rotates the turnstile secret key as set by the defaults of the account.
+func (a *AccountConfig) AutoProtectZoneConfig(zoneID string, zoneName string) *ZoneConfig {
+	zone := a.AutoProtectNewZones.ZoneConfig(zoneID, zoneName)
+	if a.AutoProtectNewZones.Template == nil {
+		zone.Turnstile.RotateSecretKeyEvery = 0
+	}
+	a.ApplyTurnstileDefaults(zone)
+	return zone
+}
+
+// When enabled, decisions are stored in KV under HMAC-SHA256(salt, scope:value) instead of in clear.
+// IP ranges and AS numbers are kept in clear as the worker needs them to match the request.
+type DecisionHashingConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Salt    string `yaml:"salt,omitempty"` // random if empty, which requires cleanup_on_exit
+}
+
+// When enabled, the logs and exceptions of the deployed worker are streamed into the bouncer logs.
+type WorkerTailConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	BufferSize int  `yaml:"buffer_size,omitempty"` // events waiting to be logged, further events are dropped
 }
 
 // YAML struct derived from cloudflare.CreateWorkerParams
 // https://github.com/cloudflare/cloudflare-go/blob/056b65c6e956a7119d0d89b27a659ea63b1c0506/workers.go#L24
 type CloudflareWorkerCreateParams struct {
-	ScriptName         string   `yaml:"script_name"`
-	Logpush            *bool    `yaml:"logpush"`
-	Tags               []string `yaml:"tags"`
-	CompatibilityDate  string   `yaml:"compatibility_date"`
-	CompatibilityFlags []string `yaml:"compatibility_flags"`
-	LogOnly            bool     `yaml:"log_only"`
-	KVNameSpaceName    string   `yaml:"-"` // Currently hardcoded string in worker code but may allow customization in future
-	D1DBName           string   `yaml:"-"` // Hardcoded, internal implementation detail for metrics support
+	ScriptName         string                `yaml:"script_name"`
+	Logpush            *bool                 `yaml:"logpush"`
+	Tags               []string              `yaml:"tags"`
+	CompatibilityDate  string                `yaml:"compatibility_date"`
+	CompatibilityFlags []string              `yaml:"compatibility_flags"`
+	LogOnly            bool                  `yaml:"log_only"`
+	DecisionHashing    DecisionHashingConfig `yaml:"decision_hashing,omitempty"`
+	Tail               WorkerTailConfig      `yaml:"tail,omitempty"`
+	// PreserveD1 keeps the D1 metrics DB across restarts, reusing it by name, so that the request
+	// counters of the worker aren't reset. The bouncer never deletes it then.
+	PreserveD1 bool `yaml:"preserve_d1,omitempty"`
+	// DisableD1 deploys the workers of every account without the D1 DB they report their metrics to, for
+	// tokens lacking the D1 permissions. The processed and blocked request metrics aren't reported then.
+	DisableD1 bool `yaml:"disable_d1,omitempty"`
+	// D1Retention deletes the metrics rows of the D1 DB which the worker didn't update for longer, like the
+	// ones of an origin which no longer blocks requests, so that the table of a preserved DB doesn't keep
+	// growing. 0 keeps them forever.
+	D1Retention time.Duration `yaml:"d1_retention,omitempty"`
+	// DispatchNamespace uploads the worker to a Workers for Platforms dispatch namespace instead of as a
+	// standalone script. No route is created then, the dispatch worker of the namespace routes the requests.
+	DispatchNamespace string `yaml:"dispatch_namespace,omitempty"`
+	// ManageWorker set to false leaves the worker script and its routes to be provisioned outside of the
+	// bouncer, e.g. with Terraform, bound to the KV namespace it looks up by name. The bouncer then only
+	// writes the decisions and the config of the worker to KV. -print-worker-bindings prints the bindings
+	// the worker needs.
+	ManageWorker *bool `yaml:"manage_worker,omitempty"`
+	// TagScenarios writes each decision to KV as a JSON {"action", "scenario"} instead of the bare action, so
+	// that the worker can apply the scenario_actions of the zones.
+	TagScenarios bool `yaml:"tag_scenarios,omitempty"`
+	// IPRangesCommitInterval coalesces the changes of the IP ranges, written to KV as a single entry, and
+	// writes them at most once per interval instead of after every batch of decisions. 0 writes them at once.
+	IPRangesCommitInterval time.Duration `yaml:"ip_ranges_commit_interval,omitempty"`
+	KVNameSpaceName        string        `yaml:"-"` // Currently hardcoded string in worker code but may allow customization in future
+	D1DBName               string        `yaml:"-"` // Hardcoded, internal implementation detail for metrics support
 }
 
-func (w *CloudflareWorkerCreateParams) setDefaults() {
+// DefaultCompatibilityDate is the compatibility date the worker is uploaded with when none is set, the one
+// its script is tested against. Cloudflare stops supporting the older ones over time.
+const DefaultCompatibilityDate = "2025-01-01"
+
+func (w *CloudflareWorkerCreateParams) setDefaults() error {
 	if w.ScriptName == "" {
 		w.ScriptName = "crowdsec-cloudflare-worker-bouncer"
 	}
+	if w.CompatibilityDate == "" {
+		w.CompatibilityDate = DefaultCompatibilityDate
+	}
+	compatibilityDate, err := time.Parse(time.DateOnly, w.CompatibilityDate)
+	if err != nil {
+		return fmt.Errorf("invalid worker compatibility_date %s, expected YYYY-MM-DD", w.CompatibilityDate)
+	}
+	// Cloudflare refuses the dates its runtime doesn't know yet
+	if compatibilityDate.After(time.Now()) {
+		return fmt.Errorf("worker compatibility_date %s is in the future", w.CompatibilityDate)
+	}
+	for _, flag := range w.CompatibilityFlags {
+		if strings.TrimSpace(flag) == "" || strings.ContainsAny(flag, " \t") {
+			return fmt.Errorf("invalid worker compatibility flag '%s'", flag)
+		}
+	}
+	if w.DecisionHashing.Enabled && w.DecisionHashing.Salt == "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return fmt.Errorf("unable to generate decision hashing salt: %w", err)
+		}
+		w.DecisionHashing.Salt = hex.EncodeToString(salt)
+	}
+	if w.Tail.BufferSize == 0 {
+		w.Tail.BufferSize = 1000
+	}
+	if w.Tail.BufferSize < 0 {
+		return fmt.Errorf("worker tail buffer_size can't be negative")
+	}
+	if w.PreserveD1 && w.DisableD1 {
+		return fmt.Errorf("preserve_d1 can't be set along with disable_d1")
+	}
+	if w.D1Retention < 0 {
+		return fmt.Errorf("d1_retention can't be negative")
+	}
+	if w.D1Retention > 0 && w.DisableD1 {
+		return fmt.Errorf("d1_retention can't be set along with disable_d1")
+	}
+	if w.Tail.Enabled && w.DispatchNamespace != "" {
+		return fmt.Errorf("worker tail isn't supported for workers uploaded to a dispatch_namespace")
+	}
+	if w.IPRangesCommitInterval < 0 {
+		return fmt.Errorf("ip_ranges_commit_interval can't be negative")
+	}
 	if w.KVNameSpaceName == "" {
 		w.KVNameSpaceName = "CROWDSECCFBOUNCERNS"
 	}
 	if w.D1DBName == "" {
 		w.D1DBName = "CROWDSECCFBOUNCERDB"
 	}
+	return nil
+}
+
+// ManagesWorker tells whether the bouncer uploads the worker and binds it to the routes, which it does
+// unless manage_worker is false.
+func (w *CloudflareWorkerCreateParams) ManagesWorker() bool {
+	return w.ManageWorker == nil || *w.ManageWorker
+}
+
+// ObserverScriptName is the name of the worker bound to the observe_routes of the zones.
+func (w *CloudflareWorkerCreateParams) ObserverScriptName() string {
+	return w.ScriptName + "-observer"
+}
+
+// ObserverWorkerParams returns the params to upload the worker bound to the observe_routes, which is
+// only bound to the D1 DB to report its metrics.
+func (w *CloudflareWorkerCreateParams) ObserverWorkerParams(observerScript string, dbID string) cloudflare.CreateWorkerParams {
+	bindings := map[string]cloudflare.WorkerBinding{}
+	if dbID != "" {
+		bindings[w.D1DBName] = cloudflare.WorkerD1DatabaseBinding{
+			DatabaseID: dbID,
+		}
+	}
+	return cloudflare.CreateWorkerParams{
+		Script:             observerScript,
+		ScriptName:         w.ObserverScriptName(),
+		Bindings:           bindings,
+		Module:             true,
+		Logpush:            w.Logpush,
+		Tags:               w.Tags,
+		CompatibilityDate:  w.CompatibilityDate,
+		CompatibilityFlags: w.CompatibilityFlags,
+	}
 }
 
 func (w *CloudflareWorkerCreateParams) CreateWorkerParams(workerScript string, ID string, varActionsForZoneByDomain []byte, dbID string) cloudflare.CreateWorkerParams {
@@ -82,52 +522,384 @@ func (w *CloudflareWorkerCreateParams) CreateWorkerParams(workerScript string, I
 		},
 	}
 
+	if w.DecisionHashing.Enabled {
+		bindings["DECISION_HASH_SALT"] = cloudflare.WorkerSecretTextBinding{
+			Text: w.DecisionHashing.Salt,
+		}
+	}
+
 	if dbID != "" {
 		bindings[w.D1DBName] = cloudflare.WorkerD1DatabaseBinding{
 			DatabaseID: dbID,
 		}
 	}
+	var dispatchNamespace *string
+	if w.DispatchNamespace != "" {
+		dispatchNamespace = &w.DispatchNamespace
+	}
 	return cloudflare.CreateWorkerParams{
-		Script:             workerScript,
-		ScriptName:         w.ScriptName,
-		Bindings:           bindings,
-		Module:             true,
-		Logpush:            w.Logpush,
-		Tags:               w.Tags,
-		CompatibilityDate:  w.CompatibilityDate,
-		CompatibilityFlags: w.CompatibilityFlags,
+		DispatchNamespaceName: dispatchNamespace,
+		Script:                workerScript,
+		ScriptName:            w.ScriptName,
+		Bindings:              bindings,
+		Module:                true,
+		Logpush:               w.Logpush,
+		Tags:                  w.Tags,
+		CompatibilityDate:     w.CompatibilityDate,
+		CompatibilityFlags:    w.CompatibilityFlags,
 	}
 }
 
+// Settings of the HTTP client used to talk to the Cloudflare API.
+type CloudflareAPIConfig struct {
+	DeprecationWarnings string `yaml:"deprecation_warnings,omitempty"` // how to report API deprecation warnings: warn, debug or ignore
+	CleanupConcurrency  int    `yaml:"cleanup_concurrency,omitempty"`  // max concurrent API calls when cleaning up an account
+	RouteConcurrency    int    `yaml:"route_concurrency,omitempty"`    // max concurrent API calls when creating routes and turnstile widgets
+	// API calls failing with one of these HTTP status codes, or with one of these cloudflare error codes
+	// in the response, are retried with an exponential backoff.
+	RetryableStatusCodes  []int `yaml:"retryable_status_codes,omitempty"`
+	RetryableCFErrorCodes []int `yaml:"retryable_cf_error_codes,omitempty"`
+	// Timeout of an API call, retries included.
+	Timeout time.Duration `yaml:"api_timeout,omitempty"`
+	// Times a step of the deployment, like creating the KV namespace or uploading the worker, is attempted
+	// again when it fails with a transient error. 0 disables it.
+	DeployRetries *int `yaml:"deploy_retries,omitempty"`
+	// KV batches are paused until the API budget of the account resets once Cloudflare reports fewer calls
+	// left than this. 0 disables it.
+	RateLimitMinRemaining *int `yaml:"rate_limit_min_remaining,omitempty"`
+	// Connection pool of the account client.
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout,omitempty"`
+	// Proxy the API calls go through. When empty, the HTTPS_PROXY environment variable is honored.
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+}
+
+// Proxy parses the proxy URL, which may be an http, https or socks5 proxy. It returns nil if no proxy
+// is configured.
+func (c *CloudflareAPIConfig) Proxy() (*url.URL, error) {
+	if c.ProxyURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy_url '%s': scheme must be either of 'http', 'https', 'socks5', 'socks5h'", proxyURL.Redacted())
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy_url '%s': missing host", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+func (c *CloudflareAPIConfig) setDefaults() {
+	if c.DeprecationWarnings == "" {
+		c.DeprecationWarnings = "warn"
+	}
+	if c.CleanupConcurrency == 0 {
+		c.CleanupConcurrency = 10
+	}
+	if c.RouteConcurrency == 0 {
+		c.RouteConcurrency = 5
+	}
+	if len(c.RetryableStatusCodes) == 0 {
+		c.RetryableStatusCodes = []int{429, 500, 502, 503, 504}
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.DeployRetries == nil {
+		deployRetries := 3
+		c.DeployRetries = &deployRetries
+	}
+	if c.RateLimitMinRemaining == nil {
+		rateLimitMinRemaining := 50
+		c.RateLimitMinRemaining = &rateLimitMinRemaining
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 10
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 90 * time.Second
+	}
+}
+
+func (c *CloudflareAPIConfig) validate() error {
+	switch c.DeprecationWarnings {
+	case "warn", "debug", "ignore":
+	default:
+		return fmt.Errorf("deprecation_warnings should be either of 'warn', 'debug', 'ignore'")
+	}
+	if c.CleanupConcurrency < 1 {
+		return fmt.Errorf("cleanup_concurrency must be at least 1")
+	}
+	if c.RouteConcurrency < 1 {
+		return fmt.Errorf("route_concurrency must be at least 1")
+	}
+	for _, code := range c.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retryable_status_codes: %d isn't a valid HTTP status code", code)
+		}
+		if code < 400 {
+			return fmt.Errorf("retryable_status_codes: %d isn't an error status code", code)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("api_timeout can't be negative")
+	}
+	if c.DeployRetries != nil && *c.DeployRetries < 0 {
+		return fmt.Errorf("deploy_retries can't be negative")
+	}
+	if c.RateLimitMinRemaining != nil && *c.RateLimitMinRemaining < 0 {
+		return fmt.Errorf("rate_limit_min_remaining can't be negative")
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns_per_host can't be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle_conn_timeout can't be negative")
+	}
+	if _, err := c.Proxy(); err != nil {
+		return err
+	}
+	return nil
+}
+
 type CloudflareConfig struct {
 	Worker   CloudflareWorkerCreateParams `yaml:"worker"`
+	API      CloudflareAPIConfig          `yaml:"api,omitempty"`
 	Accounts []AccountConfig              `yaml:"accounts"`
 }
 
+// CrowdSecSourceConfig is a LAPI the bouncer pulls decisions from, when several are configured.
+type CrowdSecSourceConfig struct {
+	Name            string `yaml:"name"`
+	CrowdSecLAPIUrl string `yaml:"lapi_url"`
+	CrowdSecLAPIKey string `yaml:"lapi_key"`
+	KeyPath         string `yaml:"key_path"`
+	CertPath        string `yaml:"cert_path"`
+	CAPath          string `yaml:"ca_cert_path"`
+}
+
 type CrowdSecConfig struct {
-	CrowdSecLAPIUrl             string   `yaml:"lapi_url"`
-	CrowdSecLAPIKey             string   `yaml:"lapi_key"`
-	CrowdsecUpdateFrequencyYAML string   `yaml:"update_frequency"`
-	IncludeScenariosContaining  []string `yaml:"include_scenarios_containing"`
-	ExcludeScenariosContaining  []string `yaml:"exclude_scenarios_containing"`
-	OnlyIncludeDecisionsFrom    []string `yaml:"only_include_decisions_from"`
-	KeyPath                     string   `yaml:"key_path"`
-	CertPath                    string   `yaml:"cert_path"`
-	CAPath                      string   `yaml:"ca_cert_path"`
+	CrowdSecLAPIUrl             string                 `yaml:"lapi_url"`
+	CrowdSecLAPIKey             string                 `yaml:"lapi_key"`
+	Sources                     []CrowdSecSourceConfig `yaml:"sources,omitempty"`
+	CrowdsecUpdateFrequencyYAML string                 `yaml:"update_frequency"`
+	// The decisions of the other scenarios and origins are filtered out of the stream by LAPI, and again by
+	// the bouncer, for these filters to be reloaded on SIGHUP without reconnecting.
+	IncludeScenariosContaining []string `yaml:"include_scenarios_containing"`
+	ExcludeScenariosContaining []string `yaml:"exclude_scenarios_containing"`
+	OnlyIncludeDecisionsFrom   []string `yaml:"only_include_decisions_from"`
+	// Decisions of the other types, or of these types, are dropped before reaching the accounts, whatever
+	// the actions and the action_fallback of their zones.
+	OnlyIncludeTypes []string `yaml:"only_include_types,omitempty"`
+	ExcludeTypes     []string `yaml:"exclude_types,omitempty"`
+	KeyPath          string   `yaml:"key_path"`
+	CertPath         string   `yaml:"cert_path"`
+	CAPath           string   `yaml:"ca_cert_path"`
+	// StreamTimeout is how long a LAPI may not deliver the decisions stream before it's considered
+	// disconnected, 1m by default. Its reconnection is then logged and counted.
+	StreamTimeout time.Duration `yaml:"stream_timeout,omitempty"`
+	// PassThroughScopes are the scopes the worker doesn't enforce whose decisions are pulled from LAPI
+	// anyway, and stored in a KV entry of their own for the workers which consume them.
+	PassThroughScopes []string `yaml:"pass_through_scopes,omitempty"`
+	// LocalDBPath is the SQLite DB of a local CrowdSec to read the decisions from instead of streaming them
+	// from LAPI, for the air-gapped deployments which can't reach it. It's polled every update_frequency.
+	LocalDBPath string `yaml:"local_db_path,omitempty"`
+}
+
+const defaultStreamTimeout = time.Minute
+
+// workerScopes are the scopes of the decisions the worker enforces.
+var workerScopes = []string{"ip", "range", "as", "country"}
+
+// validatePassThroughScopes lowercases the pass-through scopes, like the scopes of the decisions, and
+// makes sure the worker doesn't already enforce them.
+func (c *CrowdSecConfig) validatePassThroughScopes() error {
+	for i, scope := range c.PassThroughScopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" {
+			return fmt.Errorf("pass_through_scopes can't hold an empty scope")
+		}
+		if slices.Contains(workerScopes, scope) {
+			return fmt.Errorf("pass_through_scopes can't hold %s, the worker already enforces it", scope)
+		}
+		c.PassThroughScopes[i] = scope
+	}
+	return nil
+}
+
+// validateStreamTimeout defaults the stream timeout, and makes sure the stream is polled more often.
+func (c *CrowdSecConfig) validateStreamTimeout() error {
+	if c.StreamTimeout == 0 {
+		c.StreamTimeout = defaultStreamTimeout
+	}
+	if c.StreamTimeout < 0 {
+		return fmt.Errorf("stream_timeout can't be negative")
+	}
+	if updateFrequency, err := time.ParseDuration(c.CrowdsecUpdateFrequencyYAML); err == nil && c.StreamTimeout <= updateFrequency {
+		return fmt.Errorf("stream_timeout %s must be longer than update_frequency %s", c.StreamTimeout, updateFrequency)
+	}
+	return nil
+}
+
+// validateLocalDB makes sure the local DB the decisions are read from exists, and that no LAPI source is
+// configured along with it.
+func (c *CrowdSecConfig) validateLocalDB() error {
+	if c.LocalDBPath == "" {
+		return nil
+	}
+	if len(c.Sources) > 0 {
+		return fmt.Errorf("local_db_path can't be set along with sources, the decisions being read from the local DB instead of LAPI")
+	}
+	if _, err := os.Stat(c.LocalDBPath); err != nil {
+		return fmt.Errorf("local_db_path: %w", err)
+	}
+	return nil
+}
+
+// LAPISources returns the LAPIs to pull decisions from. When no sources are configured, the top level
+// LAPI settings are used as the only source.
+func (c *CrowdSecConfig) LAPISources() []CrowdSecSourceConfig {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+	return []CrowdSecSourceConfig{{
+		Name:            c.CrowdSecLAPIUrl,
+		CrowdSecLAPIUrl: c.CrowdSecLAPIUrl,
+		CrowdSecLAPIKey: c.CrowdSecLAPIKey,
+		KeyPath:         c.KeyPath,
+		CertPath:        c.CertPath,
+		CAPath:          c.CAPath,
+	}}
+}
+
+// IncludesType tells whether the decisions of the type are enforced, types being compared case-insensitively.
+func (c *CrowdSecConfig) IncludesType(decisionType string) bool {
+	decisionType = strings.ToLower(decisionType)
+	if slices.Contains(c.ExcludeTypes, decisionType) {
+		return false
+	}
+	return len(c.OnlyIncludeTypes) == 0 || slices.Contains(c.OnlyIncludeTypes, decisionType)
+}
+
+func (c *CrowdSecConfig) validateTypes() error {
+	for name, types := range map[string][]string{"only_include_types": c.OnlyIncludeTypes, "exclude_types": c.ExcludeTypes} {
+		for i, decisionType := range types {
+			if decisionType == "" {
+				return fmt.Errorf("%s can't contain an empty type", name)
+			}
+			types[i] = strings.ToLower(decisionType)
+		}
+	}
+	for _, decisionType := range c.OnlyIncludeTypes {
+		if slices.Contains(c.ExcludeTypes, decisionType) {
+			return fmt.Errorf("the type '%s' is both in only_include_types and exclude_types", decisionType)
+		}
+	}
+	return nil
+}
+
+func (c *CrowdSecConfig) validateSources() error {
+	sourceNameSet := make(map[string]bool)
+	for i := range c.Sources {
+		source := &c.Sources[i]
+		if source.CrowdSecLAPIUrl == "" {
+			return fmt.Errorf("crowdsec source %d is missing lapi_url", i)
+		}
+		if source.Name == "" {
+			source.Name = source.CrowdSecLAPIUrl
+		}
+		if _, ok := sourceNameSet[source.Name]; ok {
+			return fmt.Errorf("the crowdsec source '%s' is duplicated", source.Name)
+		}
+		sourceNameSet[source.Name] = true
+	}
+	return nil
+}
+
+// validateTLS makes sure the files used to authenticate to the LAPI of the source with a client
+// certificate, and to verify its certificate, are readable and valid, for the bouncer not to fail later on
+// with an opaque error when connecting to it.
+func (s *CrowdSecSourceConfig) validateTLS() error {
+	for _, file := range []struct{ name, path string }{{"cert_path", s.CertPath}, {"key_path", s.KeyPath}, {"ca_cert_path", s.CAPath}} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("%s of crowdsec source '%s': %w", file.name, s.Name, err)
+		}
+	}
+	if (s.CertPath == "") != (s.KeyPath == "") {
+		return fmt.Errorf("cert_path and key_path of crowdsec source '%s' must be set together", s.Name)
+	}
+	if s.CertPath != "" {
+		if _, err := tls.LoadX509KeyPair(s.CertPath, s.KeyPath); err != nil {
+			return fmt.Errorf("unable to load the client certificate %s with the key %s of crowdsec source '%s': %w", s.CertPath, s.KeyPath, s.Name, err)
+		}
+	}
+	if s.CAPath != "" {
+		caCert, err := os.ReadFile(s.CAPath)
+		if err != nil {
+			return fmt.Errorf("ca_cert_path of crowdsec source '%s': %w", s.Name, err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("ca_cert_path %s of crowdsec source '%s' doesn't hold any PEM certificate", s.CAPath, s.Name)
+		}
+	}
+	return nil
 }
 
 type PrometheusConfig struct {
 	Enabled       bool   `yaml:"enabled"`
 	ListenAddress string `yaml:"listen_addr"`
 	ListenPort    string `yaml:"listen_port"`
+	// ScenarioLabelLimit is the number of distinct scenarios used as the scenario label of the active
+	// decisions metric. Decisions of further scenarios are labelled "other". 0 disables the label.
+	ScenarioLabelLimit int `yaml:"scenario_label_limit,omitempty"`
+	// MetricsPrefix is prepended to the name of every metric, e.g. acme_ for acme_cloudflare_keys_total.
+	// The metrics keep their default names without it.
+	MetricsPrefix string `yaml:"metrics_prefix,omitempty"`
+	// AdminToken enables the /admin/pause and /admin/resume endpoints of the metrics listener, which stop
+	// and restart the enforcement of the decisions without tearing down the infra. Their requests must
+	// carry it as a bearer token.
+	AdminToken string `yaml:"admin_token,omitempty"`
 }
 
+// minAdminTokenLength is the length of the shortest admin token accepted.
+const minAdminTokenLength = 16
+
+// metricsPrefixRegex matches the prefixes which keep the metric names valid.
+var metricsPrefixRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
 type BouncerConfig struct {
 	CloudflareConfig CloudflareConfig `yaml:"cloudflare_config"`
 	CrowdSecConfig   CrowdSecConfig   `yaml:"crowdsec_config"`
 	Daemon           bool             `yaml:"daemon"`
 	Logging          LoggingConfig    `yaml:",inline"`
 	PrometheusConfig PrometheusConfig `yaml:"prometheus"`
+	// CachePath is the directory where the decisions cache of each account is saved on shutdown. When set,
+	// the infra is left in place on shutdown and reused on the next start instead of being rebuilt.
+	CachePath string `yaml:"cache_path,omitempty"`
+	// CleanupOnExit deletes the infra of each account on shutdown. By default it's left in place, so that
+	// the zones stay protected during a restart, and adopted on the next start.
+	CleanupOnExit bool `yaml:"cleanup_on_exit"`
+	// LockFile is locked by the instance managing the infra and writing the decisions, when several
+	// replicas share it. The others wait for the lock to be released, when the leader stops or dies.
+	LockFile string `yaml:"lock_file,omitempty"`
+	// WarmUpFromKV rebuilds the decisions cache from the content of the reused KV namespace instead of
+	// trusting the one saved in CachePath, which may be stale if the bouncer didn't stop cleanly.
+	WarmUpFromKV bool `yaml:"warm_up_from_kv,omitempty"`
+	// StrictPermissions refuses to start when the config file is readable or writable by other users,
+	// instead of only warning about it.
+	StrictPermissions bool `yaml:"strict_permissions"`
+	// WebhookURL receives a JSON POST on the lifecycle events of each account: infra deployed, cleanup
+	// completed, account degraded and turnstile secret rotated.
+	WebhookURL string `yaml:"webhook_url,omitempty"`
 }
 
 func MergedConfig(configPath string) ([]byte, error) {
@@ -139,6 +911,33 @@ func MergedConfig(configPath string) ([]byte, error) {
 	return data, nil
 }
 
+// CheckConfigPermissions makes sure the config file at configPath, and its .local override if any,
+// can't be accessed by other users since they hold the cloudflare tokens and the LAPI key.
+// When strict is false, loose permissions are only logged.
+func CheckConfigPermissions(configPath string, strict bool) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	for _, path := range []string{configPath, configPath + ".local"} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) && path != configPath {
+				continue
+			}
+			return err
+		}
+		perm := info.Mode().Perm()
+		if perm&0o007 == 0 {
+			continue
+		}
+		if strict {
+			return fmt.Errorf("permissions %#o for %s are too open, it must not be accessible by other users", perm, path)
+		}
+		log.Warnf("permissions %#o for %s are too open, consider running 'chmod o-rwx %s'", perm, path, path)
+	}
+	return nil
+}
+
 // NewConfig creates bouncerConfig from the file at provided path
 func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 	config := &BouncerConfig{}
@@ -163,12 +962,32 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 		return nil, fmt.Errorf("failed to setup logging: %w", err)
 	}
 
+	if err := config.CrowdSecConfig.validateSources(); err != nil {
+		return nil, err
+	}
+	if err := config.CrowdSecConfig.validateTypes(); err != nil {
+		return nil, err
+	}
+	if err := config.CrowdSecConfig.validateStreamTimeout(); err != nil {
+		return nil, err
+	}
+	if err := config.CrowdSecConfig.validatePassThroughScopes(); err != nil {
+		return nil, err
+	}
+	if err := config.CrowdSecConfig.validateLocalDB(); err != nil {
+		return nil, err
+	}
+	for _, source := range config.CrowdSecConfig.LAPISources() {
+		if err := source.validateTLS(); err != nil {
+			return nil, err
+		}
+	}
+
 	accountIDSet := make(map[string]bool) // for verifying that each account ID is unique
 	zoneIDSet := make(map[string]bool)    // for verifying that each zoneID is unique
-	validAction := map[string]bool{"captcha": true, "ban": true}
-	validChoiceMsg := "valid choices are either of 'ban', 'captcha'"
 
-	for _, account := range config.CloudflareConfig.Accounts {
+	for i := range config.CloudflareConfig.Accounts {
+		account := &config.CloudflareConfig.Accounts[i]
 		if _, ok := accountIDSet[account.ID]; ok {
 			return nil, fmt.Errorf("the account '%s' is duplicated", account.ID)
 		}
@@ -178,31 +997,351 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 			return nil, fmt.Errorf("the account '%s' is missing token", account.ID)
 		}
 
+		if _, err := ParseAllowlist(account.Allowlist); err != nil {
+			return nil, fmt.Errorf("account %s has invalid allowlist: %w", account.ID, err)
+		}
+		asAllowlist, err := ParseASAllowlist(account.ASAllowlist)
+		if err != nil {
+			return nil, fmt.Errorf("account %s has invalid as_allowlist: %w", account.ID, err)
+		}
+		account.ASAllowlist = asAllowlist
+
+		if account.ZoneCheckInterval == 0 {
+			account.ZoneCheckInterval = defaultZoneCheckInterval
+		}
+		if account.ZoneCheckInterval < time.Minute {
+			return nil, fmt.Errorf("zone_check_interval of account %s must be at least 1m", account.ID)
+		}
+		if account.Backend == "" {
+			account.Backend = BackendKV
+		}
+		if account.Backend != BackendKV && account.Backend != BackendRuleset {
+			return nil, fmt.Errorf("invalid backend %s of account %s, valid choices are %s and %s", account.Backend, account.ID, BackendKV, BackendRuleset)
+		}
+		if account.MaxKVKeys < 0 {
+			return nil, fmt.Errorf("max_kv_keys of account %s can't be negative", account.ID)
+		}
+		if account.MetricsUpdateFrequency < 0 {
+			return nil, fmt.Errorf("metrics_update_frequency of account %s can't be negative", account.ID)
+		}
+		if every := account.TurnstileDefaults.RotateSecretKeyEvery; every != 0 && every < time.Minute {
+			return nil, fmt.Errorf("turnstile_defaults rotate_secret_key_every of account %s must be at least 1m", account.ID)
+		}
+		if jitter := account.TurnstileDefaults.RotateJitter; jitter < 0 || jitter >= 100 {
+			return nil, fmt.Errorf("turnstile_defaults rotate_jitter of account %s must be a percentage between 0 and 99", account.ID)
+		}
+
 		for _, zone := range account.ZoneConfigs {
-			if !stringSliceContains(zone.Actions, zone.DefaultAction) {
-				zone.Actions = append(zone.Actions, zone.DefaultAction)
-			}
-			if len(zone.Actions) == 0 {
-				return nil, fmt.Errorf("account %s 's zone %s has no action", account.ID, zone.ID)
+			account.ApplyTurnstileDefaults(zone)
+			if err := validateZone(account.ID, zone); err != nil {
+				return nil, err
 			}
-			for _, a := range zone.Actions {
-				if _, ok := validAction[a]; !ok {
-					return nil, fmt.Errorf("invalid actions '%s', %s", a, validChoiceMsg)
-				}
-				if a == "captcha" && !zone.Turnstile.Enabled {
-					return nil, fmt.Errorf("turnstile must be enabled for zone %s to support captcha action", zone.ID)
-				}
+			if zone.BanRedirectURL != "" && account.BanTemplate != "" {
+				return nil, fmt.Errorf("ban_redirect_url of zone %s can't be set along with the ban_template of account %s", zone.ID, account.ID)
 			}
 			if _, ok := zoneIDSet[zone.ID]; ok {
 				return nil, fmt.Errorf("zone id %s is duplicated", zone.ID)
 			}
 			zoneIDSet[zone.ID] = true
 		}
+		if account.BanTemplate != "" {
+			if _, err := os.Stat(account.BanTemplate); err != nil {
+				return nil, fmt.Errorf("ban_template of account %s: %w", account.ID, err)
+			}
+		}
+
+		if account.AutoProtectNewZones.Enabled {
+			if account.AutoProtectNewZones.Interval == 0 {
+				account.AutoProtectNewZones.Interval = time.Hour
+			}
+			if account.AutoProtectNewZones.Interval < time.Minute {
+				return nil, fmt.Errorf("auto_protect_new_zones interval of account %s must be at least 1m", account.ID)
+			}
+			if template := account.AutoProtectNewZones.Template; template != nil {
+				account.ApplyTurnstileDefaults(template)
+				if err := validateZone(account.ID, template); err != nil {
+					return nil, fmt.Errorf("invalid auto_protect_new_zones template: %w", err)
+				}
+				if len(template.Turnstile.ExtraDomains) > 0 {
+					return nil, fmt.Errorf("turnstile extra_domains of the auto_protect_new_zones template can't be set, the domains of the zones it protects being unknown")
+				}
+				if template.BanRedirectURL != "" && account.BanTemplate != "" {
+					return nil, fmt.Errorf("ban_redirect_url of the auto_protect_new_zones template can't be set along with the ban_template of account %s", account.ID)
+				}
+			}
+		}
+
+		for origin, action := range account.OriginActionOverrides {
+			if origin == "" {
+				return nil, fmt.Errorf("origin_action_overrides of account %s can't have an empty origin", account.ID)
+			}
+			if action != "ban" && action != "captcha" && action != "throttle" {
+				return nil, fmt.Errorf("invalid origin_action_overrides %s -> %s of account %s, valid choices are either of 'ban', 'captcha', 'throttle'", origin, action, account.ID)
+			}
+			if !account.supportsAction(action) {
+				return nil, fmt.Errorf("origin_action_overrides %s -> %s of account %s must target an action or an action_fallback of one of its zones", origin, action, account.ID)
+			}
+		}
+	}
+	// the keys hashed with a random salt can't be matched by the worker of the next start, which gets
+	// a new one, so the infra left in place on shutdown and adopted must keep a configured salt
+	if hashing := config.CloudflareConfig.Worker.DecisionHashing; hashing.Enabled && hashing.Salt == "" && !config.CleanupOnExit {
+		return nil, fmt.Errorf("decision_hashing requires a salt unless cleanup_on_exit is set, the infra being adopted on the next start")
+	}
+	if err := config.CloudflareConfig.Worker.setDefaults(); err != nil { // set defaults for worker
+		return nil, err
+	}
+	if !config.CloudflareConfig.Worker.TagScenarios {
+		for _, account := range config.CloudflareConfig.Accounts {
+			for _, zone := range account.ZoneConfigs {
+				if len(zone.ScenarioActions) > 0 {
+					return nil, fmt.Errorf("scenario_actions of zone %s require the worker tag_scenarios to be set", zone.ID)
+				}
+			}
+			if template := account.AutoProtectNewZones.Template; template != nil && len(template.ScenarioActions) > 0 {
+				return nil, fmt.Errorf("scenario_actions of the auto_protect_new_zones template require the worker tag_scenarios to be set")
+			}
+		}
+	}
+	if !config.CloudflareConfig.Worker.ManagesWorker() {
+		for _, account := range config.CloudflareConfig.Accounts {
+			for _, zone := range account.ZoneConfigs {
+				if len(zone.ObserveRoutes) > 0 {
+					return nil, fmt.Errorf("observe_routes of zone %s aren't supported when manage_worker is false", zone.ID)
+				}
+			}
+		}
+	}
+	if config.CloudflareConfig.Worker.DispatchNamespace != "" {
+		for _, account := range config.CloudflareConfig.Accounts {
+			for _, zone := range account.ZoneConfigs {
+				if len(zone.ObserveRoutes) > 0 {
+					return nil, fmt.Errorf("observe_routes of zone %s aren't supported with a dispatch_namespace", zone.ID)
+				}
+			}
+		}
+	}
+	config.CloudflareConfig.API.setDefaults()
+	if err := config.CloudflareConfig.API.validate(); err != nil {
+		return nil, err
+	}
+	if config.PrometheusConfig.ScenarioLabelLimit < 0 {
+		return nil, fmt.Errorf("prometheus scenario_label_limit can't be negative")
+	}
+	if prefix := config.PrometheusConfig.MetricsPrefix; prefix != "" && !metricsPrefixRegex.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid prometheus metrics_prefix %s, it can only hold letters, digits, _ and : and can't start with a digit", prefix)
+	}
+	if token := config.PrometheusConfig.AdminToken; token != "" {
+		if !config.PrometheusConfig.Enabled {
+			return nil, fmt.Errorf("prometheus admin_token requires prometheus to be enabled, the admin endpoints being served by its listener")
+		}
+		if len(token) < minAdminTokenLength {
+			return nil, fmt.Errorf("prometheus admin_token must be at least %d characters long", minAdminTokenLength)
+		}
+	}
+	if config.WarmUpFromKV && config.CachePath == "" {
+		return nil, fmt.Errorf("warm_up_from_kv requires cache_path to be set")
+	}
+	if config.CleanupOnExit && config.CachePath != "" {
+		return nil, fmt.Errorf("cleanup_on_exit can't be set along with cache_path, which leaves the infra in place on shutdown")
+	}
+	if config.WebhookURL != "" {
+		webhookURL, err := url.Parse(config.WebhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook_url: %w", err)
+		}
+		if (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			return nil, fmt.Errorf("invalid webhook_url '%s': expected an http or https URL", webhookURL.Redacted())
+		}
 	}
-	config.CloudflareConfig.Worker.setDefaults() // set defaults for worker
 	return config, nil
 }
 
+func validateZone(accountID string, zone *ZoneConfig) error {
+	validAction := map[string]bool{"captcha": true, "ban": true, "throttle": true}
+	validChoiceMsg := "valid choices are either of 'ban', 'captcha', 'throttle'"
+
+	if !stringSliceContains(zone.Actions, zone.DefaultAction) {
+		zone.Actions = append(zone.Actions, zone.DefaultAction)
+	}
+	if len(zone.Actions) == 0 {
+		return fmt.Errorf("account %s 's zone %s has no action", accountID, zone.ID)
+	}
+	for _, a := range zone.Actions {
+		if _, ok := validAction[a]; !ok {
+			return fmt.Errorf("invalid actions '%s', %s", a, validChoiceMsg)
+		}
+		if a == "captcha" && !zone.Turnstile.Enabled {
+			return fmt.Errorf("turnstile must be enabled for zone %s to support captcha action", zone.ID)
+		}
+		if a == "throttle" && zone.RateLimit.RequestsPerMinute <= 0 {
+			return fmt.Errorf("rate_limit.requests_per_minute must be set for zone %s to support throttle action", zone.ID)
+		}
+	}
+	for from, to := range zone.ActionFallback {
+		if _, ok := validAction[from]; !ok {
+			return fmt.Errorf("invalid action_fallback '%s' for zone %s, %s", from, zone.ID, validChoiceMsg)
+		}
+		if !stringSliceContains(zone.Actions, to) {
+			return fmt.Errorf("action_fallback %s -> %s of zone %s must target one of the zone actions", from, to, zone.ID)
+		}
+	}
+	for scenario, action := range zone.ScenarioActions {
+		if scenario == "" {
+			return fmt.Errorf("scenario_actions of zone %s can't have an empty scenario", zone.ID)
+		}
+		if !stringSliceContains(zone.Actions, action) {
+			return fmt.Errorf("scenario_actions %s -> %s of zone %s must target one of the zone actions", scenario, action, zone.ID)
+		}
+	}
+	for scope, action := range zone.ScopeActions {
+		if !stringSliceContains([]string{"ip", "range", "as", "country"}, scope) {
+			return fmt.Errorf("invalid scope_actions scope '%s' for zone %s, valid choices are ip, range, as and country", scope, zone.ID)
+		}
+		if _, ok := validAction[action]; !ok {
+			return fmt.Errorf("invalid scope_actions action '%s' for zone %s, %s", action, zone.ID, validChoiceMsg)
+		}
+		if action == "captcha" && !zone.Turnstile.Enabled {
+			return fmt.Errorf("turnstile must be enabled for zone %s to use the captcha action in scope_actions", zone.ID)
+		}
+		if !stringSliceContains(zone.Actions, action) {
+			return fmt.Errorf("scope_actions %s -> %s of zone %s must target one of the zone actions", scope, action, zone.ID)
+		}
+	}
+	for _, route := range zone.ObserveRoutes {
+		if stringSliceContains(zone.RoutesToProtect, route) {
+			return fmt.Errorf("route %s of zone %s can't be both protected and observed", route, zone.ID)
+		}
+	}
+	for i, country := range zone.CountryAllowlist {
+		if !isCountryCode(country) {
+			return fmt.Errorf("invalid country '%s' in country_allowlist of zone %s, expected an ISO 3166 alpha-2 code", country, zone.ID)
+		}
+		zone.CountryAllowlist[i] = strings.ToUpper(country)
+	}
+	if err := validateStatusCode("ban_status_code", zone.BanStatusCode); err != nil {
+		return fmt.Errorf("%w for zone %s", err, zone.ID)
+	}
+	if err := validateStatusCode("captcha_status_code", zone.CaptchaStatusCode); err != nil {
+		return fmt.Errorf("%w for zone %s", err, zone.ID)
+	}
+	for header, value := range zone.ResponseHeaders {
+		if !httpguts.ValidHeaderFieldName(header) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid response header '%s' for zone %s", header, zone.ID)
+		}
+	}
+	if zone.BanRedirectURL != "" {
+		redirectURL, err := url.Parse(zone.BanRedirectURL)
+		if err != nil {
+			return fmt.Errorf("invalid ban_redirect_url for zone %s: %w", zone.ID, err)
+		}
+		if (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || redirectURL.Host == "" {
+			return fmt.Errorf("invalid ban_redirect_url '%s' for zone %s: expected an http or https URL", zone.BanRedirectURL, zone.ID)
+		}
+		if zone.BanStatusCode != 0 {
+			return fmt.Errorf("ban_status_code of zone %s can't be set along with ban_redirect_url", zone.ID)
+		}
+	}
+	if zone.BanTemplate != "" {
+		if zone.BanRedirectURL != "" {
+			return fmt.Errorf("ban_template of zone %s can't be set along with its ban_redirect_url", zone.ID)
+		}
+		if _, err := os.Stat(zone.BanTemplate); err != nil {
+			return fmt.Errorf("ban_template of zone %s: %w", zone.ID, err)
+		}
+	}
+	if zone.Turnstile.RotateSecretKey && zone.Turnstile.RotateSecretKeyEvery < time.Minute {
+		return fmt.Errorf("turnstile rotate_secret_key_every of zone %s must be at least 1m", zone.ID)
+	}
+	if zone.Turnstile.RotateJitter < 0 || zone.Turnstile.RotateJitter >= 100 {
+		return fmt.Errorf("turnstile rotate_jitter of zone %s must be a percentage between 0 and 99", zone.ID)
+	}
+	for i, domain := range zone.Turnstile.ExtraDomains {
+		hostname := strings.TrimPrefix(domain, "*.")
+		if hostname == "" || strings.ContainsAny(hostname, "/:*") || strings.HasPrefix(hostname, ".") {
+			return fmt.Errorf("invalid turnstile extra_domains '%s' for zone %s: expected a hostname, like www.example.com or *.example.com", domain, zone.ID)
+		}
+		zone.Turnstile.ExtraDomains[i] = strings.ToLower(domain)
+	}
+	if zone.Schedule != nil {
+		if err := zone.Schedule.validate(); err != nil {
+			return fmt.Errorf("invalid enforcement_schedule for zone %s: %w", zone.ID, err)
+		}
+	}
+	return nil
+}
+
+// validateStatusCode checks that a status code of a remediation response, 0 if unset, is an error code.
+func validateStatusCode(name string, code int) error {
+	if code != 0 && (code < 400 || code > 599) {
+		return fmt.Errorf("invalid %s %d, expected a 4xx or 5xx status code", name, code)
+	}
+	return nil
+}
+
+// ParseAllowlist parses a list of IPs and CIDRs into networks. Plain IPs are
+// converted to single host networks (/32 or /128).
+func ParseAllowlist(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s'", entry)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP '%s'", entry)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// ParseASAllowlist normalizes a list of AS numbers, which may be prefixed with "AS", to the values of the
+// AS decisions.
+func ParseASAllowlist(entries []string) ([]string, error) {
+	asns := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 2 && strings.EqualFold(entry[:2], "as") {
+			entry = entry[2:]
+		}
+		asn, err := strconv.ParseUint(entry, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS number '%s'", entry)
+		}
+		asns = append(asns, strconv.FormatUint(asn, 10))
+	}
+	return asns, nil
+}
+
+// DeriveAccountName turns the name Cloudflare gives to an account into the name used in
+// the config and in metrics labels, by stripping the "'s Account" suffix. If nothing is left
+// after stripping, the raw account name is returned.
+func DeriveAccountName(cloudflareName string) string {
+	name := strings.TrimSpace(cloudflareName)
+	for _, suffix := range accountNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			name = strings.TrimSpace(strings.TrimSuffix(name, suffix))
+			break
+		}
+	}
+	if name == "" {
+		return strings.TrimSpace(cloudflareName)
+	}
+	return name
+}
+
 func stringSliceContains(slice []string, t string) bool {
 	for _, item := range slice {
 		if item == t {
@@ -215,6 +1354,8 @@ func stringSliceContains(slice []string, t string) bool {
 func lineComment(l string, zoneByID map[string]cloudflare.Zone, accountByID map[string]cloudflare.Account) string {
 	words := strings.Split(l, " ")
 	lastWord := words[len(words)-1]
+	// the key of the line, compared whole for the keys which end other ones, like scope_actions
+	key := strings.TrimPrefix(strings.TrimSpace(l), "- ")
 
 	if zone, ok := zoneByID[lastWord]; ok {
 		return zone.Name
@@ -233,16 +1374,56 @@ func lineComment(l string, zoneByID map[string]cloudflare.Zone, accountByID map[
 	if strings.Contains(l, "only_include_decisions_from") {
 		return `only include IPs banned due to decisions orginating from provided sources. eg value ["cscli", "crowdsec"]`
 	}
-	if strings.Contains(l, "actions:") {
-		return `supported actions for this zone. eg value ["ban", "captcha"]`
+	if strings.HasPrefix(key, "allowlist:") {
+		return "IPs or CIDRs which are never actioned by the worker"
 	}
-	if strings.Contains(l, "turnstile:") {
+	if strings.HasPrefix(key, "actions:") {
+		return `supported actions for this zone. eg value ["ban", "captcha", "throttle"]`
+	}
+	if strings.HasPrefix(key, "turnstile:") {
 		return `Turnstile must be enabled if captcha action is used.`
 	}
 	return ""
 }
 
-func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
+// SplitTokens splits a comma separated list of tokens, trimming the whitespace around each of them.
+// Empty tokens are rejected, as they are usually a copy-paste mistake.
+func SplitTokens(tokens string) ([]string, error) {
+	if strings.TrimSpace(tokens) == "" {
+		return nil, fmt.Errorf("no token provided")
+	}
+	split := strings.Split(tokens, ",")
+	for i := range split {
+		split[i] = strings.TrimSpace(split[i])
+		if split[i] == "" {
+			return nil, fmt.Errorf("token %d of %d is empty, check for extra commas", i+1, len(split))
+		}
+	}
+	return split, nil
+}
+
+// SubdomainRoutes returns one route per hostname of the A, AAAA and CNAME records, sorted and without
+// duplicates. Wildcard records give wildcard routes.
+func SubdomainRoutes(records []cloudflare.DNSRecord) []string {
+	routes := make([]string, 0, len(records))
+	for _, record := range records {
+		switch record.Type {
+		case "A", "AAAA", "CNAME":
+			routes = append(routes, record.Name+"/*")
+		}
+	}
+	slices.Sort(routes)
+	return slices.Compact(routes)
+}
+
+// ConfigTokens generates a config protecting every zone with an address record of the accounts of the
+// tokens. With subdomains, each hostname of the zone gets its own route instead of a single route
+// matching the whole zone.
+func ConfigTokens(tokens string, baseConfigPath string, subdomains bool) (string, error) {
+	tokenList, err := SplitTokens(tokens)
+	if err != nil {
+		return "", err
+	}
 	baseConfig := &BouncerConfig{}
 	hasBaseConfig := true
 	configBuff, err := os.ReadFile(baseConfigPath)
@@ -259,12 +1440,25 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 		setDefaults(baseConfig)
 	}
 
+	// account names set in the base config take precedence over the derived ones
+	accountNameOverrides := make(map[string]string)
+	// the zones of the base config are kept even without A or AAAA records, they were added on purpose
+	baseZoneIDs := make(map[string]bool)
+	for _, account := range baseConfig.CloudflareConfig.Accounts {
+		if account.Name != "" {
+			accountNameOverrides[account.ID] = account.Name
+		}
+		for _, zone := range account.ZoneConfigs {
+			baseZoneIDs[zone.ID] = true
+		}
+	}
+
 	accountConfigs := make([]AccountConfig, 0)
 	zoneByID := make(map[string]cloudflare.Zone)
 	accountByID := make(map[string]cloudflare.Account)
 	accountIDXByID := make(map[string]int)
 	ctx := context.Background()
-	for _, token := range strings.Split(tokens, ",") {
+	for _, token := range tokenList {
 		api, err := cloudflare.NewWithAPIToken(token)
 		if err != nil {
 			return "", fmt.Errorf("failed to create cloudflare api client: %w", err)
@@ -280,9 +1474,13 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 		for _, account := range accounts {
 			accountByID[account.ID] = account
 			if _, ok := accountIDXByID[account.ID]; !ok {
+				accountName, ok := accountNameOverrides[account.ID]
+				if !ok {
+					accountName = DeriveAccountName(account.Name)
+				}
 				accountConfigs = append(accountConfigs, AccountConfig{
 					ID:          account.ID,
-					Name:        strings.Replace(account.Name, "'s Account", "", -1),
+					Name:        accountName,
 					ZoneConfigs: make([]*ZoneConfig, 0),
 					Token:       token,
 					BanTemplate: "",
@@ -294,6 +1492,7 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 
 		for _, zone := range zones {
 			has_a_record := false
+			// all the pages of records are fetched, zones may have hundreds of them
 			records, _, err := api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(zone.ID), cloudflare.ListDNSRecordsParams{})
 
 			if err != nil {
@@ -307,28 +1506,21 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 				}
 			}
 
-			if !has_a_record {
+			if !has_a_record && !baseZoneIDs[zone.ID] {
 				log.Infof("Skipping zone %s as it does not have any A or AAAA records", zone.Name)
 				continue
 			}
 
 			zoneByID[zone.ID] = zone
 			accountIDX := accountIDXByID[zone.Account.ID]
-			accountConfigs[accountIDX].ZoneConfigs = append(accountConfigs[accountIDX].ZoneConfigs, &ZoneConfig{
-				ID:            zone.ID,
-				Actions:       []string{"captcha"},
-				DefaultAction: "captcha",
-				Turnstile: TurnstileConfig{
-					Enabled:              true,
-					RotateSecretKey:      true,
-					RotateSecretKeyEvery: time.Hour * 24 * 7,
-					Mode:                 "managed",
-				},
-				RoutesToProtect: []string{fmt.Sprintf("*%s/*", zone.Name)},
-			})
-		}
-	}
-	cfConfig := CloudflareConfig{Accounts: accountConfigs}
+			zoneCfg := DefaultZoneConfig(zone.ID, zone.Name)
+			if subdomains {
+				zoneCfg.RoutesToProtect = SubdomainRoutes(records)
+			}
+			accountConfigs[accountIDX].ZoneConfigs = append(accountConfigs[accountIDX].ZoneConfigs, zoneCfg)
+		}
+	}
+	cfConfig := CloudflareConfig{Accounts: MergeAccountConfigs(accountConfigs, baseConfig.CloudflareConfig.Accounts)}
 	baseConfig.CloudflareConfig = cfConfig
 	data, err := yaml.Marshal(baseConfig)
 	if err != nil {
@@ -360,6 +1552,46 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 	return strings.Join(lines, "\n"), nil
 }
 
+// MergeAccountConfigs returns the generated account configs with the settings of the base ones, so that
+// regenerating a config keeps what was tuned by hand. The accounts and zones found in the base config
+// keep their settings, only the new zones get the default ones, and the zones no longer found in the
+// account are dropped.
+func MergeAccountConfigs(generated []AccountConfig, base []AccountConfig) []AccountConfig {
+	baseAccountByID := make(map[string]AccountConfig, len(base))
+	for _, account := range base {
+		baseAccountByID[account.ID] = account
+	}
+	merged := make([]AccountConfig, 0, len(generated))
+	for _, account := range generated {
+		baseAccount, ok := baseAccountByID[account.ID]
+		if !ok {
+			merged = append(merged, account)
+			continue
+		}
+		baseZoneByID := make(map[string]*ZoneConfig, len(baseAccount.ZoneConfigs))
+		for _, zone := range baseAccount.ZoneConfigs {
+			baseZoneByID[zone.ID] = zone
+		}
+		zones := make([]*ZoneConfig, 0, len(account.ZoneConfigs))
+		for _, zone := range account.ZoneConfigs {
+			if baseZone, ok := baseZoneByID[zone.ID]; ok {
+				zone = baseZone
+				delete(baseZoneByID, zone.ID)
+			} else {
+				log.Infof("Adding zone %s to account %s", zone.ID, account.Name)
+			}
+			zones = append(zones, zone)
+		}
+		for id := range baseZoneByID {
+			log.Warnf("Dropping zone %s of account %s, it's no longer in the account", id, account.Name)
+		}
+		baseAccount.Token = account.Token
+		baseAccount.ZoneConfigs = zones
+		merged = append(merged, baseAccount)
+	}
+	return merged
+}
+
 func setDefaults(cfg *BouncerConfig) {
 	cfg.CrowdSecConfig.CrowdSecLAPIUrl = "http://localhost:8080/"
 	cfg.CrowdSecConfig.CrowdsecUpdateFrequencyYAML = "10s"
@@ -2,9 +2,24 @@ package cfg_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
 	"path"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
 
 	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
 )
@@ -16,9 +31,10 @@ var (
 // Basic tests to check for nil pointers and empty config
 func TestConfig(t *testing.T) {
 	tests := []struct {
-		name string
-		yaml []byte
-		err  error
+		name   string
+		yaml   []byte
+		err    error
+		errMsg string
 	}{
 		{
 			name: "Default Config Test",
@@ -29,11 +45,820 @@ func TestConfig(t *testing.T) {
 			yaml: []byte(""),
 			err:  cfg.EmptyConfigError,
 		},
+		{
+			name: "Throttle without rate limit",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [throttle]
+          default_action: throttle
+`),
+			errMsg: "rate_limit.requests_per_minute must be set",
+		},
+		{
+			name: "Throttle with rate limit",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [throttle]
+          default_action: throttle
+          rate_limit:
+            requests_per_minute: 60
+`),
+		},
+		{
+			name: "Action fallback to unsupported action",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          action_fallback:
+            captcha: throttle
+`),
+			errMsg: "must target one of the zone actions",
+		},
+		{
+			name: "Action fallback",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          action_fallback:
+            captcha: ban
+`),
+		},
+		{
+			name: "Origin action overrides",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      origin_action_overrides:
+        cscli: ban
+        lists: captcha
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          action_fallback:
+            captcha: ban
+`),
+		},
+		{
+			name: "Origin action overrides to invalid action",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      origin_action_overrides:
+        cscli: block
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+`),
+			errMsg: "invalid origin_action_overrides cscli -> block of account account",
+		},
+		{
+			name: "Origin action overrides to unsupported action",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      origin_action_overrides:
+        cscli: captcha
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+`),
+			errMsg: "origin_action_overrides cscli -> captcha of account account must target an action or an action_fallback of one of its zones",
+		},
+		{
+			name: "Too short zone check interval",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zone_check_interval: 10s
+`),
+			errMsg: "zone_check_interval of account account must be at least 1m",
+		},
+		{
+			name: "Negative max KV keys",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      max_kv_keys: -1
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+`),
+			errMsg: "max_kv_keys of account account can't be negative",
+		},
+		{
+			name: "Invalid backend",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      backend: waf
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+`),
+			errMsg: "invalid backend waf of account account, valid choices are kv and ruleset",
+		},
+		{
+			name: "Observe routes of an unmanaged worker",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    manage_worker: false
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          observe_routes: ["*example.com/*"]
+`),
+			errMsg: "observe_routes of zone zone aren't supported when manage_worker is false",
+		},
+		{
+			name: "Scenario actions",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    tag_scenarios: true
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban, throttle]
+          default_action: ban
+          rate_limit:
+            requests_per_minute: 60
+          scenario_actions:
+            crowdsecurity/http-crawl-non_statics: throttle
+`),
+		},
+		{
+			name: "Scenario actions to unsupported action",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    tag_scenarios: true
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          scenario_actions:
+            crowdsecurity/ssh-bf: captcha
+`),
+			errMsg: "scenario_actions crowdsecurity/ssh-bf -> captcha of zone zone must target one of the zone actions",
+		},
+		{
+			name: "Scope actions to captcha without turnstile",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          scope_actions:
+            country: captcha
+`),
+			errMsg: "turnstile must be enabled for zone zone to use the captcha action in scope_actions",
+		},
+		{
+			name: "Scope actions of an unknown scope",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          scope_actions:
+            username: ban
+`),
+			errMsg: "invalid scope_actions scope 'username' for zone zone, valid choices are ip, range, as and country",
+		},
+		{
+			name: "Scenario actions without tag scenarios",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          scenario_actions:
+            crowdsecurity/ssh-bf: ban
+`),
+			errMsg: "scenario_actions of zone zone require the worker tag_scenarios to be set",
+		},
+		{
+			name: "Enforcement schedule",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          enforcement_schedule:
+            timezone: UTC
+            windows:
+              - days: [fri, sat]
+                start: "22:00"
+                end: "06:00"
+`),
+		},
+		{
+			name: "Enforcement schedule with invalid time",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          enforcement_schedule:
+            windows:
+              - start: "22h"
+                end: "06:00"
+`),
+			errMsg: "invalid time '22h', expected HH:MM",
+		},
+		{
+			name: "Enforcement schedule with invalid day",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          enforcement_schedule:
+            windows:
+              - days: [friday]
+                start: "22:00"
+                end: "06:00"
+`),
+			errMsg: "invalid day 'friday'",
+		},
+		{
+			name: "Enforcement schedule without window",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          enforcement_schedule:
+            timezone: Europe/Paris
+`),
+			errMsg: "at least one window is required",
+		},
+		{
+			name: "Route both protected and observed",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          routes_to_protect: ["example.com/*"]
+          observe_routes: ["example.com/*"]
+`),
+			errMsg: "route example.com/* of zone zone can't be both protected and observed",
+		},
+		{
+			name: "Invalid country allowlist",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          country_allowlist: [fr, XX]
+`),
+			errMsg: "invalid country 'XX' in country_allowlist of zone zone",
+		},
+		{
+			name: "Invalid ban status code",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_status_code: 302
+`),
+			errMsg: "invalid ban_status_code 302, expected a 4xx or 5xx status code for zone zone",
+		},
+		{
+			name: "Invalid response header",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_status_code: 451
+          response_headers:
+            "Retry After": "60"
+`),
+			errMsg: "invalid response header 'Retry After' for zone zone",
+		},
+		{
+			name: "Invalid ban redirect url",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_redirect_url: status.example.com/banned
+`),
+			errMsg: "invalid ban_redirect_url 'status.example.com/banned' for zone zone: expected an http or https URL",
+		},
+		{
+			name: "Missing zone ban template",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_template: /nonexistent/ban.html
+`),
+			errMsg: "ban_template of zone zone: stat /nonexistent/ban.html",
+		},
+		{
+			name: "Missing account ban template",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      ban_template: /nonexistent/ban.html
+`),
+			errMsg: "ban_template of account account: stat /nonexistent/ban.html",
+		},
+		{
+			name: "Zone ban template with ban redirect url",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_template: config_test.go
+          ban_redirect_url: https://status.example.com/banned
+`),
+			errMsg: "ban_template of zone zone can't be set along with its ban_redirect_url",
+		},
+		{
+			name: "Ban redirect url with ban template",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      ban_template: /etc/ban.html
+      zones:
+        - zone_id: zone
+          actions: [ban]
+          default_action: ban
+          ban_redirect_url: https://status.example.com/banned
+`),
+			errMsg: "ban_redirect_url of zone zone can't be set along with the ban_template of account account",
+		},
+		{
+			name: "Invalid AS allowlist",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      as_allowlist: [AS64496, cloudflare]
+`),
+			errMsg: "account account has invalid as_allowlist: invalid AS number 'cloudflare'",
+		},
+		{
+			name: "Invalid auto protect template",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      auto_protect_new_zones:
+        enabled: true
+        template:
+          actions: [captcha]
+          default_action: captcha
+`),
+			errMsg: "invalid auto_protect_new_zones template",
+		},
+		{
+			name: "Auto protect interval too short",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      auto_protect_new_zones:
+        enabled: true
+        interval: 10s
+`),
+			errMsg: "must be at least 1m",
+		},
+		{
+			name: "Duplicated crowdsec source",
+			yaml: []byte(`
+crowdsec_config:
+  sources:
+    - lapi_url: http://dc1:8080/
+    - lapi_url: http://dc1:8080/
+`),
+			errMsg: "the crowdsec source 'http://dc1:8080/' is duplicated",
+		},
+		{
+			name: "Crowdsec source without url",
+			yaml: []byte(`
+crowdsec_config:
+  sources:
+    - name: dc1
+`),
+			errMsg: "crowdsec source 0 is missing lapi_url",
+		},
+		{
+			name: "Local DB along with sources",
+			yaml: []byte(`
+crowdsec_config:
+  local_db_path: config_test.go
+  sources:
+    - lapi_url: http://dc1:8080/
+`),
+			errMsg: "local_db_path can't be set along with sources",
+		},
+		{
+			name: "Missing local DB",
+			yaml: []byte(`
+crowdsec_config:
+  local_db_path: /nonexistent/crowdsec.db
+`),
+			errMsg: "local_db_path: stat /nonexistent/crowdsec.db: no such file or directory",
+		},
+		{
+			name: "Missing client certificate",
+			yaml: []byte(`
+crowdsec_config:
+  lapi_url: http://localhost:8080/
+  cert_path: /nonexistent/bouncer.pem
+  key_path: /nonexistent/bouncer-key.pem
+`),
+			errMsg: "cert_path of crowdsec source 'http://localhost:8080/': stat /nonexistent/bouncer.pem",
+		},
+		{
+			name: "Client certificate without key",
+			yaml: []byte(`
+crowdsec_config:
+  sources:
+    - name: dc1
+      lapi_url: http://dc1:8080/
+      cert_path: config_test.go
+`),
+			errMsg: "cert_path and key_path of crowdsec source 'dc1' must be set together",
+		},
+		{
+			name: "Invalid turnstile extra domain",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      zones:
+        - zone_id: zone
+          actions: [captcha]
+          default_action: captcha
+          turnstile:
+            enabled: true
+            extra_domains: ["https://www.example.com/"]
+`),
+			errMsg: "invalid turnstile extra_domains 'https://www.example.com/' for zone zone",
+		},
+		{
+			name: "Stream timeout shorter than the update frequency",
+			yaml: []byte(`
+crowdsec_config:
+  update_frequency: 1m
+  stream_timeout: 30s
+`),
+			errMsg: "stream_timeout 30s must be longer than update_frequency 1m0s",
+		},
+		{
+			name: "Pass-through scope enforced by the worker",
+			yaml: []byte(`
+crowdsec_config:
+  pass_through_scopes: [username, Country]
+`),
+			errMsg: "pass_through_scopes can't hold country, the worker already enforces it",
+		},
+		{
+			name: "Invalid worker compatibility date",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    compatibility_date: 01/02/2025
+`),
+			errMsg: "invalid worker compatibility_date 01/02/2025, expected YYYY-MM-DD",
+		},
+		{
+			name: "Worker compatibility date in the future",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    compatibility_date: 2999-01-01
+`),
+			errMsg: "worker compatibility_date 2999-01-01 is in the future",
+		},
+		{
+			name: "Invalid retryable status code",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    retryable_status_codes: [429, 200]
+`),
+			errMsg: "retryable_status_codes: 200 isn't an error status code",
+		},
+		{
+			name: "Negative API timeout",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    api_timeout: -1s
+`),
+			errMsg: "api_timeout can't be negative",
+		},
+		{
+			name: "Negative deploy retries",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    deploy_retries: -1
+`),
+			errMsg: "deploy_retries can't be negative",
+		},
+		{
+			name: "Type both included and excluded",
+			yaml: []byte(`
+crowdsec_config:
+  only_include_types: [ban, Captcha]
+  exclude_types: [captcha]
+`),
+			errMsg: "the type 'captcha' is both in only_include_types and exclude_types",
+		},
+		{
+			name: "Empty excluded type",
+			yaml: []byte(`
+crowdsec_config:
+  exclude_types: [""]
+`),
+			errMsg: "exclude_types can't contain an empty type",
+		},
+		{
+			name: "Negative IP ranges commit interval",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    ip_ranges_commit_interval: -5s
+`),
+			errMsg: "ip_ranges_commit_interval can't be negative",
+		},
+		{
+			name: "D1 retention without D1",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    disable_d1: true
+    d1_retention: 720h
+`),
+			errMsg: "d1_retention can't be set along with disable_d1",
+		},
+		{
+			name: "Negative rate limit min remaining",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    rate_limit_min_remaining: -1
+`),
+			errMsg: "rate_limit_min_remaining can't be negative",
+		},
+		{
+			name: "Invalid proxy url",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    proxy_url: ftp://proxy:21
+`),
+			errMsg: "invalid proxy_url 'ftp://proxy:21': scheme must be either of",
+		},
+		{
+			name: "Proxy url without host",
+			yaml: []byte(`
+cloudflare_config:
+  api:
+    proxy_url: "http://"
+`),
+			errMsg: "invalid proxy_url 'http:': missing host",
+		},
+		{
+			name: "Warm up from KV without cache path",
+			yaml: []byte(`
+warm_up_from_kv: true
+`),
+			errMsg: "warm_up_from_kv requires cache_path to be set",
+		},
+		{
+			name: "Invalid metrics prefix",
+			yaml: []byte(`
+prometheus:
+  metrics_prefix: 1acme-
+`),
+			errMsg: "invalid prometheus metrics_prefix 1acme-",
+		},
+		{
+			name: "Admin token without prometheus",
+			yaml: []byte(`
+prometheus:
+  enabled: false
+  admin_token: 0123456789abcdef
+`),
+			errMsg: "prometheus admin_token requires prometheus to be enabled",
+		},
+		{
+			name: "Short admin token",
+			yaml: []byte(`
+prometheus:
+  enabled: true
+  admin_token: secret
+`),
+			errMsg: "prometheus admin_token must be at least 16 characters long",
+		},
+		{
+			name: "Cleanup on exit with cache path",
+			yaml: []byte(`
+cache_path: /var/lib/crowdsec-cloudflare-worker-bouncer
+cleanup_on_exit: true
+`),
+			errMsg: "cleanup_on_exit can't be set along with cache_path, which leaves the infra in place on shutdown",
+		},
+		{
+			name: "Decision hashing without salt with the infra left in place",
+			yaml: []byte(`
+cloudflare_config:
+  worker:
+    decision_hashing:
+      enabled: true
+`),
+			errMsg: "decision_hashing requires a salt unless cleanup_on_exit is set, the infra being adopted on the next start",
+		},
+		{
+			name: "Decision hashing with a random salt and cleanup on exit",
+			yaml: []byte(`
+cleanup_on_exit: true
+cloudflare_config:
+  worker:
+    decision_hashing:
+      enabled: true
+`),
+		},
+		{
+			name: "Invalid webhook url",
+			yaml: []byte(`
+webhook_url: hooks.example.com/bouncer
+`),
+			errMsg: "invalid webhook_url 'hooks.example.com/bouncer': expected an http or https URL",
+		},
+		{
+			name: "Negative metrics update frequency",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      metrics_update_frequency: -1m
+`),
+			errMsg: "metrics_update_frequency of account account can't be negative",
+		},
+		{
+			name: "Turnstile default rotation too frequent",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      turnstile_defaults:
+        rotate_secret_key_every: 10s
+`),
+			errMsg: "rotate_secret_key_every of account account must be at least 1m",
+		},
+		{
+			name: "Invalid turnstile default jitter",
+			yaml: []byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      turnstile_defaults:
+        rotate_jitter: 100
+`),
+			errMsg: "rotate_jitter of account account must be a percentage between 0 and 99",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := cfg.NewConfig(bytes.NewReader([]byte(tt.yaml)))
 			if err != nil {
+				if tt.errMsg != "" {
+					if !strings.Contains(err.Error(), tt.errMsg) {
+						t.Fatalf("expected error containing %q, got %s", tt.errMsg, err)
+					}
+					return
+				}
 				if tt.err == nil {
 					t.Fatalf("unexpected error: %s", err)
 				}
@@ -43,6 +868,414 @@ func TestConfig(t *testing.T) {
 				}
 				return
 			}
+			if tt.err != nil || tt.errMsg != "" {
+				t.Fatalf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "ipv4 and ipv6 hosts",
+			entries: []string{"1.2.3.4", "2001:db8::1"},
+			want:    []string{"1.2.3.4/32", "2001:db8::1/128"},
+		},
+		{
+			name:    "cidrs are normalized",
+			entries: []string{"10.0.0.1/8", " 2001:db8::/32 "},
+			want:    []string{"10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:    "invalid ip",
+			entries: []string{"1.2.3"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cidr",
+			entries: []string{"1.2.3.4/33"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := cfg.ParseAllowlist(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(nets) != len(tt.want) {
+				t.Fatalf("expected %d networks, got %d", len(tt.want), len(nets))
+			}
+			for i, n := range nets {
+				if n.String() != tt.want[i] {
+					t.Fatalf("expected %s, got %s", tt.want[i], n.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSplitTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  string
+		want    []string
+		wantErr bool
+	}{
+		{name: "single token", tokens: "token1", want: []string{"token1"}},
+		{name: "whitespace is trimmed", tokens: " token1 ,\ttoken2\n", want: []string{"token1", "token2"}},
+		{name: "empty", tokens: "", wantErr: true},
+		{name: "only whitespace", tokens: "  ", wantErr: true},
+		{name: "only commas", tokens: ",,", wantErr: true},
+		{name: "trailing comma", tokens: "token1,", wantErr: true},
+		{name: "whitespace token", tokens: "token1, ,token2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := cfg.SplitTokens(tt.tokens)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", tokens)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if strings.Join(tokens, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected %v, got %v", tt.want, tokens)
+			}
+		})
+	}
+
+	// invalid tokens are rejected before reaching the cloudflare API
+	if _, err := cfg.ConfigTokens("token1,", "/nonexistent", false); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("expected an empty token error, got %v", err)
+	}
+}
+
+func TestSubdomainRoutes(t *testing.T) {
+	records := []cloudflare.DNSRecord{
+		{Type: "A", Name: "www.example.com"},
+		{Type: "AAAA", Name: "www.example.com"},
+		{Type: "CNAME", Name: "blog.example.com"},
+		{Type: "A", Name: "*.dev.example.com"},
+		{Type: "MX", Name: "example.com"},
+		{Type: "TXT", Name: "example.com"},
+	}
+	want := []string{"*.dev.example.com/*", "blog.example.com/*", "www.example.com/*"}
+	if routes := cfg.SubdomainRoutes(records); !slices.Equal(routes, want) {
+		t.Fatalf("expected %v, got %v", want, routes)
+	}
+}
+
+func TestMergeAccountConfigs(t *testing.T) {
+	tuned := &cfg.ZoneConfig{ID: "zone1", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"example.com/api/*"}}
+	base := []cfg.AccountConfig{{
+		ID:          "account1",
+		Name:        "tuned",
+		Token:       "old",
+		Backend:     cfg.BackendRuleset,
+		ZoneConfigs: []*cfg.ZoneConfig{tuned, {ID: "removed"}},
+	}}
+	generated := []cfg.AccountConfig{
+		{
+			ID:          "account1",
+			Name:        "tuned",
+			Token:       "new",
+			ZoneConfigs: []*cfg.ZoneConfig{cfg.DefaultZoneConfig("zone1", "example.com"), cfg.DefaultZoneConfig("zone2", "example.org")},
+		},
+		{ID: "account2", Name: "other", Token: "new", ZoneConfigs: []*cfg.ZoneConfig{cfg.DefaultZoneConfig("zone3", "example.net")}},
+	}
+
+	merged := cfg.MergeAccountConfigs(generated, base)
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 accounts, got %d", len(merged))
+	}
+	account := merged[0]
+	if account.Token != "new" || account.Backend != cfg.BackendRuleset {
+		t.Fatalf("expected the settings of the base account with the new token, got %+v", account)
+	}
+	if len(account.ZoneConfigs) != 2 || account.ZoneConfigs[0] != tuned {
+		t.Fatalf("expected the tuned zone to be kept and the removed one to be dropped, got %+v", account.ZoneConfigs)
+	}
+	if account.ZoneConfigs[1].ID != "zone2" || account.ZoneConfigs[1].DefaultAction != "captcha" {
+		t.Fatalf("expected the new zone to get the defaults, got %+v", account.ZoneConfigs[1])
+	}
+	if merged[1].ID != "account2" || len(merged[1].ZoneConfigs) != 1 {
+		t.Fatalf("expected the new account to be added as generated, got %+v", merged[1])
+	}
+}
+
+func TestDeriveAccountName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "current suffix", in: "owner@example.com's Account", want: "owner@example.com"},
+		{name: "typographic apostrophe", in: "owner@example.com’s Account", want: "owner@example.com"},
+		{name: "lowercase suffix", in: "Acme's account", want: "Acme"},
+		{name: "legacy plural suffix", in: "Ops Teams' Account", want: "Ops Teams"},
+		{name: "no suffix", in: "Acme Corp", want: "Acme Corp"},
+		{name: "suffix in the middle is kept", in: "Bob's Account Team", want: "Bob's Account Team"},
+		{name: "only suffix falls back to raw name", in: "'s Account", want: "'s Account"},
+		{name: "surrounding whitespace", in: "  Acme's Account  ", want: "Acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.DeriveAccountName(tt.in); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScheduleCovers(t *testing.T) {
+	// 2024-01-01 is a monday
+	night := cfg.ScheduleWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}
+	tests := []struct {
+		name     string
+		timezone string
+		at       string
+		want     bool
+	}{
+		{name: "before the window", at: "2024-01-01T21:59:00Z", want: false},
+		{name: "start of the window", at: "2024-01-01T22:00:00Z", want: true},
+		{name: "after midnight of the start day", at: "2024-01-02T05:59:00Z", want: true},
+		{name: "end of the window", at: "2024-01-02T06:00:00Z", want: false},
+		{name: "other start day", at: "2024-01-02T23:00:00Z", want: false},
+		{name: "timezone", timezone: "Europe/Paris", at: "2024-01-01T21:30:00Z", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schedule := cfg.EnforcementScheduleConfig{Timezone: tt.timezone, Windows: []cfg.ScheduleWindow{night}}
+			if got := schedule.Covers(at); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckConfigPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on windows")
+	}
+	tests := []struct {
+		name    string
+		perm    os.FileMode
+		strict  bool
+		wantErr bool
+	}{
+		{name: "owner only", perm: 0o600, strict: true},
+		{name: "group readable", perm: 0o640, strict: true},
+		{name: "world readable strict", perm: 0o644, strict: true, wantErr: true},
+		{name: "world readable not strict", perm: 0o644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := path.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte("daemon: true\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(configPath, tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.CheckConfigPermissions(configPath, tt.strict)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	t.Run("loose local override", func(t *testing.T) {
+		configPath := path.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(configPath, []byte("daemon: true\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(configPath+".local", []byte("daemon: false\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(configPath+".local", 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.CheckConfigPermissions(configPath, true); err == nil {
+			t.Fatalf("expected error, got none")
+		}
+	})
+}
+
+func TestAutoProtectZoneConfig(t *testing.T) {
+	autoProtect := cfg.AutoProtectConfig{ExcludedZones: []string{"zone3", "excluded.com"}}
+	if !autoProtect.Excludes("zone3", "three.com") || !autoProtect.Excludes("zone4", "excluded.com") {
+		t.Fatalf("expected zones to be excluded by id and by name")
+	}
+	if autoProtect.Excludes("zone5", "five.com") {
+		t.Fatalf("expected zone5 not to be excluded")
+	}
+
+	zone := autoProtect.ZoneConfig("zone5", "five.com")
+	if zone.ID != "zone5" || zone.Domain != "five.com" || zone.RoutesToProtect[0] != "*five.com/*" || !zone.Turnstile.Enabled {
+		t.Fatalf("expected default zone config, got %+v", zone)
+	}
+
+	autoProtect.Template = &cfg.ZoneConfig{
+		ID:              "ignored",
+		Actions:         []string{"ban"},
+		DefaultAction:   "ban",
+		RoutesToProtect: []string{"{zone}/admin*", "www.{zone}/admin*"},
+	}
+	zone = autoProtect.ZoneConfig("zone5", "five.com")
+	if zone.ID != "zone5" || zone.RoutesToProtect[0] != "five.com/admin*" || zone.RoutesToProtect[1] != "www.five.com/admin*" {
+		t.Fatalf("unexpected zone config %+v", zone)
+	}
+	if autoProtect.Template.RoutesToProtect[0] != "{zone}/admin*" || autoProtect.Template.ID != "ignored" {
+		t.Fatalf("expected template to be left untouched")
+	}
+}
+
+func TestTurnstileDefaults(t *testing.T) {
+	conf, err := cfg.NewConfig(bytes.NewReader([]byte(`
+cloudflare_config:
+  accounts:
+    - id: account
+      token: token
+      metrics_update_frequency: 5m
+      turnstile_defaults:
+        rotate_secret_key_every: 24h
+        rotate_jitter: 10
+      zones:
+        - zone_id: zone1
+          actions: [captcha]
+          default_action: captcha
+          turnstile:
+            enabled: true
+            rotate_secret_key: true
+        - zone_id: zone2
+          actions: [captcha]
+          default_action: captcha
+          turnstile:
+            enabled: true
+            rotate_secret_key: true
+            rotate_secret_key_every: 1h
+            rotate_jitter: 5
+        - zone_id: zone3
+          actions: [ban]
+          default_action: ban
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := conf.CloudflareConfig.Accounts[0]
+	if account.MetricsUpdateFrequency != 5*time.Minute {
+		t.Fatalf("unexpected metrics update frequency %s", account.MetricsUpdateFrequency)
+	}
+	zones := account.ZoneConfigs
+	if zones[0].Turnstile.RotateSecretKeyEvery != 24*time.Hour || zones[0].Turnstile.RotateJitter != 10 {
+		t.Fatalf("expected the account defaults, got %+v", zones[0].Turnstile)
+	}
+	if zones[1].Turnstile.RotateSecretKeyEvery != time.Hour || zones[1].Turnstile.RotateJitter != 5 {
+		t.Fatalf("expected the zone settings to be kept, got %+v", zones[1].Turnstile)
+	}
+
+	// zones protected automatically without template rotate as set by the account defaults
+	zone := account.AutoProtectZoneConfig("zone4", "four.com")
+	if zone.Turnstile.RotateSecretKeyEvery != 24*time.Hour || zone.Turnstile.RotateJitter != 10 {
+		t.Fatalf("expected the account defaults, got %+v", zone.Turnstile)
+	}
+	account.TurnstileDefaults = cfg.TurnstileRotationConfig{}
+	zone = account.AutoProtectZoneConfig("zone4", "four.com")
+	if zone.Turnstile.RotateSecretKeyEvery != 7*24*time.Hour || zone.Turnstile.RotateJitter != 0 {
+		t.Fatalf("expected a weekly rotation, got %+v", zone.Turnstile)
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir, and returns their paths.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bouncer"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := path.Join(dir, "bouncer.pem"), path.Join(dir, "bouncer-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestCrowdSecTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir)
+	otherCertPath, _ := writeCertificate(t, t.TempDir())
+	invalidPath := path.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		certPath string
+		keyPath  string
+		caPath   string
+		errMsg   string
+	}{
+		{name: "valid", certPath: certPath, keyPath: keyPath, caPath: certPath},
+		{name: "mismatched key", certPath: otherCertPath, keyPath: keyPath, errMsg: "unable to load the client certificate " + otherCertPath},
+		{name: "invalid certificate", certPath: invalidPath, keyPath: keyPath, errMsg: "unable to load the client certificate " + invalidPath},
+		{name: "invalid CA", caPath: invalidPath, errMsg: "ca_cert_path " + invalidPath + " of crowdsec source 'http://localhost:8080/' doesn't hold any PEM certificate"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := cfg.NewConfig(strings.NewReader(fmt.Sprintf(`
+crowdsec_config:
+  lapi_url: http://localhost:8080/
+  cert_path: "%s"
+  key_path: "%s"
+  ca_cert_path: "%s"
+`, tc.certPath, tc.keyPath, tc.caPath)))
+			switch {
+			case tc.errMsg == "" && err != nil:
+				t.Fatalf("unexpected error %s", err)
+			case tc.errMsg != "" && (err == nil || !strings.Contains(err.Error(), tc.errMsg)):
+				t.Fatalf("expected error containing %q, got %v", tc.errMsg, err)
+			}
 		})
 	}
 }
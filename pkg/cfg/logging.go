@@ -16,6 +16,7 @@ import (
 type LoggingConfig struct {
 	LogLevel     *log.Level `yaml:"log_level"`
 	LogMode      string     `yaml:"log_mode"`
+	LogFormat    string     `yaml:"log_format,omitempty"`
 	LogDir       string     `yaml:"log_dir"`
 	LogMaxSize   int        `yaml:"log_max_size,omitempty"`
 	LogMaxFiles  int        `yaml:"log_max_files,omitempty"`
@@ -47,6 +48,10 @@ func (c *LoggingConfig) setDefaults() {
 		c.LogMode = "stdout"
 	}
 
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+
 	if c.LogDir == "" {
 		c.LogDir = "/var/log/"
 	}
@@ -76,6 +81,9 @@ func (c *LoggingConfig) validate() error {
 	if c.LogMode != "stdout" && c.LogMode != "file" {
 		return fmt.Errorf("log_mode should be either 'stdout' or 'file'")
 	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format should be either 'text' or 'json'")
+	}
 	return nil
 }
 
@@ -86,11 +94,17 @@ func (c *LoggingConfig) setup(fileName string) error {
 	}
 	log.SetLevel(*c.LogLevel)
 
+	if c.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339})
+	}
+
 	if c.LogMode == "stdout" {
 		return nil
 	}
 
-	log.SetFormatter(&log.TextFormatter{TimestampFormat: time.RFC3339, FullTimestamp: true})
+	if c.LogFormat == "text" {
+		log.SetFormatter(&log.TextFormatter{TimestampFormat: time.RFC3339, FullTimestamp: true})
+	}
 
 	logger, err := c.LoggerForFile(fileName)
 	if err != nil {
@@ -0,0 +1,54 @@
+package cfg_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whuang8/redactrus"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+func TestJSONLogFormatRedaction(t *testing.T) {
+	std := log.StandardLogger()
+	formatter, out, hooks := std.Formatter, std.Out, std.ReplaceHooks(make(log.LevelHooks))
+	t.Cleanup(func() {
+		std.SetFormatter(formatter)
+		std.SetOutput(out)
+		std.ReplaceHooks(hooks)
+	})
+
+	_, err := cfg.NewConfig(bytes.NewReader([]byte("log_mode: stdout\nlog_format: json\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	std.SetOutput(buf)
+	std.AddHook(&redactrus.Hook{
+		AcceptedLevels: log.AllLevels,
+		RedactionList:  []string{"token", "secret"},
+	})
+
+	log.WithFields(log.Fields{"account": "acme", "zone": "example.com", "token": "abcd"}).Info("Deploying")
+
+	entry := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not valid json: %s (%q)", err, buf.String())
+	}
+	if entry["token"] != "[REDACTED]" {
+		t.Fatalf("expected token to be redacted, got %q", entry["token"])
+	}
+	if entry["account"] != "acme" || entry["zone"] != "example.com" {
+		t.Fatalf("expected account and zone fields to be preserved, got %+v", entry)
+	}
+}
+
+func TestInvalidLogFormat(t *testing.T) {
+	_, err := cfg.NewConfig(bytes.NewReader([]byte("log_mode: stdout\nlog_format: xml\n")))
+	if err == nil {
+		t.Fatal("expected error for invalid log_format")
+	}
+}
@@ -0,0 +1,154 @@
+package cf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/notify"
+)
+
+// authErrorCodes are the error codes of a 403 rejecting the token itself, once it's revoked or expired.
+// 10000 isn't one of them, Cloudflare also returns it when the token only lacks a permission.
+var authErrorCodes = []int{
+	9109, // Invalid access token
+}
+
+// authChecks is how many times the token is verified again once Cloudflare rejected it, before the account
+// is stopped, in case the rejection was spurious.
+const authChecks = 3
+
+// authState tells whether Cloudflare rejected the token of an account. It's shared by the transport of the
+// account client, which detects the rejected token, and the manager of the account, which stops once it
+// is, unless the token is accepted again when verified.
+type authState struct {
+	lock sync.Mutex
+	// closed once the token is rejected, and replaced once it's accepted again
+	failed chan struct{}
+	err    error
+}
+
+func newAuthState() *authState {
+	return &authState{failed: make(chan struct{})}
+}
+
+// fail records that the token was rejected with err, only the first rejection being kept until the token
+// is accepted again.
+func (s *authState) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.failed)
+	}
+}
+
+// succeed clears the rejection of the token once it's accepted again.
+func (s *authState) succeed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		s.err = nil
+		s.failed = make(chan struct{})
+	}
+}
+
+// rejected returns a channel closed once the token is rejected.
+func (s *authState) rejected() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failed
+}
+
+// failure returns the error of the rejection of the token, nil if it's accepted.
+func (s *authState) failure() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// authFailure returns the error of a response rejecting the token, nil for the other responses. A 403
+// is only one if its error code says so, as it's also returned for the calls the token isn't allowed to
+// make. The body is restored after being read.
+func authFailure(resp *http.Response) error {
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	var apiErrors apiResponseErrors
+	if resp.Body != nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			_ = json.Unmarshal(body, &apiErrors)
+		}
+	}
+	for _, apiError := range apiErrors.Errors {
+		if slices.Contains(authErrorCodes, apiError.Code) {
+			err := cf.NewAuthenticationError(&cf.Error{StatusCode: resp.StatusCode, ErrorCodes: []int{apiError.Code}, ErrorMessages: []string{apiError.Message}})
+			return &err
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		err := cf.NewAuthenticationError(&cf.Error{StatusCode: resp.StatusCode})
+		return &err
+	}
+	return nil
+}
+
+// AuthFailed tells whether Cloudflare rejected the token of the account, which stopped managing it.
+func (m *CloudflareAccountManager) AuthFailed() bool {
+	return m.auth != nil && m.auth.failure() != nil
+}
+
+// WatchAuth calls stop once Cloudflare rejects the token of the account, to stop managing it without
+// affecting the other accounts. The token is verified again first, the account being kept if Cloudflare
+// accepts it. It returns when ctx is done.
+func (m *CloudflareAccountManager) WatchAuth(ctx context.Context, stop context.CancelFunc) {
+	if m.auth == nil {
+		return
+	}
+	metrics.CloudflareAuthFailed.WithLabelValues(m.AccountCfg.Name).Set(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.auth.rejected():
+		}
+		if !m.checkRejectedToken(ctx) {
+			break
+		}
+		m.logger.Warn("Cloudflare accepted the token of the account again, it keeps being managed")
+	}
+	err := m.auth.failure()
+	metrics.CloudflareAuthFailed.WithLabelValues(m.AccountCfg.Name).Set(1)
+	m.logger.Errorf("Cloudflare rejected the token of the account, it was likely revoked or has expired: %s", err)
+	m.logger.Error("The account is no longer managed, the other ones are. Create a new token with the permissions listed by -validate-token, set it in the config and restart the bouncer")
+	m.Notifier.Notify(notify.EventAccountDegraded, m.AccountCfg.Name, err)
+	stop()
+}
+
+// checkRejectedToken verifies the token rejected by Cloudflare up to authChecks times, deployRetryDelay
+// apart, and tells whether it's accepted again.
+func (m *CloudflareAccountManager) checkRejectedToken(ctx context.Context) bool {
+	for check := 0; check < authChecks; check++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(m.deployRetryDelay):
+		}
+		if verified, err := m.api.VerifyAPIToken(ctx); err == nil && verified.Status == "active" {
+			m.auth.succeed()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package cf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// WorkerBinding is a binding of the worker script, with the value it's bound to.
+type WorkerBinding struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// WorkerBindings are the bindings the worker of an account is uploaded with.
+type WorkerBindings struct {
+	Account    string          `json:"account"`
+	ScriptName string          `json:"script_name"`
+	Bindings   []WorkerBinding `json:"bindings"`
+	// BanTemplate is the path of the configured ban template, or "default"
+	BanTemplate string `json:"ban_template"`
+	// BanTemplateInKV tells whether the KV namespace holds the ban template the worker serves
+	BanTemplateInKV bool `json:"ban_template_in_kv"`
+}
+
+// describeWorkerBindings returns the bindings of the params in a printable form, sorted by name. Secrets
+// are redacted.
+func describeWorkerBindings(params cf.CreateWorkerParams) []WorkerBinding {
+	bindings := make([]WorkerBinding, 0, len(params.Bindings))
+	for name, binding := range params.Bindings {
+		described := WorkerBinding{Name: name, Type: string(binding.Type())}
+		switch b := binding.(type) {
+		case cf.WorkerKvNamespaceBinding:
+			described.Value = b.NamespaceID
+		case cf.WorkerPlainTextBinding:
+			described.Value = b.Text
+		case cf.WorkerD1DatabaseBinding:
+			described.Value = b.DatabaseID
+		case cf.WorkerSecretTextBinding:
+			described.Value = "<redacted>"
+		default:
+			described.Value = fmt.Sprintf("%+v", b)
+		}
+		bindings = append(bindings, described)
+	}
+	slices.SortFunc(bindings, func(a, b WorkerBinding) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return bindings
+}
+
+// WorkerBindings returns the bindings the worker would be uploaded with, bound to the KV namespace and
+// the D1 DB the account already has, if any, without changing anything. The token may lack the D1
+// permissions, so D1 listing errors are only logged.
+func (m *CloudflareAccountManager) WorkerBindings() (*WorkerBindings, error) {
+	if _, err := m.findKVNamespace(); err != nil {
+		return nil, err
+	}
+
+	m.DatabaseID = ""
+	if !m.d1Disabled() {
+		db, found, err := m.findD1Database()
+		if err != nil {
+			m.logger.Warnf("Unable to list D1 DBs, make sure your token has the proper permissions: %s", err)
+		} else if found {
+			m.DatabaseID = db.UUID
+		}
+	}
+
+	varActionsForZoneByDomain, err := actionsForZoneByDomain(m.zones())
+	if err != nil {
+		return nil, err
+	}
+	params := m.Worker.CreateWorkerParams(workerScript, m.NamespaceID, varActionsForZoneByDomain, m.DatabaseID)
+	bindings := &WorkerBindings{
+		Account:     m.AccountCfg.Name,
+		ScriptName:  params.ScriptName,
+		Bindings:    describeWorkerBindings(params),
+		BanTemplate: m.AccountCfg.BanTemplate,
+	}
+	if bindings.BanTemplate == "" {
+		bindings.BanTemplate = "default"
+	}
+
+	if m.NamespaceID != "" {
+		_, err := m.api.GetWorkersKV(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.GetWorkersKVParams{
+			NamespaceID: m.NamespaceID,
+			Key:         VarNameForBanTemplate,
+		})
+		switch {
+		case err == nil:
+			bindings.BanTemplateInKV = true
+		case !isNotFound(err):
+			return nil, fmt.Errorf("unable to read the ban template from KV: %w", err)
+		}
+	}
+	return bindings, nil
+}
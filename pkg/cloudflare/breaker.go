@@ -0,0 +1,58 @@
+package cf
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	d1BreakerMaxFailures = 3
+	d1BreakerCooldown    = 5 * time.Minute
+)
+
+// circuitBreaker stops calling a failing dependency for a cooldown once it failed too many times in a
+// row. After the cooldown, a single call is let through to test whether it recovered: its success closes
+// the breaker, its failure opens it for another cooldown. The zero value is closed.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  int // consecutive failures
+	openUntil time.Time
+	probing   bool // a call testing the recovery is in flight
+}
+
+// allow tells whether a call can be made.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < d1BreakerMaxFailures {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful call, and returns true if it closed the breaker.
+func (b *circuitBreaker) success() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	wasOpen := b.failures >= d1BreakerMaxFailures
+	b.failures = 0
+	b.probing = false
+	return wasOpen
+}
+
+// failure records a failed call, and returns true if it opened the breaker.
+func (b *circuitBreaker) failure(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures < d1BreakerMaxFailures {
+		return false
+	}
+	b.openUntil = now.Add(d1BreakerCooldown)
+	return true
+}
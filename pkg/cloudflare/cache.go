@@ -0,0 +1,431 @@
+package cf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/notify"
+)
+
+// managerCache is the state of a manager persisted between restarts, so that the KV namespace and the
+// decisions it holds can be reused instead of being rebuilt.
+type managerCache struct {
+	NamespaceID           string                      `json:"namespace_id"`
+	DatabaseID            string                      `json:"database_id,omitempty"`
+	HasD1Access           bool                        `json:"has_d1_access"`
+	KVPairByDecisionValue map[string]cf.WorkersKVPair `json:"kv_pair_by_decision_value"`
+	ActionByIPRange       map[string]string           `json:"action_by_ip_range"`
+	ActionByAS            map[string]string           `json:"action_by_as,omitempty"`
+	ActionByOtherScope    map[string]string           `json:"action_by_other_scope,omitempty"`
+	EnforcementPaused     bool                        `json:"enforcement_paused,omitempty"`
+}
+
+func cacheFilePath(cachePath string, accountID string) string {
+	return filepath.Join(cachePath, accountID+".json")
+}
+
+// SaveCache writes the state of the manager in cachePath, for ResumeFromCache to reuse the infra on the
+// next start.
+func (m *CloudflareAccountManager) SaveCache(cachePath string) error {
+	data, err := json.Marshal(managerCache{
+		NamespaceID:           m.NamespaceID,
+		DatabaseID:            m.DatabaseID,
+		HasD1Access:           m.hasD1Access,
+		KVPairByDecisionValue: m.KVPairByDecisionValue,
+		ActionByIPRange:       m.ActionByIPRange,
+		ActionByAS:            m.ActionByAS,
+		ActionByOtherScope:    m.ActionByOtherScope,
+		EnforcementPaused:     m.EnforcementPaused(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cachePath, 0700); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that an interrupted write never leaves a truncated cache
+	tmpFile, err := os.CreateTemp(cachePath, m.AccountCfg.ID+".json.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	path := cacheFilePath(cachePath, m.AccountCfg.ID)
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return err
+	}
+	m.logger.Infof("Saved %d decisions and %d IP ranges to %s", len(m.KVPairByDecisionValue), len(m.ActionByIPRange), path)
+	return nil
+}
+
+// ResumeFromCache restores the state saved by SaveCache and redeploys the worker on top of the cached
+// KV namespace, keeping the decisions stored in it. It returns false when there is no usable cache, in
+// which case the infra must be rebuilt from scratch.
+func (m *CloudflareAccountManager) ResumeFromCache(cachePath string) (bool, error) {
+	path := cacheFilePath(cachePath, m.AccountCfg.ID)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		m.logger.Infof("No cache found at %s", path)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var cache managerCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		m.logger.Warnf("Ignoring invalid cache %s: %s", path, err)
+		return false, nil
+	}
+
+	exists, err := m.kvNamespaceExists(cache.NamespaceID)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		m.logger.Warnf("KV namespace %s found in %s no longer exists, rebuilding the infra", cache.NamespaceID, path)
+		return false, nil
+	}
+
+	m.NamespaceID = cache.NamespaceID
+	m.DatabaseID = cache.DatabaseID
+	m.hasD1Access = cache.HasD1Access
+	m.KVPairByDecisionValue = cache.KVPairByDecisionValue
+	if cache.ActionByIPRange != nil {
+		m.ActionByIPRange = cache.ActionByIPRange
+	}
+	ipRanges, err := json.Marshal(aggregateIPRanges(m.ActionByIPRange))
+	if err != nil {
+		return false, err
+	}
+	m.ipRangeKVPair.Value = string(ipRanges)
+	m.hasIPRangeKV = len(m.ActionByIPRange) > 0
+	if cache.ActionByAS != nil {
+		m.ActionByAS = cache.ActionByAS
+	}
+	asDecisions, err := json.Marshal(m.ActionByAS)
+	if err != nil {
+		return false, err
+	}
+	m.asKVPair.Value = string(asDecisions)
+	m.hasASKV = len(m.ActionByAS) > 0
+	if cache.ActionByOtherScope != nil {
+		m.ActionByOtherScope = cache.ActionByOtherScope
+	}
+	otherScopeDecisions, err := json.Marshal(m.ActionByOtherScope)
+	if err != nil {
+		return false, err
+	}
+	m.otherScopeKVPair.Value = string(otherScopeDecisions)
+	m.hasOtherScopeKV = len(m.ActionByOtherScope) > 0
+	m.setEnforcementPaused(cache.EnforcementPaused)
+
+	legacyKeys, err := m.migrateUnscopedKeys()
+	if err != nil {
+		m.logger.Warnf("Unable to migrate the decisions of %s to scoped keys, rebuilding the infra: %s", path, err)
+		m.resetState()
+		return false, nil
+	}
+	if err := m.resumeInfra(); err != nil {
+		m.logger.Warnf("Unable to resume the infra from %s, rebuilding it: %s", path, err)
+		m.resetState()
+		return false, nil
+	}
+	// the legacy keys are only deleted once the worker looking up the scoped ones is deployed
+	if len(legacyKeys) > 0 {
+		if err := m.deleteKVKeys(legacyKeys); err != nil {
+			return false, fmt.Errorf("unable to delete unscoped keys: %w", err)
+		}
+		m.logger.Infof("Deleted %d unscoped keys", len(legacyKeys))
+	}
+	m.logger.Infof("Resumed the infra with %d cached decisions and %d IP ranges", len(m.KVPairByDecisionValue), len(m.ActionByIPRange))
+	m.Notifier.Notify(notify.EventInfraDeployed, m.AccountCfg.Name, nil)
+	return true, nil
+}
+
+// migrateUnscopedKeys writes the decisions stored by previous versions under their bare value, like
+// 1.2.3.4 instead of ip:1.2.3.4, to their scoped key, and returns the unscoped keys to delete. The scope is
+// inferred from the value, as these keys only held IP and country decisions. Hashed keys can't be told
+// apart, so only the ones of the cached decisions are migrated, the others are deleted as stale keys when
+// the decisions are reconciled.
+func (m *CloudflareAccountManager) migrateUnscopedKeys() ([]string, error) {
+	actionByLegacyKey := make(map[string]string)
+	valueByLegacyKey := make(map[string]string)
+	kvPairByDecisionValue := make(map[string]cf.WorkersKVPair, len(m.KVPairByDecisionValue))
+	for value, kvPair := range m.KVPairByDecisionValue {
+		if hasScopePrefix(value) {
+			kvPairByDecisionValue[value] = kvPair
+			continue
+		}
+		actionByLegacyKey[kvPair.Key] = kvPair.Value
+		valueByLegacyKey[kvPair.Key] = value
+	}
+	if !m.Worker.DecisionHashing.Enabled {
+		keys, err := m.listKVKeys()
+		if err != nil {
+			return nil, err
+		}
+		uncachedKeys := make([]string, 0)
+		for _, key := range keys {
+			if _, ok := actionByLegacyKey[key]; !ok && !isReservedKVKey(key) && !hasScopePrefix(key) {
+				uncachedKeys = append(uncachedKeys, key)
+			}
+		}
+		entries, err := m.readKVEntries(uncachedKeys)
+		if err != nil {
+			return nil, err
+		}
+		for key, action := range entries {
+			actionByLegacyKey[key] = action
+		}
+	}
+	if len(actionByLegacyKey) == 0 {
+		return nil, nil
+	}
+
+	legacyKeys := make([]string, 0, len(actionByLegacyKey))
+	keysToWrite := make([]*cf.WorkersKVPair, 0, len(actionByLegacyKey))
+	for legacyKey, action := range actionByLegacyKey {
+		legacyKeys = append(legacyKeys, legacyKey)
+		value, cached := valueByLegacyKey[legacyKey]
+		if !cached {
+			value = legacyKey
+		}
+		scope := "country"
+		if _, err := netip.ParseAddr(value); err == nil {
+			scope = "ip"
+		}
+		id := scopedValue(scope, value)
+		kvPair := cf.WorkersKVPair{Key: m.kvKeyForValue(id), Value: action}
+		keysToWrite = append(keysToWrite, &kvPair)
+		if cached {
+			kvPairByDecisionValue[id] = kvPair
+		}
+	}
+	m.logger.Infof("Migrating %d decisions to scoped keys", len(keysToWrite))
+	if _, err := m.writeKVPairs(keysToWrite); err != nil {
+		return nil, err
+	}
+	m.KVPairByDecisionValue = kvPairByDecisionValue
+	return legacyKeys, nil
+}
+
+// AdoptExistingInfra resumes the infra left in place by a previous run without a cache: the decisions are
+// loaded from the existing KV namespace, and the worker is uploaded again bound to it with the current
+// config. It returns false when there is no KV namespace to adopt or it can't be resumed, in which case
+// the infra has to be rebuilt.
+func (m *CloudflareAccountManager) AdoptExistingInfra() (bool, error) {
+	found, err := m.findKVNamespace()
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		m.logger.Infof("No existing KV namespace %s to adopt", m.Worker.KVNameSpaceName)
+		return false, nil
+	}
+	if !m.d1Disabled() {
+		db, found, err := m.findD1Database()
+		if err != nil {
+			m.logger.Warnf("Unable to list D1 DBs, make sure your token has the proper permissions: %s", err)
+		} else if found {
+			m.DatabaseID = db.UUID
+			m.hasD1Access = true
+		}
+	}
+	if err := m.LoadFromKV(); err != nil {
+		m.logger.Warnf("Unable to load the decisions of KV namespace %s, rebuilding the infra: %s", m.NamespaceID, err)
+		m.resetState()
+		return false, nil
+	}
+	if !m.adoptDeferredCleanUp(time.Now()) {
+		m.resetState()
+		return false, nil
+	}
+	if err := m.resumeInfra(); err != nil {
+		m.logger.Warnf("Unable to adopt the infra of KV namespace %s, rebuilding it: %s", m.NamespaceID, err)
+		m.resetState()
+		return false, nil
+	}
+	m.logger.Infof("Adopted the existing infra with %d decisions and %d IP ranges", len(m.KVPairByDecisionValue), len(m.ActionByIPRange))
+	m.Notifier.Notify(notify.EventInfraDeployed, m.AccountCfg.Name, nil)
+	return true, nil
+}
+
+// AttachExistingInfra looks up the KV namespace and the D1 DB of the infra deployed by another instance of
+// the bouncer by their names, without changing anything, so that the metrics of the worker can be read.
+// The D1 DB is required, as it holds the metrics.
+func (m *CloudflareAccountManager) AttachExistingInfra() error {
+	if m.d1Disabled() {
+		return fmt.Errorf("D1 is disabled, the worker doesn't report metrics")
+	}
+	found, err := m.findKVNamespace()
+	if err != nil {
+		return err
+	}
+	if !found {
+		m.logger.Warnf("KV namespace %s not found, the worker may not be deployed", m.Worker.KVNameSpaceName)
+	}
+	db, found, err := m.findD1Database()
+	if err != nil {
+		return fmt.Errorf("unable to list D1 DBs: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("D1 DB %s not found", m.Worker.D1DBName)
+	}
+	m.DatabaseID = db.UUID
+	m.hasD1Access = true
+	m.logger.Infof("Reading the metrics of D1 DB %s", m.DatabaseID)
+	return nil
+}
+
+// resumeInfra recreates the turnstile widgets and routes, and uploads the worker bound to the existing KV
+// namespace. The D1 DB is created again if it's gone, and the IP list of the ruleset backend is adopted.
+func (m *CloudflareAccountManager) resumeInfra() error {
+	if err := m.cleanUpWidgetsAndRoutes(); err != nil {
+		return err
+	}
+	if m.d1Disabled() || !m.hasD1Access || !m.d1DatabaseExists() {
+		if err := m.createD1Database(); err != nil {
+			return err
+		}
+	}
+	if err := m.deployWorker(); err != nil {
+		return err
+	}
+	return m.deployRuleset()
+}
+
+func (m *CloudflareAccountManager) kvNamespaceExists(namespaceID string) (bool, error) {
+	kvNamespaces, err := m.listKVNamespaces()
+	if err != nil {
+		return false, err
+	}
+	for _, kvNamespace := range kvNamespaces {
+		if kvNamespace.ID == namespaceID && kvNamespace.Title == m.Worker.KVNameSpaceName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *CloudflareAccountManager) d1DatabaseExists() bool {
+	dbs, err := m.listD1Databases("")
+	if err != nil {
+		return false
+	}
+	for _, db := range dbs {
+		if db.UUID == m.DatabaseID {
+			return true
+		}
+	}
+	return false
+}
+
+// resetState forgets the state restored from a cache.
+func (m *CloudflareAccountManager) resetState() {
+	m.NamespaceID = ""
+	m.DatabaseID = ""
+	m.hasD1Access = false
+	m.KVPairByDecisionValue = nil
+	m.ActionByIPRange = make(map[string]string)
+	m.ipRangeKVPair.Value = "{}"
+	m.hasIPRangeKV = false
+	m.ActionByAS = make(map[string]string)
+	m.asKVPair.Value = "{}"
+	m.hasASKV = false
+	m.ActionByOtherScope = make(map[string]string)
+	m.otherScopeKVPair.Value = "{}"
+	m.hasOtherScopeKV = false
+	m.setEnforcementPaused(false)
+	m.cleanupDeadline = time.Time{}
+}
+
+// LoadFromKV rebuilds the decisions cache from the content of the KV namespace, so that it matches what
+// the worker enforces even if the cache restored by ResumeFromCache is stale. Hashed keys can't be mapped
+// back to their decision, so when decision hashing is enabled the restored entries are only kept if
+// their key is still in KV, with the action found there.
+func (m *CloudflareAccountManager) LoadFromKV() error {
+	storageKeys, err := m.listKVStorageKeys()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(storageKeys))
+	expirationByKey := make(map[string]int, len(storageKeys))
+	for _, key := range storageKeys {
+		keys = append(keys, key.Name)
+		expirationByKey[key.Name] = key.Expiration
+	}
+	entries, err := m.readKVEntries(keys)
+	if err != nil {
+		return err
+	}
+
+	actionByIPRange := make(map[string]string)
+	if ipRanges, ok := entries[IpRangeKeyName]; ok {
+		if err := json.Unmarshal([]byte(ipRanges), &actionByIPRange); err != nil {
+			return fmt.Errorf("invalid %s value: %w", IpRangeKeyName, err)
+		}
+		m.ipRangeKVPair.Value = ipRanges
+	} else {
+		m.ipRangeKVPair.Value = "{}"
+	}
+	m.ActionByIPRange = actionByIPRange
+	m.hasIPRangeKV = len(actionByIPRange) > 0
+
+	actionByAS := make(map[string]string)
+	if asDecisions, ok := entries[ASDecisionsKeyName]; ok {
+		if err := json.Unmarshal([]byte(asDecisions), &actionByAS); err != nil {
+			return fmt.Errorf("invalid %s value: %w", ASDecisionsKeyName, err)
+		}
+		m.asKVPair.Value = asDecisions
+	} else {
+		m.asKVPair.Value = "{}"
+	}
+	m.ActionByAS = actionByAS
+	m.hasASKV = len(actionByAS) > 0
+
+	actionByOtherScope := make(map[string]string)
+	if otherScopeDecisions, ok := entries[OtherScopeDecisionsKeyName]; ok {
+		if err := json.Unmarshal([]byte(otherScopeDecisions), &actionByOtherScope); err != nil {
+			return fmt.Errorf("invalid %s value: %w", OtherScopeDecisionsKeyName, err)
+		}
+		m.otherScopeKVPair.Value = otherScopeDecisions
+	} else {
+		m.otherScopeKVPair.Value = "{}"
+	}
+	m.ActionByOtherScope = actionByOtherScope
+	m.hasOtherScopeKV = len(actionByOtherScope) > 0
+	m.setEnforcementPaused(entries[EnforcementKeyName] == "false")
+	m.cleanupDeadline = cleanupDeadlineFrom(entries)
+
+	kvPairByDecisionValue := make(map[string]cf.WorkersKVPair)
+	if m.Worker.DecisionHashing.Enabled {
+		for value, kvPair := range m.KVPairByDecisionValue {
+			if action, ok := entries[kvPair.Key]; ok {
+				kvPairByDecisionValue[value] = cf.WorkersKVPair{Key: kvPair.Key, Value: action, Expiration: expirationByKey[kvPair.Key]}
+			}
+		}
+	} else {
+		for key, action := range entries {
+			if isReservedKVKey(key) || !hasScopePrefix(key) {
+				continue
+			}
+			kvPairByDecisionValue[key] = cf.WorkersKVPair{Key: key, Value: action, Expiration: expirationByKey[key]}
+		}
+	}
+	m.KVPairByDecisionValue = kvPairByDecisionValue
+	m.logger.Infof("Loaded %d decisions and %d IP ranges from KV", len(m.KVPairByDecisionValue), len(m.ActionByIPRange))
+	return nil
+}
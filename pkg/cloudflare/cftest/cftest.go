@@ -0,0 +1,617 @@
+// Package cftest provides an in-memory implementation of the Cloudflare API used by the account managers,
+// to test them without a live account.
+package cftest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+const (
+	defaultPerPage = 20    // page size of the paginated listings when none is requested
+	kvKeysPerPage  = 1000  // page size of the KV keys listing, which follows a cursor
+	maxListItems   = 10000 // items an IP list can hold
+)
+
+// API is an in-memory Cloudflare account: its zones and their DNS records, KV namespaces and their
+// entries, workers, routes, turnstile widgets, D1 DBs, IP lists and the custom rules of the zones.
+// Listings are paginated like the real API. It's safe for concurrent use.
+type API struct {
+	lock      sync.Mutex
+	accountID string
+	nextID    int
+
+	zones         []cf.Zone
+	dnsRecords    map[string][]cf.DNSRecord // by zone ID
+	kvNamespaces  []cf.WorkersKVNamespace
+	kv            map[string]map[string]string // entries by namespace ID
+	workers       map[string]cf.CreateWorkerParams
+	secrets       map[string]map[string]string // secrets by script name
+	routes        map[string][]cf.WorkerRoute  // by zone ID
+	widgets       []cf.TurnstileWidget
+	d1Databases   []cf.D1Database
+	tokenPolicies []cf.APITokenPolicies
+	lists         []cf.List
+	listItems     map[string][]cf.ListItem    // by list ID
+	customRules   map[string][]cf.RulesetRule // by zone ID
+}
+
+// New returns an empty account.
+func New(accountID string) *API {
+	return &API{
+		accountID:   accountID,
+		dnsRecords:  make(map[string][]cf.DNSRecord),
+		kv:          make(map[string]map[string]string),
+		workers:     make(map[string]cf.CreateWorkerParams),
+		secrets:     make(map[string]map[string]string),
+		routes:      make(map[string][]cf.WorkerRoute),
+		listItems:   make(map[string][]cf.ListItem),
+		customRules: make(map[string][]cf.RulesetRule),
+	}
+}
+
+// AddZone adds a zone to the account, with an A record so that it can be protected automatically.
+func (a *API) AddZone(zoneID string, name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.zones = append(a.zones, cf.Zone{ID: zoneID, Name: name, Account: cf.Account{ID: a.accountID}})
+	a.dnsRecords[zoneID] = append(a.dnsRecords[zoneID], cf.DNSRecord{ID: a.newID("record"), Type: "A", Name: name, Content: "192.0.2.1"})
+}
+
+// SetTokenPolicies sets the policies of the token returned by GetAPIToken.
+func (a *API) SetTokenPolicies(policies []cf.APITokenPolicies) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tokenPolicies = policies
+}
+
+// KVNamespaces returns the KV namespaces of the account.
+func (a *API) KVNamespaces() []cf.WorkersKVNamespace {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.kvNamespaces)
+}
+
+// KVEntries returns a copy of the entries of the KV namespace.
+func (a *API) KVEntries(namespaceID string) map[string]string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries := make(map[string]string, len(a.kv[namespaceID]))
+	for key, value := range a.kv[namespaceID] {
+		entries[key] = value
+	}
+	return entries
+}
+
+// Worker returns the params the script was last uploaded with, if it exists.
+func (a *API) Worker(scriptName string) (cf.CreateWorkerParams, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	params, ok := a.workers[scriptName]
+	return params, ok
+}
+
+// Routes returns the worker routes of the zone.
+func (a *API) Routes(zoneID string) []cf.WorkerRoute {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.routes[zoneID])
+}
+
+// Widgets returns the turnstile widgets of the account.
+func (a *API) Widgets() []cf.TurnstileWidget {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.widgets)
+}
+
+// Lists returns the lists of the account.
+func (a *API) Lists() []cf.List {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.lists)
+}
+
+// ListIPs returns the IPs of the list with the name, sorted.
+func (a *API) ListIPs(name string) []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ips := make([]string, 0)
+	for _, list := range a.lists {
+		if list.Name != name {
+			continue
+		}
+		for _, item := range a.listItems[list.ID] {
+			ips = append(ips, *item.IP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// CustomRules returns the WAF custom rules of the zone.
+func (a *API) CustomRules(zoneID string) []cf.RulesetRule {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.customRules[zoneID])
+}
+
+// D1Databases returns the D1 DBs of the account.
+func (a *API) D1Databases() []cf.D1Database {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.d1Databases)
+}
+
+// newID returns a unique ID with the prefix. The lock must be held.
+func (a *API) newID(prefix string) string {
+	a.nextID++
+	return fmt.Sprintf("%s%d", prefix, a.nextID)
+}
+
+func notFound(format string, args ...any) error {
+	err := cf.NewNotFoundError(&cf.Error{
+		StatusCode:    http.StatusNotFound,
+		ErrorMessages: []string{fmt.Sprintf(format, args...)},
+	})
+	return &err
+}
+
+// paginate returns the page of items requested like the real API, the first one if none is.
+func paginate[T any](items []T, page cf.ResultInfo) ([]T, *cf.ResultInfo) {
+	perPage := page.PerPage
+	if perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	pageNumber := max(page.Page, 1)
+	start := min((pageNumber-1)*perPage, len(items))
+	end := min(start+perPage, len(items))
+	return slices.Clone(items[start:end]), &cf.ResultInfo{
+		Page:       pageNumber,
+		PerPage:    perPage,
+		TotalPages: (len(items) + perPage - 1) / perPage,
+		Count:      end - start,
+		Total:      len(items),
+	}
+}
+
+func (a *API) Account(ctx context.Context, accountID string) (cf.Account, cf.ResultInfo, error) {
+	if accountID != a.accountID {
+		return cf.Account{}, cf.ResultInfo{}, notFound("account %s not found", accountID)
+	}
+	return cf.Account{ID: a.accountID}, cf.ResultInfo{}, nil
+}
+
+func (a *API) VerifyAPIToken(ctx context.Context) (cf.APITokenVerifyBody, error) {
+	return cf.APITokenVerifyBody{ID: "token", Status: "active"}, nil
+}
+
+func (a *API) GetAPIToken(ctx context.Context, tokenID string) (cf.APIToken, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return cf.APIToken{ID: tokenID, Status: "active", Policies: a.tokenPolicies}, nil
+}
+
+func (a *API) ListZones(ctx context.Context, z ...string) ([]cf.Zone, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	zones := make([]cf.Zone, 0, len(a.zones))
+	for _, zone := range a.zones {
+		if len(z) == 0 || slices.Contains(z, zone.Name) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+func (a *API) ListDNSRecords(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDNSRecordsParams) ([]cf.DNSRecord, *cf.ResultInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	records, resultInfo := paginate(a.dnsRecords[rc.Identifier], params.ResultInfo)
+	return records, resultInfo, nil
+}
+
+func (a *API) CreateWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkersKVNamespaceParams) (cf.WorkersKVNamespaceResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	namespace := cf.WorkersKVNamespace{ID: a.newID("namespace"), Title: params.Title}
+	a.kvNamespaces = append(a.kvNamespaces, namespace)
+	a.kv[namespace.ID] = make(map[string]string)
+	return cf.WorkersKVNamespaceResponse{Response: cf.Response{Success: true}, Result: namespace}, nil
+}
+
+func (a *API) ListWorkersKVNamespaces(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVNamespacesParams) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	namespaces, resultInfo := paginate(a.kvNamespaces, params.ResultInfo)
+	return namespaces, resultInfo, nil
+}
+
+func (a *API) DeleteWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, namespaceID string) (cf.Response, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.kv[namespaceID]; !ok {
+		return cf.Response{}, notFound("namespace %s not found", namespaceID)
+	}
+	delete(a.kv, namespaceID)
+	a.kvNamespaces = slices.DeleteFunc(a.kvNamespaces, func(namespace cf.WorkersKVNamespace) bool {
+		return namespace.ID == namespaceID
+	})
+	return cf.Response{Success: true}, nil
+}
+
+func (a *API) WriteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.WriteWorkersKVEntriesParams) (cf.Response, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries, ok := a.kv[params.NamespaceID]
+	if !ok {
+		return cf.Response{}, notFound("namespace %s not found", params.NamespaceID)
+	}
+	for _, kv := range params.KVs {
+		entries[kv.Key] = kv.Value
+	}
+	return cf.Response{Success: true}, nil
+}
+
+func (a *API) DeleteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkersKVEntriesParams) (cf.Response, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries, ok := a.kv[params.NamespaceID]
+	if !ok {
+		return cf.Response{}, notFound("namespace %s not found", params.NamespaceID)
+	}
+	for _, key := range params.Keys {
+		delete(entries, key)
+	}
+	return cf.Response{Success: true}, nil
+}
+
+func (a *API) GetWorkersKV(ctx context.Context, rc *cf.ResourceContainer, params cf.GetWorkersKVParams) ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	value, ok := a.kv[params.NamespaceID][params.Key]
+	if !ok {
+		return nil, notFound("key %s not found", params.Key)
+	}
+	return []byte(value), nil
+}
+
+// ListWorkersKVKeys lists the keys in lexicographic order, following a cursor like the real API.
+func (a *API) ListWorkersKVKeys(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVsParams) (cf.ListStorageKeysResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries, ok := a.kv[params.NamespaceID]
+	if !ok {
+		return cf.ListStorageKeysResponse{}, notFound("namespace %s not found", params.NamespaceID)
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	start := 0
+	if params.Cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(params.Cursor); err != nil || start > len(keys) {
+			return cf.ListStorageKeysResponse{}, fmt.Errorf("invalid cursor %q", params.Cursor)
+		}
+	}
+	end := min(start+kvKeysPerPage, len(keys))
+	resp := cf.ListStorageKeysResponse{Response: cf.Response{Success: true}}
+	for _, key := range keys[start:end] {
+		resp.Result = append(resp.Result, cf.StorageKey{Name: key})
+	}
+	if end < len(keys) {
+		resp.ResultInfo.Cursor = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func workerKey(dispatchNamespace *string, scriptName string) string {
+	if dispatchNamespace != nil {
+		return *dispatchNamespace + "/" + scriptName
+	}
+	return scriptName
+}
+
+func (a *API) UploadWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerParams) (cf.WorkerScriptResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.workers[workerKey(params.DispatchNamespaceName, params.ScriptName)] = params
+	resp := cf.WorkerScriptResponse{}
+	resp.ID = params.ScriptName
+	return resp, nil
+}
+
+func (a *API) GetWorker(ctx context.Context, rc *cf.ResourceContainer, scriptName string) (cf.WorkerScriptResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	params, ok := a.workers[scriptName]
+	if !ok {
+		return cf.WorkerScriptResponse{}, notFound("worker %s not found", scriptName)
+	}
+	resp := cf.WorkerScriptResponse{}
+	resp.ID = params.ScriptName
+	resp.Script = params.Script
+	return resp, nil
+}
+
+func (a *API) ListWorkers(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersParams) (cf.WorkerListResponse, *cf.ResultInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	resp := cf.WorkerListResponse{}
+	for key, worker := range a.workers {
+		if worker.DispatchNamespaceName == nil {
+			resp.WorkerList = append(resp.WorkerList, cf.WorkerMetaData{ID: key})
+		}
+	}
+	slices.SortFunc(resp.WorkerList, func(x, y cf.WorkerMetaData) int {
+		return strings.Compare(x.ID, y.ID)
+	})
+	return resp, &cf.ResultInfo{Page: 1, TotalPages: 1, Count: len(resp.WorkerList), Total: len(resp.WorkerList)}, nil
+}
+
+func (a *API) DeleteWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkerParams) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := workerKey(params.DispatchNamespace, params.ScriptName)
+	if _, ok := a.workers[key]; !ok {
+		return notFound("worker %s not found", key)
+	}
+	delete(a.workers, key)
+	delete(a.secrets, params.ScriptName)
+	return nil
+}
+
+func (a *API) SetWorkersSecret(ctx context.Context, rc *cf.ResourceContainer, params cf.SetWorkersSecretParams) (cf.WorkersPutSecretResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if params.Secret == nil {
+		return cf.WorkersPutSecretResponse{}, fmt.Errorf("missing secret")
+	}
+	if _, ok := a.secrets[params.ScriptName]; !ok {
+		a.secrets[params.ScriptName] = make(map[string]string)
+	}
+	a.secrets[params.ScriptName][params.Secret.Name] = params.Secret.Text
+	return cf.WorkersPutSecretResponse{
+		Response: cf.Response{Success: true},
+		Result:   cf.WorkersSecret{Name: params.Secret.Name, Type: "secret_text"},
+	}, nil
+}
+
+func (a *API) ListWorkersSecrets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersSecretsParams) (cf.WorkersListSecretsResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	resp := cf.WorkersListSecretsResponse{Response: cf.Response{Success: true}}
+	for name := range a.secrets[params.ScriptName] {
+		resp.Result = append(resp.Result, cf.WorkersSecret{Name: name, Type: "secret_text"})
+	}
+	return resp, nil
+}
+
+func (a *API) CreateWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerRouteParams) (cf.WorkerRouteResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, route := range a.routes[rc.Identifier] {
+		if route.Pattern == params.Pattern {
+			return cf.WorkerRouteResponse{}, fmt.Errorf("route pattern %s is already used", params.Pattern)
+		}
+	}
+	route := cf.WorkerRoute{ID: a.newID("route"), Pattern: params.Pattern, ScriptName: params.Script}
+	a.routes[rc.Identifier] = append(a.routes[rc.Identifier], route)
+	return cf.WorkerRouteResponse{Response: cf.Response{Success: true}, WorkerRoute: route}, nil
+}
+
+func (a *API) ListWorkerRoutes(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkerRoutesParams) (cf.WorkerRoutesResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return cf.WorkerRoutesResponse{Response: cf.Response{Success: true}, Routes: slices.Clone(a.routes[rc.Identifier])}, nil
+}
+
+func (a *API) DeleteWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, routeID string) (cf.WorkerRouteResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	routes := a.routes[rc.Identifier]
+	idx := slices.IndexFunc(routes, func(route cf.WorkerRoute) bool { return route.ID == routeID })
+	if idx < 0 {
+		return cf.WorkerRouteResponse{}, notFound("route %s not found", routeID)
+	}
+	route := routes[idx]
+	a.routes[rc.Identifier] = slices.Delete(routes, idx, idx+1)
+	return cf.WorkerRouteResponse{Response: cf.Response{Success: true}, WorkerRoute: route}, nil
+}
+
+func (a *API) CreateTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateTurnstileWidgetParams) (cf.TurnstileWidget, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	widget := cf.TurnstileWidget{
+		SiteKey: a.newID("sitekey"),
+		Secret:  a.newID("secret"),
+		Name:    params.Name,
+		Domains: params.Domains,
+		Mode:    params.Mode,
+	}
+	a.widgets = append(a.widgets, widget)
+	return widget, nil
+}
+
+func (a *API) ListTurnstileWidgets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListTurnstileWidgetParams) ([]cf.TurnstileWidget, *cf.ResultInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	widgets, resultInfo := paginate(a.widgets, params.ResultInfo)
+	return widgets, resultInfo, nil
+}
+
+func (a *API) RotateTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, param cf.RotateTurnstileWidgetParams) (cf.TurnstileWidget, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, widget := range a.widgets {
+		if widget.SiteKey == param.SiteKey {
+			a.widgets[i].Secret = a.newID("secret")
+			return a.widgets[i], nil
+		}
+	}
+	return cf.TurnstileWidget{}, notFound("widget %s not found", param.SiteKey)
+}
+
+func (a *API) DeleteTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, siteKey string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	idx := slices.IndexFunc(a.widgets, func(widget cf.TurnstileWidget) bool { return widget.SiteKey == siteKey })
+	if idx < 0 {
+		return notFound("widget %s not found", siteKey)
+	}
+	a.widgets = slices.Delete(a.widgets, idx, idx+1)
+	return nil
+}
+
+func (a *API) CreateD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateD1DatabaseParams) (cf.D1Database, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	db := cf.D1Database{UUID: a.newID("database"), Name: params.Name}
+	a.d1Databases = append(a.d1Databases, db)
+	return db, nil
+}
+
+func (a *API) ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	dbs := make([]cf.D1Database, 0, len(a.d1Databases))
+	for _, db := range a.d1Databases {
+		if params.Name == "" || db.Name == params.Name {
+			dbs = append(dbs, db)
+		}
+	}
+	dbs, resultInfo := paginate(dbs, params.ResultInfo)
+	return dbs, resultInfo, nil
+}
+
+func (a *API) DeleteD1Database(ctx context.Context, rc *cf.ResourceContainer, databaseID string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	idx := slices.IndexFunc(a.d1Databases, func(db cf.D1Database) bool { return db.UUID == databaseID })
+	if idx < 0 {
+		return notFound("database %s not found", databaseID)
+	}
+	a.d1Databases = slices.Delete(a.d1Databases, idx, idx+1)
+	return nil
+}
+
+func (a *API) CreateList(ctx context.Context, rc *cf.ResourceContainer, params cf.ListCreateParams) (cf.List, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if slices.ContainsFunc(a.lists, func(list cf.List) bool { return list.Name == params.Name }) {
+		return cf.List{}, fmt.Errorf("list %s already exists", params.Name)
+	}
+	list := cf.List{ID: a.newID("list"), Name: params.Name, Description: params.Description, Kind: params.Kind}
+	a.lists = append(a.lists, list)
+	return list, nil
+}
+
+func (a *API) ListLists(ctx context.Context, rc *cf.ResourceContainer, params cf.ListListsParams) ([]cf.List, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.lists), nil
+}
+
+func (a *API) DeleteList(ctx context.Context, rc *cf.ResourceContainer, listID string) (cf.ListDeleteResponse, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	idx := slices.IndexFunc(a.lists, func(list cf.List) bool { return list.ID == listID })
+	if idx < 0 {
+		return cf.ListDeleteResponse{}, notFound("list %s not found", listID)
+	}
+	a.lists = slices.Delete(a.lists, idx, idx+1)
+	delete(a.listItems, listID)
+	return cf.ListDeleteResponse{Response: cf.Response{Success: true}}, nil
+}
+
+func (a *API) ListListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListListItemsParams) ([]cf.ListItem, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !slices.ContainsFunc(a.lists, func(list cf.List) bool { return list.ID == params.ID }) {
+		return nil, notFound("list %s not found", params.ID)
+	}
+	return slices.Clone(a.listItems[params.ID]), nil
+}
+
+// CreateListItems adds the items to the list, the IPs it already holds being kept once, and returns all
+// of its items like the real API once the bulk operation is done.
+func (a *API) CreateListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListCreateItemsParams) ([]cf.ListItem, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !slices.ContainsFunc(a.lists, func(list cf.List) bool { return list.ID == params.ID }) {
+		return nil, notFound("list %s not found", params.ID)
+	}
+	for _, request := range params.Items {
+		if request.IP == nil {
+			return nil, fmt.Errorf("cftest: only IP list items are supported")
+		}
+		if slices.ContainsFunc(a.listItems[params.ID], func(item cf.ListItem) bool { return *item.IP == *request.IP }) {
+			continue
+		}
+		if len(a.listItems[params.ID]) >= maxListItems {
+			return nil, fmt.Errorf("list %s can't hold more than %d items", params.ID, maxListItems)
+		}
+		ip := *request.IP
+		a.listItems[params.ID] = append(a.listItems[params.ID], cf.ListItem{ID: a.newID("item"), IP: &ip, Comment: request.Comment})
+	}
+	return slices.Clone(a.listItems[params.ID]), nil
+}
+
+func (a *API) DeleteListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDeleteItemsParams) ([]cf.ListItem, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !slices.ContainsFunc(a.lists, func(list cf.List) bool { return list.ID == params.ID }) {
+		return nil, notFound("list %s not found", params.ID)
+	}
+	a.listItems[params.ID] = slices.DeleteFunc(a.listItems[params.ID], func(item cf.ListItem) bool {
+		return slices.ContainsFunc(params.Items.Items, func(request cf.ListItemDeleteItemRequest) bool { return request.ID == item.ID })
+	})
+	return slices.Clone(a.listItems[params.ID]), nil
+}
+
+// GetEntrypointRuleset only knows the custom rules phase, which is not found until it has rules.
+func (a *API) GetEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, phase string) (cf.Ruleset, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	rules, ok := a.customRules[rc.Identifier]
+	if phase != "http_request_firewall_custom" || !ok {
+		return cf.Ruleset{}, notFound("no entrypoint ruleset for phase %s of zone %s", phase, rc.Identifier)
+	}
+	return cf.Ruleset{ID: "ruleset-" + rc.Identifier, Phase: phase, Rules: slices.Clone(rules)}, nil
+}
+
+func (a *API) UpdateEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, params cf.UpdateEntrypointRulesetParams) (cf.Ruleset, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if params.Phase != "http_request_firewall_custom" {
+		return cf.Ruleset{}, fmt.Errorf("cftest: unsupported phase %s", params.Phase)
+	}
+	a.customRules[rc.Identifier] = slices.Clone(params.Rules)
+	return cf.Ruleset{ID: "ruleset-" + rc.Identifier, Phase: params.Phase, Rules: slices.Clone(params.Rules)}, nil
+}
+
+// QueryD1Database succeeds without returning any row, as the queries of the worker aren't run.
+func (a *API) QueryD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.QueryD1DatabaseParams) ([]cf.D1Result, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !slices.ContainsFunc(a.d1Databases, func(db cf.D1Database) bool { return db.UUID == params.DatabaseID }) {
+		return nil, notFound("database %s not found", params.DatabaseID)
+	}
+	success := true
+	return []cf.D1Result{{Success: &success}}, nil
+}
+
+// Raw isn't supported, the worker tail it's used for needs a live account.
+func (a *API) Raw(ctx context.Context, method, endpoint string, data interface{}, headers http.Header) (cf.RawResponse, error) {
+	return cf.RawResponse{}, fmt.Errorf("cftest: unsupported raw call %s %s", method, endpoint)
+}
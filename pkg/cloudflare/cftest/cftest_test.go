@@ -0,0 +1,459 @@
+package cftest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+	cf "github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cloudflare/cftest"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+var _ cf.CloudflareAPI = (*cftest.API)(nil)
+
+func newDecision(value string, scope string, action string) *models.Decision {
+	origin := "crowdsec"
+	scenario := "crowdsecurity/http-probing"
+	return &models.Decision{Value: &value, Scope: &scope, Type: &action, Origin: &origin, Scenario: &scenario}
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	api.AddZone("zone2", "two.com")
+	accountCfg := cfg.AccountConfig{
+		ID:    "account",
+		Name:  "test",
+		Token: "token",
+		ZoneConfigs: []*cfg.ZoneConfig{
+			{ID: "zone1", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}},
+		},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.Worker("worker"); !ok {
+		t.Fatal("expected the worker to be uploaded")
+	}
+	routes := api.Routes("zone1")
+	if len(routes) != 1 || routes[0].Pattern != "*one.com/*" || routes[0].ScriptName != "worker" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	if len(api.Routes("zone2")) != 0 {
+		t.Fatalf("expected the zone which isn't configured not to be protected")
+	}
+
+	err = m.ProcessNewDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("cn", "country", "captcha"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	kv := api.KVEntries(m.NamespaceID)
+	if kv["ip:1.2.3.4"] != "ban" || kv["country:cn"] != "captcha" {
+		t.Fatalf("expected the decisions to be written, got %v", kv)
+	}
+	if !strings.Contains(kv[cf.IpRangeKeyName], "10.0.0.0/8") {
+		t.Fatalf("expected the range to be written, got %s", kv[cf.IpRangeKeyName])
+	}
+
+	err = m.ProcessDeletedDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	kv = api.KVEntries(m.NamespaceID)
+	if _, ok := kv["ip:1.2.3.4"]; ok || kv["country:cn"] != "captcha" {
+		t.Fatalf("expected only the deleted decision to be removed, got %v", kv)
+	}
+	if strings.Contains(kv[cf.IpRangeKeyName], "10.0.0.0/8") {
+		t.Fatalf("expected the range to be removed, got %s", kv[cf.IpRangeKeyName])
+	}
+
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.Worker("worker"); ok {
+		t.Fatal("expected the worker to be deleted")
+	}
+	if len(api.Routes("zone1")) != 0 || len(api.KVNamespaces()) != 0 || len(api.D1Databases()) != 0 {
+		t.Fatalf("expected every resource to be deleted, got routes %+v, namespaces %+v and DBs %+v", api.Routes("zone1"), api.KVNamespaces(), api.D1Databases())
+	}
+	// cleaning up again is a no-op
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTurnstileExtraDomains(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:    "account",
+		Name:  "test",
+		Token: "token",
+		ZoneConfigs: []*cfg.ZoneConfig{{
+			ID:            "zone1",
+			Actions:       []string{"captcha"},
+			DefaultAction: "captcha",
+			Turnstile:     cfg.TurnstileConfig{Enabled: true, Mode: "managed", ExtraDomains: []string{"www.one.com", "*.shop.one.com"}},
+		}},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateTurnstileWidgets(); err != nil {
+		t.Fatal(err)
+	}
+	widgets := api.Widgets()
+	if len(widgets) != 1 || strings.Join(widgets[0].Domains, ",") != "one.com,www.one.com,*.shop.one.com" {
+		t.Fatalf("unexpected widgets %+v", widgets)
+	}
+
+	accountCfg.ZoneConfigs[0].Turnstile.ExtraDomains = []string{"www.two.com"}
+	_, err = cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err == nil || !strings.Contains(err.Error(), "turnstile extra_domains www.two.com isn't within the zone one.com") {
+		t.Fatalf("expected the extra domain outside of the zone to be rejected, got %v", err)
+	}
+}
+
+func TestRulesetBackend(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	api.AddZone("zone2", "two.com")
+	accountCfg := cfg.AccountConfig{
+		ID:      "account",
+		Name:    "test",
+		Token:   "token",
+		Backend: cfg.BackendRuleset,
+		ZoneConfigs: []*cfg.ZoneConfig{
+			{ID: "zone1", Actions: []string{"ban", "captcha"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}},
+			{ID: "zone2", Actions: []string{"captcha"}, DefaultAction: "captcha", RoutesToProtect: []string{"*two.com/*"}},
+		},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	rules := api.CustomRules("zone1")
+	if len(rules) != 1 || rules[0].Ref != cf.BlockRuleRef || rules[0].Expression != "ip.src in $"+cf.IPListName {
+		t.Fatalf("unexpected custom rules %+v", rules)
+	}
+	if len(api.CustomRules("zone2")) != 0 {
+		t.Fatal("expected the zone which doesn't ban not to have the custom rule")
+	}
+
+	err = m.ProcessNewDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("5.6.7.8", "ip", "captcha"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := api.ListIPs(cf.IPListName); strings.Join(ips, ",") != "1.2.3.4" {
+		t.Fatalf("expected the banned IP to be listed, got %v", ips)
+	}
+	kv := api.KVEntries(m.NamespaceID)
+	if _, ok := kv["ip:1.2.3.4"]; ok || kv["ip:5.6.7.8"] != "captcha" {
+		t.Fatalf("expected only the captcha to be written to KV, got %v", kv)
+	}
+
+	// a restart adopts the list along with its items
+	m, err = cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adopted, err := m.AdoptExistingInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adopted {
+		t.Fatal("expected the existing infra to be adopted")
+	}
+	if len(api.Lists()) != 1 || len(api.CustomRules("zone1")) != 1 {
+		t.Fatalf("expected the list and the rule not to be duplicated, got %+v and %+v", api.Lists(), api.CustomRules("zone1"))
+	}
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if ips := api.ListIPs(cf.IPListName); len(ips) != 0 {
+		t.Fatalf("expected the unbanned IP to be removed from the list, got %v", ips)
+	}
+
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.Lists()) != 0 || len(api.CustomRules("zone1")) != 0 {
+		t.Fatalf("expected the list and the rule to be deleted, got %+v and %+v", api.Lists(), api.CustomRules("zone1"))
+	}
+}
+
+func TestUseIPLists(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:         "account",
+		Name:       "test",
+		Token:      "token",
+		UseIPLists: true,
+		ZoneConfigs: []*cfg.ZoneConfig{
+			{ID: "zone1", Actions: []string{"ban", "captcha"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}},
+		},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.ProcessNewDecisions([]*models.Decision{
+		newDecision("10.0.0.0/8", "range", "ban"),
+		newDecision("192.168.0.0/16", "range", "captcha"),
+		newDecision("1.2.3.4", "ip", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := api.ListIPs(cf.IPListName); strings.Join(ips, ",") != "10.0.0.0/8" {
+		t.Fatalf("expected only the banned range to be listed, got %v", ips)
+	}
+	kv := api.KVEntries(m.NamespaceID)
+	if kv["ip:1.2.3.4"] != "ban" || strings.Contains(kv[cf.IpRangeKeyName], "10.0.0.0/8") || !strings.Contains(kv[cf.IpRangeKeyName], "192.168.0.0/16") {
+		t.Fatalf("expected the IP and the range with a captcha to be written to KV, got %v", kv)
+	}
+
+	// the ranges which don't fit in the list are enforced by the worker
+	decisions := make([]*models.Decision, 0, 10000)
+	for i := range 10000 {
+		decisions = append(decisions, newDecision(fmt.Sprintf("172.%d.%d.0/24", i/256, i%256), "range", "ban"))
+	}
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := api.ListIPs(cf.IPListName); len(ips) != 10000 {
+		t.Fatalf("expected the list to be full, got %d items", len(ips))
+	}
+	if kv := api.KVEntries(m.NamespaceID); !strings.Contains(kv[cf.IpRangeKeyName], "172.39.15.0/24") {
+		t.Fatalf("expected the last range to be written to KV, got %s", kv[cf.IpRangeKeyName])
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("10.0.0.0/8", "range", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if ips := api.ListIPs(cf.IPListName); slices.Contains(ips, "10.0.0.0/8") {
+		t.Fatal("expected the deleted range to be removed from the list")
+	}
+}
+
+func TestRotateTurnstileSecrets(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:    "account",
+		Name:  "test",
+		Token: "token",
+		ZoneConfigs: []*cfg.ZoneConfig{{
+			ID:            "zone1",
+			Actions:       []string{"captcha"},
+			DefaultAction: "captcha",
+			Turnstile:     cfg.TurnstileConfig{Enabled: true, Mode: "managed"},
+		}},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	widgetTokenCfgByDomain, err := m.CreateTurnstileWidgets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the widget of a zone protected by another config is kept as is
+	widgetTokenCfgByDomain["other.com"] = cf.WidgetTokenCfg{SiteKey: "other-site-key", Secret: "other-secret"}
+	turnstileConfig, err := json.Marshal(widgetTokenCfgByDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.WriteWorkersKVEntries(context.Background(), nil, cloudflare.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs:         []*cloudflare.WorkersKVPair{{Key: cf.TurnstileConfigKey, Value: string(turnstileConfig)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rotation runs in its own invocation, without the widgets known by the running bouncer
+	rotator, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotator.RotateTurnstileSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := make(map[string]cf.WidgetTokenCfg)
+	if err := json.Unmarshal([]byte(api.KVEntries(m.NamespaceID)[cf.TurnstileConfigKey]), &rotated); err != nil {
+		t.Fatal(err)
+	}
+	widgets := api.Widgets()
+	if len(widgets) != 1 || rotated["one.com"].Secret != widgets[0].Secret || rotated["one.com"].Secret == widgetTokenCfgByDomain["one.com"].Secret {
+		t.Fatalf("expected the secret key to be rotated, got %+v and widgets %+v", rotated, widgets)
+	}
+	if rotated["other.com"] != widgetTokenCfgByDomain["other.com"] {
+		t.Fatalf("expected the other widgets to be kept, got %+v", rotated)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:    "account",
+		Name:  "test",
+		Token: "token",
+		ZoneConfigs: []*cfg.ZoneConfig{
+			{ID: "zone1", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}},
+		},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	m, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := m.DiffConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Drifted() {
+		t.Fatalf("expected no drift right after the deployment, got %+v", drift)
+	}
+
+	// a route bound by hand, and a config asking for another route and a turnstile widget
+	_, err = api.CreateWorkerRoute(context.Background(), cloudflare.ZoneIdentifier("zone1"), cloudflare.CreateWorkerRouteParams{Pattern: "one.com/admin/*", Script: "worker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountCfg.ZoneConfigs = []*cfg.ZoneConfig{{
+		ID:              "zone1",
+		Actions:         []string{"captcha"},
+		DefaultAction:   "captcha",
+		RoutesToProtect: []string{"*one.com/*", "one.com/shop/*"},
+		Turnstile:       cfg.TurnstileConfig{Enabled: true, Mode: "managed"},
+	}}
+	updated, err := cf.NewCloudflareManagerWithAPI(context.Background(), accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift, err = updated.DiffConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drift.Drifted() {
+		t.Fatal("expected the drift to be detected")
+	}
+	if len(drift.MissingRoutes) != 1 || drift.MissingRoutes[0].Pattern != "one.com/shop/*" {
+		t.Fatalf("expected the shop route to be missing, got %+v", drift.MissingRoutes)
+	}
+	if len(drift.UnexpectedRoutes) != 1 || drift.UnexpectedRoutes[0].Pattern != "one.com/admin/*" {
+		t.Fatalf("expected the admin route to be unexpected, got %+v", drift.UnexpectedRoutes)
+	}
+	if !slices.Equal(drift.MissingWidgets, []string{"one.com"}) {
+		t.Fatalf("expected the widget of one.com to be missing, got %v", drift.MissingWidgets)
+	}
+	if drift.DeployedWorkerVersion != drift.WorkerVersion || drift.KVKeys == nil {
+		t.Fatalf("expected the worker and the KV namespace to match, got %+v", drift)
+	}
+}
+
+func TestTurnstileRotationMetrics(t *testing.T) {
+	api := cftest.New("account")
+	api.AddZone("zone1", "one.com")
+	accountCfg := cfg.AccountConfig{
+		ID:    "account",
+		Name:  "rotation-metrics-test",
+		Token: "token",
+		ZoneConfigs: []*cfg.ZoneConfig{{
+			ID:            "zone1",
+			Actions:       []string{"captcha"},
+			DefaultAction: "captcha",
+			Turnstile:     cfg.TurnstileConfig{Enabled: true, Mode: "managed", RotateSecretKey: true, RotateSecretKeyEvery: 10 * time.Millisecond},
+		}},
+	}
+	worker := &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := cf.NewCloudflareManagerWithAPI(ctx, accountCfg, worker, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.HandleTurnstile()
+	}()
+
+	rotations := metrics.TurnstileRotations.WithLabelValues("rotation-metrics-test", "one.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(rotations) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the secret key to be rotated twice, got %f rotations", testutil.ToFloat64(rotations))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if lastRotation := testutil.ToFloat64(metrics.TurnstileLastRotation.WithLabelValues("rotation-metrics-test", "one.com")); lastRotation < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Fatalf("expected the last rotation to be recent, got %f", lastRotation)
+	}
+	if failures := testutil.ToFloat64(metrics.TurnstileRotationErrors.WithLabelValues("rotation-metrics-test", "one.com")); failures != 0 {
+		t.Fatalf("expected no failed rotation, got %f", failures)
+	}
+}
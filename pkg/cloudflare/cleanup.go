@@ -0,0 +1,84 @@
+package cf
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// CleanupDeadlineKeyName holds the unix time until which the infra left in place on shutdown, instead of
+// being deleted right away with cleanup_on_exit, is adopted by the next start. A later start deletes it.
+const CleanupDeadlineKeyName = "CLEANUP_DEADLINE"
+
+// DeferCleanUp leaves the infra of the account in place on shutdown, for a start of the bouncer until
+// deadline to adopt it. The bouncer waits until then and deletes the infra unless a new start adopted it,
+// the deadline letting the next start decide when it's stopped before.
+func (m *CloudflareAccountManager) DeferCleanUp(deadline time.Time) error {
+	_, err := m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs:         []*cf.WorkersKVPair{{Key: CleanupDeadlineKeyName, Value: strconv.FormatInt(deadline.Unix(), 10)}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to record the cleanup deadline: %w", err)
+	}
+	m.logger.Infof("Leaving the infra in place until %s for a new start of the bouncer to adopt it", deadline.Format(time.RFC3339))
+	return nil
+}
+
+// DeferredCleanUpAdopted tells whether a new start adopted the infra left in place by DeferCleanUp, which
+// deletes the cleanup deadline.
+func (m *CloudflareAccountManager) DeferredCleanUpAdopted() bool {
+	_, err := m.api.GetWorkersKV(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.GetWorkersKVParams{
+		NamespaceID: m.NamespaceID,
+		Key:         CleanupDeadlineKeyName,
+	})
+	if err == nil {
+		return false
+	}
+	if !isNotFound(err) {
+		m.logger.Warnf("unable to read the cleanup deadline: %s", err)
+		return false
+	}
+	m.logger.Info("A new start of the bouncer adopted the infra, leaving it in place")
+	return true
+}
+
+// cleanupDeadlineFrom parses the cleanup deadline read from KV, zero if there is none.
+func cleanupDeadlineFrom(entries map[string]string) time.Time {
+	value, ok := entries[CleanupDeadlineKeyName]
+	if !ok {
+		return time.Time{}
+	}
+	deadline, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		// an unreadable deadline is treated as passed, the infra being rebuilt
+		return time.Unix(0, 0)
+	}
+	return time.Unix(deadline, 0)
+}
+
+// adoptDeferredCleanUp tells whether the infra loaded from KV can be adopted at now: it can unless it was
+// left in place on shutdown with a deadline which passed. The deadline is deleted once adopted, for a
+// later start after a crash to adopt the infra too.
+func (m *CloudflareAccountManager) adoptDeferredCleanUp(now time.Time) bool {
+	if m.cleanupDeadline.IsZero() {
+		return true
+	}
+	if now.After(m.cleanupDeadline) {
+		m.logger.Infof("The infra was left in place on shutdown until %s, deleting it", m.cleanupDeadline.Format(time.RFC3339))
+		return false
+	}
+	_, err := m.api.DeleteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.DeleteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		Keys:        []string{CleanupDeadlineKeyName},
+	})
+	if err != nil {
+		m.logger.Warnf("Unable to delete the cleanup deadline, a start after %s will rebuild the infra: %s", m.cleanupDeadline.Format(time.RFC3339), err)
+		return true
+	}
+	m.cleanupDeadline = time.Time{}
+	m.logger.Info("The bouncer restarted within the cleanup grace period, adopting the infra left in place")
+	return true
+}
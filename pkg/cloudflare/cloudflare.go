@@ -1,15 +1,26 @@
 package cf
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cf "github.com/cloudflare/cloudflare-go"
@@ -20,11 +31,21 @@ import (
 
 	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
 	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/notify"
 )
 
 //go:embed worker/dist/main.js
 var workerScript string
 
+//go:embed worker/observer.js
+var observerScript string
+
+// WorkerScriptVersion identifies the embedded worker script: the first 12 hex digits of its SHA-256.
+func WorkerScriptVersion() string {
+	sum := sha256.Sum256([]byte(workerScript))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
 //go:embed metrics.sql
 var sqlCreateTableStatement string
 
@@ -32,37 +53,101 @@ const (
 	WidgetName            = "crowdsec-cloudflare-worker-bouncer-widget"
 	TurnstileConfigKey    = "TURNSTILE_CONFIG"
 	VarNameForBanTemplate = "BAN_TEMPLATE"
-	IpRangeKeyName        = "IP_RANGES"
+	// BanTemplateByDomainKeyName holds the ban templates of the zones overriding the one of the account
+	BanTemplateByDomainKeyName = "BAN_TEMPLATE_BY_DOMAIN"
+	IpRangeKeyName             = "IP_RANGES"
+	AllowlistKeyName           = "ALLOWLIST"
+	CountryAllowlistKeyName    = "COUNTRY_ALLOWLIST"
+	ASDecisionsKeyName         = "AS_DECISIONS"
+	// OtherScopeDecisionsKeyName holds the decisions of the pass-through scopes, by scope:value
+	OtherScopeDecisionsKeyName = "OTHER_SCOPE_DECISIONS"
+	ResponseConfigKeyName      = "RESPONSE_CONFIG"
+	SmokeTestKeyName           = "SMOKE_TEST"
+)
+
+// enforcedScopes are the scopes of the decisions the worker looks up for a request: the IP, the ranges
+// containing it, its AS and its country.
+var enforcedScopes = []string{"ip", "range", "as", "country"}
+
+// DiffMode controls whether the KV changes computed for each batch of decisions are logged, and whether
+// they are applied. It can be changed at runtime, unlike the log_only worker mode.
+type DiffMode int32
+
+const (
+	DiffModeOff     DiffMode = iota // apply decisions without logging the diff
+	DiffModeLog                     // log the diff of each batch, then apply it
+	DiffModeLogOnly                 // log the diff of each batch without applying it
 )
 
-type cloudflareAPI interface {
+var diffMode atomic.Int32
+
+func (d DiffMode) String() string {
+	switch d {
+	case DiffModeLog:
+		return "log"
+	case DiffModeLogOnly:
+		return "log-only"
+	default:
+		return "off"
+	}
+}
+
+// SetDiffMode changes the diff mode of every account manager.
+func SetDiffMode(mode DiffMode) {
+	diffMode.Store(int32(mode))
+}
+
+// CurrentDiffMode returns the diff mode currently used by the account managers.
+func CurrentDiffMode() DiffMode {
+	return DiffMode(diffMode.Load())
+}
+
+// CloudflareAPI is the part of the cloudflare API client used by the account managers. cftest implements
+// it in memory for tests.
+type CloudflareAPI interface {
 	Account(ctx context.Context, accountID string) (cf.Account, cf.ResultInfo, error)
 	CreateTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateTurnstileWidgetParams) (cf.TurnstileWidget, error)
+	CreateList(ctx context.Context, rc *cf.ResourceContainer, params cf.ListCreateParams) (cf.List, error)
+	CreateListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListCreateItemsParams) ([]cf.ListItem, error)
 	CreateWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerRouteParams) (cf.WorkerRouteResponse, error)
 	CreateWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkersKVNamespaceParams) (cf.WorkersKVNamespaceResponse, error)
+	DeleteList(ctx context.Context, rc *cf.ResourceContainer, listID string) (cf.ListDeleteResponse, error)
+	DeleteListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDeleteItemsParams) ([]cf.ListItem, error)
 	DeleteTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, siteKey string) error
 	DeleteWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkerParams) error
 	DeleteWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, routeID string) (cf.WorkerRouteResponse, error)
 	DeleteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkersKVEntriesParams) (cf.Response, error)
 	DeleteWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, namespaceID string) (cf.Response, error)
+	GetAPIToken(ctx context.Context, tokenID string) (cf.APIToken, error)
+	GetEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, phase string) (cf.Ruleset, error)
+	GetWorker(ctx context.Context, rc *cf.ResourceContainer, scriptName string) (cf.WorkerScriptResponse, error)
+	GetWorkersKV(ctx context.Context, rc *cf.ResourceContainer, params cf.GetWorkersKVParams) ([]byte, error)
+	ListListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListListItemsParams) ([]cf.ListItem, error)
+	ListLists(ctx context.Context, rc *cf.ResourceContainer, params cf.ListListsParams) ([]cf.List, error)
 	ListTurnstileWidgets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListTurnstileWidgetParams) ([]cf.TurnstileWidget, *cf.ResultInfo, error)
 	ListWorkerRoutes(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkerRoutesParams) (cf.WorkerRoutesResponse, error)
+	ListWorkers(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersParams) (cf.WorkerListResponse, *cf.ResultInfo, error)
+	ListWorkersKVKeys(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVsParams) (cf.ListStorageKeysResponse, error)
 	ListWorkersKVNamespaces(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVNamespacesParams) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error)
 	ListWorkersSecrets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersSecretsParams) (cf.WorkersListSecretsResponse, error)
 	ListZones(ctx context.Context, z ...string) ([]cf.Zone, error)
 	RotateTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, param cf.RotateTurnstileWidgetParams) (cf.TurnstileWidget, error)
 	SetWorkersSecret(ctx context.Context, rc *cf.ResourceContainer, params cf.SetWorkersSecretParams) (cf.WorkersPutSecretResponse, error)
+	UpdateEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, params cf.UpdateEntrypointRulesetParams) (cf.Ruleset, error)
 	UploadWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerParams) (cf.WorkerScriptResponse, error)
+	VerifyAPIToken(ctx context.Context) (cf.APITokenVerifyBody, error)
 	WriteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.WriteWorkersKVEntriesParams) (cf.Response, error)
 	CreateD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateD1DatabaseParams) (cf.D1Database, error)
 	DeleteD1Database(ctx context.Context, rc *cf.ResourceContainer, databaseID string) error
+	ListDNSRecords(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDNSRecordsParams) ([]cf.DNSRecord, *cf.ResultInfo, error)
 	ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error)
 	QueryD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.QueryD1DatabaseParams) ([]cf.D1Result, error)
+	Raw(ctx context.Context, method, endpoint string, data interface{}, headers http.Header) (cf.RawResponse, error)
 }
 
 type CloudflareAccountManager struct {
 	AccountCfg            cfg.AccountConfig
-	api                   cloudflareAPI
+	api                   CloudflareAPI
 	Ctx                   context.Context
 	logger                *log.Entry
 	hasIPRangeKV          bool
@@ -71,16 +156,89 @@ type CloudflareAccountManager struct {
 	KVPairByDecisionValue map[string]cf.WorkersKVPair
 	ipRangeKVPair         cf.WorkersKVPair
 	ActionByIPRange       map[string]string
-	Worker                *cfg.CloudflareWorkerCreateParams
-	hasD1Access           bool
+	hasASKV               bool
+	asKVPair              cf.WorkersKVPair
+	ActionByAS            map[string]string // AS decisions, stored in a single KV entry matched against request.cf.asn
+	hasOtherScopeKV       bool
+	otherScopeKVPair      cf.WorkersKVPair
+	// decisions of the pass-through scopes by scope:value, stored in a single KV entry the worker doesn't
+	// enforce, for the workers of the zones to consume
+	ActionByOtherScope map[string]string
+	// scopes the worker doesn't enforce whose decisions are stored in ActionByOtherScope instead of skipped
+	PassThroughScopes  []string
+	Worker             *cfg.CloudflareWorkerCreateParams
+	hasD1Access        bool
+	allowlist          []*net.IPNet
+	zoneLoggers        map[string]*log.Entry
+	cleanupConcurrency int
+	routeConcurrency   int
+	deployRetries      int           // attempts of a failed deployment step after the first one
+	deployRetryDelay   time.Duration // delay before the first of them, doubling for the next ones
+	// the API quota left, tracked by the transport of the client of NewCloudflareManager
+	rateBudget *rateBudget
+	// whether Cloudflare rejected the token, detected by the transport of the client of NewCloudflareManager
+	auth *authState
+	// batches of KV writes and deletions wait for the budget to reset when fewer calls are left
+	rateBudgetMinRemaining int
+	// protects ActionByIPRange and ipRangeKVPair, read by the IP ranges flusher
+	ipRangesLock sync.Mutex
+	// the IP ranges changed since they were last written, when their commits are debounced
+	ipRangesPending atomic.Bool
+	// protects AccountCfg.ZoneConfigs, zoneLoggers and removedZones, which change when new zones are
+	// protected automatically and when zones are deleted from the account
+	zonesLock sync.RWMutex
+	// zones of the config deleted from the account, protected again if they reappear
+	removedZones map[string]*cfg.ZoneConfig
+	// IP list of the ruleset backend, and the IDs of its items by IP
+	ipListID       string
+	ipListItemByIP map[string]string
+	// the enabled flag last set on the custom rule of each zone, by zone ID
+	blockRuleEnabledByZone map[string]bool
+	blockRuleLock          sync.Mutex
+	widgetTokenCfgByDomain map[string]WidgetTokenCfg
+	widgetLock             sync.Mutex
+	// stops querying the D1 DB for metrics while it keeps failing
+	d1Breaker circuitBreaker
+	// when the metrics were last queried, to query them at most every AccountCfg.MetricsUpdateFrequency
+	lastMetricsUpdate time.Time
+	// when the D1 metrics rows past Worker.D1Retention were last deleted, to delete them at most every
+	// d1PruneInterval
+	lastD1Prune           time.Time
+	lastMetricsUpdateLock sync.Mutex
+	// receives the lifecycle events of the account, nil to drop them
+	Notifier *notify.Notifier
+	// the worker lets every request through, see SetEnforcement
+	enforcementPaused atomic.Bool
+	// until when the infra left in place on shutdown can be adopted, zero if it wasn't, see DeferCleanUp
+	cleanupDeadline time.Time
 }
 
 // This function creates a new instance of the CloudflareAccountManager struct,
 // which is used to manage Cloudflare resources associated with a specific account.
 // It initializes the struct with the account configuration, Cloudflare API client,
 // and other necessary fields.
-func NewCloudflareManager(ctx context.Context, accountCfg cfg.AccountConfig, worker *cfg.CloudflareWorkerCreateParams) (*CloudflareAccountManager, error) {
-	api, err := NewCloudflareAPI(accountCfg)
+func NewCloudflareManager(ctx context.Context, accountCfg cfg.AccountConfig, worker *cfg.CloudflareWorkerCreateParams, apiCfg *cfg.CloudflareAPIConfig) (*CloudflareAccountManager, error) {
+	budget, auth := &rateBudget{}, newAuthState()
+	api, err := newCloudflareAPI(accountCfg, apiCfg, budget, auth)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewCloudflareManagerWithAPI(ctx, accountCfg, worker, api, apiCfg)
+	if err != nil {
+		return nil, err
+	}
+	m.rateBudget, m.auth = budget, auth
+	return m, nil
+}
+
+// NewCloudflareManagerWithAPI creates the manager of the account calling api instead of the Cloudflare API,
+// like an in-memory one from cftest or a wrapper of the client returned by NewCloudflareAPI. A nil apiCfg
+// uses the default concurrency, without retrying the deployment steps.
+func NewCloudflareManagerWithAPI(ctx context.Context, accountCfg cfg.AccountConfig, worker *cfg.CloudflareWorkerCreateParams, api CloudflareAPI, apiCfg *cfg.CloudflareAPIConfig) (*CloudflareAccountManager, error) {
+	if apiCfg == nil {
+		apiCfg = &cfg.CloudflareAPIConfig{}
+	}
+	allowlist, err := cfg.ParseAllowlist(accountCfg.Allowlist)
 	if err != nil {
 		return nil, err
 	}
@@ -88,50 +246,281 @@ func NewCloudflareManager(ctx context.Context, accountCfg cfg.AccountConfig, wor
 	if err != nil {
 		return nil, err
 	}
-	for i, zoneCfg := range accountCfg.ZoneConfigs {
+	if err := setZoneDomains(accountCfg.ZoneConfigs, zones, accountCfg.ID); err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{"account": accountCfg.Name})
+	zoneLoggers := make(map[string]*log.Entry, len(accountCfg.ZoneConfigs))
+	for _, zoneCfg := range accountCfg.ZoneConfigs {
+		zoneLoggers[zoneCfg.ID] = newZoneLogger(logger, zoneCfg)
+	}
+	deployRetries := 0
+	if apiCfg.DeployRetries != nil {
+		deployRetries = *apiCfg.DeployRetries
+	}
+	rateBudgetMinRemaining := 0
+	if apiCfg.RateLimitMinRemaining != nil {
+		rateBudgetMinRemaining = *apiCfg.RateLimitMinRemaining
+	}
+	return &CloudflareAccountManager{
+		AccountCfg:             accountCfg,
+		api:                    api,
+		Ctx:                    ctx,
+		logger:                 logger,
+		ipRangeKVPair:          cf.WorkersKVPair{Key: IpRangeKeyName, Value: "{}"},
+		ActionByIPRange:        make(map[string]string),
+		asKVPair:               cf.WorkersKVPair{Key: ASDecisionsKeyName, Value: "{}"},
+		ActionByAS:             make(map[string]string),
+		otherScopeKVPair:       cf.WorkersKVPair{Key: OtherScopeDecisionsKeyName, Value: "{}"},
+		ActionByOtherScope:     make(map[string]string),
+		Worker:                 worker,
+		allowlist:              allowlist,
+		zoneLoggers:            zoneLoggers,
+		cleanupConcurrency:     apiCfg.CleanupConcurrency,
+		routeConcurrency:       apiCfg.RouteConcurrency,
+		deployRetries:          deployRetries,
+		deployRetryDelay:       retryMinDelay,
+		rateBudgetMinRemaining: rateBudgetMinRemaining,
+	}, nil
+}
+
+// setZoneDomains sets the domain of the zone configs from the zones of the account, and checks that the
+// extra domains of their turnstile widget are within it.
+func setZoneDomains(zoneConfigs []*cfg.ZoneConfig, zones []cf.Zone, accountID string) error {
+	for i, zoneCfg := range zoneConfigs {
 		found := false
 		for _, zone := range zones {
 			if zone.ID == zoneCfg.ID {
 				found = true
-				accountCfg.ZoneConfigs[i].Domain = zone.Name
+				zoneConfigs[i].Domain = zone.Name
 				break
 			}
 		}
 		if !found {
-			return nil, fmt.Errorf("zone %s not found in account %s", zoneCfg.ID, accountCfg.ID)
+			return fmt.Errorf("zone %s not found in account %s", zoneCfg.ID, accountID)
+		}
+		if err := zoneCfg.Turnstile.ValidateExtraDomains(zoneCfg.Domain); err != nil {
+			return fmt.Errorf("zone %s of account %s: %w", zoneCfg.ID, accountID, err)
 		}
 	}
-	return &CloudflareAccountManager{
-		AccountCfg:      accountCfg,
-		api:             api,
-		Ctx:             ctx,
-		logger:          log.WithFields(log.Fields{"account": accountCfg.Name}),
-		ipRangeKVPair:   cf.WorkersKVPair{Key: IpRangeKeyName, Value: "{}"},
-		ActionByIPRange: make(map[string]string),
-		Worker:          worker,
-	}, nil
+	return nil
+}
+
+// newZoneLogger returns a logger carrying the account and zone fields. If the zone overrides
+// the log level, the entry is backed by a dedicated logger sharing the output, formatter and hooks
+// of the standard logger, so that only this zone's messages are affected by the override.
+func newZoneLogger(accountLogger *log.Entry, zone *cfg.ZoneConfig) *log.Entry {
+	if zone.LogLevel == nil {
+		return accountLogger.WithFields(log.Fields{"zone": zone.Domain})
+	}
+	std := log.StandardLogger()
+	zoneLogger := &log.Logger{
+		Out:          std.Out,
+		Hooks:        std.Hooks,
+		Formatter:    std.Formatter,
+		ReportCaller: std.ReportCaller,
+		Level:        *zone.LogLevel,
+		ExitFunc:     std.ExitFunc,
+	}
+	return zoneLogger.WithFields(accountLogger.Data).WithFields(log.Fields{"zone": zone.Domain})
+}
+
+// zoneLogger returns the logger to use for messages related to the given zone.
+func (m *CloudflareAccountManager) zoneLogger(zone *cfg.ZoneConfig) *log.Entry {
+	m.zonesLock.RLock()
+	defer m.zonesLock.RUnlock()
+	if zoneLogger, ok := m.zoneLoggers[zone.ID]; ok {
+		return zoneLogger
+	}
+	return m.logger.WithFields(log.Fields{"zone": zone.Domain})
+}
+
+// decisionsLogger returns a logger with the domains of the zones of the account, which every decision
+// applies to.
+func (m *CloudflareAccountManager) decisionsLogger() *log.Entry {
+	zones := m.zones()
+	domains := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		domains = append(domains, zone.Domain)
+	}
+	return m.logger.WithFields(log.Fields{"zones": strings.Join(domains, ",")})
+}
+
+// withDecision returns the logger with the scope and value of the decision.
+func withDecision(logger *log.Entry, decision *models.Decision) *log.Entry {
+	return logger.WithFields(log.Fields{"scope": *decision.Scope, "value": *decision.Value})
+}
+
+// zones returns the zones protected by the manager.
+func (m *CloudflareAccountManager) zones() []*cfg.ZoneConfig {
+	m.zonesLock.RLock()
+	defer m.zonesLock.RUnlock()
+	return slices.Clone(m.AccountCfg.ZoneConfigs)
 }
 
 // The CloudflareManagerHTTPTransport struct implements the http.RoundTripper interface
-// and overrides the RoundTrip method to increment a Prometheus counter for each API call made by the account owner.
+// and overrides the RoundTrip method to increment a Prometheus counter for each API call made by the account owner,
+// and to record its duration.
+// Failed calls are retried according to the retry policy, and the quota left reported by Cloudflare is
+// recorded in the rate budget.
 type CloudflareManagerHTTPTransport struct {
-	http.Transport
-	accountName string
+	*http.Transport
+	accountName         string
+	deprecationWarnings string
+	retry               retryPolicy
+	rateBudget          *rateBudget
+	auth                *authState
 }
 
 func (cfT *CloudflareManagerHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return cfT.retry.roundTripWithRetries(req, cfT.accountName, cfT.roundTrip)
+}
+
+func (cfT *CloudflareManagerHTTPTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := endpointLabel(req.URL.Path)
 	metrics.CloudflareAPICallsByAccount.WithLabelValues(cfT.accountName).Inc()
-	return http.DefaultTransport.RoundTrip(req)
+	metrics.CloudflareAPICallsByEndpoint.WithLabelValues(cfT.accountName, endpoint).Inc()
+	start := time.Now()
+	resp, err := cfT.Transport.RoundTrip(req)
+	metrics.CloudflareAPIDuration.WithLabelValues(cfT.accountName, endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return resp, err
+	}
+	if cfT.rateBudget != nil {
+		cfT.rateBudget.update(cfT.accountName, resp.Header, time.Now())
+	}
+	if cfT.auth != nil {
+		if authErr := authFailure(resp); authErr != nil {
+			cfT.auth.fail(authErr)
+		}
+	}
+	if cfT.deprecationWarnings != "ignore" {
+		cfT.reportDeprecationWarnings(req, resp)
+	}
+	return resp, nil
+}
+
+// Segments of the API paths used by the bouncer. Any other segment is an ID or a name, dropped from the
+// endpoint label to keep its cardinality bounded.
+var endpointSegments = map[string]bool{
+	"workers": true, "scripts": true, "tails": true, "routes": true, "dispatch": true,
+	"storage": true, "kv": true, "namespaces": true, "bulk": true, "keys": true, "values": true,
+	"d1": true, "database": true, "query": true,
+	"challenges": true, "widgets": true, "rotate_secret": true,
+	"user": true, "tokens": true, "verify": true,
+	"accounts": true, "zones": true, "dns_records": true,
+}
+
+// endpointLabel returns the endpoint of an API path, without the API version, the account or zone
+// prefix and the IDs, e.g. /storage/kv/namespaces/bulk for
+// /client/v4/accounts/<account>/storage/kv/namespaces/<namespace>/bulk.
+func endpointLabel(path string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(path, "/client/v4"), "/"), "/")
+	if len(segments) > 2 && (segments[0] == "accounts" || segments[0] == "zones") {
+		segments = segments[2:]
+	}
+	endpoint := ""
+	for _, segment := range segments {
+		if endpointSegments[segment] {
+			endpoint += "/" + segment
+		}
+	}
+	if endpoint == "" {
+		return "/"
+	}
+	return endpoint
+}
+
+// Subset of the Cloudflare API response envelope carrying informational messages.
+type apiResponseMessages struct {
+	Messages []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"messages"`
+}
+
+// reportDeprecationWarnings logs and counts the deprecation notices of a response, found either in
+// the Deprecation/Sunset headers or in the messages of the JSON body. The body is restored after being read.
+func (cfT *CloudflareManagerHTTPTransport) reportDeprecationWarnings(req *http.Request, resp *http.Response) {
+	warnings := make([]string, 0)
+	if deprecation := resp.Header.Get("Deprecation"); deprecation != "" {
+		warnings = append(warnings, fmt.Sprintf("endpoint deprecated (deprecation: %s, sunset: %s)", deprecation, resp.Header.Get("Sunset")))
+	}
+
+	if resp.Body != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		messages := apiResponseMessages{}
+		if err := json.Unmarshal(body, &messages); err == nil {
+			for _, msg := range messages.Messages {
+				if strings.Contains(strings.ToLower(msg.Message), "deprecat") {
+					warnings = append(warnings, fmt.Sprintf("%s (code %d)", msg.Message, msg.Code))
+				}
+			}
+		}
+	}
+
+	for _, warning := range warnings {
+		metrics.CloudflareAPIDeprecationWarnings.WithLabelValues(cfT.accountName).Inc()
+		logger := log.WithFields(log.Fields{"account": cfT.accountName})
+		if cfT.deprecationWarnings == "debug" {
+			logger.Debugf("Cloudflare API deprecation warning for %s %s: %s", req.Method, req.URL.Path, warning)
+		} else {
+			logger.Warnf("Cloudflare API deprecation warning for %s %s: %s", req.Method, req.URL.Path, warning)
+		}
+	}
+}
+
+// newHTTPTransport returns a transport of its own for an account client, with the defaults of
+// http.DefaultTransport and the connection pool and proxy of the config.
+func newHTTPTransport(apiCfg *cfg.CloudflareAPIConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = apiCfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = apiCfg.IdleConnTimeout
+	proxyURL, err := apiCfg.Proxy()
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
 }
 
-// The NewCloudflareAPI function creates a new instance of the cloudflareAPI interface, which is used to interact with the Cloudflare API.
+// The NewCloudflareAPI function creates a new instance of the CloudflareAPI interface, which is used to interact with the Cloudflare API.
 // It initializes the API client with the provided account configuration and HTTP client, and returns the client instance.
 // The function also uses a custom HTTP transport to track the number of Cloudflare API calls made by the account owner.
-func NewCloudflareAPI(accountCfg cfg.AccountConfig) (cloudflareAPI, error) {
-	transport := CloudflareManagerHTTPTransport{accountName: accountCfg.Name}
-	httpClient := http.Client{}
+func NewCloudflareAPI(accountCfg cfg.AccountConfig, apiCfg *cfg.CloudflareAPIConfig) (CloudflareAPI, error) {
+	return newCloudflareAPI(accountCfg, apiCfg, &rateBudget{}, newAuthState())
+}
+
+// newCloudflareAPI returns the client of NewCloudflareAPI, its transport recording the API quota left in
+// budget and whether the token is rejected in auth.
+func newCloudflareAPI(accountCfg cfg.AccountConfig, apiCfg *cfg.CloudflareAPIConfig, budget *rateBudget, auth *authState) (CloudflareAPI, error) {
+	httpTransport, err := newHTTPTransport(apiCfg)
+	if err != nil {
+		return nil, err
+	}
+	if apiCfg.ProxyURL != "" {
+		proxyURL, _ := apiCfg.Proxy()
+		log.WithField("account", accountCfg.Name).Infof("Using proxy %s://%s for the Cloudflare API", proxyURL.Scheme, proxyURL.Host)
+	}
+	transport := CloudflareManagerHTTPTransport{
+		Transport:           httpTransport,
+		accountName:         accountCfg.Name,
+		deprecationWarnings: apiCfg.DeprecationWarnings,
+		retry:               newRetryPolicy(apiCfg),
+		rateBudget:          budget,
+		auth:                auth,
+	}
+	httpClient := http.Client{Timeout: apiCfg.Timeout}
 	httpClient.Transport = &transport
-	api, err := cf.NewWithAPIToken(accountCfg.Token, cf.HTTPClient(&httpClient))
+	// retries are done by the transport, which knows which failures are retryable
+	api, err := cf.NewWithAPIToken(accountCfg.Token, cf.HTTPClient(&httpClient), cf.UsingRetryPolicy(0, 1, 30))
 	if err != nil {
 		return nil, err
 	}
@@ -140,33 +529,226 @@ func NewCloudflareAPI(accountCfg cfg.AccountConfig) (cloudflareAPI, error) {
 
 // This is pushed to KV. It is used by workers to determine the action to take for a given IP address and zone.
 type ActionsForZone struct {
-	SupportedActions []string `json:"supported_actions"`
-	DefaultAction    string   `json:"default_action"`
+	SupportedActions []string          `json:"supported_actions"`
+	DefaultAction    string            `json:"default_action"`
+	RateLimit        *RateLimitForZone `json:"rate_limit,omitempty"`
+	ActionFallback   map[string]string `json:"action_fallback,omitempty"`
+	Schedule         *ScheduleForZone  `json:"schedule,omitempty"`
+	ScenarioActions  map[string]string `json:"scenario_actions,omitempty"`
+	ScopeActions     map[string]string `json:"scope_actions,omitempty"`
+	// LogOnly lets the requests through, only counting the remediations in the metrics
+	LogOnly bool `json:"log_only,omitempty"`
+}
+
+// Time windows in which the worker enforces the decisions. Days follow Date.getDay(), 0 being sunday,
+// and times are in minutes since midnight in the timezone.
+type ScheduleForZone struct {
+	Timezone string                  `json:"timezone"`
+	Windows  []ScheduleWindowForZone `json:"windows"`
+}
+
+type ScheduleWindowForZone struct {
+	Days  []int `json:"days,omitempty"`
+	Start int   `json:"start"`
+	End   int   `json:"end"`
+}
+
+func scheduleForZone(schedule *cfg.EnforcementScheduleConfig) (*ScheduleForZone, error) {
+	scheduleForZone := &ScheduleForZone{Timezone: schedule.Timezone, Windows: make([]ScheduleWindowForZone, 0, len(schedule.Windows))}
+	if scheduleForZone.Timezone == "" {
+		scheduleForZone.Timezone = "UTC"
+	}
+	for _, window := range schedule.Windows {
+		weekdays, err := window.Weekdays()
+		if err != nil {
+			return nil, err
+		}
+		start, end, err := window.Minutes()
+		if err != nil {
+			return nil, err
+		}
+		days := make([]int, 0, len(weekdays))
+		for _, weekday := range weekdays {
+			days = append(days, int(weekday))
+		}
+		scheduleForZone.Windows = append(scheduleForZone.Windows, ScheduleWindowForZone{Days: days, Start: start, End: end})
+	}
+	return scheduleForZone, nil
+}
+
+// Token bucket parameters used by the worker for the throttle action.
+type RateLimitForZone struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// actionsForZoneByDomain returns the JSON encoded ActionsForZone of the zones, keyed by domain.
+func actionsForZoneByDomain(zones []*cfg.ZoneConfig) ([]byte, error) {
+	actionsForZoneByDomain := make(map[string]ActionsForZone)
+	for _, z := range zones {
+		actionsForZone := ActionsForZone{
+			SupportedActions: z.Actions,
+			DefaultAction:    z.DefaultAction,
+			ActionFallback:   z.ActionFallback,
+			ScenarioActions:  z.ScenarioActions,
+			ScopeActions:     z.ScopeActions,
+			LogOnly:          !z.Enforces(),
+		}
+		if z.RateLimit.RequestsPerMinute > 0 {
+			actionsForZone.RateLimit = &RateLimitForZone{RequestsPerMinute: z.RateLimit.RequestsPerMinute}
+		}
+		if z.Schedule != nil {
+			schedule, err := scheduleForZone(z.Schedule)
+			if err != nil {
+				return nil, err
+			}
+			actionsForZone.Schedule = schedule
+		}
+		actionsForZoneByDomain[z.Domain] = actionsForZone
+	}
+	return json.Marshal(actionsForZoneByDomain)
 }
 
 // Creates a new Cloudflare Workers KV namespace, uploads a new worker script, and binds the worker to one or more routes for
 // each zone configuration in the account. The method also creates a JSON-encoded string of supported actions for each zone
-// and binds it to the worker.
+// and binds it to the worker. When the worker is managed outside of the bouncer, only its KV namespace is
+// looked up and filled.
 func (m *CloudflareAccountManager) DeployInfra() error {
-	// Create the worker
+	for _, zone := range m.zones() {
+		if !zone.Enforces() {
+			m.zoneLogger(zone).Warn("Zone isn't enforced, the worker lets the requests through and only counts the remediations in the metrics")
+		}
+	}
+	if err := m.createKVNamespace(); err != nil {
+		return err
+	}
+	if err := m.createD1Database(); err != nil {
+		return err
+	}
+	if err := m.deployWorker(); err != nil {
+		return err
+	}
+	if err := m.deployRuleset(); err != nil {
+		return err
+	}
+	m.Notifier.Notify(notify.EventInfraDeployed, m.AccountCfg.Name, nil)
+	return nil
+}
+
+// createKVNamespace creates the KV namespace of the worker, or looks up the existing one bound to the
+// worker managed outside of the bouncer. A namespace with the same title left by a previous run is adopted
+// instead of being duplicated.
+func (m *CloudflareAccountManager) createKVNamespace() error {
+	if !m.Worker.ManagesWorker() {
+		found, err := m.findKVNamespace()
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("KV namespace %s not found, it must be bound to the worker managed outside of the bouncer", m.Worker.KVNameSpaceName)
+		}
+		m.logger.Infof("Using KVNS %s of the worker managed outside of the bouncer", m.Worker.KVNameSpaceName)
+		return nil
+	}
+
+	adopted, err := m.adoptKVNamespace()
+	if err != nil {
+		return err
+	}
+	if adopted {
+		return nil
+	}
+
 	m.logger.Infof("Creating KVNS %s", m.Worker.KVNameSpaceName)
-	kvNSResp, err := m.api.CreateWorkersKVNamespace(
-		m.Ctx,
-		cf.AccountIdentifier(m.AccountCfg.ID),
-		cf.CreateWorkersKVNamespaceParams{Title: m.Worker.KVNameSpaceName},
-	)
+	var kvNSResp cf.WorkersKVNamespaceResponse
+	err = m.retryStep("create the KV namespace", func() error {
+		var err error
+		kvNSResp, err = m.api.CreateWorkersKVNamespace(
+			m.Ctx,
+			cf.AccountIdentifier(m.AccountCfg.ID),
+			cf.CreateWorkersKVNamespaceParams{Title: m.Worker.KVNameSpaceName},
+		)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	m.logger.Tracef("KVNS: %+v", kvNSResp)
 	m.NamespaceID = kvNSResp.Result.ID
+	return nil
+}
 
-	//Create the database
-	m.logger.Info("Creating D1 Database for metrics")
+// adoptKVNamespace reuses the KV namespace with the title of the worker, left by a run which crashed
+// before recording it or which didn't clean it up, and clears its keys so that it only holds what this
+// run writes. It returns false if there is none.
+func (m *CloudflareAccountManager) adoptKVNamespace() (bool, error) {
+	kvNamespaces, err := m.listKVNamespaces()
+	if err != nil {
+		return false, err
+	}
+	matching := make([]cf.WorkersKVNamespace, 0, 1)
+	for _, kvNamespace := range kvNamespaces {
+		if kvNamespace.Title == m.Worker.KVNameSpaceName {
+			matching = append(matching, kvNamespace)
+		}
+	}
+	if len(matching) == 0 {
+		return false, nil
+	}
+	if len(matching) > 1 {
+		m.logger.Warnf("%d KV namespaces are titled %s, using %s, the others should be deleted", len(matching), m.Worker.KVNameSpaceName, matching[0].ID)
+	}
+	m.NamespaceID = matching[0].ID
+	m.logger.Infof("Adopting existing KVNS %s (%s)", m.Worker.KVNameSpaceName, m.NamespaceID)
+	keys, err := m.listKVKeys()
+	if err != nil {
+		return false, fmt.Errorf("unable to list the keys of the existing KV namespace: %w", err)
+	}
+	if len(keys) > 0 {
+		m.logger.Infof("Clearing %d keys of the existing KVNS", len(keys))
+		if err := m.deleteKVKeys(keys); err != nil {
+			return false, fmt.Errorf("unable to clear the existing KV namespace: %w", err)
+		}
+	}
+	return true, nil
+}
 
-	databaseResp, err := m.api.CreateD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.CreateD1DatabaseParams{
-		Name: m.Worker.D1DBName,
-	})
+// createD1Database creates the D1 DB used by the worker for metrics, or reuses the one with the same name
+// left by a previous run. Metrics are optional, so the lack of D1 permissions isn't an error.
+func (m *CloudflareAccountManager) createD1Database() error {
+	if m.d1Disabled() {
+		m.logger.Debug("D1 is disabled, not creating the D1 DB for metrics")
+		m.hasD1Access = false
+		m.DatabaseID = ""
+		return nil
+	}
+	var (
+		databaseResp cf.D1Database
+		err          error
+		found        bool
+	)
+	databaseResp, found, err = m.findD1Database()
+	if err != nil {
+		m.logger.Warnf("Unable to look for the existing D1 DB: %s", err)
+	}
+	switch {
+	case found:
+		m.logger.Infof("Reusing D1 Database %s for metrics", databaseResp.UUID)
+	case !m.Worker.ManagesWorker():
+		// a DB created now wouldn't be bound to the worker
+		m.logger.Infof("No D1 DB %s found for the worker managed outside of the bouncer, metrics won't be reported", m.Worker.D1DBName)
+		m.hasD1Access = false
+		m.DatabaseID = ""
+		return nil
+	default:
+		m.logger.Info("Creating D1 Database for metrics")
+		err = m.retryStep("create the D1 DB", func() error {
+			var err error
+			databaseResp, err = m.api.CreateD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.CreateD1DatabaseParams{
+				Name: m.Worker.D1DBName,
+			})
+			return err
+		})
+	}
 
 	//This could probably be a check on a more specific error, but because metrics are not critical, we just log the error and continue
 	if err != nil {
@@ -184,12 +766,64 @@ func (m *CloudflareAccountManager) DeployInfra() error {
 			SQL:        sqlCreateTableStatement,
 		})
 
+		if err == nil && found {
+			err = m.migrateD1Table()
+		}
+
+		// the DB is useless without its table, the worker is uploaded without it so that it doesn't try to write metrics
 		if err != nil {
-			return fmt.Errorf("error while creating D1 DB table, make sure your token has the proper permissions: %w", err)
+			m.logger.Warnf("Error while creating D1 DB table: %s. Remediation component won't be able to send metrics to crowdsec. Make sure your token has the proper permissions.", err)
+			m.hasD1Access = false
+			m.DatabaseID = ""
+		}
+	}
+	return nil
+}
+
+// d1Disabled returns true if the worker of the account is deployed without D1 DB, for the account or for
+// every account.
+func (m *CloudflareAccountManager) d1Disabled() bool {
+	return m.AccountCfg.DisableD1 || m.Worker.DisableD1
+}
+
+// findKVNamespace sets NamespaceID to the ID of the existing KV namespace of the worker, if any, and
+// tells whether it was found.
+func (m *CloudflareAccountManager) findKVNamespace() (bool, error) {
+	kvNamespaces, err := m.listKVNamespaces()
+	if err != nil {
+		return false, err
+	}
+	m.NamespaceID = ""
+	for _, kvNamespace := range kvNamespaces {
+		if kvNamespace.Title == m.Worker.KVNameSpaceName {
+			m.NamespaceID = kvNamespace.ID
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findD1Database looks up the D1 DB used by the worker for metrics by its name.
+func (m *CloudflareAccountManager) findD1Database() (cf.D1Database, bool, error) {
+	dbs, err := m.listD1Databases(m.Worker.D1DBName)
+	if err != nil {
+		return cf.D1Database{}, false, err
+	}
+	for _, db := range dbs {
+		if db.Name == m.Worker.D1DBName {
+			return db, true, nil
 		}
 	}
+	return cf.D1Database{}, false, nil
+}
 
-	var banTemplate []byte
+// deployWorker writes the KV entries of the config, uploads the worker bound to the KV namespace and
+// the D1 DB, and binds it to the routes to protect.
+func (m *CloudflareAccountManager) deployWorker() error {
+	var (
+		banTemplate []byte
+		err         error
+	)
 	if m.AccountCfg.BanTemplate != "" {
 		banTemplate, err = os.ReadFile(m.AccountCfg.BanTemplate)
 		if err != nil {
@@ -209,132 +843,379 @@ func (m *CloudflareAccountManager) DeployInfra() error {
 	if err != nil {
 		return fmt.Errorf("error while writing ban template to KV: %w", err)
 	}
-	actionsForZoneByDomain := make(map[string]ActionsForZone)
-	for _, z := range m.AccountCfg.ZoneConfigs {
-		actionsForZoneByDomain[z.Domain] = ActionsForZone{
-			SupportedActions: z.Actions,
-			DefaultAction:    z.DefaultAction,
+	if err := m.writeBanTemplates(m.Ctx); err != nil {
+		return err
+	}
+
+	if len(m.AccountCfg.Allowlist) > 0 {
+		allowlist, err := json.Marshal(m.AccountCfg.Allowlist)
+		if err != nil {
+			return err
+		}
+		m.logger.Infof("Writing allowlist with %d entries", len(m.AccountCfg.Allowlist))
+		_, err = m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+			NamespaceID: m.NamespaceID,
+			KVs: []*cf.WorkersKVPair{{
+				Key:   AllowlistKeyName,
+				Value: string(allowlist),
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("error while writing allowlist to KV: %w", err)
 		}
 	}
-	varActionsForZoneByDomain, err := json.Marshal(actionsForZoneByDomain)
+	if err := m.writeCountryAllowlist(m.Ctx); err != nil {
+		return err
+	}
+	if err := m.writeResponseConfig(m.Ctx); err != nil {
+		return err
+	}
+	if !m.Worker.ManagesWorker() {
+		m.logger.Infof("Worker %s is managed outside of the bouncer, not uploading it nor binding its routes", m.Worker.ScriptName)
+		return nil
+	}
+	varActionsForZoneByDomain, err := actionsForZoneByDomain(m.zones())
 	if err != nil {
 		return err
 	}
 
-	m.logger.Infof("Creating worker %s", m.Worker.ScriptName)
+	m.logger.Infof("Creating worker %s version %s", m.Worker.ScriptName, WorkerScriptVersion())
 
-	worker, err := m.api.UploadWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.CreateWorkerParams(workerScript, kvNSResp.Result.ID, varActionsForZoneByDomain, m.DatabaseID))
+	var worker cf.WorkerScriptResponse
+	err = m.retryStep("upload the worker", func() error {
+		var err error
+		worker, err = m.api.UploadWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.CreateWorkerParams(workerScript, m.NamespaceID, varActionsForZoneByDomain, m.DatabaseID))
+		return err
+	})
 	m.logger.Tracef("Worker: %+v", worker)
 
 	if err != nil {
 		return err
 	}
+	m.workerUploaded(worker)
+	m.setKVPayloadBytes(cfg.VarNameForActionsByDomain, len(varActionsForZoneByDomain))
+
+	observerID := ""
+	if m.hasObserveRoutes() {
+		if observerID, err = m.deployObserver(m.Ctx); err != nil {
+			return err
+		}
+	}
 
+	// the routes of every zone share the limit, to stay under the rate limit of the API
 	zg := errgroup.Group{}
-	for _, z := range m.AccountCfg.ZoneConfigs {
-		for _, r := range z.RoutesToProtect {
-			zone := z
-			route := r
-			zoneLogger := m.logger.WithFields(log.Fields{"zone": zone.Domain})
-			zoneLogger.Infof("Binding worker to route %s", route)
-			zg.Go(func() error {
-				workerRouteResp, err := m.api.CreateWorkerRoute(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.CreateWorkerRouteParams{
-					Pattern: route,
-					Script:  worker.ID,
-				})
-				if err != nil {
-					return err
-				}
-				zoneLogger.Tracef("WorkerRouteResp: %+v", workerRouteResp)
-				zoneLogger.Infof("Binded worker to route %s", route)
-				return nil
-			})
+	zg.SetLimit(max(m.routeConcurrency, 1))
+	for _, zone := range m.zones() {
+		m.bindWorkerRoutes(&zg, zone, zone.RoutesToProtect, worker.ID)
+		if observerID != "" {
+			m.bindWorkerRoutes(&zg, zone, zone.ObserveRoutes, observerID)
 		}
 	}
 	return zg.Wait()
 }
 
-func (m *CloudflareAccountManager) updateMetrics() {
-	totalKVPairs := 1 // one for ActionsByDomain KV pair
-	for _, zone := range m.AccountCfg.ZoneConfigs {
-		// We only create the turnstile KV pair if the account has at least one zone with turnstile enabled.
-		// This is the widgetTokenCfgByDomain KV pair found in HandleTurnstile function.
-		if zone.Turnstile.Enabled {
-			totalKVPairs += 1
-			break
-		}
+// workerUploaded exposes the version of the uploaded worker and checks that Cloudflare serves the
+// script just uploaded. A mismatch is only logged, the upload itself succeeded.
+func (m *CloudflareAccountManager) workerUploaded(uploaded cf.WorkerScriptResponse) {
+	version := WorkerScriptVersion()
+	metrics.WorkerInfo.WithLabelValues(version, m.AccountCfg.Name).Set(1)
+
+	// scripts of a dispatch namespace can't be read this way
+	if m.Worker.DispatchNamespace != "" {
+		return
 	}
-	// We only create the IP range KV pair if the account has at least one IP range decision.
-	if m.hasIPRangeKV {
-		totalKVPairs += 1
+	deployed, err := m.api.GetWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.ScriptName)
+	if err != nil {
+		m.logger.Warnf("Unable to check the deployed worker %s: %s", m.Worker.ScriptName, err)
+		return
 	}
-	totalKVPairs += len(m.KVPairByDecisionValue)
-	metrics.TotalKeysByAccount.WithLabelValues(m.AccountCfg.Name).Set(float64(totalKVPairs))
+	if uploaded.ETAG != "" && deployed.ETAG != "" && uploaded.ETAG != deployed.ETAG {
+		m.logger.Warnf("Cloudflare reports etag %s for worker %s instead of the uploaded %s, another version may be deployed", deployed.ETAG, m.Worker.ScriptName, uploaded.ETAG)
+		return
+	}
+	if deployed.Script != "" && deployed.Script != workerScript {
+		m.logger.Warnf("The deployed worker %s doesn't match version %s, another version may be deployed", m.Worker.ScriptName, version)
+		return
+	}
+	m.logger.Debugf("Worker %s version %s is deployed", m.Worker.ScriptName, version)
 }
 
-// This function checks and destroys the cloudflare infrastructure which could have been deployed by the worker in past.
-// It checks this, by matching the names of the KV namespaces, worker scripts, worker routes and turnstile widgets with the names used by the worker.
-func (m *CloudflareAccountManager) CleanUpExistingWorkers(start bool) error {
-	m.logger.Infof("Cleaning up existing workers")
+func (m *CloudflareAccountManager) hasObserveRoutes() bool {
+	for _, zone := range m.zones() {
+		if len(zone.ObserveRoutes) > 0 {
+			return true
+		}
+	}
+	return false
+}
 
-	m.logger.Debug("Listing existing turnstile widgets")
-	widgets, _, err := m.api.ListTurnstileWidgets(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListTurnstileWidgetParams{})
+// deployObserver uploads the log-only worker bound to the observe_routes, and returns its ID.
+func (m *CloudflareAccountManager) deployObserver(ctx context.Context) (string, error) {
+	m.logger.Infof("Creating observer worker %s", m.Worker.ObserverScriptName())
+	observer, err := m.api.UploadWorker(ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.ObserverWorkerParams(observerScript, m.DatabaseID))
 	if err != nil {
-		return err
+		return "", fmt.Errorf("unable to create observer worker: %w", err)
 	}
-	m.logger.Tracef("widgets: %+v", widgets)
-	m.logger.Debug("Done listing existing turnstile widgets")
+	return observer.ID, nil
+}
 
-	for _, widget := range widgets {
-		if widget.Name == WidgetName {
-			m.logger.Debugf("Deleting turnstile widget with site key %s", widget.SiteKey)
-			if err := m.api.DeleteTurnstileWidget(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), widget.SiteKey); err != nil {
+// createWorkerRoutes binds the worker to the routes to protect of the zone.
+func (m *CloudflareAccountManager) createWorkerRoutes(zone *cfg.ZoneConfig, scriptID string) error {
+	zg := errgroup.Group{}
+	zg.SetLimit(max(m.routeConcurrency, 1))
+	m.bindWorkerRoutes(&zg, zone, zone.RoutesToProtect, scriptID)
+	return zg.Wait()
+}
+
+// bindWorkerRoutes starts the creation of the routes of the zone bound to the script in zg.
+func (m *CloudflareAccountManager) bindWorkerRoutes(zg *errgroup.Group, zone *cfg.ZoneConfig, routes []string, scriptID string) {
+	zoneLogger := m.zoneLogger(zone)
+	if m.Worker.DispatchNamespace != "" {
+		zoneLogger.Infof("Not binding routes, the worker is dispatched from namespace %s", m.Worker.DispatchNamespace)
+		return
+	}
+	for _, r := range routes {
+		route := r
+		zoneLogger.Infof("Binding worker %s to route %s", scriptID, route)
+		zg.Go(func() error {
+			var workerRouteResp cf.WorkerRouteResponse
+			err := m.retryStep("bind route "+route, func() error {
+				var err error
+				workerRouteResp, err = m.api.CreateWorkerRoute(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.CreateWorkerRouteParams{
+					Pattern: route,
+					Script:  scriptID,
+				})
+				return err
+			})
+			if err != nil {
 				return err
 			}
-			m.logger.Debugf("Done deleting turnstile widget with site key %s", widget.SiteKey)
-		}
+			zoneLogger.Tracef("WorkerRouteResp: %+v", workerRouteResp)
+			zoneLogger.Infof("Binded worker %s to route %s", scriptID, route)
+			return nil
+		})
 	}
-	m.logger.Debug("Done cleaning up existing turnstile widgets")
+}
 
-	for _, zone := range m.AccountCfg.ZoneConfigs {
-		zoneLogger := m.logger.WithFields(log.Fields{"zone": zone.Domain})
-		zoneLogger.Debugf("Listing worker routes")
-		routeResp, err := m.api.ListWorkerRoutes(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.ListWorkerRoutesParams{})
-		if err != nil {
-			return err
+// configKVKeys returns the number of KV keys of the account which don't hold a single decision.
+func (m *CloudflareAccountManager) configKVKeys() int {
+	totalKVPairs := 1 // one for ActionsByDomain KV pair
+	for _, zone := range m.zones() {
+		// We only create the turnstile KV pair if the account has at least one zone with turnstile enabled.
+		// This is the widgetTokenCfgByDomain KV pair found in HandleTurnstile function.
+		if zone.Turnstile.Enabled {
+			totalKVPairs += 1
+			break
 		}
-		zoneLogger.Tracef("routeResp: %+v", routeResp)
-		zoneLogger.Debugf("Done listing worker routes")
+	}
+	if len(m.AccountCfg.Allowlist) > 0 {
+		totalKVPairs += 1
+	}
+	// We only create the IP range KV pair if the account has at least one IP range decision.
+	if m.hasIPRangeKV {
+		totalKVPairs += 1
+	}
+	if m.hasASKV {
+		totalKVPairs += 1
+	}
+	if m.hasOtherScopeKV {
+		totalKVPairs += 1
+	}
+	if m.EnforcementPaused() {
+		totalKVPairs += 1
+	}
+	if slices.ContainsFunc(m.zones(), func(zone *cfg.ZoneConfig) bool { return zone.BanTemplate != "" }) {
+		totalKVPairs += 1
+	}
+	return totalKVPairs
+}
 
-		for _, route := range routeResp.Routes {
-			if route.ScriptName == m.Worker.ScriptName {
-				zoneLogger.Debugf("Deleting worker route with ID %s", route.ID)
-				_, err := m.api.DeleteWorkerRoute(m.Ctx, cf.ZoneIdentifier(zone.ID), route.ID)
-				if err != nil {
-					return err
-				}
-				zoneLogger.Debugf("Done deleting worker route with ID %s", route.ID)
-			}
-		}
+func (m *CloudflareAccountManager) updateMetrics() {
+	totalKVPairs := m.configKVKeys() + len(m.KVPairByDecisionValue)
+	metrics.TotalKeysByAccount.WithLabelValues(m.AccountCfg.Name).Set(float64(totalKVPairs))
+
+	decisionsPayload := 0
+	for _, kvPair := range m.KVPairByDecisionValue {
+		decisionsPayload += len(kvPair.Key) + len(kvPair.Value)
+	}
+	m.setKVPayloadBytes(metrics.DecisionsPayloadKey, decisionsPayload)
+}
+
+// setKVPayloadBytes records the size of the value written for key, to spot the values getting close to
+// the 25 MiB limit of Cloudflare.
+func (m *CloudflareAccountManager) setKVPayloadBytes(key string, size int) {
+	metrics.KVPayloadBytes.WithLabelValues(m.AccountCfg.Name, key).Set(float64(size))
+}
+
+// This function checks and destroys the cloudflare infrastructure which could have been deployed by the worker in past.
+// It checks this, by matching the names of the KV namespaces, worker scripts, worker routes and turnstile widgets with the names used by the worker.
+func (m *CloudflareAccountManager) CleanUpExistingWorkers(start bool) error {
+	m.logger.Infof("Cleaning up existing workers")
+
+	// The worker can only be deleted once its routes are gone, and the KV namespace and D1 DB once the
+	// worker bound to them is gone.
+	if err := m.cleanUpWidgetsAndRoutes(); err != nil {
+		return err
+	}
+	if err := m.cleanUpRuleset(); err != nil {
+		return err
+	}
+	if !m.Worker.ManagesWorker() {
+		m.logger.Infof("Worker %s is managed outside of the bouncer, leaving it along with its KV namespace and D1 DB", m.Worker.ScriptName)
+		return nil
 	}
 
+	g := errgroup.Group{}
+	g.SetLimit(max(m.cleanupConcurrency, 1))
+
 	m.logger.Debugf("Attempting to delete worker script %s", m.Worker.ScriptName)
-	err = m.api.DeleteWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.DeleteWorkerParams{
-		ScriptName: m.Worker.ScriptName,
-	})
+	deleteWorkerParams := cf.DeleteWorkerParams{ScriptName: m.Worker.ScriptName}
+	if m.Worker.DispatchNamespace != "" {
+		deleteWorkerParams.DispatchNamespace = &m.Worker.DispatchNamespace
+	}
+	err := m.api.DeleteWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), deleteWorkerParams)
 	if err != nil {
 		m.logger.Debugf("Received error while deleting worker script %s: %s (type: %s)", m.Worker.ScriptName, err, fmt.Sprintf("%T", err))
-		var notFoundErr *cf.NotFoundError
-		if !errors.As(err, &notFoundErr) {
+		if !isNotFound(err) {
 			return err
 		}
 		m.logger.Debugf("Didn't find worker script %s", m.Worker.ScriptName)
 	} else {
 		m.logger.Debugf("Deleted worker script %s", m.Worker.ScriptName)
 	}
+	// the observer worker may have been deployed by a previous run, even if no zone has observe_routes now
+	if m.Worker.DispatchNamespace == "" {
+		err := m.api.DeleteWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.DeleteWorkerParams{ScriptName: m.Worker.ObserverScriptName()})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	g.Go(m.cleanUpKVNamespaces)
+	if (m.hasD1Access || start) && !m.Worker.PreserveD1 && !m.d1Disabled() {
+		g.Go(func() error {
+			return m.cleanUpD1Databases(start)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	m.logger.Info("Done cleaning up existing workers")
+	return nil
+}
+
+// cleanUpWidgetsAndRoutes deletes the turnstile widgets and the worker routes. They don't depend on
+// each other, so they are deleted concurrently.
+func (m *CloudflareAccountManager) cleanUpWidgetsAndRoutes() error {
+	g := errgroup.Group{}
+	g.SetLimit(max(m.cleanupConcurrency, 1))
+
+	m.logger.Debug("Listing existing turnstile widgets")
+	widgets, err := m.listTurnstileWidgets()
+	if err != nil {
+		return err
+	}
+	m.logger.Tracef("widgets: %+v", widgets)
+	m.logger.Debug("Done listing existing turnstile widgets")
+
+	for _, widget := range widgets {
+		if widget.Name != WidgetName {
+			continue
+		}
+		siteKey := widget.SiteKey
+		g.Go(func() error {
+			m.logger.Debugf("Deleting turnstile widget with site key %s", siteKey)
+			if err := m.api.DeleteTurnstileWidget(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), siteKey); err != nil {
+				if !isNotFound(err) {
+					return err
+				}
+				m.logger.Debugf("Turnstile widget with site key %s is already deleted", siteKey)
+			}
+			m.logger.Debugf("Done deleting turnstile widget with site key %s", siteKey)
+			return nil
+		})
+	}
+
+	// the routes of a worker managed outside of the bouncer aren't its own
+	if m.Worker.ManagesWorker() {
+		for _, z := range m.zones() {
+			zone := z
+			g.Go(func() error {
+				return m.cleanUpWorkerRoutes(zone)
+			})
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	m.logger.Debug("Done cleaning up existing turnstile widgets and worker routes")
+	return nil
+}
+
+// Error codes returned by the cloudflare API, with a status other than 404, for resources which don't exist.
+var notFoundErrorCodes = map[int]bool{
+	7404:  true, // D1 database not found
+	10007: true, // worker script not found
+	10013: true, // KV namespace not found
+}
+
+// isD1Gone tells whether err means that the D1 DB, or its metrics table, doesn't exist anymore, as
+// happens when it's deleted from the dashboard while the worker runs.
+func isD1Gone(err error) bool {
+	return isNotFound(err) || strings.Contains(err.Error(), "no such table")
+}
+
+// isNotFound returns true if err means that the resource doesn't exist, as happens when another bouncer
+// instance deleted it first. Deletions treat it as a success to stay idempotent.
+func isNotFound(err error) bool {
+	var notFoundErr *cf.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		return true
+	}
+	var requestErr *cf.RequestError
+	if errors.As(err, &requestErr) {
+		for _, code := range requestErr.ErrorCodes() {
+			if notFoundErrorCodes[code] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanUpWorkerRoutes deletes the routes of the zone bound to the worker.
+func (m *CloudflareAccountManager) cleanUpWorkerRoutes(zone *cfg.ZoneConfig) error {
+	zoneLogger := m.zoneLogger(zone)
+	zoneLogger.Debugf("Listing worker routes")
+	routeResp, err := m.api.ListWorkerRoutes(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.ListWorkerRoutesParams{})
+	if err != nil {
+		return err
+	}
+	zoneLogger.Tracef("routeResp: %+v", routeResp)
+	zoneLogger.Debugf("Done listing worker routes")
+
+	for _, route := range routeResp.Routes {
+		if route.ScriptName == m.Worker.ScriptName || route.ScriptName == m.Worker.ObserverScriptName() {
+			zoneLogger.Debugf("Deleting worker route with ID %s", route.ID)
+			_, err := m.api.DeleteWorkerRoute(m.Ctx, cf.ZoneIdentifier(zone.ID), route.ID)
+			if err != nil {
+				if !isNotFound(err) {
+					return err
+				}
+				zoneLogger.Debugf("Worker route with ID %s is already deleted", route.ID)
+			}
+			zoneLogger.Debugf("Done deleting worker route with ID %s", route.ID)
+		}
+	}
+	return nil
+}
 
+// cleanUpKVNamespaces deletes the KV namespace used by the worker.
+func (m *CloudflareAccountManager) cleanUpKVNamespaces() error {
 	m.logger.Debugf("Listing worker KV Namespaces")
-	kvNamespaces, _, err := m.api.ListWorkersKVNamespaces(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListWorkersKVNamespacesParams{})
+	kvNamespaces, err := m.listKVNamespaces()
 	if err != nil {
 		return err
 	}
@@ -346,89 +1227,202 @@ func (m *CloudflareAccountManager) CleanUpExistingWorkers(start bool) error {
 			m.logger.Debugf("Deleting worker KV Namespace with ID %s", kvNamespace.ID)
 			_, err := m.api.DeleteWorkersKVNamespace(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), kvNamespace.ID)
 			if err != nil {
-				return err
+				if !isNotFound(err) {
+					return err
+				}
+				m.logger.Debugf("Worker KV Namespace with ID %s is already deleted", kvNamespace.ID)
 			}
 			m.logger.Debugf("Done deleting worker KV Namespace with ID %s", kvNamespace.ID)
 		}
 	}
+	return nil
+}
 
-	if m.hasD1Access || start {
-		m.logger.Debugf("Listing D1 DBs")
-		dbs, _, err := m.api.ListD1Databases(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListD1DatabasesParams{})
+// cleanUpD1Databases deletes the D1 DB used by the worker for metrics. On start, the token may lack the
+// D1 permissions, so listing errors are ignored.
+func (m *CloudflareAccountManager) cleanUpD1Databases(start bool) error {
+	m.logger.Debugf("Listing D1 DBs")
+	dbs, err := m.listD1Databases("")
 
-		if err != nil {
-			if !start {
-				return fmt.Errorf("error while listing D1 DBs, make sure your token has the proper permissions: %w", err)
-			}
-			dbs = []cf.D1Database{}
+	if err != nil {
+		if !start {
+			return fmt.Errorf("error while listing D1 DBs, make sure your token has the proper permissions: %w", err)
 		}
+		dbs = []cf.D1Database{}
+	}
 
-		m.logger.Tracef("dbs: %+v", dbs)
+	m.logger.Tracef("dbs: %+v", dbs)
 
-		for _, db := range dbs {
-			m.logger.Debugf("Checking D1 DB %s vs %s", db.Name, m.Worker.D1DBName)
-			if db.Name == m.Worker.D1DBName {
-				m.logger.Debugf("Deleting D1 DB %s", db.UUID)
-				err = m.api.DeleteD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), db.UUID)
-				if err != nil {
+	for _, db := range dbs {
+		m.logger.Debugf("Checking D1 DB %s vs %s", db.Name, m.Worker.D1DBName)
+		if db.Name == m.Worker.D1DBName {
+			m.logger.Debugf("Deleting D1 DB %s", db.UUID)
+			err = m.api.DeleteD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), db.UUID)
+			if err != nil {
+				if !isNotFound(err) {
 					return fmt.Errorf("error while deleting D1 DB %s, make sure your token has the proper permissions: %w", db.UUID, err)
 				}
-				m.logger.Debugf("Deleted D1 DB %s", db.UUID)
+				m.logger.Debugf("D1 DB %s is already deleted", db.UUID)
 			}
+			m.logger.Debugf("Deleted D1 DB %s", db.UUID)
 		}
 	}
-
-	m.logger.Info("Done cleaning up existing workers")
 	return nil
 }
 
 func (m *CloudflareAccountManager) ProcessDeletedDecisions(decisions []*models.Decision) error {
 	keysToDelete := make([]string, 0)
 	newKVPairByValue := make(map[string]cf.WorkersKVPair)
-	for _, kvPair := range m.KVPairByDecisionValue {
-		newKVPairByValue[kvPair.Key] = kvPair
+	for value, kvPair := range m.KVPairByDecisionValue {
+		newKVPairByValue[value] = kvPair
 	}
+	newActionByIPRange := maps.Clone(m.ActionByIPRange)
+	newActionByAS := maps.Clone(m.ActionByAS)
+	newActionByOtherScope := maps.Clone(m.ActionByOtherScope)
+	// active decision metrics are only updated once the batch is applied
+	removedDecisions := make([]prometheus.Labels, 0)
+	unlistedDecisions := make([]prometheus.Labels, 0)
+	ipsToUnlist := make([]string, 0)
+	logger := m.decisionsLogger()
 
 	for _, decision := range decisions {
-		origin := *decision.Origin
-		if origin == "lists" {
-			origin = fmt.Sprintf("%s:%s", *decision.Origin, *decision.Scenario)
+		if item, ok := ipListItem(*decision.Value); ok && m.ipListItemByIP[item] != "" {
+			action := m.decisionAction(decision)
+			if fallback, ok := m.fallbackAction(action); ok {
+				action = fallback
+			}
+			if m.bannedWithRuleset(*decision.Scope, action) && !slices.Contains(ipsToUnlist, item) {
+				unlistedDecisions = append(unlistedDecisions, m.activeDecisionLabels(decision))
+				ipsToUnlist = append(ipsToUnlist, item)
+				continue
+			}
 		}
 		if *decision.Scope == "range" {
-			if _, ok := m.ActionByIPRange[*decision.Value]; ok {
-				ipType := "ipv4"
-				if strings.Contains(*decision.Value, ":") {
-					ipType = "ipv6"
-				}
-				metrics.TotalActiveDecisions.With(prometheus.Labels{"origin": origin, "ip_type": ipType, "scope": *decision.Scope, "account": m.AccountCfg.Name}).Dec()
-				delete(m.ActionByIPRange, *decision.Value)
+			if _, ok := newActionByIPRange[*decision.Value]; ok {
+				removedDecisions = append(removedDecisions, m.activeDecisionLabels(decision))
+				delete(newActionByIPRange, *decision.Value)
 			}
 			continue
 		}
-		if val, ok := m.KVPairByDecisionValue[*decision.Value]; ok {
-			if *decision.Type == val.Value {
-				ipType := "ipv4"
-				if *decision.Scope == "ip" {
-					if strings.Contains(*decision.Value, ":") {
-						ipType = "ipv6"
-					}
-				} else {
-					ipType = "N/A"
-				}
-				metrics.TotalActiveDecisions.With(prometheus.Labels{"origin": origin, "ip_type": ipType, "scope": *decision.Scope, "account": m.AccountCfg.Name}).Dec()
+		if *decision.Scope == "as" {
+			if _, ok := newActionByAS[*decision.Value]; ok {
+				removedDecisions = append(removedDecisions, m.activeDecisionLabels(decision))
+				delete(newActionByAS, *decision.Value)
+			}
+			continue
+		}
+		if slices.Contains(m.PassThroughScopes, *decision.Scope) {
+			id := scopedValue(*decision.Scope, *decision.Value)
+			if _, ok := newActionByOtherScope[id]; ok {
+				removedDecisions = append(removedDecisions, m.activeDecisionLabels(decision))
+				delete(newActionByOtherScope, id)
+			}
+			continue
+		}
+		id := scopedValue(*decision.Scope, *decision.Value)
+		if val, ok := m.KVPairByDecisionValue[id]; ok {
+			action := m.decisionAction(decision)
+			if fallback, ok := m.fallbackAction(action); ok {
+				action = fallback
+			}
+			if action != kvAction(val.Value) {
+				withDecision(logger, decision).Debugf("Keeping action %s, the deleted decision is %s", kvAction(val.Value), action)
+			} else {
+				removedDecisions = append(removedDecisions, m.activeDecisionLabels(decision))
 				keysToDelete = append(keysToDelete, val.Key)
-				delete(newKVPairByValue, val.Key)
+				delete(newKVPairByValue, id)
 			}
 		}
 	}
+	if mode := CurrentDiffMode(); mode != DiffModeOff {
+		for _, ip := range ipsToUnlist {
+			m.logger.Infof("diff: delete %s from the IP list", ip)
+		}
+		m.logDiff(nil, keysToDelete, newActionByIPRange, newActionByAS, newActionByOtherScope)
+		if mode == DiffModeLogOnly {
+			m.logger.Info("Diff mode is log-only, not deleting decisions")
+			return nil
+		}
+	}
+	if err := m.deleteIPListItems(ipsToUnlist); err != nil {
+		return err
+	}
+	for _, labels := range unlistedDecisions {
+		metrics.TotalActiveDecisions.With(labels).Dec()
+	}
+	// the state keeps the decisions until their keys are deleted, for a failed delete to be retried
 	if len(keysToDelete) == 0 {
-		m.logger.Debug("No keys to delete")
-		return nil
+		logger.Debug("No keys to delete")
+	} else {
+		logger.Infof("Deleting %d decisions", len(keysToDelete))
+		if err := m.deleteKVKeys(keysToDelete); err != nil {
+			return err
+		}
+		logger.Infof("Deleted %d decisions", len(keysToDelete))
+	}
+	for _, labels := range removedDecisions {
+		metrics.TotalActiveDecisions.With(labels).Dec()
+	}
+	m.setActionByIPRange(newActionByIPRange)
+	m.ActionByAS = newActionByAS
+	m.ActionByOtherScope = newActionByOtherScope
+	m.KVPairByDecisionValue = newKVPairByValue
+	m.updateMetrics()
+	if err := m.commitIPRanges(); err != nil {
+		return err
+	}
+	return m.commitScopeDecisions()
+}
+
+// writeKVPairs writes the provided pairs to the KV namespace, and returns the ones written, which are all
+// of them unless a batch failed.
+func (m *CloudflareAccountManager) writeKVPairs(keysToWrite []*cf.WorkersKVPair) ([]*cf.WorkersKVPair, error) {
+	writerErrGroup := errgroup.Group{}
+	batchWritten := make([]bool, (len(keysToWrite)+9999)/10000)
+	// Cloudflare API only allows writing 10k keys at a time. So we need to batch the writes.
+	var budgetErr error
+	for batch, i := 0, 0; i < len(keysToWrite); i += 10000 {
+		if budgetErr = m.waitForRateBudget(m.Ctx); budgetErr != nil {
+			break
+		}
+		batch++
+		batch := batch
+		begin := i
+		end := min(i+10000, len(keysToWrite))
+		writerErrGroup.Go(func() error {
+			resp, err := m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+				NamespaceID: m.NamespaceID,
+				KVs:         keysToWrite[begin:end],
+			})
+			batchLogger := m.logger.WithFields(log.Fields{"batch": batch, "keys": end - begin})
+			if err != nil {
+				batchLogger.Errorf("Error while writing KV keys: %s", err)
+				return fmt.Errorf("batch %d: %w", batch, err)
+			}
+			batchLogger.Tracef("write key resp: %+v", resp)
+			batchWritten[batch-1] = true
+			return nil
+		})
 	}
-	m.logger.Infof("Deleting %d decisions", len(keysToDelete))
+	err := errors.Join(writerErrGroup.Wait(), budgetErr)
+	written := make([]*cf.WorkersKVPair, 0, len(keysToWrite))
+	for i, ok := range batchWritten {
+		if ok {
+			written = append(written, keysToWrite[i*10000:min((i+1)*10000, len(keysToWrite))]...)
+		}
+	}
+	return written, err
+}
+
+// deleteKVKeys deletes the provided keys from the KV namespace.
+func (m *CloudflareAccountManager) deleteKVKeys(keysToDelete []string) error {
 	deleterGrp := errgroup.Group{}
+	var budgetErr error
 	// Cloudflare API only allows deleting 10k keys at a time. So we need to batch the deletes.
 	for batch, i := 0, 0; i < len(keysToDelete); i += 10000 {
+		if budgetErr = m.waitForRateBudget(m.Ctx); budgetErr != nil {
+			break
+		}
 		batch++
 		batch := batch
 		begin := i
@@ -438,20 +1432,158 @@ func (m *CloudflareAccountManager) ProcessDeletedDecisions(decisions []*models.D
 				Keys:        keysToDelete[begin:end],
 				NamespaceID: m.NamespaceID,
 			})
+			batchLogger := m.logger.WithFields(log.Fields{"batch": batch, "keys": end - begin})
 			if err != nil {
-				return err
+				batchLogger.Errorf("Error while deleting KV keys: %s", err)
+				return fmt.Errorf("batch %d: %w", batch, err)
 			}
-			m.logger.Tracef("batch %d delete key resp: %+v", batch, resp)
+			batchLogger.Tracef("delete key resp: %+v", resp)
 			return nil
 		})
 	}
-	if err := deleterGrp.Wait(); err != nil {
-		return err
+	return errors.Join(deleterGrp.Wait(), budgetErr)
+}
+
+// isReservedKVKey returns true for the keys written by the bouncer which don't hold a decision.
+func isReservedKVKey(key string) bool {
+	switch key {
+	case VarNameForBanTemplate, BanTemplateByDomainKeyName, TurnstileConfigKey, IpRangeKeyName, AllowlistKeyName, CountryAllowlistKeyName, ASDecisionsKeyName, OtherScopeDecisionsKeyName, ResponseConfigKeyName, SmokeTestKeyName, EnforcementKeyName, CleanupDeadlineKeyName:
+		return true
 	}
-	m.logger.Infof("Deleted %d decisions", len(keysToDelete))
-	m.KVPairByDecisionValue = newKVPairByValue
-	m.updateMetrics()
-	return m.CommitIPRangesIfChanged()
+	return false
+}
+
+// ReconcileDecisions makes the KV namespace match the provided set of active decisions. Keys present in KV
+// which don't match any active decision are deleted, then every active decision which isn't already in the
+// internal cache is written, which adds the missing keys and makes sure the action of the existing ones is up
+// to date. Afterwards, the internal cache reflects exactly what the worker enforces.
+func (m *CloudflareAccountManager) ReconcileDecisions(decisions []*models.Decision) error {
+	existingKeys, err := m.listKVKeys()
+	if err != nil {
+		return fmt.Errorf("unable to list KV keys: %w", err)
+	}
+
+	activeKeys := make(map[string]struct{}, len(decisions))
+	for _, decision := range decisions {
+		if *decision.Scope == "range" || *decision.Scope == "as" {
+			continue
+		}
+		activeKeys[m.kvKeyForValue(scopedValue(*decision.Scope, *decision.Value))] = struct{}{}
+	}
+
+	staleKeys := make([]string, 0)
+	// the keys left once the stale ones are deleted
+	liveKeys := make([]string, 0, len(existingKeys))
+	for _, key := range existingKeys {
+		if isReservedKVKey(key) {
+			continue
+		}
+		if _, ok := activeKeys[key]; !ok {
+			staleKeys = append(staleKeys, key)
+			continue
+		}
+		liveKeys = append(liveKeys, key)
+	}
+	if len(staleKeys) > 0 {
+		m.logger.Infof("Deleting %d stale decisions found in KV", len(staleKeys))
+		if err := m.deleteKVKeys(staleKeys); err != nil {
+			return fmt.Errorf("unable to delete stale keys: %w", err)
+		}
+	}
+
+	m.pruneCachedDecisions(decisions, liveKeys)
+	m.logger.Infof("Reconciling %d active decisions", len(decisions))
+	// the batches written before a failure are kept in the internal cache, so each retry only writes the
+	// decisions of the failed ones
+	return m.retryStep("write the active decisions", func() error {
+		return m.ProcessNewDecisions(decisions)
+	})
+}
+
+// pruneCachedDecisions drops from the internal cache the entries which don't match an active decision
+// or a key present in KV, so that they are written again. The entries left, restored from a cache on
+// disk, aren't written again and are counted as active decisions.
+func (m *CloudflareAccountManager) pruneCachedDecisions(decisions []*models.Decision, existingKeys []string) {
+	existingKeySet := make(map[string]struct{}, len(existingKeys))
+	for _, key := range existingKeys {
+		existingKeySet[key] = struct{}{}
+	}
+	activeByValueAndAction := make(map[string]*models.Decision, len(decisions))
+	for _, decision := range decisions {
+		action := m.decisionAction(decision)
+		if fallback, ok := m.fallbackAction(action); ok {
+			action = fallback
+		}
+		activeByValueAndAction[scopedValue(*decision.Scope, *decision.Value)+"|"+action] = decision
+	}
+
+	kvPairByValue := make(map[string]cf.WorkersKVPair)
+	for value, kvPair := range m.KVPairByDecisionValue {
+		decision, ok := activeByValueAndAction[value+"|"+kvAction(kvPair.Value)]
+		if !ok || kvPair.Key != m.kvKeyForValue(value) {
+			continue
+		}
+		if _, ok := existingKeySet[kvPair.Key]; !ok {
+			continue
+		}
+		kvPairByValue[value] = kvPair
+		metrics.TotalActiveDecisions.With(m.activeDecisionLabels(decision)).Inc()
+	}
+	m.KVPairByDecisionValue = kvPairByValue
+
+	actionByIPRange := make(map[string]string)
+	for ipRange, action := range m.ActionByIPRange {
+		decision, ok := activeByValueAndAction[scopedValue("range", ipRange)+"|"+action]
+		if !ok {
+			continue
+		}
+		actionByIPRange[ipRange] = action
+		metrics.TotalActiveDecisions.With(m.activeDecisionLabels(decision)).Inc()
+	}
+	m.setActionByIPRange(actionByIPRange)
+
+	actionByAS := make(map[string]string)
+	for asn, action := range m.ActionByAS {
+		decision, ok := activeByValueAndAction[scopedValue("as", asn)+"|"+action]
+		if !ok {
+			continue
+		}
+		actionByAS[asn] = action
+		metrics.TotalActiveDecisions.With(m.activeDecisionLabels(decision)).Inc()
+	}
+	m.ActionByAS = actionByAS
+
+	actionByOtherScope := make(map[string]string)
+	for id, action := range m.ActionByOtherScope {
+		decision, ok := activeByValueAndAction[id+"|"+action]
+		if !ok {
+			continue
+		}
+		actionByOtherScope[id] = action
+		metrics.TotalActiveDecisions.With(m.activeDecisionLabels(decision)).Inc()
+	}
+	m.ActionByOtherScope = actionByOtherScope
+}
+
+// activeDecisionLabels returns the labels of the active decisions metric for the decision. The scenario
+// label is bounded by metrics.ScenarioLabel to keep the cardinality of the metric under control.
+func (m *CloudflareAccountManager) activeDecisionLabels(decision *models.Decision) prometheus.Labels {
+	origin := *decision.Origin
+	if origin == "lists" {
+		origin = fmt.Sprintf("%s:%s", *decision.Origin, *decision.Scenario)
+	}
+	ipType := "N/A"
+	if *decision.Scope == "ip" || *decision.Scope == "range" {
+		ipType = "ipv4"
+		if strings.Contains(*decision.Value, ":") {
+			ipType = "ipv6"
+		}
+	}
+	scenario := ""
+	if decision.Scenario != nil {
+		scenario = metrics.ScenarioLabel(*decision.Scenario)
+	}
+	return prometheus.Labels{"origin": origin, "ip_type": ipType, "scope": *decision.Scope, "scenario": scenario, "account": m.AccountCfg.Name}
 }
 
 type WidgetTokenCfg struct {
@@ -477,6 +1609,7 @@ func (m *CloudflareAccountManager) writeWidgetCfgToKV(ctx context.Context, widge
 		return err
 	}
 	m.logger.Tracef("resp after writing turnstile cfg %+v", resp)
+	m.setKVPayloadBytes(TurnstileConfigKey, len(kv.Value))
 	return nil
 }
 
@@ -485,225 +1618,1260 @@ func (m *CloudflareAccountManager) ProcessNewDecisions(decisions []*models.Decis
 	newKVPairByValue := make(map[string]cf.WorkersKVPair)
 
 	//copy existing kv pairs
-	for _, kvPair := range m.KVPairByDecisionValue {
-		newKVPairByValue[kvPair.Key] = kvPair
+	for value, kvPair := range m.KVPairByDecisionValue {
+		newKVPairByValue[value] = kvPair
 	}
+	newActionByIPRange := maps.Clone(m.ActionByIPRange)
+	newActionByAS := maps.Clone(m.ActionByAS)
+	newActionByOtherScope := maps.Clone(m.ActionByOtherScope)
+	// active decision metrics are only updated once the batch is applied, the ones of the KV keys once they
+	// are written
+	addedDecisions := make([]prometheus.Labels, 0)
+	addedKVDecisions := make(map[string]prometheus.Labels)
+	idByKey := make(map[string]string)
+	ipsToList := make([]string, 0)
+	now := time.Now()
+	logger := m.decisionsLogger()
 
 	for _, decision := range decisions {
-		origin := *decision.Origin
-		if origin == "lists" {
-			origin = fmt.Sprintf("%s:%s", *decision.Origin, *decision.Scenario)
+		decisionLogger := withDecision(logger, decision)
+		passThrough := slices.Contains(m.PassThroughScopes, *decision.Scope)
+		if !slices.Contains(enforcedScopes, *decision.Scope) && !passThrough {
+			decisionLogger.Debug("Skipping decision, the worker can't enforce this scope")
+			metrics.SkippedUnsupportedDecisions.With(prometheus.Labels{"scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+			continue
+		}
+		if m.isAllowlisted(decision) {
+			decisionLogger.Debug("Skipping decision for allowlisted value")
+			metrics.SkippedAllowlistedDecisions.With(prometheus.Labels{"scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+			continue
+		}
+		if m.isCountryAllowlisted(decision) {
+			decisionLogger.Debug("Skipping decision for allowlisted country")
+			metrics.SkippedAllowlistedDecisions.With(prometheus.Labels{"scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+			continue
+		}
+		if *decision.Scope == "as" && slices.Contains(m.AccountCfg.ASAllowlist, *decision.Value) {
+			decisionLogger.Debug("Skipping decision for allowlisted AS")
+			metrics.SkippedAllowlistedDecisions.With(prometheus.Labels{"scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+			continue
+		}
+		action := m.decisionAction(decision)
+		if action != *decision.Type {
+			decisionLogger.Debugf("Using action %s of origin %s instead of %s", action, *decision.Origin, *decision.Type)
+		}
+		if fallback, ok := m.fallbackAction(action); ok {
+			decisionLogger.Debugf("Using fallback action %s instead of %s", fallback, action)
+			metrics.ActionFallbacks.With(prometheus.Labels{"from": action, "to": fallback, "account": m.AccountCfg.Name}).Inc()
+			action = fallback
+		}
+		if m.bannedWithRuleset(*decision.Scope, action) {
+			item, ok := ipListItem(*decision.Value)
+			_, listed := m.ipListItemByIP[item]
+			switch {
+			case !ok:
+				decisionLogger.Debugf("IP list %s can't hold the value, enforcing the decision with the worker", IPListName)
+			case listed || slices.Contains(ipsToList, item):
+				continue
+			case m.ipListHasRoom(ipsToList):
+				addedDecisions = append(addedDecisions, m.activeDecisionLabels(decision))
+				ipsToList = append(ipsToList, item)
+				continue
+			default:
+				decisionLogger.Debugf("IP list %s is full, enforcing the decision with the worker", IPListName)
+			}
+		}
+		if passThrough {
+			id := scopedValue(*decision.Scope, *decision.Value)
+			existingAction, ok := newActionByOtherScope[id]
+			if ok && !shouldReplaceAction(existingAction, action) {
+				decisionLogger.Debugf("Keeping action %s over %s", existingAction, action)
+				continue
+			}
+			if !ok {
+				addedDecisions = append(addedDecisions, m.activeDecisionLabels(decision))
+			}
+			newActionByOtherScope[id] = action
+			continue
 		}
 		switch *decision.Scope {
 		case "range":
-			_, ok := m.ActionByIPRange[*decision.Value]
+			existingAction, ok := newActionByIPRange[*decision.Value]
+			if ok && !shouldReplaceAction(existingAction, action) {
+				decisionLogger.Debugf("Keeping action %s over %s", existingAction, action)
+				continue
+			}
 			if !ok {
-				ipType := "ipv4"
-				if strings.Contains(*decision.Value, ":") {
-					ipType = "ipv6"
-				}
-				metrics.TotalActiveDecisions.With(prometheus.Labels{"origin": origin, "ip_type": ipType, "scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+				addedDecisions = append(addedDecisions, m.activeDecisionLabels(decision))
+			}
+			newActionByIPRange[*decision.Value] = action
+			continue
+		case "as":
+			existingAction, ok := newActionByAS[*decision.Value]
+			if ok && !shouldReplaceAction(existingAction, action) {
+				decisionLogger.Debugf("Keeping action %s over %s", existingAction, action)
+				continue
+			}
+			if !ok {
+				addedDecisions = append(addedDecisions, m.activeDecisionLabels(decision))
 			}
-			m.ActionByIPRange[*decision.Value] = *decision.Type
+			newActionByAS[*decision.Value] = action
 			continue
 		default:
-			if val, ok := newKVPairByValue[*decision.Value]; ok {
-				if *decision.Type != val.Value {
-					found := false
-					for idx, kvPair := range keysToWrite {
-						if kvPair.Key == *decision.Value {
-							found = true
-							keysToWrite[idx].Value = *decision.Type
-							break
-						}
-					}
-					if !found {
-						keysToWrite = append(keysToWrite, &cf.WorkersKVPair{Key: *decision.Value, Value: *decision.Type})
-						newKVPairByValue[*decision.Value] = cf.WorkersKVPair{Key: *decision.Value, Value: *decision.Type}
+			id := scopedValue(*decision.Scope, *decision.Value)
+			key := m.kvKeyForValue(id)
+			expiration := decisionExpiration(decision, now)
+			if val, ok := newKVPairByValue[id]; ok {
+				existingAction := kvAction(val.Value)
+				switch {
+				case action == existingAction:
+					// the entry lives as long as the longest of the decisions
+					expiration = laterExpiration(val.Expiration, expiration)
+					if expiration == val.Expiration {
+						continue
 					}
+				case !shouldReplaceAction(existingAction, action):
+					decisionLogger.Debugf("Keeping action %s over %s", existingAction, action)
+					continue
 				}
-			} else {
-				keysToWrite = append(keysToWrite, &cf.WorkersKVPair{Key: *decision.Value, Value: *decision.Type})
-				newKVPairByValue[*decision.Value] = cf.WorkersKVPair{Key: *decision.Value, Value: *decision.Type}
-
-				ipType := "ipv4"
-				if *decision.Scope == "ip" {
-					if strings.Contains(*decision.Value, ":") {
-						ipType = "ipv6"
-					}
+				kvPair := cf.WorkersKVPair{Key: key, Value: m.kvValue(action, decision), Expiration: expiration}
+				newKVPairByValue[id] = kvPair
+				idByKey[key] = id
+				idx := slices.IndexFunc(keysToWrite, func(toWrite *cf.WorkersKVPair) bool { return toWrite.Key == key })
+				if idx >= 0 {
+					*keysToWrite[idx] = kvPair
 				} else {
-					ipType = "N/A"
+					keysToWrite = append(keysToWrite, &kvPair)
 				}
-				metrics.TotalActiveDecisions.With(prometheus.Labels{"origin": origin, "ip_type": ipType, "scope": *decision.Scope, "account": m.AccountCfg.Name}).Inc()
+			} else {
+				kvPair := cf.WorkersKVPair{Key: key, Value: m.kvValue(action, decision), Expiration: expiration}
+				keysToWrite = append(keysToWrite, &kvPair)
+				newKVPairByValue[id] = kvPair
+				idByKey[key] = id
+				addedKVDecisions[key] = m.activeDecisionLabels(decision)
 			}
 		}
 	}
+	keysToWrite = m.shedKVPairs(keysToWrite, newKVPairByValue, idByKey, addedKVDecisions)
+	if mode := CurrentDiffMode(); mode != DiffModeOff {
+		for _, ip := range ipsToList {
+			m.logger.Infof("diff: add %s to the IP list", ip)
+		}
+		m.logDiff(keysToWrite, nil, newActionByIPRange, newActionByAS, newActionByOtherScope)
+		if mode == DiffModeLogOnly {
+			m.logger.Info("Diff mode is log-only, not adding decisions")
+			return nil
+		}
+	}
+	for _, labels := range addedDecisions {
+		metrics.TotalActiveDecisions.With(labels).Inc()
+	}
+	m.setActionByIPRange(newActionByIPRange)
+	m.ActionByAS = newActionByAS
+	m.ActionByOtherScope = newActionByOtherScope
+	if err := m.addIPListItems(ipsToList); err != nil {
+		return err
+	}
 	if len(keysToWrite) == 0 {
-		m.logger.Debug("No keys to write")
+		logger.Debug("No keys to write")
 	} else {
-		writerErrGroup := errgroup.Group{}
-		m.logger.Infof("Adding %d decisions", len(keysToWrite))
-		// Cloudflare API only allows writing 10k keys at a time. So we need to batch the writes.
-		for batch, i := 0, 0; i < len(keysToWrite); i += 10000 {
-			batch++
-			batch := batch
-			begin := i
-			end := min(i+10000, len(keysToWrite))
-			writerErrGroup.Go(func() error {
-				resp, err := m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
-					NamespaceID: m.NamespaceID,
-					KVs:         keysToWrite[begin:end],
-				})
-				if err != nil {
-					return err
-				}
-				m.logger.Tracef("batch %d write key resp: %+v", batch, resp)
-				return nil
-			})
-		}
-		if err := writerErrGroup.Wait(); err != nil {
+		logger.Infof("Adding %d decisions", len(keysToWrite))
+		written, err := m.writeKVPairs(keysToWrite)
+		if err != nil {
+			// the decisions of the batches written are kept, so that retrying only writes the others
+			m.commitWrittenKVPairs(written, idByKey, addedKVDecisions)
+			m.updateMetrics()
+			logger.Warnf("Added %d of %d decisions", len(written), len(keysToWrite))
 			return err
 		}
 		m.KVPairByDecisionValue = newKVPairByValue
-		m.logger.Infof("Added %d decisions", len(keysToWrite))
+		for _, labels := range addedKVDecisions {
+			metrics.TotalActiveDecisions.With(labels).Inc()
+		}
+		logger.Infof("Added %d decisions", len(keysToWrite))
 	}
 	m.updateMetrics()
-	return m.CommitIPRangesIfChanged()
+	if err := m.commitIPRanges(); err != nil {
+		return err
+	}
+	return m.commitScopeDecisions()
 }
 
-// check if the ip ranges have changed and updates the KV pair if they have.
-func (m *CloudflareAccountManager) CommitIPRangesIfChanged() error {
-	m.hasIPRangeKV = true
-	c, err := json.Marshal(m.ActionByIPRange)
+// actionPriority ranks the actions by severity, for a ban to be kept over a captcha when KV keys are shed.
+var actionPriority = map[string]int{"ban": 2, "captcha": 1, "throttle": 0}
+
+// shedKVPairs drops from keysToWrite the new keys which would take the account over its max_kv_keys, the
+// lowest-priority first: throttle, then captcha, then ban, the ones expiring sooner first for the same
+// action. The keys already written are kept, so the cap never deletes a decision the worker enforces. The
+// shed keys are removed from newKVPairByValue, idByKey and addedKVDecisions, and keysToWrite is returned
+// without them.
+func (m *CloudflareAccountManager) shedKVPairs(keysToWrite []*cf.WorkersKVPair, newKVPairByValue map[string]cf.WorkersKVPair, idByKey map[string]string, addedKVDecisions map[string]prometheus.Labels) []*cf.WorkersKVPair {
+	if m.AccountCfg.MaxKVKeys <= 0 {
+		return keysToWrite
+	}
+	excess := m.configKVKeys() + len(newKVPairByValue) - m.AccountCfg.MaxKVKeys
+	if excess <= 0 {
+		return keysToWrite
+	}
+	added := make([]*cf.WorkersKVPair, 0, len(addedKVDecisions))
+	for _, kvPair := range keysToWrite {
+		if _, ok := addedKVDecisions[kvPair.Key]; ok {
+			added = append(added, kvPair)
+		}
+	}
+	if len(added) == 0 {
+		return keysToWrite
+	}
+	slices.SortStableFunc(added, func(a, b *cf.WorkersKVPair) int {
+		if c := cmp.Compare(actionPriority[kvAction(a.Value)], actionPriority[kvAction(b.Value)]); c != 0 {
+			return c
+		}
+		// 0 never expires, it's kept over the others
+		switch {
+		case a.Expiration == b.Expiration:
+			return 0
+		case a.Expiration == 0:
+			return 1
+		case b.Expiration == 0:
+			return -1
+		}
+		return cmp.Compare(a.Expiration, b.Expiration)
+	})
+	shed := make(map[string]struct{}, excess)
+	for _, kvPair := range added[:min(excess, len(added))] {
+		shed[kvPair.Key] = struct{}{}
+		delete(newKVPairByValue, idByKey[kvPair.Key])
+		delete(idByKey, kvPair.Key)
+		delete(addedKVDecisions, kvPair.Key)
+		metrics.ShedDecisions.With(prometheus.Labels{"action": kvAction(kvPair.Value), "account": m.AccountCfg.Name}).Inc()
+	}
+	m.logger.Warnf("Shedding %d decisions, the account would exceed its max_kv_keys of %d", len(shed), m.AccountCfg.MaxKVKeys)
+	return slices.DeleteFunc(keysToWrite, func(kvPair *cf.WorkersKVPair) bool {
+		_, ok := shed[kvPair.Key]
+		return ok
+	})
+}
+
+// commitWrittenKVPairs adds to the internal cache the pairs written before a batch failed, identified by
+// idByKey, and counts the active decisions they add.
+func (m *CloudflareAccountManager) commitWrittenKVPairs(written []*cf.WorkersKVPair, idByKey map[string]string, addedKVDecisions map[string]prometheus.Labels) {
+	kvPairByValue := make(map[string]cf.WorkersKVPair, len(m.KVPairByDecisionValue)+len(written))
+	maps.Copy(kvPairByValue, m.KVPairByDecisionValue)
+	for _, kvPair := range written {
+		kvPairByValue[idByKey[kvPair.Key]] = *kvPair
+		if labels, ok := addedKVDecisions[kvPair.Key]; ok {
+			metrics.TotalActiveDecisions.With(labels).Inc()
+		}
+	}
+	m.KVPairByDecisionValue = kvPairByValue
+}
+
+// logDiff logs the KV keys about to be written or deleted, and the IP ranges, AS and pass-through
+// decisions which differ between the current state and newActionByIPRange, newActionByAS and
+// newActionByOtherScope.
+func (m *CloudflareAccountManager) logDiff(keysToWrite []*cf.WorkersKVPair, keysToDelete []string, newActionByIPRange map[string]string, newActionByAS map[string]string, newActionByOtherScope map[string]string) {
+	for _, kvPair := range keysToWrite {
+		m.logger.Infof("diff: write %s=%s", kvPair.Key, kvPair.Value)
+	}
+	for _, key := range keysToDelete {
+		m.logger.Infof("diff: delete %s", key)
+	}
+	m.logActionsDiff("range", m.ActionByIPRange, newActionByIPRange)
+	m.logActionsDiff("AS", m.ActionByAS, newActionByAS)
+	m.logActionsDiff("pass-through", m.ActionByOtherScope, newActionByOtherScope)
+	m.logger.Infof("diff: %d keys to write, %d keys to delete", len(keysToWrite), len(keysToDelete))
+}
+
+// scopedValue returns the value of a decision prefixed with its scope, e.g. ip:1.2.3.4, which identifies it
+// in KVPairByDecisionValue and from which its KV key is derived. This way decisions of different scopes
+// never share a key.
+func scopedValue(scope string, value string) string {
+	return scope + ":" + value
+}
+
+// taggedKVValue is the value of a decision key when the decisions are tagged with their scenario.
+type taggedKVValue struct {
+	Action   string `json:"action"`
+	Scenario string `json:"scenario"`
+}
+
+// kvValue returns the KV value of the decision with the action: the bare action, or a JSON holding the
+// scenario of the decision too when tag_scenarios is set, for the zones to map scenarios to actions.
+func (m *CloudflareAccountManager) kvValue(action string, decision *models.Decision) string {
+	if !m.Worker.TagScenarios {
+		return action
+	}
+	tagged := taggedKVValue{Action: action}
+	if decision.Scenario != nil {
+		tagged.Scenario = *decision.Scenario
+	}
+	// marshalling strings can't fail
+	value, _ := json.Marshal(tagged)
+	return string(value)
+}
+
+// kvAction returns the action of a decision KV value, whether it's tagged with its scenario or not.
+func kvAction(value string) string {
+	if !strings.HasPrefix(value, "{") {
+		return value
+	}
+	tagged := taggedKVValue{}
+	if err := json.Unmarshal([]byte(value), &tagged); err != nil {
+		return value
+	}
+	return tagged.Action
+}
+
+// hasScopePrefix returns true if value is prefixed with the scope of a decision stored under its own KV key.
+// Keys written before the decisions were scoped aren't.
+func hasScopePrefix(value string) bool {
+	return strings.HasPrefix(value, "ip:") || strings.HasPrefix(value, "country:")
+}
+
+// kvKeyForValue returns the KV key under which the decision for value, as returned by scopedValue, is
+// stored. When decision hashing is enabled, this is the hex encoded HMAC-SHA256 of the value keyed with the salt shared with the worker.
+func (m *CloudflareAccountManager) kvKeyForValue(value string) string {
+	if !m.Worker.DecisionHashing.Enabled {
+		return value
+	}
+	mac := hmac.New(sha256.New, []byte(m.Worker.DecisionHashing.Salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// decisionAction returns the action of a decision, the one origin_action_overrides maps its origin to if
+// any. It's still subject to the action_fallback of the zones.
+func (m *CloudflareAccountManager) decisionAction(decision *models.Decision) string {
+	if decision.Origin != nil {
+		if action, ok := m.AccountCfg.OriginActionOverrides[*decision.Origin]; ok {
+			return action
+		}
+	}
+	return *decision.Type
+}
+
+// fallbackAction returns the action to store for decisions of type action, when it differs. It's only the
+// case when no zone of the account supports action and all of them define the same action_fallback for it,
+// as decisions are shared by every zone. Otherwise the worker applies the fallback of each zone itself.
+func (m *CloudflareAccountManager) fallbackAction(action string) (string, bool) {
+	fallback := ""
+	for _, zone := range m.zones() {
+		if slices.Contains(zone.Actions, action) {
+			return "", false
+		}
+		zoneFallback, ok := zone.ActionFallback[action]
+		if !ok || (fallback != "" && zoneFallback != fallback) {
+			return "", false
+		}
+		fallback = zoneFallback
+	}
+	return fallback, fallback != ""
+}
+
+// shouldReplaceAction reports whether newAction may overwrite the action currently stored for a value.
+// A throttle decision never downgrades an existing ban or captcha for the same value, so when an IP has
+// both a ban and a throttle decision, the ban wins.
+func shouldReplaceAction(currentAction string, newAction string) bool {
+	return newAction != "throttle" || currentAction == "throttle"
+}
+
+// minKVExpirationTTL is the shortest time to live of a KV entry accepted by Cloudflare.
+const minKVExpirationTTL = 60 * time.Second
+
+// decisionExpiration returns the unix time at which the KV entry of the decision expires, once its duration
+// elapsed, so that it's gone even if its deletion is missed. It's 0, for an entry which never expires,
+// when the decision has no duration or an invalid or negative one.
+func decisionExpiration(decision *models.Decision, now time.Time) int {
+	if decision.Duration == nil {
+		return 0
+	}
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil || duration <= 0 {
+		return 0
+	}
+	return int(now.Add(max(duration, minKVExpirationTTL)).Unix())
+}
+
+// laterExpiration returns the latest of the expirations of KV entries, 0 meaning never.
+func laterExpiration(a int, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// isAllowlisted returns true if the decision targets an IP or a range fully contained in the account allowlist.
+func (m *CloudflareAccountManager) isAllowlisted(decision *models.Decision) bool {
+	if len(m.allowlist) == 0 {
+		return false
+	}
+	switch *decision.Scope {
+	case "ip":
+		ip := net.ParseIP(*decision.Value)
+		if ip == nil {
+			return false
+		}
+		for _, allowed := range m.allowlist {
+			if allowed.Contains(ip) {
+				return true
+			}
+		}
+	case "range":
+		_, ipNet, err := net.ParseCIDR(*decision.Value)
+		if err != nil {
+			return false
+		}
+		rangeSize, _ := ipNet.Mask.Size()
+		for _, allowed := range m.allowlist {
+			allowedSize, _ := allowed.Mask.Size()
+			if allowed.Contains(ipNet.IP) && rangeSize >= allowedSize {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCountryAllowlist writes the country allowlist of the zones to KV, for the worker to ignore the
+// country decisions of the allowlisted countries. Nothing is written if no zone has one.
+func (m *CloudflareAccountManager) writeCountryAllowlist(ctx context.Context) error {
+	countryAllowlistByDomain := make(map[string][]string)
+	for _, zone := range m.zones() {
+		if len(zone.CountryAllowlist) > 0 {
+			countryAllowlistByDomain[zone.Domain] = zone.CountryAllowlist
+		}
+	}
+	if len(countryAllowlistByDomain) == 0 {
+		return nil
+	}
+	countryAllowlist, err := json.Marshal(countryAllowlistByDomain)
 	if err != nil {
 		return err
 	}
-	ipRangeContent := string(c)
-	if ipRangeContent != m.ipRangeKVPair.Value {
-		changeCount := strings.Count(ipRangeContent, ",") - strings.Count(m.ipRangeKVPair.Value, ",")
-		if changeCount > 0 {
-			m.logger.Infof("Adding %d IP ranges", changeCount)
-		} else {
-			m.logger.Infof("Removing %d IP ranges", -changeCount)
+	m.logger.Infof("Writing country allowlist of %d zones", len(countryAllowlistByDomain))
+	_, err = m.api.WriteWorkersKVEntries(ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs: []*cf.WorkersKVPair{{
+			Key:   CountryAllowlistKeyName,
+			Value: string(countryAllowlist),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error while writing country allowlist to KV: %w", err)
+	}
+	return nil
+}
+
+// writeBanTemplates writes the ban templates of the zones overriding the one of the account to KV, keyed
+// by domain. Nothing is written if every zone uses the template of the account.
+func (m *CloudflareAccountManager) writeBanTemplates(ctx context.Context) error {
+	banTemplateByDomain := make(map[string]string)
+	for _, zone := range m.zones() {
+		if zone.BanTemplate == "" {
+			continue
 		}
-		m.logger.Debugf("IP ranges changed, writing new value: %s", ipRangeContent)
-		m.ipRangeKVPair.Value = ipRangeContent
-		_, err := m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
-			NamespaceID: m.NamespaceID,
-			KVs:         []*cf.WorkersKVPair{&m.ipRangeKVPair},
-		})
+		banTemplate, err := os.ReadFile(zone.BanTemplate)
 		if err != nil {
-			return err
+			return fmt.Errorf("error while reading ban template of zone %s at path %s: %w", zone.Domain, zone.BanTemplate, err)
+		}
+		banTemplateByDomain[zone.Domain] = string(banTemplate)
+	}
+	if len(banTemplateByDomain) == 0 {
+		return nil
+	}
+	banTemplates, err := json.Marshal(banTemplateByDomain)
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Writing ban templates of %d zones", len(banTemplateByDomain))
+	_, err = m.api.WriteWorkersKVEntries(ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs: []*cf.WorkersKVPair{{
+			Key:   BanTemplateByDomainKeyName,
+			Value: string(banTemplates),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error while writing ban templates to KV: %w", err)
+	}
+	m.setKVPayloadBytes(BanTemplateByDomainKeyName, len(banTemplates))
+	return nil
+}
+
+// ResponseForZone customizes the ban and captcha responses of the worker for a zone.
+type ResponseForZone struct {
+	BanStatusCode     int               `json:"ban_status_code,omitempty"`
+	CaptchaStatusCode int               `json:"captcha_status_code,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	BanRedirectURL    string            `json:"ban_redirect_url,omitempty"`
+}
+
+// writeResponseConfig writes the custom ban and captcha responses of the zones to KV. Nothing is written
+// if every zone uses the default ones.
+func (m *CloudflareAccountManager) writeResponseConfig(ctx context.Context) error {
+	responseByDomain := make(map[string]ResponseForZone)
+	for _, zone := range m.zones() {
+		if zone.HasCustomResponse() {
+			responseByDomain[zone.Domain] = ResponseForZone{
+				BanStatusCode:     zone.BanStatusCode,
+				CaptchaStatusCode: zone.CaptchaStatusCode,
+				Headers:           zone.ResponseHeaders,
+				BanRedirectURL:    zone.BanRedirectURL,
+			}
+		}
+	}
+	if len(responseByDomain) == 0 {
+		return nil
+	}
+	responseConfig, err := json.Marshal(responseByDomain)
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Writing response config of %d zones", len(responseByDomain))
+	_, err = m.api.WriteWorkersKVEntries(ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs: []*cf.WorkersKVPair{{
+			Key:   ResponseConfigKeyName,
+			Value: string(responseConfig),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error while writing response config to KV: %w", err)
+	}
+	return nil
+}
+
+// isCountryAllowlisted returns true if the decision targets a country allowlisted by every zone of the
+// account. The decision is needed as soon as one zone doesn't allowlist the country, the worker then
+// ignores it for the zones which do.
+func (m *CloudflareAccountManager) isCountryAllowlisted(decision *models.Decision) bool {
+	if *decision.Scope != "country" {
+		return false
+	}
+	zones := m.zones()
+	if len(zones) == 0 {
+		return false
+	}
+	for _, zone := range zones {
+		if !slices.Contains(zone.CountryAllowlist, strings.ToUpper(*decision.Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// logActionsDiff logs the values of kind whose action differs between current and updated.
+func (m *CloudflareAccountManager) logActionsDiff(kind string, current map[string]string, updated map[string]string) {
+	for value, action := range updated {
+		if currentAction, ok := current[value]; !ok || currentAction != action {
+			m.logger.Infof("diff: set %s %s=%s", kind, value, action)
+		}
+	}
+	for value := range current {
+		if _, ok := updated[value]; !ok {
+			m.logger.Infof("diff: remove %s %s", kind, value)
 		}
 	}
+}
+
+// setActionByIPRange replaces the IP ranges of the decisions.
+func (m *CloudflareAccountManager) setActionByIPRange(actionByIPRange map[string]string) {
+	m.ipRangesLock.Lock()
+	defer m.ipRangesLock.Unlock()
+	m.ActionByIPRange = actionByIPRange
+}
+
+// commitIPRanges writes the IP ranges if they changed, or only marks them to be written by the flusher
+// when their commits are debounced.
+func (m *CloudflareAccountManager) commitIPRanges() error {
+	if m.Worker.IPRangesCommitInterval <= 0 {
+		return m.CommitIPRangesIfChanged()
+	}
+	m.ipRangesPending.Store(true)
+	return nil
+}
+
+// FlushIPRanges writes the IP ranges changed since they were last written by the flusher, if any. It's
+// called on shutdown so that the last changes aren't lost.
+func (m *CloudflareAccountManager) FlushIPRanges() error {
+	if !m.ipRangesPending.Swap(false) {
+		return nil
+	}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		m.ipRangesPending.Store(true)
+		return err
+	}
+	return nil
+}
+
+// FlushIPRangesPeriodically writes the pending changes of the IP ranges every ip_ranges_commit_interval
+// until the context of the manager is done. It returns at once if their commits aren't debounced.
+func (m *CloudflareAccountManager) FlushIPRangesPeriodically() error {
+	interval := m.Worker.IPRangesCommitInterval
+	if interval <= 0 {
+		return nil
+	}
+	m.logger.Infof("Writing the IP ranges at most every %s", interval)
+	ctx := m.Ctx
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.FlushIPRanges(); err != nil {
+				m.logger.Errorf("unable to write the IP ranges, retrying in %s: %s", interval, err)
+			}
+		}
+	}
+}
+
+// check if the ip ranges have changed and updates the KV pair if they have. The ranges are compared as
+// sets, the JSON encoding sorting the keys so that the same set is always written the same way.
+func (m *CloudflareAccountManager) CommitIPRangesIfChanged() error {
+	m.ipRangesLock.Lock()
+	defer m.ipRangesLock.Unlock()
+	m.hasIPRangeKV = true
+	// the worker only needs the aggregated ranges, the decisions are still tracked per range
+	actionByIPRange := aggregateIPRanges(m.ActionByIPRange)
+	committed := make(map[string]string)
+	if err := json.Unmarshal([]byte(m.ipRangeKVPair.Value), &committed); err != nil {
+		m.logger.Debugf("Unable to decode the committed IP ranges, writing them again: %s", err)
+		committed = nil
+	}
+	if committed != nil && maps.Equal(committed, actionByIPRange) {
+		return nil
+	}
+	c, err := json.Marshal(actionByIPRange)
+	if err != nil {
+		return err
+	}
+	ipRangeContent := string(c)
+	added, updated, removed := diffIPRanges(committed, actionByIPRange)
+	m.logger.Infof("Adding %d, updating %d and removing %d IP ranges", added, updated, removed)
+	m.logger.Debugf("IP ranges changed, writing new value: %s", ipRangeContent)
+	m.ipRangeKVPair.Value = ipRangeContent
+	_, err = m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs:         []*cf.WorkersKVPair{&m.ipRangeKVPair},
+	})
+	if err != nil {
+		return err
+	}
+	m.setKVPayloadBytes(IpRangeKeyName, len(ipRangeContent))
+	return nil
+}
+
+// CommitASDecisionsIfChanged writes the AS decisions to KV if they changed. They are kept in clear, as
+// the worker matches them against the AS number of the request.
+func (m *CloudflareAccountManager) CommitASDecisionsIfChanged() error {
+	m.hasASKV = true
+	c, err := json.Marshal(m.ActionByAS)
+	if err != nil {
+		return err
+	}
+	asContent := string(c)
+	if asContent == m.asKVPair.Value {
+		return nil
+	}
+	m.logger.Debugf("AS decisions changed, writing new value: %s", asContent)
+	m.asKVPair.Value = asContent
+	_, err = m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs:         []*cf.WorkersKVPair{&m.asKVPair},
+	})
+	if err != nil {
+		return err
+	}
+	m.setKVPayloadBytes(ASDecisionsKeyName, len(asContent))
+	return nil
+}
+
+// CommitOtherScopeDecisionsIfChanged writes the decisions of the pass-through scopes to KV if they
+// changed, and counts them by scope. Like the AS decisions, they are kept in clear.
+func (m *CloudflareAccountManager) CommitOtherScopeDecisionsIfChanged() error {
+	if len(m.PassThroughScopes) == 0 && !m.hasOtherScopeKV {
+		return nil
+	}
+	countByScope := make(map[string]int, len(m.PassThroughScopes))
+	for _, scope := range m.PassThroughScopes {
+		countByScope[scope] = 0
+	}
+	for id := range m.ActionByOtherScope {
+		scope, _, _ := strings.Cut(id, ":")
+		countByScope[scope]++
+	}
+	for scope, count := range countByScope {
+		metrics.OtherScopeDecisions.With(prometheus.Labels{"scope": scope, "account": m.AccountCfg.Name}).Set(float64(count))
+	}
+
+	m.hasOtherScopeKV = true
+	c, err := json.Marshal(m.ActionByOtherScope)
+	if err != nil {
+		return err
+	}
+	content := string(c)
+	if content == m.otherScopeKVPair.Value {
+		return nil
+	}
+	m.logger.Debugf("Pass-through decisions changed, writing new value: %s", content)
+	m.otherScopeKVPair.Value = content
+	_, err = m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs:         []*cf.WorkersKVPair{&m.otherScopeKVPair},
+	})
+	if err != nil {
+		return err
+	}
+	m.setKVPayloadBytes(OtherScopeDecisionsKeyName, len(content))
 	return nil
 }
 
+// commitScopeDecisions writes the AS decisions and the ones of the pass-through scopes if they changed.
+func (m *CloudflareAccountManager) commitScopeDecisions() error {
+	if err := m.CommitASDecisionsIfChanged(); err != nil {
+		return err
+	}
+	return m.CommitOtherScopeDecisionsIfChanged()
+}
+
+// CreateTurnstileWidgets creates the turnstile widget of each zone enabling turnstile. A zone whose widget
+// can't be created is skipped rather than failing the others: the worker lets the requests of its captcha
+// decisions through until the widget is created on a later start. An error is only returned when no
+// widget could be created.
 func (m *CloudflareAccountManager) CreateTurnstileWidgets() (map[string]WidgetTokenCfg, error) {
 	widgetCreatorGrp := errgroup.Group{}
+	widgetCreatorGrp.SetLimit(max(m.routeConcurrency, 1))
 	widgetTokenCfgByDomain := make(map[string]WidgetTokenCfg)
+	widgetErrs := make([]error, 0)
 	widgetTokenCfgByDomainLock := sync.Mutex{}
-	for _, z := range m.AccountCfg.ZoneConfigs {
+	for _, z := range m.zones() {
 		zone := z
 		if !zone.Turnstile.Enabled {
 			continue
 		}
-		zoneLogger := m.logger.WithFields(log.Fields{"zone": zone.Domain})
-		zoneLogger.Info(("Creating turnstile widget"))
 		widgetCreatorGrp.Go(func() error {
-			resp, err := m.api.CreateTurnstileWidget(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.CreateTurnstileWidgetParams{
-				Name:    WidgetName,
-				Domains: []string{zone.Domain},
-				Mode:    zone.Turnstile.Mode,
-			})
-			if err != nil {
-				return err
-			}
-			zoneLogger.Tracef("resp: %+v", resp)
-			zoneLogger.Info(("Done creating turnstile widget"))
+			widgetTokenCfg, err := m.createTurnstileWidget(zone)
 			widgetTokenCfgByDomainLock.Lock()
 			defer widgetTokenCfgByDomainLock.Unlock()
-			widgetTokenCfgByDomain[zone.Domain] = WidgetTokenCfg{SiteKey: resp.SiteKey, Secret: resp.Secret}
+			if err != nil {
+				m.zoneLogger(zone).Errorf("Unable to create turnstile widget, captcha is unavailable for the zone: %s", err)
+				widgetErrs = append(widgetErrs, fmt.Errorf("zone %s: %w", zone.Domain, err))
+				return nil
+			}
+			widgetTokenCfgByDomain[zone.Domain] = widgetTokenCfg
 			return nil
 		})
 	}
-	if err := widgetCreatorGrp.Wait(); err != nil {
-		return nil, err
+	_ = widgetCreatorGrp.Wait()
+	if len(widgetErrs) > 0 && len(widgetTokenCfgByDomain) == 0 {
+		return nil, fmt.Errorf("unable to create any turnstile widget: %w", errors.Join(widgetErrs...))
 	}
 	return widgetTokenCfgByDomain, nil
 }
 
+func (m *CloudflareAccountManager) createTurnstileWidget(zone *cfg.ZoneConfig) (WidgetTokenCfg, error) {
+	zoneLogger := m.zoneLogger(zone)
+	zoneLogger.Info(("Creating turnstile widget"))
+	resp, err := m.api.CreateTurnstileWidget(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.CreateTurnstileWidgetParams{
+		Name:    WidgetName,
+		Domains: zone.Turnstile.WidgetDomains(zone.Domain),
+		Mode:    zone.Turnstile.Mode,
+	})
+	if err != nil {
+		return WidgetTokenCfg{}, err
+	}
+	zoneLogger.Tracef("resp: %+v", resp)
+	zoneLogger.Info(("Done creating turnstile widget"))
+	return WidgetTokenCfg{SiteKey: resp.SiteKey, Secret: resp.Secret}, nil
+}
+
+// setWidgetTokenCfgs stores the widget tokens of the provided domains and writes the tokens of every
+// domain to KV.
+func (m *CloudflareAccountManager) setWidgetTokenCfgs(ctx context.Context, widgetTokenCfgByDomain map[string]WidgetTokenCfg) error {
+	m.widgetLock.Lock()
+	defer m.widgetLock.Unlock()
+	if m.widgetTokenCfgByDomain == nil {
+		m.widgetTokenCfgByDomain = make(map[string]WidgetTokenCfg)
+	}
+	maps.Copy(m.widgetTokenCfgByDomain, widgetTokenCfgByDomain)
+	return m.writeWidgetCfgToKV(ctx, m.widgetTokenCfgByDomain)
+}
+
+// jitteredInterval spreads interval by a random amount of up to jitterPercent percent of it, in either
+// direction, so that zones sharing the same rotation interval don't all rotate at the same time.
+func jitteredInterval(interval time.Duration, jitterPercent int) time.Duration {
+	if jitterPercent <= 0 {
+		return interval
+	}
+	maxJitter := int64(interval) * int64(jitterPercent) / 100
+	if maxJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(2*maxJitter+1)-maxJitter)
+}
+
 // Creates the turnstile widgets and writes the widget tokens to KV.
 // It runs infinitely, rotating the secret keys every configured interval.
 func (m *CloudflareAccountManager) HandleTurnstile() error {
-	widgetTokenCfgByDomainLock := sync.Mutex{}
 	// Create the tokens
 	widgetTokenCfgByDomain, err := m.CreateTurnstileWidgets()
 	if err != nil {
 		return err
 	}
 
-	if err := m.writeWidgetCfgToKV(m.Ctx, widgetTokenCfgByDomain); err != nil {
+	if err := m.setWidgetTokenCfgs(m.Ctx, widgetTokenCfgByDomain); err != nil {
 		return nil
 	}
 
 	// Start the rotators
 	g, ctx := errgroup.WithContext(m.Ctx)
-	for _, z := range m.AccountCfg.ZoneConfigs {
+	for _, z := range m.zones() {
 		if !z.Turnstile.RotateSecretKey || !z.Turnstile.Enabled {
 			continue
 		}
+		// the zones whose widget couldn't be created have no secret key to rotate
+		if _, ok := widgetTokenCfgByDomain[z.Domain]; !ok {
+			continue
+		}
 		zone := z
 		g.Go(func() error {
-			zoneLogger := m.logger.WithFields(log.Fields{"zone": zone.Domain})
-			zoneLogger.Info(("Starting turnstile rotator"))
-			ticker := time.NewTicker(zone.Turnstile.RotateSecretKeyEvery)
-			for {
-				select {
-				case <-m.Ctx.Done():
-					zoneLogger.Warn("Stopping turnstile rotator")
-					return m.Ctx.Err()
-				case <-ticker.C:
-					zoneLogger.Info(("Rotating turnstile secret key"))
-					widgetTokenCfgByDomainLock.Lock()
-					widgetTokenCfg := widgetTokenCfgByDomain[zone.Domain]
-					widgetTokenCfgByDomainLock.Unlock()
-					resp, err := m.api.RotateTurnstileWidget(ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.RotateTurnstileWidgetParams{
-						SiteKey:               widgetTokenCfg.SiteKey,
-						InvalidateImmediately: true,
-					})
-					zoneLogger.Tracef("resp: %+v", resp)
-					if err != nil {
-						return err
-					}
-					widgetTokenCfg.Secret = resp.Secret
-					widgetTokenCfgByDomainLock.Lock()
-					widgetTokenCfgByDomain[zone.Domain] = widgetTokenCfg
-					if err := m.writeWidgetCfgToKV(ctx, widgetTokenCfgByDomain); err != nil {
-						return err
-					}
-					widgetTokenCfgByDomainLock.Unlock()
-				}
-			}
+			return m.rotateTurnstileSecret(ctx, zone)
 		})
 	}
 	return g.Wait()
 }
 
+// rotateTurnstileSecret rotates the secret key of the zone's widget every configured interval.
+func (m *CloudflareAccountManager) rotateTurnstileSecret(ctx context.Context, zone *cfg.ZoneConfig) error {
+	zoneLogger := m.zoneLogger(zone)
+	zoneLogger.Info(("Starting turnstile rotator"))
+	timer := time.NewTimer(jitteredInterval(zone.Turnstile.RotateSecretKeyEvery, zone.Turnstile.RotateJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.Ctx.Done():
+			zoneLogger.Warn("Stopping turnstile rotator")
+			return m.Ctx.Err()
+		case <-timer.C:
+			timer.Reset(jitteredInterval(zone.Turnstile.RotateSecretKeyEvery, zone.Turnstile.RotateJitter))
+			if m.isZoneRemoved(zone.ID) {
+				zoneLogger.Debug("Not rotating the turnstile secret key of the zone deleted from the account")
+				continue
+			}
+			zoneLogger.Info(("Rotating turnstile secret key"))
+			m.widgetLock.Lock()
+			widgetTokenCfg := m.widgetTokenCfgByDomain[zone.Domain]
+			m.widgetLock.Unlock()
+			resp, err := m.api.RotateTurnstileWidget(ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.RotateTurnstileWidgetParams{
+				SiteKey:               widgetTokenCfg.SiteKey,
+				InvalidateImmediately: true,
+			})
+			zoneLogger.Tracef("resp: %+v", resp)
+			if err != nil {
+				metrics.TurnstileRotationErrors.WithLabelValues(m.AccountCfg.Name, zone.Domain).Inc()
+				m.Notifier.Notify(notify.EventTurnstileRotated, m.AccountCfg.Name, fmt.Errorf("zone %s: %w", zone.Domain, err))
+				return err
+			}
+			widgetTokenCfg.Secret = resp.Secret
+			if err := m.setWidgetTokenCfgs(ctx, map[string]WidgetTokenCfg{zone.Domain: widgetTokenCfg}); err != nil {
+				metrics.TurnstileRotationErrors.WithLabelValues(m.AccountCfg.Name, zone.Domain).Inc()
+				m.Notifier.Notify(notify.EventTurnstileRotated, m.AccountCfg.Name, fmt.Errorf("zone %s: %w", zone.Domain, err))
+				return err
+			}
+			metrics.TurnstileRotations.WithLabelValues(m.AccountCfg.Name, zone.Domain).Inc()
+			metrics.TurnstileLastRotation.WithLabelValues(m.AccountCfg.Name, zone.Domain).SetToCurrentTime()
+			m.Notifier.Notify(notify.EventTurnstileRotated, m.AccountCfg.Name, nil)
+		}
+	}
+}
+
+// RotateTurnstileSecrets rotates the secret key of the widget of every zone with turnstile enabled now,
+// invalidating the previous one immediately, and writes the new secrets to KV. The widgets are the ones
+// of the TURNSTILE_CONFIG key of the deployed infra, so that it can run along with the bouncer.
+func (m *CloudflareAccountManager) RotateTurnstileSecrets() error {
+	if err := m.ResolveNamespaceID(); err != nil {
+		return err
+	}
+	value, err := m.api.GetWorkersKV(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.GetWorkersKVParams{
+		NamespaceID: m.NamespaceID,
+		Key:         TurnstileConfigKey,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read the turnstile config from KV: %w", err)
+	}
+	widgetTokenCfgByDomain := make(map[string]WidgetTokenCfg)
+	if err := json.Unmarshal(value, &widgetTokenCfgByDomain); err != nil {
+		return fmt.Errorf("invalid %s value: %w", TurnstileConfigKey, err)
+	}
+
+	rotated := make(map[string]WidgetTokenCfg)
+	for _, zone := range m.zones() {
+		if !zone.Turnstile.Enabled {
+			continue
+		}
+		zoneLogger := m.zoneLogger(zone)
+		widgetTokenCfg, ok := widgetTokenCfgByDomain[zone.Domain]
+		if !ok {
+			zoneLogger.Warn("No turnstile widget deployed for the zone, not rotating its secret key")
+			continue
+		}
+		zoneLogger.Info("Rotating turnstile secret key")
+		resp, err := m.api.RotateTurnstileWidget(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.RotateTurnstileWidgetParams{
+			SiteKey:               widgetTokenCfg.SiteKey,
+			InvalidateImmediately: true,
+		})
+		if err != nil {
+			m.Notifier.Notify(notify.EventTurnstileRotated, m.AccountCfg.Name, fmt.Errorf("zone %s: %w", zone.Domain, err))
+			return fmt.Errorf("unable to rotate the turnstile secret key of zone %s: %w", zone.Domain, err)
+		}
+		widgetTokenCfg.Secret = resp.Secret
+		rotated[zone.Domain] = widgetTokenCfg
+	}
+	if len(rotated) == 0 {
+		return nil
+	}
+	// the widgets of the other domains are written back as they were
+	m.widgetLock.Lock()
+	m.widgetTokenCfgByDomain = widgetTokenCfgByDomain
+	m.widgetLock.Unlock()
+	if err := m.setWidgetTokenCfgs(m.Ctx, rotated); err != nil {
+		return err
+	}
+	m.Notifier.Notify(notify.EventTurnstileRotated, m.AccountCfg.Name, nil)
+	return nil
+}
+
+// WatchNewZones periodically protects the zones of the account which aren't in the config, when
+// auto_protect_new_zones is enabled. It runs until the context is done.
+func (m *CloudflareAccountManager) WatchNewZones() error {
+	autoProtect := m.AccountCfg.AutoProtectNewZones
+	if !autoProtect.Enabled {
+		return nil
+	}
+	m.logger.Infof("Looking for new zones to protect every %s", autoProtect.Interval)
+	// rotators of the turnstile widgets of the new zones
+	g, ctx := errgroup.WithContext(m.Ctx)
+	ticker := time.NewTicker(autoProtect.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.logger.Warn("Stopping new zones watcher")
+			return g.Wait()
+		case <-ticker.C:
+			if err := m.protectNewZones(ctx, g); err != nil {
+				m.logger.Errorf("unable to protect new zones: %s", err)
+			}
+		}
+	}
+}
+
+func (m *CloudflareAccountManager) protectNewZones(ctx context.Context, g *errgroup.Group) error {
+	autoProtect := m.AccountCfg.AutoProtectNewZones
+	zones, err := m.api.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	knownZones := make(map[string]bool)
+	for _, zone := range m.zones() {
+		knownZones[zone.ID] = true
+	}
+	for _, zone := range zones {
+		// the zones deleted from the account which reappear are protected again by WatchZones
+		if zone.Account.ID != m.AccountCfg.ID || knownZones[zone.ID] || m.isZoneRemoved(zone.ID) {
+			continue
+		}
+		if autoProtect.Excludes(zone.ID, zone.Name) {
+			m.logger.Debugf("Not protecting excluded zone %s", zone.Name)
+			continue
+		}
+		hasAddressRecord, err := m.zoneHasAddressRecord(ctx, zone.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list dns records for zone %s: %w", zone.Name, err)
+		}
+		if !hasAddressRecord {
+			m.logger.Debugf("Not protecting zone %s as it does not have any A or AAAA records", zone.Name)
+			continue
+		}
+		m.logger.Infof("Automatically protecting new zone %s (%s)", zone.Name, zone.ID)
+		if err := m.protectZone(ctx, g, m.AccountCfg.AutoProtectZoneConfig(zone.ID, zone.Name)); err != nil {
+			return fmt.Errorf("unable to protect zone %s, restart the bouncer to retry: %w", zone.Name, err)
+		}
+		m.logger.Infof("Automatically protected new zone %s", zone.Name)
+	}
+	return nil
+}
+
+func (m *CloudflareAccountManager) zoneHasAddressRecord(ctx context.Context, zoneID string) (bool, error) {
+	records, err := m.listDNSRecords(ctx, zoneID)
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if record.Type == "A" || record.Type == "AAAA" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// protectZone deploys the protection of a zone which wasn't known when the infra was deployed: its
+// turnstile widget, its actions in the worker bindings and its routes. The zone is known by the manager
+// from the start, so that a failure isn't retried with duplicated widgets and routes, and its
+// resources are cleaned up with the others.
+func (m *CloudflareAccountManager) protectZone(ctx context.Context, g *errgroup.Group, zone *cfg.ZoneConfig) error {
+	m.zonesLock.Lock()
+	m.AccountCfg.ZoneConfigs = append(m.AccountCfg.ZoneConfigs, zone)
+	if m.zoneLoggers == nil {
+		m.zoneLoggers = make(map[string]*log.Entry)
+	}
+	m.zoneLoggers[zone.ID] = newZoneLogger(m.logger, zone)
+	m.zonesLock.Unlock()
+
+	if zone.Turnstile.Enabled {
+		widgetTokenCfg, err := m.createTurnstileWidget(zone)
+		if err != nil {
+			return err
+		}
+		if err := m.setWidgetTokenCfgs(ctx, map[string]WidgetTokenCfg{zone.Domain: widgetTokenCfg}); err != nil {
+			return err
+		}
+	}
+	if len(zone.CountryAllowlist) > 0 {
+		if err := m.writeCountryAllowlist(ctx); err != nil {
+			return err
+		}
+	}
+	if zone.HasCustomResponse() {
+		if err := m.writeResponseConfig(ctx); err != nil {
+			return err
+		}
+	}
+	if zone.BanTemplate != "" {
+		if err := m.writeBanTemplates(ctx); err != nil {
+			return err
+		}
+	}
+
+	varActionsForZoneByDomain, err := actionsForZoneByDomain(m.zones())
+	if err != nil {
+		return err
+	}
+	m.zoneLogger(zone).Infof("Updating worker %s version %s", m.Worker.ScriptName, WorkerScriptVersion())
+	worker, err := m.api.UploadWorker(ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.CreateWorkerParams(workerScript, m.NamespaceID, varActionsForZoneByDomain, m.DatabaseID))
+	if err != nil {
+		return err
+	}
+	m.workerUploaded(worker)
+	m.setKVPayloadBytes(cfg.VarNameForActionsByDomain, len(varActionsForZoneByDomain))
+	if err := m.createWorkerRoutes(zone, worker.ID); err != nil {
+		return err
+	}
+	if err := m.addBlockRule(zone); err != nil {
+		return err
+	}
+	if len(zone.ObserveRoutes) > 0 {
+		observerID, err := m.deployObserver(ctx)
+		if err != nil {
+			return err
+		}
+		zg := errgroup.Group{}
+		zg.SetLimit(max(m.routeConcurrency, 1))
+		m.bindWorkerRoutes(&zg, zone, zone.ObserveRoutes, observerID)
+		if err := zg.Wait(); err != nil {
+			return err
+		}
+	}
+
+	if zone.Turnstile.Enabled && zone.Turnstile.RotateSecretKey {
+		g.Go(func() error {
+			return m.rotateTurnstileSecret(ctx, zone)
+		})
+	}
+	return nil
+}
+
+// ResolveNamespaceID looks up the KV namespace used by the worker by its name. It is used by the
+// commands which run against an existing deployment, when the namespace wasn't created by this process.
+func (m *CloudflareAccountManager) ResolveNamespaceID() error {
+	kvNamespaces, err := m.listKVNamespaces()
+	if err != nil {
+		return err
+	}
+	for _, kvNamespace := range kvNamespaces {
+		if kvNamespace.Title == m.Worker.KVNameSpaceName {
+			m.NamespaceID = kvNamespace.ID
+			return nil
+		}
+	}
+	return fmt.Errorf("kv namespace %s not found", m.Worker.KVNameSpaceName)
+}
+
+// ImportDecisions enforces decisions obtained without a LAPI stream, like the ones of a blocklist file,
+// with the deployed infra. Its state is loaded first, for the decisions it already enforces to be kept.
+func (m *CloudflareAccountManager) ImportDecisions(decisions []*models.Decision) error {
+	if err := m.ResolveNamespaceID(); err != nil {
+		return err
+	}
+	if err := m.LoadFromKV(); err != nil {
+		return fmt.Errorf("unable to load the decisions of KV namespace %s: %w", m.NamespaceID, err)
+	}
+	if err := m.deployRuleset(); err != nil {
+		return err
+	}
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		return err
+	}
+	return m.CommitIPRangesIfChanged()
+}
+
+// listKVKeys returns the name of every key in the KV namespace, following the pagination cursor.
+func (m *CloudflareAccountManager) listKVKeys() ([]string, error) {
+	storageKeys, err := m.listKVStorageKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(storageKeys))
+	for _, key := range storageKeys {
+		keys = append(keys, key.Name)
+	}
+	return keys, nil
+}
+
+// listKVStorageKeys returns every key in the KV namespace with its expiration, following the pagination
+// cursor.
+func (m *CloudflareAccountManager) listKVStorageKeys() ([]cf.StorageKey, error) {
+	keys := make([]cf.StorageKey, 0)
+	cursor := ""
+	for {
+		resp, err := m.api.ListWorkersKVKeys(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListWorkersKVsParams{
+			NamespaceID: m.NamespaceID,
+			Cursor:      cursor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, resp.Result...)
+		cursor = resp.ResultInfo.Cursor
+		if cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// KVDump is the state of the KV namespace of an account, as written by the dump-kv command.
+type KVDump struct {
+	Account         string            `json:"account"`
+	NamespaceID     string            `json:"namespace_id"`
+	ActionsByDomain json.RawMessage   `json:"actions_by_domain"`
+	Entries         map[string]string `json:"entries"`
+}
+
+// DumpKV reads every key and value of the KV namespace. The ACTIONS_BY_DOMAIN binding isn't stored
+// in KV, so the value derived from the current config is included instead.
+func (m *CloudflareAccountManager) DumpKV() (*KVDump, error) {
+	actionsByDomain, err := actionsForZoneByDomain(m.zones())
+	if err != nil {
+		return nil, err
+	}
+	keys, err := m.listKVKeys()
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Infof("Dumping %d KV keys", len(keys))
+
+	entries, err := m.readKVEntries(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &KVDump{
+		Account:         m.AccountCfg.Name,
+		NamespaceID:     m.NamespaceID,
+		ActionsByDomain: actionsByDomain,
+		Entries:         entries,
+	}, nil
+}
+
+// readKVEntries reads the value of each of the keys of the KV namespace.
+func (m *CloudflareAccountManager) readKVEntries(keys []string) (map[string]string, error) {
+	entries := make(map[string]string, len(keys))
+	entriesLock := sync.Mutex{}
+	g := errgroup.Group{}
+	g.SetLimit(10)
+	for _, k := range keys {
+		key := k
+		g.Go(func() error {
+			value, err := m.api.GetWorkersKV(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.GetWorkersKVParams{
+				NamespaceID: m.NamespaceID,
+				Key:         key,
+			})
+			if err != nil {
+				return fmt.Errorf("unable to read key %s: %w", key, err)
+			}
+			entriesLock.Lock()
+			defer entriesLock.Unlock()
+			entries[key] = string(value)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// metricsUpdateDue tells whether the metrics of the account should be queried at now, recording the query
+// if so.
+func (m *CloudflareAccountManager) metricsUpdateDue(now time.Time) bool {
+	m.lastMetricsUpdateLock.Lock()
+	defer m.lastMetricsUpdateLock.Unlock()
+	if frequency := m.AccountCfg.MetricsUpdateFrequency; frequency > 0 && !m.lastMetricsUpdate.IsZero() && now.Sub(m.lastMetricsUpdate) < frequency {
+		return false
+	}
+	m.lastMetricsUpdate = now
+	return true
+}
+
 func (m *CloudflareAccountManager) UpdateMetrics() error {
 	m.logger.Debug("Getting metrics")
 	if !m.hasD1Access {
 		m.logger.Debug("No D1 access, skipping metrics update")
 		return nil
 	}
+	if !m.d1Breaker.allow(time.Now()) {
+		m.logger.Debug("D1 queries are failing, skipping metrics update")
+		return nil
+	}
+	if !m.metricsUpdateDue(time.Now()) {
+		m.logger.Debug("Metrics were updated recently, skipping metrics update")
+		return nil
+	}
 	resp, err := m.api.QueryD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.QueryD1DatabaseParams{
 		DatabaseID: m.DatabaseID,
-		SQL:        "SELECT * FROM metrics",
+		SQL:        sqlSelectMetrics,
 	})
 	if err != nil {
+		if isD1Gone(err) {
+			metrics.WorkerD1Healthy.WithLabelValues(m.AccountCfg.Name).Set(0)
+			m.logger.Errorf("D1 DB %s or its metrics table is gone, the worker can't write its metrics anymore. Restart the bouncer to deploy it again: %s", m.DatabaseID, err)
+		}
+		if m.d1Breaker.failure(time.Now()) {
+			m.logger.Warnf("D1 metrics query keeps failing, not querying it for %s: %s", d1BreakerCooldown, err)
+			m.Notifier.Notify(notify.EventAccountDegraded, m.AccountCfg.Name, fmt.Errorf("D1 metrics query keeps failing: %w", err))
+			return nil
+		}
 		return err
 	}
+	if m.d1Breaker.success() {
+		m.logger.Info("D1 metrics query succeeded, resuming metrics updates")
+	}
+	metrics.WorkerD1Healthy.WithLabelValues(m.AccountCfg.Name).Set(1)
 	m.logger.Tracef("resp: %+v", resp)
+	if err := m.pruneD1Metrics(time.Now()); err != nil {
+		m.logger.Warnf("Unable to delete the D1 metrics rows past the retention: %s", err)
+	}
 
 	for _, r := range resp {
 		if r.Success == nil || !*r.Success {
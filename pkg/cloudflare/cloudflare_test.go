@@ -0,0 +1,3106 @@
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+func TestTransportReportsDeprecationWarnings(t *testing.T) {
+	body := `{"success":true,"errors":[],"messages":[{"code":10000,"message":"This endpoint is deprecated, use /v2 instead"}],"result":{}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	transport := &CloudflareManagerHTTPTransport{Transport: &http.Transport{}, accountName: "deprecation-test", deprecationWarnings: "warn"}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Fatalf("expected body to be preserved, got %q", string(got))
+	}
+	if count := testutil.ToFloat64(metrics.CloudflareAPIDeprecationWarnings.WithLabelValues("deprecation-test")); count != 1 {
+		t.Fatalf("expected 1 deprecation warning, got %f", count)
+	}
+	duration := &io_prometheus_client.Metric{}
+	if err := metrics.CloudflareAPIDuration.WithLabelValues("deprecation-test", "/").(prometheus.Histogram).Write(duration); err != nil {
+		t.Fatal(err)
+	}
+	if count := duration.GetHistogram().GetSampleCount(); count != 1 {
+		t.Fatalf("expected the duration of 1 call to be recorded, got %d", count)
+	}
+}
+
+func TestTransportRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []string // status and body of each response, separated by a space
+		retryable bool
+	}{
+		{name: "retryable status", responses: []string{`503 {}`, `200 {"success":true}`}, retryable: true},
+		{name: "retryable cloudflare error", responses: []string{`400 {"errors":[{"code":10013}]}`, `200 {"success":true}`}, retryable: true},
+		{name: "other cloudflare error", responses: []string{`400 {"errors":[{"code":10000}]}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "payload" {
+					t.Errorf("expected body to be replayed, got %q", string(body))
+				}
+				status, response, _ := strings.Cut(tt.responses[calls], " ")
+				calls++
+				code, _ := strconv.Atoi(status)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(code)
+				_, _ = w.Write([]byte(response))
+			}))
+			defer server.Close()
+
+			transport := &CloudflareManagerHTTPTransport{Transport: &http.Transport{}, accountName: "retry-test", retry: retryPolicy{
+				maxRetries:  3,
+				minDelay:    time.Millisecond,
+				maxDelay:    time.Millisecond,
+				statusCodes: []int{503},
+				cfCodes:     []int{10013},
+			}}
+			resp, err := (&http.Client{Transport: transport}).Post(server.URL, "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if calls != len(tt.responses) {
+				t.Fatalf("expected %d calls, got %d", len(tt.responses), calls)
+			}
+			if tt.retryable && resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected the call to succeed after a retry, got %d", resp.StatusCode)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			_, expected, _ := strings.Cut(tt.responses[calls-1], " ")
+			if string(got) != expected {
+				t.Fatalf("expected body %q, got %q", expected, string(got))
+			}
+		})
+	}
+}
+
+func TestTransportPerAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	apiCfg := &cfg.CloudflareAPIConfig{MaxIdleConnsPerHost: 3, IdleConnTimeout: time.Minute}
+	dials := make(map[string]int)
+	clients := make(map[string]*http.Client)
+	for _, account := range []string{"first", "second"} {
+		httpTransport, err := newHTTPTransport(apiCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &CloudflareManagerHTTPTransport{Transport: httpTransport, accountName: account}
+		if transport.MaxIdleConnsPerHost != 3 || transport.IdleConnTimeout != time.Minute || transport.TLSHandshakeTimeout == 0 {
+			t.Fatalf("expected the transport to have the defaults and the pool of the config")
+		}
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials[account]++
+			return dial(ctx, network, addr)
+		}
+		transport.DisableKeepAlives = true
+		clients[account] = &http.Client{Transport: transport}
+	}
+
+	for _, account := range []string{"first", "second", "second"} {
+		resp, err := clients[account].Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if dials["first"] != 1 || dials["second"] != 2 {
+		t.Fatalf("expected each account to dial through its own transport, got %v", dials)
+	}
+	if http.DefaultTransport.(*http.Transport).DialContext == nil || http.DefaultTransport.(*http.Transport).DisableKeepAlives {
+		t.Fatalf("expected the default transport to be left untouched")
+	}
+}
+
+func TestRateBudget(t *testing.T) {
+	for _, tc := range []struct {
+		header    http.Header
+		remaining int
+		reset     time.Duration
+		ok        bool
+	}{
+		{header: http.Header{"Ratelimit": {`"default";r=40;t=120`}}, remaining: 40, reset: 2 * time.Minute, ok: true},
+		{header: http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Ratelimit-Reset": {"30"}}, remaining: 10, reset: 30 * time.Second, ok: true},
+		{header: http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"5"}}, remaining: 0, reset: 5 * time.Second, ok: true},
+		{header: http.Header{"Ratelimit": {`"default";r=40`}}},
+		{header: http.Header{}},
+	} {
+		remaining, reset, ok := parseRateLimitHeaders(tc.header)
+		if remaining != tc.remaining || reset != tc.reset || ok != tc.ok {
+			t.Fatalf("%v: expected %d, %s, %t, got %d, %s, %t", tc.header, tc.remaining, tc.reset, tc.ok, remaining, reset, ok)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Ratelimit", `"default";r=20;t=60`)
+	}))
+	defer server.Close()
+	budget := &rateBudget{}
+	transport := &CloudflareManagerHTTPTransport{Transport: &http.Transport{}, accountName: "rate-budget-test", rateBudget: budget}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if remaining := testutil.ToFloat64(metrics.CloudflareAPIRateRemaining.WithLabelValues("rate-budget-test")); remaining != 20 {
+		t.Fatalf("expected 20 calls left, got %f", remaining)
+	}
+
+	now := time.Now()
+	if delay := budget.delay(10, now); delay != 0 {
+		t.Fatalf("expected no delay with enough calls left, got %s", delay)
+	}
+	if delay := budget.delay(50, now); delay <= 0 || delay > time.Minute {
+		t.Fatalf("expected to wait for the reset, got %s", delay)
+	}
+	if delay := budget.delay(50, now.Add(2*time.Minute)); delay != 0 {
+		t.Fatalf("expected no delay once the budget is reset, got %s", delay)
+	}
+	if delay := (&rateBudget{}).delay(50, now); delay != 0 {
+		t.Fatalf("expected no delay with an unknown budget, got %s", delay)
+	}
+
+	// the batches aren't submitted while the budget is exhausted
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.rateBudget = budget
+	m.rateBudgetMinRemaining = 50
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Ctx = ctx
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be interrupted, got %v", err)
+	}
+	if len(api.writes) != 0 {
+		t.Fatalf("expected no write, got %v", api.writes)
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	httpTransport, err := newHTTPTransport(&cfg.CloudflareAPIConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: &CloudflareManagerHTTPTransport{Transport: httpTransport}}).Get("http://api.cloudflare.invalid/client/v4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if url := <-proxied; url != "http://api.cloudflare.invalid/client/v4" {
+		t.Fatalf("expected the call to go through the proxy, got %s", url)
+	}
+}
+
+func TestEndpointLabel(t *testing.T) {
+	tests := map[string]string{
+		"/client/v4/accounts/abc123/workers/scripts/crowdsec-worker":           "/workers/scripts",
+		"/client/v4/accounts/abc123/storage/kv/namespaces/ns42/bulk":           "/storage/kv/namespaces/bulk",
+		"/client/v4/accounts/abc123/storage/kv/namespaces/ns42/values/1.2.3.4": "/storage/kv/namespaces/values",
+		"/client/v4/accounts/abc123/d1/database/0f2a-4b1c/query":               "/d1/database/query",
+		"/client/v4/accounts/abc123/workers/scripts/worker/tails/tail1":        "/workers/scripts/tails",
+		"/client/v4/zones/zone1/workers/routes/route1":                         "/workers/routes",
+		"/client/v4/zones":              "/zones",
+		"/client/v4/user/tokens/verify": "/user/tokens/verify",
+		"/client/v4/accounts/abc123/challenges/widgets/sitekey/rotate_secret":      "/challenges/widgets/rotate_secret",
+		"/client/v4/accounts/abc123/workers/dispatch/namespaces/tenants/scripts/w": "/workers/dispatch/namespaces/scripts",
+		"/client/v4/accounts/abc123/unknown/endpoint":                              "/",
+	}
+	for path, expected := range tests {
+		if label := endpointLabel(path); label != expected {
+			t.Errorf("expected %s for %s, got %s", expected, path, label)
+		}
+	}
+}
+
+func TestKVKeyForValue(t *testing.T) {
+	m := &CloudflareAccountManager{Worker: &cfg.CloudflareWorkerCreateParams{}}
+	if key := m.kvKeyForValue("1.2.3.4"); key != "1.2.3.4" {
+		t.Fatalf("expected value to be used as key when hashing is disabled, got %s", key)
+	}
+
+	m.Worker.DecisionHashing = cfg.DecisionHashingConfig{Enabled: true, Salt: "key"}
+	// HMAC-SHA256 test vector for key "key" and message "The quick brown fox jumps over the lazy dog"
+	expected := "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if key := m.kvKeyForValue("The quick brown fox jumps over the lazy dog"); key != expected {
+		t.Fatalf("expected %s, got %s", expected, key)
+	}
+}
+
+// The embedded bundle must look up the keys the bouncer writes, or the decisions go unenforced: this
+// catches a change of worker.js without make build-worker-js.
+func TestWorkerScriptKVKeys(t *testing.T) {
+	for _, scope := range []string{"ip", "country"} {
+		prefix := strings.TrimSuffix(scopedValue(scope, "value"), "value")
+		if !strings.Contains(workerScript, "decisionKey(`"+prefix+"${") {
+			t.Errorf("expected the worker to look up the %s decisions under the %s keys", scope, prefix)
+		}
+	}
+	// OTHER_SCOPE_DECISIONS is left to a custom worker
+	keys := []string{
+		VarNameForBanTemplate, BanTemplateByDomainKeyName, TurnstileConfigKey, IpRangeKeyName, AllowlistKeyName,
+		CountryAllowlistKeyName, ASDecisionsKeyName, ResponseConfigKeyName, SmokeTestKeyName, EnforcementKeyName,
+	}
+	for _, key := range keys {
+		if !strings.Contains(workerScript, `"`+key+`"`) {
+			t.Errorf("expected the worker to read %s", key)
+		}
+	}
+}
+
+// fakeAPI keeps the KV namespace in memory. Calls to methods which aren't overridden panic.
+type fakeAPI struct {
+	CloudflareAPI
+	lock   sync.Mutex
+	kv     map[string]string
+	calls  []string // cleanup calls, in order
+	writes []string // keys written to KV, in order
+
+	tokenPolicies []cf.APITokenPolicies
+	tailURL       string
+
+	d1Allowed        bool  // whether D1 databases can be created
+	d1QueryErr       error // error of D1 queries
+	uploadedBindings map[string]cf.WorkerBinding
+	uploadedScript   string
+	d1Listed         bool             // whether D1 databases were listed
+	deleteErr        error            // error of the cleanup deletions
+	widgetErrs       map[string]error // error of the turnstile widget creation, by domain
+	d1Queries        []cf.QueryD1DatabaseParams
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{kv: make(map[string]string)}
+}
+
+func (f *fakeAPI) WriteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.WriteWorkersKVEntriesParams) (cf.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, kv := range params.KVs {
+		f.kv[kv.Key] = kv.Value
+		f.writes = append(f.writes, kv.Key)
+	}
+	return cf.Response{Success: true}, nil
+}
+
+func (f *fakeAPI) DeleteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkersKVEntriesParams) (cf.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, key := range params.Keys {
+		delete(f.kv, key)
+	}
+	return cf.Response{Success: true}, nil
+}
+
+func (f *fakeAPI) ListWorkersKVKeys(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVsParams) (cf.ListStorageKeysResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resp := cf.ListStorageKeysResponse{}
+	for key := range f.kv {
+		resp.Result = append(resp.Result, cf.StorageKey{Name: key})
+	}
+	return resp, nil
+}
+
+func (f *fakeAPI) GetWorkersKV(ctx context.Context, rc *cf.ResourceContainer, params cf.GetWorkersKVParams) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	value, ok := f.kv[params.Key]
+	if !ok {
+		return nil, &cf.NotFoundError{}
+	}
+	return []byte(value), nil
+}
+
+func (f *fakeAPI) record(call string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeAPI) ListTurnstileWidgets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListTurnstileWidgetParams) ([]cf.TurnstileWidget, *cf.ResultInfo, error) {
+	return []cf.TurnstileWidget{{Name: WidgetName, SiteKey: "bouncer"}, {Name: "other", SiteKey: "other"}}, nil, nil
+}
+
+func (f *fakeAPI) DeleteTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, siteKey string) error {
+	f.record("widget:" + siteKey)
+	return f.deleteErr
+}
+
+func (f *fakeAPI) ListWorkerRoutes(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkerRoutesParams) (cf.WorkerRoutesResponse, error) {
+	return cf.WorkerRoutesResponse{Routes: []cf.WorkerRoute{{ID: rc.Identifier, ScriptName: "worker"}}}, nil
+}
+
+func (f *fakeAPI) DeleteWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, routeID string) (cf.WorkerRouteResponse, error) {
+	f.record("route:" + routeID)
+	return cf.WorkerRouteResponse{}, f.deleteErr
+}
+
+func (f *fakeAPI) DeleteWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkerParams) error {
+	if params.DispatchNamespace != nil {
+		f.record("worker:" + *params.DispatchNamespace + "/" + params.ScriptName)
+		return f.deleteErr
+	}
+	f.record("worker:" + params.ScriptName)
+	return f.deleteErr
+}
+
+func (f *fakeAPI) ListWorkersKVNamespaces(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVNamespacesParams) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error) {
+	return []cf.WorkersKVNamespace{{ID: "namespace", Title: "kv"}}, nil, nil
+}
+
+func (f *fakeAPI) DeleteWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, namespaceID string) (cf.Response, error) {
+	f.record("kv:" + namespaceID)
+	return cf.Response{Success: true}, f.deleteErr
+}
+
+func (f *fakeAPI) ListZones(ctx context.Context, z ...string) ([]cf.Zone, error) {
+	zones := make([]cf.Zone, 0)
+	for _, zone := range []struct{ id, name, account string }{
+		{"zone1", "one.com", "account"},
+		{"zone2", "two.com", "account"},
+		{"zone3", "excluded.com", "account"},
+		{"zone4", "norecords.com", "account"},
+		{"zone5", "other.com", "other"},
+	} {
+		zones = append(zones, cf.Zone{ID: zone.id, Name: zone.name, Account: cf.Account{ID: zone.account}})
+	}
+	return zones, nil
+}
+
+func (f *fakeAPI) ListDNSRecords(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDNSRecordsParams) ([]cf.DNSRecord, *cf.ResultInfo, error) {
+	if rc.Identifier == "zone4" {
+		return []cf.DNSRecord{{Type: "TXT"}}, nil, nil
+	}
+	return []cf.DNSRecord{{Type: "MX"}, {Type: "AAAA"}}, nil, nil
+}
+
+func (f *fakeAPI) CreateTurnstileWidget(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateTurnstileWidgetParams) (cf.TurnstileWidget, error) {
+	f.record("widget:" + params.Domains[0])
+	if err := f.widgetErrs[params.Domains[0]]; err != nil {
+		return cf.TurnstileWidget{}, err
+	}
+	return cf.TurnstileWidget{SiteKey: "site-" + params.Domains[0], Secret: "secret"}, nil
+}
+
+func (f *fakeAPI) UploadWorker(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerParams) (cf.WorkerScriptResponse, error) {
+	if params.DispatchNamespaceName != nil {
+		f.record("worker:" + *params.DispatchNamespaceName + "/" + params.ScriptName)
+	} else {
+		f.record("worker:" + params.ScriptName)
+	}
+	f.lock.Lock()
+	f.uploadedBindings = params.Bindings
+	f.uploadedScript = params.Script
+	f.lock.Unlock()
+	resp := cf.WorkerScriptResponse{}
+	resp.ID = params.ScriptName
+	return resp, nil
+}
+
+func (f *fakeAPI) GetWorker(ctx context.Context, rc *cf.ResourceContainer, scriptName string) (cf.WorkerScriptResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resp := cf.WorkerScriptResponse{}
+	resp.ID = scriptName
+	resp.Script = f.uploadedScript
+	return resp, nil
+}
+
+func (f *fakeAPI) CreateWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerRouteParams) (cf.WorkerRouteResponse, error) {
+	f.record("route:" + rc.Identifier + ":" + params.Pattern)
+	return cf.WorkerRouteResponse{}, nil
+}
+
+func (f *fakeAPI) CreateD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateD1DatabaseParams) (cf.D1Database, error) {
+	if !f.d1Allowed {
+		return cf.D1Database{}, errors.New("missing D1 permissions")
+	}
+	return cf.D1Database{UUID: "database", Name: params.Name}, nil
+}
+
+func (f *fakeAPI) ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.d1Listed = true
+	if !f.d1Allowed {
+		return nil, nil, errors.New("permission denied")
+	}
+	return nil, nil, nil
+}
+
+func (f *fakeAPI) QueryD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.QueryD1DatabaseParams) ([]cf.D1Result, error) {
+	f.lock.Lock()
+	f.d1Queries = append(f.d1Queries, params)
+	f.lock.Unlock()
+	return nil, f.d1QueryErr
+}
+
+func (f *fakeAPI) VerifyAPIToken(ctx context.Context) (cf.APITokenVerifyBody, error) {
+	return cf.APITokenVerifyBody{ID: "token", Status: "active"}, nil
+}
+
+func (f *fakeAPI) GetAPIToken(ctx context.Context, tokenID string) (cf.APIToken, error) {
+	return cf.APIToken{ID: tokenID, Policies: f.tokenPolicies}, nil
+}
+
+func (f *fakeAPI) Raw(ctx context.Context, method, endpoint string, data interface{}, headers http.Header) (cf.RawResponse, error) {
+	f.record(method + " " + endpoint)
+	return cf.RawResponse{Result: []byte(`{"id":"tail","url":"` + f.tailURL + `","expires_at":"2026-01-01T00:00:00Z"}`)}, nil
+}
+
+func (f *fakeAPI) keys() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]string, 0, len(f.kv))
+	for key := range f.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestManager(api CloudflareAPI) *CloudflareAccountManager {
+	return &CloudflareAccountManager{
+		AccountCfg:         cfg.AccountConfig{ID: "account", Name: "test"},
+		api:                api,
+		Ctx:                context.Background(),
+		logger:             log.WithFields(log.Fields{"account": "test"}),
+		ipRangeKVPair:      cf.WorkersKVPair{Key: IpRangeKeyName, Value: "{}"},
+		ActionByIPRange:    make(map[string]string),
+		asKVPair:           cf.WorkersKVPair{Key: ASDecisionsKeyName, Value: "{}"},
+		ActionByAS:         make(map[string]string),
+		otherScopeKVPair:   cf.WorkersKVPair{Key: OtherScopeDecisionsKeyName, Value: "{}"},
+		ActionByOtherScope: make(map[string]string),
+		Worker:             &cfg.CloudflareWorkerCreateParams{},
+		NamespaceID:        "namespace",
+	}
+}
+
+func newDecision(value string, scope string, action string) *models.Decision {
+	origin := "crowdsec"
+	scenario := "crowdsecurity/http-probing"
+	return &models.Decision{Value: &value, Scope: &scope, Type: &action, Origin: &origin, Scenario: &scenario}
+}
+
+func TestReconcileDecisions(t *testing.T) {
+	api := newFakeAPI()
+	api.kv[VarNameForBanTemplate] = "Access Denied"
+	api.kv["ip:5.6.7.8"] = "ban"     // stale
+	api.kv["ip:1.2.3.4"] = "ban"     // active, outdated action
+	api.kv["country:de"] = "captcha" // stale
+
+	m := newTestManager(api)
+	err := m.ReconcileDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "captcha"),
+		newDecision("9.9.9.9", "ip", "ban"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedKeys := []string{VarNameForBanTemplate, IpRangeKeyName, "ip:1.2.3.4", "ip:9.9.9.9"}
+	keys := api.keys()
+	if len(keys) != len(expectedKeys) {
+		t.Fatalf("expected keys %v, got %v", expectedKeys, keys)
+	}
+	for i := range keys {
+		if keys[i] != expectedKeys[i] {
+			t.Fatalf("expected keys %v, got %v", expectedKeys, keys)
+		}
+	}
+	if api.kv["ip:1.2.3.4"] != "captcha" {
+		t.Fatalf("expected action of 1.2.3.4 to be updated to captcha, got %s", api.kv["ip:1.2.3.4"])
+	}
+	if api.kv[IpRangeKeyName] != `{"10.0.0.0/8":"ban"}` {
+		t.Fatalf("unexpected ip ranges %s", api.kv[IpRangeKeyName])
+	}
+	if len(m.KVPairByDecisionValue) != 2 {
+		t.Fatalf("expected 2 cached decisions, got %d", len(m.KVPairByDecisionValue))
+	}
+}
+
+func TestJitteredInterval(t *testing.T) {
+	interval := time.Hour
+	if got := jitteredInterval(interval, 0); got != interval {
+		t.Fatalf("expected no jitter, got %s", got)
+	}
+	for i := 0; i < 1000; i++ {
+		got := jitteredInterval(interval, 10)
+		if got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("expected interval within 10%% of %s, got %s", interval, got)
+		}
+	}
+}
+
+func TestDiffModeLogOnly(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	decisions := []*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	}
+
+	SetDiffMode(DiffModeLogOnly)
+	t.Cleanup(func() { SetDiffMode(DiffModeOff) })
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if keys := api.keys(); len(keys) != 0 {
+		t.Fatalf("expected no keys to be written in log-only mode, got %v", keys)
+	}
+	if len(m.KVPairByDecisionValue) != 0 || len(m.ActionByIPRange) != 0 {
+		t.Fatalf("expected state to be left untouched in log-only mode")
+	}
+
+	SetDiffMode(DiffModeLog)
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv["ip:1.2.3.4"] != "ban" || api.kv[IpRangeKeyName] != `{"10.0.0.0/8":"ban"}` {
+		t.Fatalf("expected decisions to be applied in log mode, got %v", api.kv)
+	}
+
+	SetDiffMode(DiffModeLogOnly)
+	if err := m.ProcessDeletedDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; !ok {
+		t.Fatalf("expected 1.2.3.4 to be kept in log-only mode")
+	}
+	if len(m.KVPairByDecisionValue) != 1 || len(m.ActionByIPRange) != 1 {
+		t.Fatalf("expected state to be left untouched in log-only mode")
+	}
+}
+
+func TestActionFallback(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Actions: []string{"ban"}, DefaultAction: "ban", ActionFallback: map[string]string{"captcha": "ban"}},
+		{ID: "zone2", Actions: []string{"ban", "throttle"}, DefaultAction: "ban", ActionFallback: map[string]string{"captcha": "ban"}},
+	}
+
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "captcha")}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv["ip:1.2.3.4"] != "ban" {
+		t.Fatalf("expected captcha to fall back to ban, got %s", api.kv["ip:1.2.3.4"])
+	}
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "captcha")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; ok {
+		t.Fatalf("expected the fallback decision to be deleted")
+	}
+
+	// zones disagreeing on the fallback leave it to the worker
+	m.AccountCfg.ZoneConfigs[1].ActionFallback = map[string]string{"captcha": "throttle"}
+	if _, ok := m.fallbackAction("captcha"); ok {
+		t.Fatalf("expected no fallback when zones disagree")
+	}
+	// a zone supporting the action disables the fallback
+	m.AccountCfg.ZoneConfigs[1].Actions = append(m.AccountCfg.ZoneConfigs[1].Actions, "captcha")
+	m.AccountCfg.ZoneConfigs[1].ActionFallback = map[string]string{"captcha": "ban"}
+	if _, ok := m.fallbackAction("captcha"); ok {
+		t.Fatalf("expected no fallback when a zone supports the action")
+	}
+}
+
+func TestOriginActionOverrides(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Actions: []string{"ban", "captcha"}, DefaultAction: "ban"},
+		{ID: "zone2", Actions: []string{"captcha"}, DefaultAction: "captcha", ActionFallback: map[string]string{"throttle": "captcha"}},
+	}
+	m.AccountCfg.OriginActionOverrides = map[string]string{"cscli": "ban", "lists": "throttle"}
+
+	manual := newDecision("1.2.3.4", "ip", "captcha")
+	*manual.Origin = "cscli"
+	listed := newDecision("5.6.7.8", "ip", "ban")
+	*listed.Origin = "lists"
+	if err := m.ProcessNewDecisions([]*models.Decision{manual, listed, newDecision("9.9.9.9", "ip", "captcha")}); err != nil {
+		t.Fatal(err)
+	}
+	// zone1 doesn't fall back from throttle, the worker applies the default action of each zone
+	if api.kv["ip:1.2.3.4"] != "ban" || api.kv["ip:5.6.7.8"] != "throttle" || api.kv["ip:9.9.9.9"] != "captcha" {
+		t.Fatalf("unexpected actions %v", api.kv)
+	}
+
+	// both zones falling back from throttle, the fallback applies to the overridden action
+	m.AccountCfg.ZoneConfigs[0].ActionFallback = map[string]string{"throttle": "captcha"}
+	if err := m.ProcessNewDecisions([]*models.Decision{listed}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv["ip:5.6.7.8"] != "captcha" {
+		t.Fatalf("expected throttle to fall back to captcha, got %s", api.kv["ip:5.6.7.8"])
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{manual, listed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; ok {
+		t.Fatalf("expected the overridden decision to be deleted")
+	}
+	if _, ok := api.kv["ip:5.6.7.8"]; ok {
+		t.Fatalf("expected the overridden decision falling back to be deleted")
+	}
+}
+
+func TestMaxKVKeys(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	// the ActionsByDomain key leaves room for 3 decisions
+	m.AccountCfg.MaxKVKeys = 4
+
+	withDuration := func(decision *models.Decision, duration string) *models.Decision {
+		decision.Duration = &duration
+		return decision
+	}
+	err := m.ProcessNewDecisions([]*models.Decision{
+		withDuration(newDecision("1.1.1.1", "ip", "ban"), "1h"),
+		newDecision("2.2.2.2", "ip", "captcha"),
+		withDuration(newDecision("3.3.3.3", "ip", "throttle"), "4h"),
+		withDuration(newDecision("4.4.4.4", "ip", "ban"), "4h"),
+		withDuration(newDecision("5.5.5.5", "ip", "captcha"), "1h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.KVPairByDecisionValue) != 3 || api.kv["ip:1.1.1.1"] != "ban" || api.kv["ip:4.4.4.4"] != "ban" || api.kv["ip:2.2.2.2"] != "captcha" {
+		t.Fatalf("expected the bans and the captcha which never expires to be kept, got %v", api.kv)
+	}
+	if got := testutil.ToFloat64(metrics.ShedDecisions.WithLabelValues("captcha", "test")); got != 1 {
+		t.Fatalf("expected 1 shed captcha, got %f", got)
+	}
+
+	// the decisions already written are kept over the new ones
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("6.6.6.6", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv["ip:6.6.6.6"]; ok || len(m.KVPairByDecisionValue) != 3 {
+		t.Fatalf("expected the new decision to be shed, got %v", api.kv)
+	}
+	// updating a decision doesn't add a key
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("2.2.2.2", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv["ip:2.2.2.2"] != "ban" {
+		t.Fatalf("expected the decision to be updated, got %s", api.kv["ip:2.2.2.2"])
+	}
+}
+
+func TestCleanUpExistingWorkersOrder(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.cleanupConcurrency = 2
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	for _, zoneID := range []string{"zone1", "zone2", "zone3"} {
+		m.AccountCfg.ZoneConfigs = append(m.AccountCfg.ZoneConfigs, &cfg.ZoneConfig{ID: zoneID})
+	}
+
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 7 {
+		t.Fatalf("unexpected cleanup calls %v", api.calls)
+	}
+	// widgets and routes are deleted in any order, but always before the workers, themselves deleted before KV
+	first := append([]string{}, api.calls[:4]...)
+	sort.Strings(first)
+	expectedFirst := []string{"route:zone1", "route:zone2", "route:zone3", "widget:bouncer"}
+	for i := range expectedFirst {
+		if first[i] != expectedFirst[i] {
+			t.Fatalf("unexpected cleanup calls %v", api.calls)
+		}
+	}
+	if api.calls[4] != "worker:worker" || api.calls[5] != "worker:worker-observer" || api.calls[6] != "kv:namespace" {
+		t.Fatalf("unexpected cleanup calls %v", api.calls)
+	}
+}
+
+func TestProtectNewZones(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban"}}
+	m.AccountCfg.AutoProtectNewZones = cfg.AutoProtectConfig{
+		Enabled:       true,
+		ExcludedZones: []string{"excluded.com"},
+		Template: &cfg.ZoneConfig{
+			Actions:         []string{"captcha"},
+			DefaultAction:   "captcha",
+			RoutesToProtect: []string{"{zone}/login*"},
+			Turnstile:       cfg.TurnstileConfig{Enabled: true, Mode: "managed"},
+		},
+	}
+
+	g := &errgroup.Group{}
+	if err := m.protectNewZones(context.Background(), g); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	zones := m.zones()
+	if len(zones) != 2 || zones[1].ID != "zone2" || zones[1].Domain != "two.com" {
+		t.Fatalf("expected only zone2 to be protected, got %+v", zones)
+	}
+	expectedCalls := []string{"widget:two.com", "worker:worker", "route:zone2:two.com/login*"}
+	if len(api.calls) != len(expectedCalls) {
+		t.Fatalf("expected calls %v, got %v", expectedCalls, api.calls)
+	}
+	for i := range expectedCalls {
+		if api.calls[i] != expectedCalls[i] {
+			t.Fatalf("expected calls %v, got %v", expectedCalls, api.calls)
+		}
+	}
+	if api.kv[TurnstileConfigKey] != `{"two.com":{"site_key":"site-two.com","secret":"secret"}}` {
+		t.Fatalf("unexpected turnstile config %s", api.kv[TurnstileConfigKey])
+	}
+
+	// known zones aren't protected twice
+	api.calls = nil
+	if err := m.protectNewZones(context.Background(), g); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.calls) != 0 {
+		t.Fatalf("expected no call, got %v", api.calls)
+	}
+}
+
+func TestResumeFromCache(t *testing.T) {
+	cachePath := t.TempDir()
+	api := newFakeAPI()
+	newManager := func() *CloudflareAccountManager {
+		m := newTestManager(api)
+		m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+		return m
+	}
+
+	m := newManager()
+	if err := m.ProcessNewDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("5.6.7.8", "ip", "ban"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newManager()
+	resumed, err := m.ResumeFromCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatalf("expected the infra to be resumed from cache")
+	}
+	if m.NamespaceID != "namespace" || len(m.KVPairByDecisionValue) != 2 || m.ActionByIPRange["10.0.0.0/8"] != "ban" {
+		t.Fatalf("unexpected state restored from cache")
+	}
+
+	api.writes = nil
+	if err := m.ReconcileDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("9.9.9.9", "ip", "captcha"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// only the new decision is written, the cached ones are kept as is
+	if len(api.writes) != 1 || api.writes[0] != "ip:9.9.9.9" {
+		t.Fatalf("expected only 9.9.9.9 to be written, got %v", api.writes)
+	}
+	if _, ok := api.kv["ip:5.6.7.8"]; ok {
+		t.Fatalf("expected expired decision 5.6.7.8 to be deleted")
+	}
+
+	// a cache pointing to a namespace which no longer exists isn't used
+	m.NamespaceID = "gone"
+	if err := m.SaveCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	m = newManager()
+	resumed, err = m.ResumeFromCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed || len(m.KVPairByDecisionValue) != 0 {
+		t.Fatalf("expected the cache of a deleted namespace to be ignored")
+	}
+}
+
+func TestLoadFromKV(t *testing.T) {
+	api := newFakeAPI()
+	api.kv[VarNameForBanTemplate] = "Access Denied"
+	api.kv[TurnstileConfigKey] = "{}"
+	api.kv[IpRangeKeyName] = `{"10.0.0.0/8":"ban"}`
+	api.kv["ip:1.2.3.4"] = "ban"
+	api.kv["ip:5.6.7.8"] = "captcha"
+
+	m := newTestManager(api)
+	// stale cache restored from disk
+	m.KVPairByDecisionValue = map[string]cf.WorkersKVPair{"ip:9.9.9.9": {Key: "ip:9.9.9.9", Value: "ban"}}
+	if err := m.LoadFromKV(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]cf.WorkersKVPair{
+		"ip:1.2.3.4": {Key: "ip:1.2.3.4", Value: "ban"},
+		"ip:5.6.7.8": {Key: "ip:5.6.7.8", Value: "captcha"},
+	}
+	if !maps.Equal(m.KVPairByDecisionValue, expected) {
+		t.Fatalf("expected %v, got %v", expected, m.KVPairByDecisionValue)
+	}
+	if len(m.ActionByIPRange) != 1 || m.ActionByIPRange["10.0.0.0/8"] != "ban" || !m.hasIPRangeKV {
+		t.Fatalf("unexpected IP ranges loaded from KV: %v", m.ActionByIPRange)
+	}
+
+	api.writes = nil
+	if err := m.ReconcileDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("5.6.7.8", "ip", "captcha"),
+		newDecision("10.0.0.0/8", "range", "ban"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the decisions already at the edge aren't written again
+	if len(api.writes) != 0 {
+		t.Fatalf("expected no write, got %v", api.writes)
+	}
+
+	// hashed keys are only matched against the restored cache
+	m = newTestManager(api)
+	m.Worker.DecisionHashing = cfg.DecisionHashingConfig{Enabled: true, Salt: "salt"}
+	key := m.kvKeyForValue("ip:1.2.3.4")
+	api.kv[key] = "captcha"
+	m.KVPairByDecisionValue = map[string]cf.WorkersKVPair{
+		"ip:1.2.3.4": {Key: key, Value: "ban"},
+		"ip:9.9.9.9": {Key: m.kvKeyForValue("ip:9.9.9.9"), Value: "ban"},
+	}
+	if err := m.LoadFromKV(); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]cf.WorkersKVPair{"ip:1.2.3.4": {Key: key, Value: "captcha"}}
+	if !maps.Equal(m.KVPairByDecisionValue, expected) {
+		t.Fatalf("expected %v, got %v", expected, m.KVPairByDecisionValue)
+	}
+}
+
+func TestAttachExistingInfra(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	if err := m.AttachExistingInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if m.NamespaceID != "namespace" || m.DatabaseID != "existing" || !m.hasD1Access {
+		t.Fatalf("expected the existing KV namespace and D1 DB to be found, got %q and %q", m.NamespaceID, m.DatabaseID)
+	}
+	if len(api.calls) != 0 || len(api.writes) != 0 {
+		t.Fatalf("expected nothing to be changed, got calls %v and writes %v", api.calls, api.writes)
+	}
+
+	m.Worker.D1DBName = "missing"
+	if err := m.AttachExistingInfra(); err == nil || !strings.Contains(err.Error(), "D1 DB missing not found") {
+		t.Fatalf("expected an error without the D1 DB, got %v", err)
+	}
+	m.AccountCfg.DisableD1 = true
+	if err := m.AttachExistingInfra(); err == nil {
+		t.Fatal("expected an error with D1 disabled")
+	}
+}
+
+func TestAdoptExistingInfra(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	api.kv[IpRangeKeyName] = `{"10.0.0.0/8":"ban"}`
+	api.kv["ip:1.2.3.4"] = "ban"
+	newManager := func(kvNamespace string) *CloudflareAccountManager {
+		m := newTestManager(api)
+		m.NamespaceID = ""
+		m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: kvNamespace, D1DBName: "db"}
+		m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}}}
+		return m
+	}
+
+	m := newManager("kv")
+	adopted, err := m.AdoptExistingInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adopted {
+		t.Fatal("expected the existing infra to be adopted")
+	}
+	if m.NamespaceID != "namespace" || m.DatabaseID != "existing" || !m.hasD1Access {
+		t.Fatalf("expected the existing KV namespace and D1 DB to be reused, got %q and %q", m.NamespaceID, m.DatabaseID)
+	}
+	if len(m.KVPairByDecisionValue) != 1 || m.ActionByIPRange["10.0.0.0/8"] != "ban" {
+		t.Fatalf("expected the decisions to be loaded from KV, got %v and %v", m.KVPairByDecisionValue, m.ActionByIPRange)
+	}
+	if !slices.Contains(api.calls, "worker:worker") || !slices.Contains(api.calls, "route:zone1:*one.com/*") {
+		t.Fatalf("expected the worker to be uploaded again and bound to the routes, got %v", api.calls)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; !ok {
+		t.Fatal("expected the decisions to be kept in KV")
+	}
+
+	m = newManager("missing")
+	adopted, err = m.AdoptExistingInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted {
+		t.Fatal("expected nothing to be adopted without a KV namespace")
+	}
+}
+
+func TestDeferCleanUp(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	api.kv["ip:1.2.3.4"] = "ban"
+	newManager := func() *CloudflareAccountManager {
+		m := newTestManager(api)
+		m.NamespaceID = ""
+		m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+		return m
+	}
+
+	// a restart within the grace period adopts the infra and forgets the deadline
+	if err := newTestManager(api).DeferCleanUp(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !isReservedKVKey(CleanupDeadlineKeyName) {
+		t.Fatalf("expected %s to be reserved", CleanupDeadlineKeyName)
+	}
+	adopted, err := newManager().AdoptExistingInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adopted {
+		t.Fatal("expected the infra to be adopted within the grace period")
+	}
+	if _, ok := api.kv[CleanupDeadlineKeyName]; ok {
+		t.Fatal("expected the cleanup deadline to be deleted once the infra is adopted")
+	}
+
+	// a later start rebuilds it
+	if err := newTestManager(api).DeferCleanUp(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	m := newManager()
+	adopted, err = m.AdoptExistingInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted || m.NamespaceID != "" {
+		t.Fatal("expected the infra left in place past the grace period not to be adopted")
+	}
+}
+
+func TestMissingTokenPermissions(t *testing.T) {
+	groups := func(names ...string) []cf.APITokenPermissionGroups {
+		permissionGroups := make([]cf.APITokenPermissionGroups, 0, len(names))
+		for _, name := range names {
+			permissionGroups = append(permissionGroups, cf.APITokenPermissionGroups{Name: name})
+		}
+		return permissionGroups
+	}
+
+	api := newFakeAPI()
+	api.tokenPolicies = []cf.APITokenPolicies{
+		{Effect: "allow", PermissionGroups: groups("Workers Scripts Write", "Workers KV Storage Write", "D1 Write")},
+		{Effect: "allow", PermissionGroups: groups("Workers Routes Write", "Zone Read")},
+		{Effect: "deny", PermissionGroups: groups("D1 Write")},
+	}
+	missing, err := missingTokenPermissions(context.Background(), api, RequiredTokenPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(missing, []string{"D1 Write", "Turnstile Sites Write"}) {
+		t.Fatalf("unexpected missing permissions %v", missing)
+	}
+
+	api.tokenPolicies = []cf.APITokenPolicies{{Effect: "allow", PermissionGroups: groups(RequiredTokenPermissions...)}}
+	missing, err = missingTokenPermissions(context.Background(), api, RequiredTokenPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing permission, got %v", missing)
+	}
+}
+
+func TestDisableD1(t *testing.T) {
+	api := &flakyKVNamespaceAPI{fakeAPI: newFakeAPI()}
+	api.d1Allowed = true
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.AccountCfg.DisableD1 = true
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if m.hasD1Access || m.DatabaseID != "" {
+		t.Fatalf("expected no D1 DB, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+	if _, ok := api.uploadedBindings["db"]; ok {
+		t.Fatalf("expected the worker not to be bound to a D1 DB, got %v", api.uploadedBindings)
+	}
+	if err := m.CleanUpExistingWorkers(true); err != nil {
+		t.Fatal(err)
+	}
+	if api.d1Listed {
+		t.Fatal("expected the D1 DBs not to be listed")
+	}
+
+	// D1 Write isn't required then
+	required := requiredTokenPermissions(m.AccountCfg, m.Worker)
+	if slices.Contains(required, "D1 Write") || len(required) != len(RequiredTokenPermissions)-1 {
+		t.Fatalf("unexpected required permissions %v", required)
+	}
+	if !slices.Contains(RequiredTokenPermissions, "D1 Write") {
+		t.Fatal("expected the required permissions to be left untouched")
+	}
+}
+
+func TestWorkerInfo(t *testing.T) {
+	api := &flakyKVNamespaceAPI{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.AccountCfg.Name = "worker-info-test"
+	m.AccountCfg.DisableD1 = true
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+
+	version := WorkerScriptVersion()
+	if len(version) != 12 || version != WorkerScriptVersion() {
+		t.Fatalf("unexpected version %q", version)
+	}
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if value := testutil.ToFloat64(metrics.WorkerInfo.WithLabelValues(version, "worker-info-test")); value != 1 {
+		t.Fatalf("expected the worker info to be 1, got %f", value)
+	}
+	if api.uploadedScript != workerScript {
+		t.Fatal("expected the embedded script to be uploaded")
+	}
+}
+
+func TestActiveDecisionsScenarioLabel(t *testing.T) {
+	metrics.SetScenarioLabelLimit(1)
+	t.Cleanup(func() { metrics.SetScenarioLabelLimit(0) })
+
+	withScenario := func(decision *models.Decision, scenario string) *models.Decision {
+		decision.Scenario = &scenario
+		return decision
+	}
+	activeDecisions := func(scenario string) float64 {
+		return testutil.ToFloat64(metrics.TotalActiveDecisions.WithLabelValues("crowdsec", "ipv4", "ip", scenario, "scenario-test"))
+	}
+
+	m := newTestManager(newFakeAPI())
+	m.AccountCfg.Name = "scenario-test"
+	if err := m.ProcessNewDecisions([]*models.Decision{
+		withScenario(newDecision("1.2.3.4", "ip", "ban"), "crowdsecurity/ssh-bf"),
+		withScenario(newDecision("5.6.7.8", "ip", "ban"), "crowdsecurity/http-probing"),
+		withScenario(newDecision("9.9.9.9", "ip", "ban"), "crowdsecurity/http-crawl"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count := activeDecisions("crowdsecurity/ssh-bf"); count != 1 {
+		t.Fatalf("expected 1 active decision for crowdsecurity/ssh-bf, got %f", count)
+	}
+	// scenarios over the limit share the same label
+	if count := activeDecisions(metrics.OtherScenarioLabel); count != 2 {
+		t.Fatalf("expected 2 active decisions for other scenarios, got %f", count)
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{
+		withScenario(newDecision("5.6.7.8", "ip", "ban"), "crowdsecurity/http-probing"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count := activeDecisions(metrics.OtherScenarioLabel); count != 1 {
+		t.Fatalf("expected 1 active decision for other scenarios, got %f", count)
+	}
+}
+
+func TestTailWorker(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		var filters map[string]any
+		if err := websocket.JSON.Receive(conn, &filters); err != nil {
+			return
+		}
+		for _, event := range []string{
+			`{"outcome":"ok","logs":[{"level":"log","message":["banned","1.2.3.4"]}]}`,
+			`not json`,
+			`{"outcome":"exception","exceptions":[{"name":"Error","message":"boom"}]}`,
+		} {
+			if err := websocket.Message.Send(conn, event); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	api := newFakeAPI()
+	api.tailURL = "ws" + strings.TrimPrefix(server.URL, "http")
+	m := newTestManager(api)
+	m.AccountCfg.Name = "tail-test"
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker"}
+
+	// a single slot, the last event is dropped as nothing reads the buffer
+	events := make(chan tailEvent, 1)
+	if err := m.tailWorker(context.Background(), events); err == nil {
+		t.Fatalf("expected the tail session to end with an error")
+	}
+	event := <-events
+	if event.Outcome != "ok" || len(event.Logs) != 1 || event.Logs[0].Message[1] != "1.2.3.4" {
+		t.Fatalf("unexpected tail event %+v", event)
+	}
+	if count := testutil.ToFloat64(metrics.DroppedWorkerTailEvents.WithLabelValues("tail-test")); count != 1 {
+		t.Fatalf("expected 1 dropped tail event, got %f", count)
+	}
+	expectedCalls := []string{"POST /accounts/account/workers/scripts/worker/tails", "DELETE /accounts/account/workers/scripts/worker/tails/tail"}
+	if !slices.Equal(api.calls, expectedCalls) {
+		t.Fatalf("expected calls %v, got %v", expectedCalls, api.calls)
+	}
+}
+
+func TestCreateD1DatabaseTableDenied(t *testing.T) {
+	api := newFakeAPI()
+	api.d1Allowed = true
+	api.d1QueryErr = errors.New("permission denied")
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	if err := m.createD1Database(); err != nil {
+		t.Fatalf("expected a failed table creation to be tolerated, got %s", err)
+	}
+	if m.hasD1Access || m.DatabaseID != "" {
+		t.Fatalf("expected D1 access to be disabled, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.uploadedBindings["db"]; ok {
+		t.Fatalf("expected the worker to be uploaded without the D1 binding")
+	}
+
+	// the DB is kept when its table is created
+	api.d1QueryErr = nil
+	if err := m.createD1Database(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasD1Access || m.DatabaseID != "database" {
+		t.Fatalf("expected D1 access, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+}
+
+// longestPrefixAction returns the action of the most specific range containing ip, like the worker.
+func longestPrefixAction(actionByIPRange map[string]string, ip netip.Addr) string {
+	action, bits := "", -1
+	for ipRange, rangeAction := range actionByIPRange {
+		prefix := netip.MustParsePrefix(ipRange)
+		if prefix.Contains(ip) && prefix.Bits() > bits {
+			action, bits = rangeAction, prefix.Bits()
+		}
+	}
+	return action
+}
+
+func TestAggregateIPRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "siblings of the same action are merged",
+			ranges:   map[string]string{"2001:db8::/65": "ban", "2001:db8:0:0:8000::/65": "ban", "10.0.0.0/25": "ban", "10.0.0.128/25": "ban"},
+			expected: map[string]string{"2001:db8::/64": "ban", "10.0.0.0/24": "ban"},
+		},
+		{
+			name:     "siblings of different actions are kept",
+			ranges:   map[string]string{"10.0.0.0/25": "ban", "10.0.0.128/25": "captcha"},
+			expected: map[string]string{"10.0.0.0/25": "ban", "10.0.0.128/25": "captcha"},
+		},
+		{
+			name:     "contained range of the same action is dropped",
+			ranges:   map[string]string{"2001:db8::/48": "ban", "2001:db8:0:1::/64": "ban", "2001:db8:0:2::/64": "captcha"},
+			expected: map[string]string{"2001:db8::/48": "ban", "2001:db8:0:2::/64": "captcha"},
+		},
+		{
+			name:     "a range fully shadowed by its subranges takes their action",
+			ranges:   map[string]string{"10.0.0.0/24": "captcha", "10.0.0.0/25": "ban", "10.0.0.128/25": "ban"},
+			expected: map[string]string{"10.0.0.0/24": "ban"},
+		},
+		{
+			name:     "partial coverage isn't merged",
+			ranges:   map[string]string{"2001:db8:0:1::/64": "ban", "2001:db8:0:2::/64": "ban"},
+			expected: map[string]string{"2001:db8:0:1::/64": "ban", "2001:db8:0:2::/64": "ban"},
+		},
+		{
+			name:     "merges cascade and non canonical ranges are masked",
+			ranges:   map[string]string{"10.0.0.1/26": "ban", "10.0.0.64/26": "ban", "10.0.0.128/25": "ban", "1.2.3.4/32": "ban"},
+			expected: map[string]string{"10.0.0.0/24": "ban", "1.2.3.4/32": "ban"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregated := aggregateIPRanges(tt.ranges)
+			if !maps.Equal(aggregated, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, aggregated)
+			}
+		})
+	}
+}
+
+func TestAggregateIPRangesKeepsActions(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	actions := []string{"ban", "captcha"}
+	actionByIPRange := make(map[string]string)
+	for range 500 {
+		ip := netip.AddrFrom4([4]byte{10, byte(rnd.IntN(4)), byte(rnd.IntN(256)), byte(rnd.IntN(256))})
+		prefix, _ := ip.Prefix(18 + rnd.IntN(15))
+		actionByIPRange[prefix.String()] = actions[rnd.IntN(len(actions))]
+	}
+	aggregated := aggregateIPRanges(actionByIPRange)
+	if len(aggregated) >= len(actionByIPRange) {
+		t.Fatalf("expected fewer ranges after aggregation, got %d from %d", len(aggregated), len(actionByIPRange))
+	}
+	for range 5000 {
+		ip := netip.AddrFrom4([4]byte{10, byte(rnd.IntN(5)), byte(rnd.IntN(256)), byte(rnd.IntN(256))})
+		if expected, got := longestPrefixAction(actionByIPRange, ip), longestPrefixAction(aggregated, ip); expected != got {
+			t.Fatalf("action of %s changed from %q to %q", ip, expected, got)
+		}
+	}
+}
+
+// BenchmarkAggregateIPRanges reports the size of the IP_RANGES payload before and after aggregation for
+// an account with every /64 of a /52 banned, and a few /128 inside them.
+func BenchmarkAggregateIPRanges(b *testing.B) {
+	actionByIPRange := make(map[string]string)
+	base := netip.MustParseAddr("2001:db8::").As16()
+	for i := range 4096 {
+		addr := base
+		addr[6], addr[7] = byte(i>>8), byte(i)
+		actionByIPRange[netip.PrefixFrom(netip.AddrFrom16(addr), 64).String()] = "ban"
+		if i%16 == 0 {
+			addr[15] = 1
+			actionByIPRange[netip.PrefixFrom(netip.AddrFrom16(addr), 128).String()] = "ban"
+		}
+	}
+	raw, _ := json.Marshal(actionByIPRange)
+	var aggregated map[string]string
+	b.ResetTimer()
+	for range b.N {
+		aggregated = aggregateIPRanges(actionByIPRange)
+	}
+	b.StopTimer()
+	payload, _ := json.Marshal(aggregated)
+	b.ReportMetric(float64(len(raw)), "raw-bytes")
+	b.ReportMetric(float64(len(payload)), "aggregated-bytes")
+}
+
+func TestActionsForZoneSchedule(t *testing.T) {
+	zones := []*cfg.ZoneConfig{{
+		Domain:        "example.com",
+		Actions:       []string{"ban"},
+		DefaultAction: "ban",
+		Schedule: &cfg.EnforcementScheduleConfig{
+			Windows: []cfg.ScheduleWindow{{Days: []string{"sun", "Fri"}, Start: "22:00", End: "06:30"}},
+		},
+	}}
+	data, err := actionsForZoneByDomain(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actionsByDomain map[string]ActionsForZone
+	if err := json.Unmarshal(data, &actionsByDomain); err != nil {
+		t.Fatal(err)
+	}
+	schedule := actionsByDomain["example.com"].Schedule
+	if schedule == nil || schedule.Timezone != "UTC" || len(schedule.Windows) != 1 {
+		t.Fatalf("unexpected schedule %+v", schedule)
+	}
+	window := schedule.Windows[0]
+	if !slices.Equal(window.Days, []int{0, 5}) || window.Start != 22*60 || window.End != 6*60+30 {
+		t.Fatalf("unexpected schedule window %+v", window)
+	}
+}
+
+func TestActionsForZoneLogOnly(t *testing.T) {
+	enforce := false
+	zones := []*cfg.ZoneConfig{
+		{Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", Enforce: &enforce},
+		{Domain: "two.com", Actions: []string{"ban"}, DefaultAction: "ban"},
+	}
+	data, err := actionsForZoneByDomain(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actionsByDomain map[string]ActionsForZone
+	if err := json.Unmarshal(data, &actionsByDomain); err != nil {
+		t.Fatal(err)
+	}
+	if !actionsByDomain["one.com"].LogOnly || actionsByDomain["two.com"].LogOnly {
+		t.Fatalf("expected only the zone which isn't enforced to be log-only, got %+v", actionsByDomain)
+	}
+}
+
+func TestDispatchNamespace(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", DispatchNamespace: "tenants"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", RoutesToProtect: []string{"one.com/*"}}}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	// the dispatch worker of the namespace routes the requests, no route is bound to the worker
+	if !slices.Equal(api.calls, []string{"worker:tenants/worker"}) {
+		t.Fatalf("expected the worker to be uploaded to the dispatch namespace only, got %v", api.calls)
+	}
+
+	api.calls = nil
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(api.calls, "worker:tenants/worker") {
+		t.Fatalf("expected the worker to be deleted from the dispatch namespace, got %v", api.calls)
+	}
+}
+
+func TestCleanUpAlreadyDeleted(t *testing.T) {
+	requestErr := func(code int) error {
+		err := cf.NewRequestError(&cf.Error{StatusCode: http.StatusBadRequest, ErrorCodes: []int{code}})
+		return &err
+	}
+	notFoundErr := cf.NewNotFoundError(&cf.Error{StatusCode: http.StatusNotFound})
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "not found", err: &notFoundErr},
+		{name: "worker not found code", err: requestErr(10007)},
+		{name: "wrapped KV namespace not found code", err: fmt.Errorf("wrapped: %w", requestErr(10013))},
+		{name: "other request error", err: requestErr(10000), wantErr: true},
+		{name: "other error", err: errors.New("boom"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeAPI()
+			api.deleteErr = tt.err
+			m := newTestManager(api)
+			m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+			m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1"}}
+
+			err := m.CleanUpExistingWorkers(false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected resources deleted by someone else to be ignored, got %s", err)
+			}
+			if len(api.calls) != 5 {
+				t.Fatalf("expected every resource to be deleted, got %v", api.calls)
+			}
+		})
+	}
+}
+
+func TestCountryAllowlist(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", CountryAllowlist: []string{"FR", "BE"}},
+		{ID: "zone2", Domain: "two.com", Actions: []string{"ban"}, DefaultAction: "ban", CountryAllowlist: []string{"FR"}},
+	}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv[CountryAllowlistKeyName] != `{"one.com":["FR","BE"],"two.com":["FR"]}` {
+		t.Fatalf("unexpected country allowlist %s", api.kv[CountryAllowlistKeyName])
+	}
+
+	if err := m.ProcessNewDecisions([]*models.Decision{
+		newDecision("FR", "country", "ban"),
+		newDecision("BE", "country", "ban"),
+		newDecision("CN", "country", "ban"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// FR is allowlisted by every zone, BE is still needed by two.com
+	if _, ok := api.kv["country:FR"]; ok {
+		t.Fatalf("expected the decision of an allowlisted country to be skipped")
+	}
+	if api.kv["country:BE"] != "ban" || api.kv["country:CN"] != "ban" {
+		t.Fatalf("expected the decisions of other countries to be written, got %v", api.kv)
+	}
+}
+
+func TestDebouncedIPRanges(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker.IPRangesCommitInterval = 10 * time.Millisecond
+	countWrites := func() int {
+		api.lock.Lock()
+		defer api.lock.Unlock()
+		return len(slices.DeleteFunc(slices.Clone(api.writes), func(key string) bool { return key != IpRangeKeyName }))
+	}
+
+	for _, ipRange := range []string{"10.0.0.0/8", "192.168.0.0/16"} {
+		if err := m.ProcessNewDecisions([]*models.Decision{newDecision(ipRange, "range", "ban")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writes := countWrites(); writes != 0 {
+		t.Fatalf("expected the IP ranges not to be written before the flush, got %d writes", writes)
+	}
+	if err := m.FlushIPRanges(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := countWrites(); writes != 1 || !strings.Contains(api.kv[IpRangeKeyName], "192.168.0.0/16") {
+		t.Fatalf("expected the changes to be written at once, got %d writes of %s", writes, api.kv[IpRangeKeyName])
+	}
+	if err := m.FlushIPRanges(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := countWrites(); writes != 1 {
+		t.Fatalf("expected nothing to be written without changes, got %d writes", writes)
+	}
+
+	// the flusher writes the pending changes until the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Ctx = ctx
+	done := make(chan error)
+	go func() {
+		done <- m.FlushIPRangesPeriodically()
+	}()
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("10.0.0.0/8", "range", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); countWrites() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the flusher to write the IP ranges")
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if strings.Contains(api.kv[IpRangeKeyName], "10.0.0.0/8") {
+		t.Fatalf("expected the deleted range to be removed, got %s", api.kv[IpRangeKeyName])
+	}
+}
+
+// TestDebouncedIPRangesConcurrentDecisions is meant to be run with -race, the flusher reading the IP
+// ranges while the new decisions replace them.
+func TestDebouncedIPRangesConcurrentDecisions(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker.IPRangesCommitInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Ctx = ctx
+	done := make(chan error)
+	go func() {
+		done <- m.FlushIPRangesPeriodically()
+	}()
+	for i := range 50 {
+		decision := newDecision(fmt.Sprintf("10.%d.0.0/16", 2*i), "range", "ban")
+		if err := m.ProcessNewDecisions([]*models.Decision{decision}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FlushIPRanges(); err != nil {
+		t.Fatal(err)
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if !strings.Contains(api.kv[IpRangeKeyName], "10.98.0.0/16") {
+		t.Fatalf("expected every range to be written, got %s", api.kv[IpRangeKeyName])
+	}
+}
+
+func TestKVPayloadBytes(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Name = "payload-test"
+	if err := m.ProcessNewDecisions([]*models.Decision{
+		newDecision("1.2.3.4", "ip", "ban"),
+		newDecision("10.0.0.0/8", "range", "captcha"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if size := testutil.ToFloat64(metrics.KVPayloadBytes.WithLabelValues("payload-test", metrics.DecisionsPayloadKey)); size != float64(len("ip:1.2.3.4")+len("ban")) {
+		t.Fatalf("unexpected decisions payload size %f", size)
+	}
+	if size := testutil.ToFloat64(metrics.KVPayloadBytes.WithLabelValues("payload-test", IpRangeKeyName)); size != float64(len(api.kv[IpRangeKeyName])) {
+		t.Fatalf("unexpected IP ranges payload size %f", size)
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if size := testutil.ToFloat64(metrics.KVPayloadBytes.WithLabelValues("payload-test", metrics.DecisionsPayloadKey)); size != 0 {
+		t.Fatalf("expected the decisions payload to be empty, got %f", size)
+	}
+}
+
+// routeConcurrencyAPI tracks the max number of routes created concurrently.
+type routeConcurrencyAPI struct {
+	*fakeAPI
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (f *routeConcurrencyAPI) CreateWorkerRoute(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkerRouteParams) (cf.WorkerRouteResponse, error) {
+	inFlight := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		maxInFlight := f.maxInFlight.Load()
+		if inFlight <= maxInFlight || f.maxInFlight.CompareAndSwap(maxInFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return f.fakeAPI.CreateWorkerRoute(ctx, rc, params)
+}
+
+func TestRouteConcurrency(t *testing.T) {
+	api := &routeConcurrencyAPI{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.routeConcurrency = 3
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	for _, zoneID := range []string{"zone1", "zone2", "zone3", "zone4"} {
+		m.AccountCfg.ZoneConfigs = append(m.AccountCfg.ZoneConfigs, &cfg.ZoneConfig{
+			ID:              zoneID,
+			Domain:          zoneID + ".com",
+			RoutesToProtect: []string{zoneID + ".com/a/*", zoneID + ".com/b/*", zoneID + ".com/c/*"},
+		})
+	}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	routes := 0
+	for _, call := range api.calls {
+		if strings.HasPrefix(call, "route:") {
+			routes++
+		}
+	}
+	if routes != 12 {
+		t.Fatalf("expected 12 routes to be created, got %v", api.calls)
+	}
+	if maxInFlight := api.maxInFlight.Load(); maxInFlight > 3 {
+		t.Fatalf("expected at most 3 routes to be created concurrently, got %d", maxInFlight)
+	}
+}
+
+func TestObserveRoutes(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "DB"}
+	m.DatabaseID = "database"
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", RoutesToProtect: []string{"one.com/app/*"}, ObserveRoutes: []string{"one.com/*"}},
+		{ID: "zone2", Domain: "two.com", RoutesToProtect: []string{"two.com/*"}},
+	}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	calls := slices.Clone(api.calls)
+	sort.Strings(calls)
+	expected := []string{"route:zone1:one.com/*", "route:zone1:one.com/app/*", "route:zone2:two.com/*", "worker:worker", "worker:worker-observer"}
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+	// the observer only reports metrics
+	if len(api.uploadedBindings) != 1 || api.uploadedBindings["DB"] == nil {
+		t.Fatalf("unexpected observer bindings %v", api.uploadedBindings)
+	}
+}
+
+// reloadRoutesAPI lists the routes bound by the current config of zone1.
+type reloadRoutesAPI struct {
+	*fakeAPI
+}
+
+func (f *reloadRoutesAPI) ListWorkerRoutes(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkerRoutesParams) (cf.WorkerRoutesResponse, error) {
+	return cf.WorkerRoutesResponse{Routes: []cf.WorkerRoute{
+		{ID: "app", Pattern: "one.com/app/*", ScriptName: "worker"},
+		{ID: "api", Pattern: "one.com/api/*", ScriptName: "worker"},
+		{ID: "other", Pattern: "one.com/other/*", ScriptName: "other"},
+	}}, nil
+}
+
+func TestReloadZones(t *testing.T) {
+	api := &reloadRoutesAPI{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"one.com/app/*", "one.com/api/*"}},
+	}
+
+	err := m.ReloadZones([]*cfg.ZoneConfig{
+		{ID: "zone1", Actions: []string{"ban", "captcha"}, DefaultAction: "captcha", RoutesToProtect: []string{"one.com/app/*", "one.com/*"}},
+		{ID: "zone2", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"two.com/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := slices.Clone(api.calls)
+	sort.Strings(calls)
+	expected := []string{"route:api", "route:zone1:one.com/*", "route:zone2:two.com/*", "worker:worker"}
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+	// the KV namespace isn't recreated, and the worker is updated with the actions of the new zones
+	if api.uploadedBindings["kv"] != (cf.WorkerKvNamespaceBinding{NamespaceID: "namespace"}) {
+		t.Fatalf("unexpected KV binding %v", api.uploadedBindings["kv"])
+	}
+	var actionsByDomain map[string]ActionsForZone
+	if err := json.Unmarshal([]byte(api.uploadedBindings[cfg.VarNameForActionsByDomain].(cf.WorkerPlainTextBinding).Text), &actionsByDomain); err != nil {
+		t.Fatal(err)
+	}
+	if actionsByDomain["one.com"].DefaultAction != "captcha" || actionsByDomain["two.com"].DefaultAction != "ban" {
+		t.Fatalf("unexpected actions %+v", actionsByDomain)
+	}
+	if zones := m.zones(); len(zones) != 2 || zones[1].Domain != "two.com" {
+		t.Fatalf("unexpected zones %+v", zones)
+	}
+
+	// turnstile changes require a restart, and leave the zones untouched
+	api.calls = nil
+	err = m.ReloadZones([]*cfg.ZoneConfig{
+		{ID: "zone1", Actions: []string{"captcha"}, DefaultAction: "captcha", Turnstile: cfg.TurnstileConfig{Enabled: true}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(api.calls) != 0 || len(m.zones()) != 2 {
+		t.Fatalf("expected nothing to be applied, got calls %v", api.calls)
+	}
+}
+
+// deletedZoneAPI doesn't list zone2 while it's deleted.
+type deletedZoneAPI struct {
+	*fakeAPI
+	deleted bool
+}
+
+func (f *deletedZoneAPI) ListZones(ctx context.Context, z ...string) ([]cf.Zone, error) {
+	zones, err := f.fakeAPI.ListZones(ctx, z...)
+	if f.deleted {
+		zones = slices.DeleteFunc(zones, func(zone cf.Zone) bool { return zone.ID == "zone2" })
+	}
+	return zones, err
+}
+
+func TestReconcileZones(t *testing.T) {
+	api := &deletedZoneAPI{fakeAPI: newFakeAPI(), deleted: true}
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"one.com/*"}},
+		{ID: "zone2", Domain: "two.com", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"two.com/*"}},
+	}
+
+	if err := m.reconcileZones(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if zones := m.zones(); len(zones) != 1 || zones[0].ID != "zone1" || !m.isZoneRemoved("zone2") {
+		t.Fatalf("expected the deleted zone to be dropped, got %+v", zones)
+	}
+	var actionsByDomain map[string]ActionsForZone
+	if err := json.Unmarshal([]byte(api.uploadedBindings[cfg.VarNameForActionsByDomain].(cf.WorkerPlainTextBinding).Text), &actionsByDomain); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := actionsByDomain["two.com"]; ok || len(actionsByDomain) != 1 {
+		t.Fatalf("expected the worker to be updated without the deleted zone, got %+v", actionsByDomain)
+	}
+
+	// nothing changed
+	api.calls = nil
+	if err := m.reconcileZones(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.calls) != 0 {
+		t.Fatalf("expected no calls, got %v", api.calls)
+	}
+
+	api.deleted = false
+	if err := m.reconcileZones(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if zones := m.zones(); len(zones) != 2 || m.isZoneRemoved("zone2") {
+		t.Fatalf("expected the zone to be protected again, got %+v", zones)
+	}
+	if !slices.Contains(api.calls, "route:zone2:two.com/*") {
+		t.Fatalf("expected the routes of the zone to be bound again, got %v", api.calls)
+	}
+}
+
+// d1QueriesAPI counts the D1 queries.
+type d1QueriesAPI struct {
+	*fakeAPI
+	queries int
+}
+
+func (f *d1QueriesAPI) QueryD1Database(ctx context.Context, rc *cf.ResourceContainer, params cf.QueryD1DatabaseParams) ([]cf.D1Result, error) {
+	f.queries++
+	return f.fakeAPI.QueryD1Database(ctx, rc, params)
+}
+
+func TestUpdateMetricsCircuitBreaker(t *testing.T) {
+	api := &d1QueriesAPI{fakeAPI: newFakeAPI()}
+	api.d1QueryErr = errors.New("D1 is unavailable")
+	m := newTestManager(api)
+	m.hasD1Access = true
+	m.DatabaseID = "database"
+
+	for i := 0; i < d1BreakerMaxFailures-1; i++ {
+		if err := m.UpdateMetrics(); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	// the failure opening the breaker isn't reported as an error, nor are the skipped updates
+	for i := 0; i < 3; i++ {
+		if err := m.UpdateMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if api.queries != d1BreakerMaxFailures {
+		t.Fatalf("expected %d queries, got %d", d1BreakerMaxFailures, api.queries)
+	}
+
+	// once the cooldown is over, a failed query opens the breaker again
+	m.d1Breaker.openUntil = time.Now().Add(-time.Second)
+	if err := m.UpdateMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpdateMetrics(); err != nil || api.queries != d1BreakerMaxFailures+1 {
+		t.Fatalf("expected the breaker to be open again, got %d queries and error %v", api.queries, err)
+	}
+
+	// and a successful one closes it
+	m.d1Breaker.openUntil = time.Now().Add(-time.Second)
+	api.d1QueryErr = nil
+	for i := 0; i < 2; i++ {
+		if err := m.UpdateMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if api.queries != d1BreakerMaxFailures+3 {
+		t.Fatalf("expected the breaker to be closed, got %d queries", api.queries)
+	}
+}
+
+func TestUpdateMetricsFrequency(t *testing.T) {
+	api := &d1QueriesAPI{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.hasD1Access = true
+	m.DatabaseID = "database"
+	m.AccountCfg.MetricsUpdateFrequency = time.Hour
+
+	for i := 0; i < 3; i++ {
+		if err := m.UpdateMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if api.queries != 1 {
+		t.Fatalf("expected 1 query, got %d", api.queries)
+	}
+
+	// the metrics are queried again once the frequency elapsed
+	m.lastMetricsUpdate = time.Now().Add(-time.Hour)
+	if err := m.UpdateMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if api.queries != 2 {
+		t.Fatalf("expected 2 queries, got %d", api.queries)
+	}
+}
+
+func TestDecisionExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	withDuration := func(duration string) *models.Decision {
+		decision := newDecision("1.2.3.4", "ip", "ban")
+		decision.Duration = &duration
+		return decision
+	}
+	tests := map[*models.Decision]int{
+		withDuration("4h"):                  1700000000 + 4*3600,
+		withDuration("10s"):                 1700000000 + 60, // clamped to the minimum TTL
+		withDuration("-5s"):                 0,
+		withDuration("invalid"):             0,
+		newDecision("1.2.3.4", "ip", "ban"): 0,
+	}
+	for decision, expected := range tests {
+		if expiration := decisionExpiration(decision, now); expiration != expected {
+			t.Errorf("expected expiration %d for duration %v, got %d", expected, decision.Duration, expiration)
+		}
+	}
+
+	api := newFakeAPI()
+	m := newTestManager(api)
+	if err := m.ProcessNewDecisions([]*models.Decision{withDuration("1h")}); err != nil {
+		t.Fatal(err)
+	}
+	first := m.KVPairByDecisionValue["ip:1.2.3.4"].Expiration
+	if first == 0 {
+		t.Fatal("expected the entry to expire")
+	}
+
+	// a longer decision with the same action extends the entry, a shorter one leaves it untouched
+	if err := m.ProcessNewDecisions([]*models.Decision{withDuration("4h")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ProcessNewDecisions([]*models.Decision{withDuration("1m")}); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := m.KVPairByDecisionValue["ip:1.2.3.4"].Expiration; expiration < first+3*3600 {
+		t.Fatalf("expected the entry to be extended, got expiration %d", expiration)
+	}
+	if len(api.writes) != 2 {
+		t.Fatalf("expected the entry to be written twice, got %v", api.writes)
+	}
+
+	// a decision without duration never expires
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := m.KVPairByDecisionValue["ip:1.2.3.4"].Expiration; expiration != 0 {
+		t.Fatalf("expected the entry not to expire, got expiration %d", expiration)
+	}
+}
+
+func TestASDecisions(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.ASAllowlist = []string{"64497"}
+
+	err := m.ProcessNewDecisions([]*models.Decision{
+		newDecision("64496", "as", "captcha"),
+		newDecision("64496", "as", "ban"),
+		newDecision("64497", "as", "ban"),
+		newDecision("1.2.3.4", "ip", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AS decisions aren't stored as keys of their own
+	if keys := api.keys(); !slices.Equal(keys, []string{ASDecisionsKeyName, "ip:1.2.3.4"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if api.kv[ASDecisionsKeyName] != `{"64496":"ban"}` {
+		t.Fatalf("unexpected AS decisions %s", api.kv[ASDecisionsKeyName])
+	}
+	if _, ok := m.KVPairByDecisionValue["as:64496"]; ok {
+		t.Fatal("expected the AS decision not to be stored with the IP decisions")
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("64496", "as", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv[ASDecisionsKeyName] != `{}` {
+		t.Fatalf("expected the AS decision to be deleted, got %s", api.kv[ASDecisionsKeyName])
+	}
+}
+
+func TestCommitIPRangesIfChanged(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.ActionByIPRange = map[string]string{"1.2.3.0/24": "ban", "5.6.0.0/16": "captcha"}
+	// the same set, encoded differently
+	m.ipRangeKVPair.Value = `{ "5.6.0.0/16": "captcha", "1.2.3.0/24": "ban" }`
+
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.writes) != 0 {
+		t.Fatalf("expected no write, got %v", api.writes)
+	}
+
+	m.ActionByIPRange = map[string]string{"1.2.3.0/24": "captcha", "9.9.9.0/24": "ban"}
+	if err := m.CommitIPRangesIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv[IpRangeKeyName] != `{"1.2.3.0/24":"captcha","9.9.9.0/24":"ban"}` {
+		t.Fatalf("unexpected IP ranges %s", api.kv[IpRangeKeyName])
+	}
+	added, updated, removed := diffIPRanges(
+		map[string]string{"1.2.3.0/24": "ban", "5.6.0.0/16": "captcha"},
+		map[string]string{"1.2.3.0/24": "captcha", "9.9.9.0/24": "ban", "8.8.8.0/24": "ban"},
+	)
+	if added != 2 || updated != 1 || removed != 1 {
+		t.Fatalf("expected 2 added, 1 updated and 1 removed ranges, got %d, %d and %d", added, updated, removed)
+	}
+}
+
+func TestUnsupportedScopeSkipped(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Name = "unsupported-scope-test"
+
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("alice", "username", "ban"), newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := api.keys(); !slices.Equal(keys, []string{"ip:1.2.3.4"}) {
+		t.Fatalf("expected only the IP decision to be written, got %v", keys)
+	}
+	if count := testutil.ToFloat64(metrics.SkippedUnsupportedDecisions.WithLabelValues("username", "unsupported-scope-test")); count != 1 {
+		t.Fatalf("expected 1 skipped decision, got %f", count)
+	}
+}
+
+func TestPassThroughScope(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Name = "pass-through-test"
+	m.PassThroughScopes = []string{"username"}
+
+	err := m.ProcessNewDecisions([]*models.Decision{
+		newDecision("alice", "username", "captcha"),
+		newDecision("alice", "username", "ban"),
+		newDecision("bob", "session", "ban"),
+		newDecision("1.2.3.4", "ip", "ban"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := api.keys(); !slices.Equal(keys, []string{OtherScopeDecisionsKeyName, "ip:1.2.3.4"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if api.kv[OtherScopeDecisionsKeyName] != `{"username:alice":"ban"}` {
+		t.Fatalf("unexpected pass-through decisions %s", api.kv[OtherScopeDecisionsKeyName])
+	}
+	if count := testutil.ToFloat64(metrics.OtherScopeDecisions.WithLabelValues("username", "pass-through-test")); count != 1 {
+		t.Fatalf("expected 1 username decision, got %f", count)
+	}
+	if count := testutil.ToFloat64(metrics.SkippedUnsupportedDecisions.WithLabelValues("session", "pass-through-test")); count != 1 {
+		t.Fatalf("expected the session decision to be skipped, got %f", count)
+	}
+
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("alice", "username", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv[OtherScopeDecisionsKeyName] != `{}` {
+		t.Fatalf("expected the pass-through decision to be deleted, got %s", api.kv[OtherScopeDecisionsKeyName])
+	}
+	if count := testutil.ToFloat64(metrics.OtherScopeDecisions.WithLabelValues("username", "pass-through-test")); count != 0 {
+		t.Fatalf("expected no username decision, got %f", count)
+	}
+}
+
+func TestResponseConfig(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", BanStatusCode: 451, ResponseHeaders: map[string]string{"Cache-Control": "no-store"}},
+		{ID: "zone2", Domain: "two.com", Actions: []string{"ban"}, DefaultAction: "ban"},
+		{ID: "zone3", Domain: "three.com", Actions: []string{"ban"}, DefaultAction: "ban", BanRedirectURL: "https://status.example.com/banned"},
+	}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	// zones using the default responses are left out
+	if api.kv[ResponseConfigKeyName] != `{"one.com":{"ban_status_code":451,"headers":{"Cache-Control":"no-store"}},"three.com":{"ban_redirect_url":"https://status.example.com/banned"}}` {
+		t.Fatalf("unexpected response config %s", api.kv[ResponseConfigKeyName])
+	}
+}
+
+func TestBanTemplateByDomain(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+	banTemplate := filepath.Join(t.TempDir(), "ban.html")
+	if err := os.WriteFile(banTemplate, []byte("<h1>Banned from one.com</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", BanTemplate: banTemplate},
+		{ID: "zone2", Domain: "two.com", Actions: []string{"ban"}, DefaultAction: "ban"},
+	}
+
+	if err := m.deployWorker(); err != nil {
+		t.Fatal(err)
+	}
+	// the account template stays the fallback of the zones without their own
+	if api.kv[VarNameForBanTemplate] != "Access Denied" {
+		t.Fatalf("unexpected ban template %s", api.kv[VarNameForBanTemplate])
+	}
+	if api.kv[BanTemplateByDomainKeyName] != `{"one.com":"\u003ch1\u003eBanned from one.com\u003c/h1\u003e"}` {
+		t.Fatalf("unexpected ban templates %s", api.kv[BanTemplateByDomainKeyName])
+	}
+	if !isReservedKVKey(BanTemplateByDomainKeyName) {
+		t.Fatal("expected the ban templates key not to be taken for a decision")
+	}
+}
+
+// existingD1API lists a D1 DB left by a previous run.
+type existingD1API struct {
+	*fakeAPI
+}
+
+func (f *existingD1API) ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error) {
+	return []cf.D1Database{{UUID: "other", Name: "other-db"}, {UUID: "existing", Name: "db"}}, nil, nil
+}
+
+func TestPreserveD1(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	api.d1Allowed = true
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	if err := m.createD1Database(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasD1Access || m.DatabaseID != "existing" {
+		t.Fatalf("expected the DB left by a previous run to be reused, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+
+	m.Worker.PreserveD1 = true
+	if err := m.createD1Database(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasD1Access || m.DatabaseID != "existing" {
+		t.Fatalf("expected the existing DB to be reused, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+
+	// a new DB is created when there is none
+	m.Worker.D1DBName = "missing"
+	if err := m.createD1Database(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasD1Access || m.DatabaseID != "database" {
+		t.Fatalf("expected a new DB to be created, got hasD1Access=%t DatabaseID=%q", m.hasD1Access, m.DatabaseID)
+	}
+}
+
+// listResourcesAPI lists the scripts and D1 DBs of an account with leftovers of the bouncer.
+type listResourcesAPI struct {
+	*fakeAPI
+}
+
+func (f *listResourcesAPI) ListWorkers(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersParams) (cf.WorkerListResponse, *cf.ResultInfo, error) {
+	return cf.WorkerListResponse{WorkerList: []cf.WorkerMetaData{{ID: "worker"}, {ID: "other"}}}, nil, nil
+}
+
+func (f *listResourcesAPI) ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error) {
+	return nil, nil, errors.New("missing D1 permissions")
+}
+
+func TestListResources(t *testing.T) {
+	api := &listResourcesAPI{fakeAPI: newFakeAPI()}
+	api.kv["ip:1.2.3.4"] = "ban"
+	api.kv[IpRangeKeyName] = "{}"
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	resources, err := m.ListResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resources.Scripts, []string{"worker"}) {
+		t.Fatalf("unexpected scripts %v", resources.Scripts)
+	}
+	// the routes of the zones of other accounts aren't listed
+	zones := make([]string, 0)
+	for _, route := range resources.Routes {
+		zones = append(zones, route.Zone)
+	}
+	if !slices.Equal(zones, []string{"excluded.com", "norecords.com", "one.com", "two.com"}) {
+		t.Fatalf("unexpected routes %+v", resources.Routes)
+	}
+	if resources.KVNamespace == nil || *resources.KVNamespace != (KVNamespaceResource{ID: "namespace", Keys: 2}) {
+		t.Fatalf("unexpected KV namespace %+v", resources.KVNamespace)
+	}
+	if resources.D1Database != nil {
+		t.Fatalf("expected no D1 DB when they can't be listed, got %+v", resources.D1Database)
+	}
+	if len(resources.Widgets) != 1 || resources.Widgets[0].SiteKey != "bouncer" {
+		t.Fatalf("unexpected widgets %+v", resources.Widgets)
+	}
+	if len(api.calls) != 0 {
+		t.Fatalf("expected no resource to be changed, got %v", api.calls)
+	}
+}
+
+func TestWorkerBindings(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	api.kv[VarNameForBanTemplate] = "Access Denied"
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban"}}
+	m.Worker = &cfg.CloudflareWorkerCreateParams{
+		ScriptName:      "worker",
+		KVNameSpaceName: "kv",
+		D1DBName:        "db",
+		DecisionHashing: cfg.DecisionHashingConfig{Enabled: true, Salt: "salt"},
+	}
+
+	bindings, err := m.WorkerBindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	values := make(map[string]string)
+	for _, binding := range bindings.Bindings {
+		names = append(names, binding.Name)
+		values[binding.Name] = binding.Value
+	}
+	if !slices.Equal(names, []string{cfg.VarNameForActionsByDomain, "DECISION_HASH_SALT", "LOG_ONLY", "db", "kv"}) {
+		t.Fatalf("unexpected bindings %+v", bindings.Bindings)
+	}
+	if values["kv"] != "namespace" || values["db"] != "existing" || values["DECISION_HASH_SALT"] != "<redacted>" {
+		t.Fatalf("unexpected binding values %v", values)
+	}
+	if !strings.Contains(values[cfg.VarNameForActionsByDomain], "one.com") {
+		t.Fatalf("expected the actions of the zones, got %s", values[cfg.VarNameForActionsByDomain])
+	}
+	if bindings.ScriptName != "worker" || bindings.BanTemplate != "default" || !bindings.BanTemplateInKV {
+		t.Fatalf("unexpected worker bindings %+v", bindings)
+	}
+	if len(api.calls) != 0 {
+		t.Fatalf("expected nothing to be uploaded, got %v", api.calls)
+	}
+}
+
+// paginatedAPI returns the KV namespaces, widgets and D1 DBs of the account in pages of 2 items, the ones
+// of the bouncer being on the last page.
+type paginatedAPI struct {
+	*fakeAPI
+	pages []int // pages requested
+}
+
+func paginate[T any](f *paginatedAPI, items []T, page cf.ResultInfo) ([]T, *cf.ResultInfo, error) {
+	f.lock.Lock()
+	f.pages = append(f.pages, page.Page)
+	f.lock.Unlock()
+	if page.PerPage != listPageSize {
+		return nil, nil, fmt.Errorf("unexpected page size %d", page.PerPage)
+	}
+	totalPages := (len(items) + 1) / 2
+	start := min((page.Page-1)*2, len(items))
+	end := min(start+2, len(items))
+	return items[start:end], &cf.ResultInfo{Page: page.Page, PerPage: 2, TotalPages: totalPages, Total: len(items)}, nil
+}
+
+func (f *paginatedAPI) ListWorkersKVNamespaces(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVNamespacesParams) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error) {
+	return paginate(f, []cf.WorkersKVNamespace{{ID: "a", Title: "a"}, {ID: "b", Title: "b"}, {ID: "c", Title: "c"}, {ID: "namespace", Title: "kv"}, {ID: "e", Title: "e"}}, params.ResultInfo)
+}
+
+func (f *paginatedAPI) ListTurnstileWidgets(ctx context.Context, rc *cf.ResourceContainer, params cf.ListTurnstileWidgetParams) ([]cf.TurnstileWidget, *cf.ResultInfo, error) {
+	return paginate(f, []cf.TurnstileWidget{{Name: "a", SiteKey: "a"}, {Name: "b", SiteKey: "b"}, {Name: WidgetName, SiteKey: "bouncer"}}, params.ResultInfo)
+}
+
+func (f *paginatedAPI) ListD1Databases(ctx context.Context, rc *cf.ResourceContainer, params cf.ListD1DatabasesParams) ([]cf.D1Database, *cf.ResultInfo, error) {
+	return paginate(f, []cf.D1Database{{UUID: "a", Name: "a"}, {UUID: "b", Name: "b"}, {UUID: "database", Name: "db"}}, params.ResultInfo)
+}
+
+func TestPagination(t *testing.T) {
+	api := &paginatedAPI{fakeAPI: newFakeAPI()}
+	m := newTestManager(api)
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+
+	if err := m.cleanUpKVNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(api.pages, []int{1, 2, 3}) || !slices.Equal(api.calls, []string{"kv:namespace"}) {
+		t.Fatalf("expected every page to be listed and the namespace deleted, got pages %v and calls %v", api.pages, api.calls)
+	}
+
+	api.pages = nil
+	widgets, err := m.listTurnstileWidgets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 3 || widgets[2].SiteKey != "bouncer" || !slices.Equal(api.pages, []int{1, 2}) {
+		t.Fatalf("expected the widgets of every page, got %+v from pages %v", widgets, api.pages)
+	}
+
+	db, found, err := m.findD1Database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || db.UUID != "database" {
+		t.Fatalf("expected the DB of the last page to be found, got %+v", db)
+	}
+}
+
+func TestMigrateUnscopedKeys(t *testing.T) {
+	api := newFakeAPI()
+	api.kv[IpRangeKeyName] = "{}"
+	api.kv["1.2.3.4"] = "ban"
+	api.kv["2001:db8::1"] = "captcha"
+	api.kv["cn"] = "ban"
+	api.kv["ip:5.6.7.8"] = "ban"
+	m := newTestManager(api)
+	m.KVPairByDecisionValue = map[string]cf.WorkersKVPair{
+		"1.2.3.4":    {Key: "1.2.3.4", Value: "ban"},
+		"ip:5.6.7.8": {Key: "ip:5.6.7.8", Value: "ban"},
+	}
+
+	legacyKeys, err := m.migrateUnscopedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(legacyKeys)
+	if !slices.Equal(legacyKeys, []string{"1.2.3.4", "2001:db8::1", "cn"}) {
+		t.Fatalf("unexpected legacy keys %v", legacyKeys)
+	}
+	if api.kv["ip:1.2.3.4"] != "ban" || api.kv["ip:2001:db8::1"] != "captcha" || api.kv["country:cn"] != "ban" {
+		t.Fatalf("expected the decisions to be written to scoped keys, got %v", api.kv)
+	}
+	expected := map[string]cf.WorkersKVPair{
+		"ip:1.2.3.4": {Key: "ip:1.2.3.4", Value: "ban"},
+		"ip:5.6.7.8": {Key: "ip:5.6.7.8", Value: "ban"},
+	}
+	if !maps.Equal(m.KVPairByDecisionValue, expected) {
+		t.Fatalf("expected %v, got %v", expected, m.KVPairByDecisionValue)
+	}
+
+	// hashed keys are migrated from the cache
+	api = newFakeAPI()
+	m = newTestManager(api)
+	m.Worker.DecisionHashing = cfg.DecisionHashingConfig{Enabled: true, Salt: "salt"}
+	m.KVPairByDecisionValue = map[string]cf.WorkersKVPair{"1.2.3.4": {Key: m.kvKeyForValue("1.2.3.4"), Value: "ban"}}
+	legacyKeys, err = m.migrateUnscopedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(legacyKeys, []string{m.kvKeyForValue("1.2.3.4")}) {
+		t.Fatalf("unexpected legacy keys %v", legacyKeys)
+	}
+	key := m.kvKeyForValue("ip:1.2.3.4")
+	if api.kv[key] != "ban" || m.KVPairByDecisionValue["ip:1.2.3.4"] != (cf.WorkersKVPair{Key: key, Value: "ban"}) {
+		t.Fatalf("expected the cached decision to be written to its scoped key, got %v", api.kv)
+	}
+}
+
+// flakyKVNamespaceAPI fails to create the KV namespace with err the first failures times. The namespace
+// is only listed once created.
+type flakyKVNamespaceAPI struct {
+	*fakeAPI
+	failures int
+	err      error
+	attempts int
+	created  bool
+}
+
+func (f *flakyKVNamespaceAPI) ListWorkersKVNamespaces(ctx context.Context, rc *cf.ResourceContainer, params cf.ListWorkersKVNamespacesParams) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error) {
+	if !f.created {
+		return nil, nil, nil
+	}
+	return f.fakeAPI.ListWorkersKVNamespaces(ctx, rc, params)
+}
+
+func (f *flakyKVNamespaceAPI) CreateWorkersKVNamespace(ctx context.Context, rc *cf.ResourceContainer, params cf.CreateWorkersKVNamespaceParams) (cf.WorkersKVNamespaceResponse, error) {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return cf.WorkersKVNamespaceResponse{}, f.err
+	}
+	f.created = true
+	resp := cf.WorkersKVNamespaceResponse{}
+	resp.Result.ID = "namespace"
+	return resp, nil
+}
+
+func TestDeployInfraAdoptsKVNamespace(t *testing.T) {
+	// the namespace titled kv is left by a previous run, the fake API panics if another one is created
+	api := newFakeAPI()
+	api.kv["ip:1.2.3.4"] = "ban"
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.AccountCfg.DisableD1 = true
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv"}
+
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if m.NamespaceID != "namespace" {
+		t.Fatalf("expected the existing KV namespace to be adopted, got %q", m.NamespaceID)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; ok {
+		t.Fatal("expected the keys of the adopted namespace to be cleared")
+	}
+	if _, ok := api.kv[VarNameForBanTemplate]; !ok {
+		t.Fatal("expected the ban template to be written to the adopted namespace")
+	}
+}
+
+func TestDeployInfraRetries(t *testing.T) {
+	transientErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection reset by peer")}
+	newManager := func(api CloudflareAPI) *CloudflareAccountManager {
+		m := newTestManager(api)
+		m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db"}
+		m.NamespaceID = ""
+		m.deployRetries = 2
+		m.deployRetryDelay = time.Millisecond
+		return m
+	}
+
+	api := &flakyKVNamespaceAPI{fakeAPI: newFakeAPI(), failures: 2, err: transientErr}
+	m := newManager(api)
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if api.attempts != 3 || m.NamespaceID != "namespace" {
+		t.Fatalf("expected the KV namespace to be created on the third attempt, got %d attempts", api.attempts)
+	}
+
+	// the retries are exhausted
+	api = &flakyKVNamespaceAPI{fakeAPI: newFakeAPI(), failures: 3, err: transientErr}
+	if err := newManager(api).DeployInfra(); !errors.Is(err, transientErr) || api.attempts != 3 {
+		t.Fatalf("expected the transient error after 3 attempts, got %v after %d", err, api.attempts)
+	}
+
+	// other errors aren't retried
+	api = &flakyKVNamespaceAPI{fakeAPI: newFakeAPI(), failures: 1, err: errors.New("invalid title")}
+	if err := newManager(api).DeployInfra(); err == nil || api.attempts != 1 {
+		t.Fatalf("expected the error to be returned without retrying, got %v after %d attempts", err, api.attempts)
+	}
+
+	// nor are failures once the context is done
+	api = &flakyKVNamespaceAPI{fakeAPI: newFakeAPI(), failures: 1, err: transientErr}
+	m = newManager(api)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Ctx = ctx
+	if err := m.DeployInfra(); !errors.Is(err, transientErr) || api.attempts != 1 {
+		t.Fatalf("expected no retry once the context is done, got %v after %d attempts", err, api.attempts)
+	}
+}
+
+// roundTripFunc serves the requests of an http.Client without a network.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSmokeTest(t *testing.T) {
+	for route, expected := range map[string]string{
+		"*one.com/*":            "https://one.com/",
+		"*.one.com/*":           "https://www.one.com/",
+		"one.com/api/*":         "https://one.com/api/",
+		"https://one.com":       "https://one.com/",
+		"shop.one.com/checkout": "https://shop.one.com/checkout",
+	} {
+		if url := smokeTestURL(route); url != expected {
+			t.Errorf("expected %s for route %s, got %s", expected, route, url)
+		}
+	}
+
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.Worker = &cfg.CloudflareWorkerCreateParams{KVNameSpaceName: "kv"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", RoutesToProtect: []string{"*one.com/*"}},
+		{ID: "zone2", Domain: "two.com", RoutesToProtect: []string{"*two.com/*"}},
+		{ID: "zone3", Domain: "three.com"},
+	}
+	// the worker is only bound to one.com
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader("")), Request: req}
+		test := smokeTest{}
+		api.lock.Lock()
+		err := json.Unmarshal([]byte(api.kv[SmokeTestKeyName]), &test)
+		api.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if req.URL.Host == "one.com" && req.Header.Get(SmokeTestHeader) == test.Token {
+			resp.StatusCode = http.StatusForbidden
+			resp.Header.Set(SmokeTestRemediationHeader, test.Action)
+		}
+		return resp, nil
+	})}
+
+	results, err := m.SmokeTest(client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected the zones with routes to be tested, got %+v", results)
+	}
+	if !results[0].Passed() || results[0].Zone != "one.com" || results[0].Remediation != "ban" {
+		t.Fatalf("expected the worker to ban the test request on one.com, got %+v", results[0])
+	}
+	if results[1].Passed() || results[1].Zone != "two.com" || results[1].Remediation != "" {
+		t.Fatalf("expected the test of two.com to fail, got %+v", results[1])
+	}
+	if _, ok := api.kv[SmokeTestKeyName]; ok {
+		t.Fatal("expected the test decision to be removed")
+	}
+
+	m.Worker.KVNameSpaceName = "missing"
+	if _, err := m.SmokeTest(client, 0); err == nil {
+		t.Fatal("expected an error without a deployed worker")
+	}
+}
+
+func TestTagScenarios(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.Worker.TagScenarios = true
+
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if value := api.kv["ip:1.2.3.4"]; value != `{"action":"ban","scenario":"crowdsecurity/http-probing"}` {
+		t.Fatalf("expected the decision to be tagged with its scenario, got %s", value)
+	}
+	// the action of a tagged value is compared, not the value itself
+	api.writes = nil
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.writes) != 0 {
+		t.Fatalf("expected the same decision not to be written again, got %v", api.writes)
+	}
+	if err := m.ProcessDeletedDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv["ip:1.2.3.4"]; ok {
+		t.Fatal("expected the tagged decision to be deleted")
+	}
+
+	if action := kvAction("captcha"); action != "captcha" {
+		t.Fatalf("expected the bare action to be kept, got %s", action)
+	}
+}
+
+func TestUnmanagedWorker(t *testing.T) {
+	api := &existingD1API{fakeAPI: newFakeAPI()}
+	manageWorker := false
+	m := newTestManager(api)
+	m.NamespaceID = ""
+	m.Worker = &cfg.CloudflareWorkerCreateParams{ScriptName: "worker", KVNameSpaceName: "kv", D1DBName: "db", ManageWorker: &manageWorker}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban", RoutesToProtect: []string{"*one.com/*"}}}
+
+	if err := m.DeployInfra(); err != nil {
+		t.Fatal(err)
+	}
+	if m.NamespaceID != "namespace" || m.DatabaseID != "existing" {
+		t.Fatalf("expected the existing KV namespace and D1 DB to be used, got %q and %q", m.NamespaceID, m.DatabaseID)
+	}
+	if len(api.calls) != 0 {
+		t.Fatalf("expected the worker not to be uploaded nor bound to routes, got %v", api.calls)
+	}
+	if _, ok := api.kv[VarNameForBanTemplate]; !ok {
+		t.Fatal("expected the ban template to be written to the existing KV namespace")
+	}
+	if err := m.ProcessNewDecisions([]*models.Decision{newDecision("1.2.3.4", "ip", "ban")}); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv["ip:1.2.3.4"] != "ban" {
+		t.Fatal("expected the decision to be written to the existing KV namespace")
+	}
+
+	// only the turnstile widgets of the bouncer are deleted
+	if err := m.CleanUpExistingWorkers(false); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(api.calls, []string{"widget:bouncer"}) {
+		t.Fatalf("expected the worker, its routes and KV namespace to be left, got %v", api.calls)
+	}
+
+	m.Worker.KVNameSpaceName = "missing"
+	if err := m.DeployInfra(); err == nil {
+		t.Fatal("expected an error without the KV namespace of the worker")
+	}
+}
+
+// flakyKVWriteAPI fails the first writes of the batches smaller than the 10k keys limit.
+type flakyKVWriteAPI struct {
+	*fakeAPI
+	failures int
+	err      error
+}
+
+func (f *flakyKVWriteAPI) WriteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.WriteWorkersKVEntriesParams) (cf.Response, error) {
+	f.lock.Lock()
+	fail := len(params.KVs) < 10000 && f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.lock.Unlock()
+	if fail {
+		return cf.Response{}, f.err
+	}
+	return f.fakeAPI.WriteWorkersKVEntries(ctx, rc, params)
+}
+
+func TestReconcileResumesFailedBatches(t *testing.T) {
+	transientErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection reset by peer")}
+	decisions := make([]*models.Decision, 0, 12000)
+	for i := range 12000 {
+		decisions = append(decisions, newDecision(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "ip", "ban"))
+	}
+
+	// without retries, the decisions of the batch written are kept
+	api := &flakyKVWriteAPI{fakeAPI: newFakeAPI(), failures: 1, err: transientErr}
+	m := newTestManager(api)
+	if err := m.ReconcileDecisions(decisions); !errors.Is(err, transientErr) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if len(m.KVPairByDecisionValue) != 10000 {
+		t.Fatalf("expected the 10000 decisions written to be cached, got %d", len(m.KVPairByDecisionValue))
+	}
+
+	// a retry only writes the decisions of the failed batch
+	api = &flakyKVWriteAPI{fakeAPI: newFakeAPI(), failures: 1, err: transientErr}
+	m = newTestManager(api)
+	m.deployRetries = 1
+	m.deployRetryDelay = time.Millisecond
+	if err := m.ReconcileDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.KVPairByDecisionValue) != 12000 || len(api.kv) != 12000 {
+		t.Fatalf("expected every decision to be written, got %d cached and %d in KV", len(m.KVPairByDecisionValue), len(api.kv))
+	}
+	if len(api.writes) != 12000 {
+		t.Fatalf("expected each decision to be written once, got %d writes", len(api.writes))
+	}
+}
+
+// failingKVDeleteAPI fails the deletion of KV keys while err is set.
+type failingKVDeleteAPI struct {
+	*fakeAPI
+	err error
+}
+
+func (f *failingKVDeleteAPI) DeleteWorkersKVEntries(ctx context.Context, rc *cf.ResourceContainer, params cf.DeleteWorkersKVEntriesParams) (cf.Response, error) {
+	if f.err != nil {
+		return cf.Response{}, f.err
+	}
+	return f.fakeAPI.DeleteWorkersKVEntries(ctx, rc, params)
+}
+
+func TestDeletedDecisionsKeptUntilDeleted(t *testing.T) {
+	deleteErr := errors.New("internal error")
+	api := &failingKVDeleteAPI{fakeAPI: newFakeAPI(), err: deleteErr}
+	m := newTestManager(api)
+	m.AccountCfg.Name = "failed-delete"
+	decisions := []*models.Decision{newDecision("1.2.3.4", "ip", "ban"), newDecision("10.0.0.0/8", "range", "ban")}
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	active := func() float64 {
+		return testutil.ToFloat64(metrics.TotalActiveDecisions.With(m.activeDecisionLabels(decisions[0])))
+	}
+
+	if err := m.ProcessDeletedDecisions(decisions); !errors.Is(err, deleteErr) {
+		t.Fatalf("expected the delete error, got %v", err)
+	}
+	if _, ok := m.KVPairByDecisionValue["ip:1.2.3.4"]; !ok || len(m.ActionByIPRange) != 1 {
+		t.Fatalf("expected the decisions to be kept while their keys aren't deleted, got %v and %v", m.KVPairByDecisionValue, m.ActionByIPRange)
+	}
+	if api.kv[IpRangeKeyName] != `{"10.0.0.0/8":"ban"}` {
+		t.Fatalf("expected the IP ranges to be left in KV, got %s", api.kv[IpRangeKeyName])
+	}
+	if count := active(); count != 1 {
+		t.Fatalf("expected the IP decision to still be active, got %f", count)
+	}
+
+	// the retry deletes them
+	api.err = nil
+	if err := m.ProcessDeletedDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.KVPairByDecisionValue) != 0 || len(m.ActionByIPRange) != 0 || len(api.kv["ip:1.2.3.4"]) != 0 {
+		t.Fatalf("expected the decisions to be deleted, got %v and %v", m.KVPairByDecisionValue, m.ActionByIPRange)
+	}
+	if count := active(); count != 0 {
+		t.Fatalf("expected no active decision, got %f", count)
+	}
+}
+
+func TestUpdateMetricsD1Health(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Name = "d1-health"
+	m.hasD1Access = true
+	m.DatabaseID = "database"
+
+	api.d1QueryErr = errors.New("no such table: metrics: SQLITE_ERROR")
+	if err := m.UpdateMetrics(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if healthy := testutil.ToFloat64(metrics.WorkerD1Healthy.WithLabelValues("d1-health")); healthy != 0 {
+		t.Fatalf("expected D1 to be unhealthy, got %f", healthy)
+	}
+
+	api.d1QueryErr = nil
+	if err := m.UpdateMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if healthy := testutil.ToFloat64(metrics.WorkerD1Healthy.WithLabelValues("d1-health")); healthy != 1 {
+		t.Fatalf("expected D1 to be healthy, got %f", healthy)
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       bool
+	}{
+		{name: "revoked token", statusCode: http.StatusUnauthorized, body: `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`, want: true},
+		{name: "invalid token", statusCode: http.StatusForbidden, body: `{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`, want: true},
+		{name: "unauthorized", statusCode: http.StatusUnauthorized, body: `{"success":false,"errors":[]}`, want: true},
+		{name: "missing permission", statusCode: http.StatusForbidden, body: `{"success":false,"errors":[{"code":10001,"message":"Unauthorized to access requested resource"}]}`, want: false},
+		{name: "missing permission for a resource", statusCode: http.StatusForbidden, body: `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`, want: false},
+		{name: "success", statusCode: http.StatusOK, body: `{"success":true,"errors":[]}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.statusCode, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if err := authFailure(resp); (err != nil) != tt.want {
+				t.Fatalf("expected an auth failure: %t, got %v", tt.want, err)
+			}
+			// the body is still there for the client
+			if body, _ := io.ReadAll(resp.Body); string(body) != tt.body {
+				t.Fatalf("expected the body to be restored, got %s", body)
+			}
+		})
+	}
+}
+
+// revokedTokenAPI fails the verification of the token.
+type revokedTokenAPI struct {
+	*fakeAPI
+}
+
+func (f *revokedTokenAPI) VerifyAPIToken(ctx context.Context) (cf.APITokenVerifyBody, error) {
+	return cf.APITokenVerifyBody{}, errors.New("invalid API token")
+}
+
+func TestWatchAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`)
+	}))
+	defer server.Close()
+
+	m := newTestManager(&revokedTokenAPI{fakeAPI: newFakeAPI()})
+	m.AccountCfg.Name = "auth-failed-test"
+	m.auth = newAuthState()
+	m.deployRetryDelay = time.Millisecond
+	transport := &CloudflareManagerHTTPTransport{Transport: http.DefaultTransport.(*http.Transport), accountName: m.AccountCfg.Name, auth: m.auth}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		m.WatchAuth(ctx, stop)
+		close(done)
+	}()
+	if m.AuthFailed() {
+		t.Fatal("expected the token not to be rejected yet")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/client/v4/accounts/account/workers/scripts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.roundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the account to be stopped once its token is rejected")
+	}
+	if !m.AuthFailed() || ctx.Err() == nil {
+		t.Fatal("expected the context of the account to be cancelled")
+	}
+	if failed := testutil.ToFloat64(metrics.CloudflareAuthFailed.WithLabelValues("auth-failed-test")); failed != 1 {
+		t.Fatalf("expected the auth failure to be exposed, got %f", failed)
+	}
+}
+
+func TestWatchAuthTokenAcceptedAgain(t *testing.T) {
+	m := newTestManager(newFakeAPI())
+	m.AccountCfg.Name = "auth-accepted-test"
+	m.auth = newAuthState()
+	m.deployRetryDelay = time.Millisecond
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		m.WatchAuth(ctx, stop)
+		close(done)
+	}()
+
+	// the token verified right after a spurious rejection keeps the account managed, and is watched again
+	for range 2 {
+		rejected := m.auth.rejected()
+		m.auth.fail(errors.New("invalid access token"))
+		<-rejected
+		deadline := time.Now().Add(time.Second)
+		for m.AuthFailed() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if m.AuthFailed() || ctx.Err() != nil {
+			t.Fatal("expected the account to be kept once its token is accepted again")
+		}
+	}
+	stop()
+	<-done
+	if failed := testutil.ToFloat64(metrics.CloudflareAuthFailed.WithLabelValues("auth-accepted-test")); failed != 0 {
+		t.Fatalf("expected no auth failure to be exposed, got %f", failed)
+	}
+}
+
+func TestSetEnforcement(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Name = "enforcement-test"
+
+	if err := m.SetEnforcement(false); err != nil {
+		t.Fatal(err)
+	}
+	if api.kv[EnforcementKeyName] != "false" || !m.EnforcementPaused() {
+		t.Fatalf("expected the enforcement to be paused, got %q", api.kv[EnforcementKeyName])
+	}
+	if paused := testutil.ToFloat64(metrics.EnforcementPaused.WithLabelValues("enforcement-test")); paused != 1 {
+		t.Fatalf("expected the paused metric to be 1, got %f", paused)
+	}
+	if !isReservedKVKey(EnforcementKeyName) {
+		t.Fatalf("expected %s to be reserved", EnforcementKeyName)
+	}
+
+	if err := m.SetEnforcement(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.kv[EnforcementKeyName]; ok || m.EnforcementPaused() {
+		t.Fatal("expected the enforcement to be resumed")
+	}
+	if paused := testutil.ToFloat64(metrics.EnforcementPaused.WithLabelValues("enforcement-test")); paused != 0 {
+		t.Fatalf("expected the paused metric to be 0, got %f", paused)
+	}
+}
+
+// rulesetAPI keeps the custom rules of the zones and the items of the IP list of the ruleset backend.
+type rulesetAPI struct {
+	*fakeAPI
+	rulesByZone map[string][]cf.RulesetRule
+	items       map[string]cf.ListItem // by ID
+	deletedIDs  []string
+}
+
+func newRulesetAPI() *rulesetAPI {
+	return &rulesetAPI{fakeAPI: newFakeAPI(), rulesByZone: make(map[string][]cf.RulesetRule), items: make(map[string]cf.ListItem)}
+}
+
+func (f *rulesetAPI) GetEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, phase string) (cf.Ruleset, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return cf.Ruleset{Rules: slices.Clone(f.rulesByZone[rc.Identifier])}, nil
+}
+
+func (f *rulesetAPI) UpdateEntrypointRuleset(ctx context.Context, rc *cf.ResourceContainer, params cf.UpdateEntrypointRulesetParams) (cf.Ruleset, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rulesByZone[rc.Identifier] = params.Rules
+	return cf.Ruleset{Rules: params.Rules}, nil
+}
+
+func (f *rulesetAPI) CreateListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListCreateItemsParams) ([]cf.ListItem, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, item := range params.Items {
+		id := "item-" + *item.IP
+		f.items[id] = cf.ListItem{ID: id, IP: item.IP}
+	}
+	return slices.Collect(maps.Values(f.items)), nil
+}
+
+func (f *rulesetAPI) DeleteListItems(ctx context.Context, rc *cf.ResourceContainer, params cf.ListDeleteItemsParams) ([]cf.ListItem, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, item := range params.Items.Items {
+		f.deletedIDs = append(f.deletedIDs, item.ID)
+		delete(f.items, item.ID)
+	}
+	return slices.Collect(maps.Values(f.items)), nil
+}
+
+// blockRuleEnabled returns whether the zone has the custom rule, and its enabled flag.
+func (f *rulesetAPI) blockRuleEnabled(zoneID string) (bool, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, rule := range f.rulesByZone[zoneID] {
+		if rule.Ref == BlockRuleRef {
+			return true, rule.Enabled != nil && *rule.Enabled
+		}
+	}
+	return false, false
+}
+
+func TestBlockRuleFollowsEnforcement(t *testing.T) {
+	api := newRulesetAPI()
+	api.rulesByZone["zone1"] = []cf.RulesetRule{{Ref: "other", Action: "skip"}}
+	m := newTestManager(api)
+	m.AccountCfg.Backend = cfg.BackendRuleset
+	zone := &cfg.ZoneConfig{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban"}
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{zone}
+
+	if err := m.addBlockRule(zone); err != nil {
+		t.Fatal(err)
+	}
+	if found, enabled := api.blockRuleEnabled("zone1"); !found || !enabled {
+		t.Fatalf("expected the custom rule to be added enabled, got found %t enabled %t", found, enabled)
+	}
+
+	if err := m.SetEnforcement(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, enabled := api.blockRuleEnabled("zone1"); enabled {
+		t.Fatal("expected the custom rule to be disabled while the enforcement is paused")
+	}
+	if err := m.SetEnforcement(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, enabled := api.blockRuleEnabled("zone1"); !enabled {
+		t.Fatal("expected the custom rule to be enabled once the enforcement is resumed")
+	}
+
+	// a window of a single minute, which has just ended
+	end := time.Now().UTC().Add(-time.Minute)
+	zone.Schedule = &cfg.EnforcementScheduleConfig{Windows: []cfg.ScheduleWindow{{
+		Start: end.Add(-time.Minute).Format("15:04"),
+		End:   end.Format("15:04"),
+	}}}
+	if err := m.syncBlockRules(); err != nil {
+		t.Fatal(err)
+	}
+	if _, enabled := api.blockRuleEnabled("zone1"); enabled {
+		t.Fatal("expected the custom rule to be disabled outside of the enforcement schedule")
+	}
+	if rules := api.rulesByZone["zone1"]; len(rules) != 2 || rules[0].Ref != "other" {
+		t.Fatalf("expected the other custom rules to be kept, got %+v", rules)
+	}
+}
+
+func TestIPListItem(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{value: "1.2.3.4", want: "1.2.3.4", ok: true},
+		{value: "1.2.3.4/32", want: "1.2.3.4", ok: true},
+		{value: "1.2.3.4/24", want: "1.2.3.0/24", ok: true},
+		{value: "10.0.0.0/8", want: "10.0.0.0/8", ok: true},
+		{value: "10.0.0.0/7", ok: false},
+		{value: "::ffff:1.2.3.4", want: "1.2.3.4", ok: true},
+		{value: "2001:db8::1", want: "2001:db8::/64", ok: true},
+		{value: "2001:db8:0:0:1::/80", ok: false},
+		{value: "2001:db8::/32", want: "2001:db8::/32", ok: true},
+		{value: "2000::/8", ok: false},
+		{value: "not an ip", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := ipListItem(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: expected %q %t, got %q %t", tt.value, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestIPListItemsLimit(t *testing.T) {
+	api := newRulesetAPI()
+	m := newTestManager(api)
+	m.AccountCfg.Backend = cfg.BackendRuleset
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{{ID: "zone1", Domain: "one.com", Actions: []string{"ban"}, DefaultAction: "ban"}}
+	m.ipListItemByIP = make(map[string]string)
+	for i := range maxIPListItems - 1 {
+		ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+		api.items["item-"+ip] = cf.ListItem{ID: "item-" + ip, IP: &ip}
+		m.ipListItemByIP[ip] = "item-" + ip
+	}
+
+	decisions := []*models.Decision{
+		newDecision("2001:db8::1", "ip", "ban"),
+		newDecision("1.2.3.4", "ip", "ban"),
+	}
+	if err := m.ProcessNewDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.items) != maxIPListItems {
+		t.Fatalf("expected the IP list to hold %d items, got %d", maxIPListItems, len(api.items))
+	}
+	if _, ok := m.ipListItemByIP["2001:db8::/64"]; !ok {
+		t.Fatal("expected the IPv6 address to be listed as its /64")
+	}
+	if _, ok := api.kv[scopedValue("ip", "1.2.3.4")]; !ok {
+		t.Fatalf("expected the decision beyond the limit to be written to KV, got %v", slices.Collect(maps.Keys(api.kv)))
+	}
+
+	decisions = []*models.Decision{
+		newDecision("2001:db8::1", "ip", "ban"),
+		newDecision("5.6.7.8", "ip", "ban"),
+	}
+	if err := m.ProcessDeletedDecisions(decisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deletedIDs) != 1 || api.deletedIDs[0] != "item-2001:db8::/64" {
+		t.Fatalf("expected only the listed /64 to be deleted, got %v", api.deletedIDs)
+	}
+}
+
+func TestCreateTurnstileWidgetsIsolatesZoneFailures(t *testing.T) {
+	api := newFakeAPI()
+	api.widgetErrs = map[string]error{"two.com": errors.New("internal error")}
+	m := newTestManager(api)
+	m.AccountCfg.ZoneConfigs = []*cfg.ZoneConfig{
+		{ID: "zone1", Domain: "one.com", Actions: []string{"captcha"}, DefaultAction: "captcha", Turnstile: cfg.TurnstileConfig{Enabled: true}},
+		{ID: "zone2", Domain: "two.com", Actions: []string{"captcha"}, DefaultAction: "captcha", Turnstile: cfg.TurnstileConfig{Enabled: true}},
+	}
+
+	widgetTokenCfgByDomain, err := m.CreateTurnstileWidgets()
+	if err != nil {
+		t.Fatalf("expected the failure of a single zone to be skipped, got %s", err)
+	}
+	if len(widgetTokenCfgByDomain) != 1 || widgetTokenCfgByDomain["one.com"].SiteKey != "site-one.com" {
+		t.Fatalf("expected only the widget of one.com, got %+v", widgetTokenCfgByDomain)
+	}
+
+	api.widgetErrs["one.com"] = errors.New("internal error")
+	if _, err := m.CreateTurnstileWidgets(); err == nil || !strings.Contains(err.Error(), "two.com") {
+		t.Fatalf("expected an error when every zone fails, got %v", err)
+	}
+}
+
+func TestPruneD1Metrics(t *testing.T) {
+	api := newFakeAPI()
+	m := newTestManager(api)
+	m.hasD1Access = true
+	m.DatabaseID = "db"
+	m.Worker.D1Retention = 24 * time.Hour
+
+	for range 2 {
+		if err := m.UpdateMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prunes := slices.DeleteFunc(slices.Clone(api.d1Queries), func(query cf.QueryD1DatabaseParams) bool { return query.SQL != sqlPruneMetrics })
+	if len(api.d1Queries) != 3 || api.d1Queries[0].SQL != sqlSelectMetrics {
+		t.Fatalf("expected 2 aggregated metrics queries and a single deletion, got %+v", api.d1Queries)
+	}
+	if len(prunes) != 1 {
+		t.Fatalf("expected the rows to be deleted at most every %s, got %d deletions", d1PruneInterval, len(prunes))
+	}
+	before, err := strconv.ParseInt(prunes[0].Parameters[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Now().Add(-24 * time.Hour).Unix(); before < expected-60 || before > expected {
+		t.Fatalf("expected the rows not updated for 24h to be deleted, got the ones before %d", before)
+	}
+
+	// without retention, the rows are kept
+	api.d1Queries = nil
+	m.Worker.D1Retention = 0
+	m.lastD1Prune = time.Time{}
+	if err := m.UpdateMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.d1Queries) != 1 {
+		t.Fatalf("expected only the metrics query, got %+v", api.d1Queries)
+	}
+}
@@ -0,0 +1,65 @@
+package cf
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+const (
+	// sqlAddUpdatedAtColumn migrates the metrics table of a D1 DB created before the rows recorded when the
+	// worker last updated them. The rows it already holds are never pruned, until they're updated again.
+	sqlAddUpdatedAtColumn = "ALTER TABLE metrics ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0"
+	// sqlSelectMetrics reads the metrics, one row each, without their updated_at.
+	sqlSelectMetrics = "SELECT metric_name, origin, remediation_type, ip_type, val FROM metrics"
+	// sqlPruneMetrics deletes the rows the worker didn't update since the parameter, a unix timestamp.
+	sqlPruneMetrics = "DELETE FROM metrics WHERE updated_at > 0 AND updated_at < ?"
+	// d1PruneInterval is how often the metrics rows past the retention are deleted, at most.
+	d1PruneInterval = time.Hour
+)
+
+// migrateD1Table adds the columns missing from the metrics table of a reused D1 DB.
+func (m *CloudflareAccountManager) migrateD1Table() error {
+	_, err := m.api.QueryD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.QueryD1DatabaseParams{
+		DatabaseID: m.DatabaseID,
+		SQL:        sqlAddUpdatedAtColumn,
+	})
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+	return nil
+}
+
+// d1PruneDue tells whether the metrics rows past the retention should be deleted at now, recording the
+// deletion if so.
+func (m *CloudflareAccountManager) d1PruneDue(now time.Time) bool {
+	if m.Worker.D1Retention <= 0 {
+		return false
+	}
+	m.lastMetricsUpdateLock.Lock()
+	defer m.lastMetricsUpdateLock.Unlock()
+	if !m.lastD1Prune.IsZero() && now.Sub(m.lastD1Prune) < d1PruneInterval {
+		return false
+	}
+	m.lastD1Prune = now
+	return true
+}
+
+// pruneD1Metrics deletes the metrics rows the worker didn't update within the retention, when due. Their
+// requests are still counted by the gauges they were exposed with, and a row written again later starts
+// from 0, which the usage metrics pushed to LAPI treat as a counter reset.
+func (m *CloudflareAccountManager) pruneD1Metrics(now time.Time) error {
+	if !m.d1PruneDue(now) {
+		return nil
+	}
+	before := now.Add(-m.Worker.D1Retention)
+	m.logger.Debugf("Deleting the D1 metrics rows not updated since %s", before.Format(time.RFC3339))
+	_, err := m.api.QueryD1Database(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.QueryD1DatabaseParams{
+		DatabaseID: m.DatabaseID,
+		SQL:        sqlPruneMetrics,
+		Parameters: []string{strconv.FormatInt(before.Unix(), 10)},
+	})
+	return err
+}
@@ -0,0 +1,58 @@
+package cf
+
+import (
+	"fmt"
+
+	cf "github.com/cloudflare/cloudflare-go"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+// EnforcementKeyName holds "false" while the enforcement is paused, the worker then letting every request
+// through. It's deleted when the enforcement resumes.
+const EnforcementKeyName = "ENFORCEMENT_ENABLED"
+
+// SetEnforcement pauses or resumes the enforcement of the decisions by the worker of the account. The
+// decisions keep being written while it's paused and the infra is left in place, so that resuming
+// enforces them again right away. The custom rule of the ruleset backend is disabled while it's paused.
+func (m *CloudflareAccountManager) SetEnforcement(enabled bool) error {
+	rc := cf.AccountIdentifier(m.AccountCfg.ID)
+	if enabled {
+		_, err := m.api.DeleteWorkersKVEntries(m.Ctx, rc, cf.DeleteWorkersKVEntriesParams{
+			NamespaceID: m.NamespaceID,
+			Keys:        []string{EnforcementKeyName},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to resume the enforcement: %w", err)
+		}
+		m.logger.Info("Enforcement resumed")
+	} else {
+		_, err := m.api.WriteWorkersKVEntries(m.Ctx, rc, cf.WriteWorkersKVEntriesParams{
+			NamespaceID: m.NamespaceID,
+			KVs:         []*cf.WorkersKVPair{{Key: EnforcementKeyName, Value: "false"}},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to pause the enforcement: %w", err)
+		}
+		m.logger.Warn("Enforcement paused, the worker lets every request through until it's resumed")
+	}
+	m.setEnforcementPaused(!enabled)
+	if err := m.syncBlockRules(); err != nil {
+		return fmt.Errorf("unable to update the custom rule blocking the IPs: %w", err)
+	}
+	return nil
+}
+
+// EnforcementPaused tells whether the worker of the account lets every request through.
+func (m *CloudflareAccountManager) EnforcementPaused() bool {
+	return m.enforcementPaused.Load()
+}
+
+func (m *CloudflareAccountManager) setEnforcementPaused(paused bool) {
+	m.enforcementPaused.Store(paused)
+	value := 0.0
+	if paused {
+		value = 1
+	}
+	metrics.EnforcementPaused.WithLabelValues(m.AccountCfg.Name).Set(value)
+}
@@ -0,0 +1,109 @@
+package cf
+
+import "net/netip"
+
+// ipRangeNode is a node of a binary trie of CIDRs, the path from the root giving the bits of the prefix.
+type ipRangeNode struct {
+	children [2]*ipRangeNode
+	action   string // empty if the prefix of the node isn't a range
+}
+
+func (n *ipRangeNode) insert(prefix netip.Prefix, action string) {
+	addr := prefix.Addr().AsSlice()
+	node := n
+	for bit := 0; bit < prefix.Bits(); bit++ {
+		b := addr[bit/8] >> (7 - bit%8) & 1
+		if node.children[b] == nil {
+			node.children[b] = &ipRangeNode{}
+		}
+		node = node.children[b]
+	}
+	node.action = action
+}
+
+// compact removes the ranges which don't change the action of any address under longest-prefix match,
+// inherited being the action of the closest range containing the node. Two sibling ranges of the same
+// action are merged into their parent, which they fully cover.
+func (n *ipRangeNode) compact(inherited string) {
+	effective := inherited
+	if n.action != "" {
+		effective = n.action
+	}
+	for _, child := range n.children {
+		if child != nil {
+			child.compact(effective)
+		}
+	}
+	left, right := n.children[0], n.children[1]
+	if left != nil && right != nil && left.action != "" && left.action == right.action {
+		// any action of the node itself is shadowed by its children
+		n.action = left.action
+		left.action, right.action = "", ""
+	}
+	if n.action == inherited {
+		n.action = ""
+	}
+}
+
+func (n *ipRangeNode) collect(addr []byte, bits int, actionByIPRange map[string]string) {
+	if n.action != "" {
+		ip, _ := netip.AddrFromSlice(addr)
+		actionByIPRange[netip.PrefixFrom(ip, bits).String()] = n.action
+	}
+	for b, child := range n.children {
+		if child == nil {
+			continue
+		}
+		childAddr := append([]byte(nil), addr...)
+		childAddr[bits/8] |= byte(b) << (7 - bits%8)
+		child.collect(childAddr, bits+1, actionByIPRange)
+	}
+}
+
+// aggregateIPRanges returns a smaller set of ranges giving every address the same action as
+// actionByIPRange, when the most specific range containing an address decides of its action. Contained
+// ranges of the same action as their closest containing range are dropped, and ranges fully covered by
+// two ranges of the same action are merged. Values which aren't valid CIDRs are kept as is.
+func aggregateIPRanges(actionByIPRange map[string]string) map[string]string {
+	aggregated := make(map[string]string, len(actionByIPRange))
+	v4, v6 := &ipRangeNode{}, &ipRangeNode{}
+	for ipRange, action := range actionByIPRange {
+		prefix, err := netip.ParsePrefix(ipRange)
+		if err != nil || action == "" {
+			aggregated[ipRange] = action
+			continue
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4() {
+			v4.insert(prefix, action)
+		} else {
+			v6.insert(prefix, action)
+		}
+	}
+	v4.compact("")
+	v4.collect(make([]byte, 4), 0, aggregated)
+	v6.compact("")
+	v6.collect(make([]byte, 16), 0, aggregated)
+	return aggregated
+}
+
+// diffIPRanges counts the ranges of updated which aren't in current, the ones whose action changed, and
+// the ranges of current which aren't in updated.
+func diffIPRanges(current map[string]string, updated map[string]string) (int, int, int) {
+	added, changed, removed := 0, 0, 0
+	for ipRange, action := range updated {
+		currentAction, ok := current[ipRange]
+		switch {
+		case !ok:
+			added++
+		case currentAction != action:
+			changed++
+		}
+	}
+	for ipRange := range current {
+		if _, ok := updated[ipRange]; !ok {
+			removed++
+		}
+	}
+	return added, changed, removed
+}
@@ -4,5 +4,6 @@ CREATE TABLE IF NOT EXISTS metrics (
   origin TEXT NOT NULL DEFAULT '',
   remediation_type TEXT NOT NULL DEFAULT '',
   ip_type TEXT NOT NULL DEFAULT '',
+  updated_at INTEGER NOT NULL DEFAULT 0,
   UNIQUE(metric_name, origin, remediation_type, ip_type)
 );
\ No newline at end of file
@@ -0,0 +1,55 @@
+package cf
+
+import (
+	"context"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// listPageSize is the number of items requested per page, accepted by every paginated list endpoint used.
+const listPageSize = 100
+
+// listAllPages calls list for every page until the last one, as told by the returned ResultInfo, and
+// returns the items of all of them. A nil ResultInfo means that the response isn't paginated, like the worker
+// routes of a zone which are all returned at once.
+func listAllPages[T any](list func(page cf.ResultInfo) ([]T, *cf.ResultInfo, error)) ([]T, error) {
+	all := make([]T, 0)
+	for page := 1; ; page++ {
+		items, resultInfo, err := list(cf.ResultInfo{Page: page, PerPage: listPageSize})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if resultInfo == nil || len(items) == 0 || page >= resultInfo.TotalPages {
+			return all, nil
+		}
+	}
+}
+
+// listKVNamespaces returns every KV namespace of the account.
+func (m *CloudflareAccountManager) listKVNamespaces() ([]cf.WorkersKVNamespace, error) {
+	return listAllPages(func(page cf.ResultInfo) ([]cf.WorkersKVNamespace, *cf.ResultInfo, error) {
+		return m.api.ListWorkersKVNamespaces(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListWorkersKVNamespacesParams{ResultInfo: page})
+	})
+}
+
+// listTurnstileWidgets returns every turnstile widget of the account.
+func (m *CloudflareAccountManager) listTurnstileWidgets() ([]cf.TurnstileWidget, error) {
+	return listAllPages(func(page cf.ResultInfo) ([]cf.TurnstileWidget, *cf.ResultInfo, error) {
+		return m.api.ListTurnstileWidgets(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListTurnstileWidgetParams{ResultInfo: page})
+	})
+}
+
+// listD1Databases returns the D1 DBs of the account matching name, or all of them if it's empty.
+func (m *CloudflareAccountManager) listD1Databases(name string) ([]cf.D1Database, error) {
+	return listAllPages(func(page cf.ResultInfo) ([]cf.D1Database, *cf.ResultInfo, error) {
+		return m.api.ListD1Databases(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListD1DatabasesParams{Name: name, ResultInfo: page})
+	})
+}
+
+// listDNSRecords returns every DNS record of the zone.
+func (m *CloudflareAccountManager) listDNSRecords(ctx context.Context, zoneID string) ([]cf.DNSRecord, error) {
+	return listAllPages(func(page cf.ResultInfo) ([]cf.DNSRecord, *cf.ResultInfo, error) {
+		return m.api.ListDNSRecords(ctx, cf.ZoneIdentifier(zoneID), cf.ListDNSRecordsParams{ResultInfo: page})
+	})
+}
@@ -0,0 +1,113 @@
+package cf
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+// rateBudgetMaxWait bounds the pause before a batch, Cloudflare resetting the budget of an account every
+// 5 minutes.
+const rateBudgetMaxWait = 5 * time.Minute
+
+// rateBudget is the remaining API quota of an account, as last reported by Cloudflare. It's shared by the
+// transport of the account client, which updates it, and the manager of the account, which waits on it.
+// The zero value knows nothing about the quota and never asks to wait.
+type rateBudget struct {
+	lock      sync.Mutex
+	known     bool
+	remaining int
+	resetAt   time.Time
+}
+
+// parseRateLimitHeaders returns the remaining quota and the time until it resets from the headers of a
+// response. Both the Ratelimit header of Cloudflare, like `"default";r=1199;t=299`, and the
+// RateLimit-Remaining/RateLimit-Reset headers, prefixed by X- or not, are understood.
+func parseRateLimitHeaders(header http.Header) (int, time.Duration, bool) {
+	if value := header.Get("Ratelimit"); value != "" {
+		remaining, reset := -1, -1
+		for _, param := range strings.Split(value, ";") {
+			key, raw, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				continue
+			}
+			switch key {
+			case "r":
+				remaining = n
+			case "t":
+				reset = n
+			}
+		}
+		if remaining >= 0 && reset >= 0 {
+			return remaining, time.Duration(reset) * time.Second, true
+		}
+	}
+	for _, prefix := range []string{"", "X-"} {
+		remaining, err := strconv.Atoi(header.Get(prefix + "RateLimit-Remaining"))
+		if err != nil || remaining < 0 {
+			continue
+		}
+		reset, err := strconv.Atoi(header.Get(prefix + "RateLimit-Reset"))
+		if err != nil || reset < 0 {
+			continue
+		}
+		return remaining, time.Duration(reset) * time.Second, true
+	}
+	return 0, 0, false
+}
+
+// update records the quota reported by a response, and exposes it for the account.
+func (b *rateBudget) update(accountName string, header http.Header, now time.Time) {
+	remaining, reset, ok := parseRateLimitHeaders(header)
+	if !ok {
+		return
+	}
+	b.lock.Lock()
+	b.known = true
+	b.remaining = remaining
+	b.resetAt = now.Add(reset)
+	b.lock.Unlock()
+	metrics.CloudflareAPIRateRemaining.WithLabelValues(accountName).Set(float64(remaining))
+}
+
+// delay returns how long to wait for the budget to reset before making more calls, 0 if more than
+// minRemaining calls are left or nothing is known about the budget.
+func (b *rateBudget) delay(minRemaining int, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.known || b.remaining > minRemaining || !now.Before(b.resetAt) {
+		return 0
+	}
+	if delay := b.resetAt.Sub(now); delay < rateBudgetMaxWait {
+		return delay
+	}
+	return rateBudgetMaxWait
+}
+
+// waitForRateBudget pauses until the API budget of the account resets if it's running low, to submit the
+// next batch without being rate limited. It returns early with the error of the context if it's done.
+func (m *CloudflareAccountManager) waitForRateBudget(ctx context.Context) error {
+	if m.rateBudget == nil || m.rateBudgetMinRemaining <= 0 {
+		return nil
+	}
+	delay := m.rateBudget.delay(m.rateBudgetMinRemaining, time.Now())
+	if delay == 0 {
+		return nil
+	}
+	m.logger.Infof("Cloudflare API budget is running low, pausing for %s until it resets", delay.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,190 @@
+package cf
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// routesDiff holds the routes of a zone to bind and to delete when its config is reloaded.
+type routesDiff struct {
+	zone                 *cfg.ZoneConfig
+	addedRoutes          []string
+	removedRoutes        []string
+	addedObserveRoutes   []string
+	removedObserveRoutes []string
+}
+
+func diffRoutes(current []string, updated []string) ([]string, []string) {
+	added := make([]string, 0)
+	for _, route := range updated {
+		if !slices.Contains(current, route) {
+			added = append(added, route)
+		}
+	}
+	removed := make([]string, 0)
+	for _, route := range current {
+		if !slices.Contains(updated, route) {
+			removed = append(removed, route)
+		}
+	}
+	return added, removed
+}
+
+// ReloadZones applies the zones of a reloaded config without redeploying the infra: the worker is
+// updated with the actions of the zones, the new routes are bound and the removed ones are deleted.
+// The KV namespace, and the decisions it holds, are kept. Turnstile changes can't be applied this way
+// and require a restart.
+func (m *CloudflareAccountManager) ReloadZones(zoneConfigs []*cfg.ZoneConfig) error {
+	zones, err := m.api.ListZones(m.Ctx)
+	if err != nil {
+		return err
+	}
+	if err := setZoneDomains(zoneConfigs, zones, m.AccountCfg.ID); err != nil {
+		return err
+	}
+
+	currentZones := make(map[string]*cfg.ZoneConfig)
+	for _, zone := range m.zones() {
+		currentZones[zone.ID] = zone
+	}
+	diffs := make([]routesDiff, 0)
+	for _, zone := range zoneConfigs {
+		current, ok := currentZones[zone.ID]
+		delete(currentZones, zone.ID)
+		if !ok {
+			if zone.Turnstile.Enabled {
+				return fmt.Errorf("zone %s has turnstile enabled, adding it requires a restart", zone.Domain)
+			}
+			current = &cfg.ZoneConfig{}
+		} else if !reflect.DeepEqual(current.Turnstile, zone.Turnstile) {
+			return fmt.Errorf("turnstile config of zone %s changed, applying it requires a restart", zone.Domain)
+		}
+		diff := routesDiff{zone: zone}
+		diff.addedRoutes, diff.removedRoutes = diffRoutes(current.RoutesToProtect, zone.RoutesToProtect)
+		diff.addedObserveRoutes, diff.removedObserveRoutes = diffRoutes(current.ObserveRoutes, zone.ObserveRoutes)
+		diffs = append(diffs, diff)
+	}
+	// the zones left were removed from the config
+	for _, zone := range currentZones {
+		diffs = append(diffs, routesDiff{zone: zone, removedRoutes: zone.RoutesToProtect, removedObserveRoutes: zone.ObserveRoutes})
+	}
+
+	m.zonesLock.Lock()
+	m.AccountCfg.ZoneConfigs = zoneConfigs
+	// the zones of the reloaded config all exist
+	m.removedZones = nil
+	m.zoneLoggers = make(map[string]*log.Entry, len(zoneConfigs))
+	for _, zone := range zoneConfigs {
+		m.zoneLoggers[zone.ID] = newZoneLogger(m.logger, zone)
+	}
+	m.zonesLock.Unlock()
+
+	if err := m.writeCountryAllowlist(m.Ctx); err != nil {
+		return err
+	}
+	if err := m.writeResponseConfig(m.Ctx); err != nil {
+		return err
+	}
+	if err := m.writeBanTemplates(m.Ctx); err != nil {
+		return err
+	}
+	varActionsForZoneByDomain, err := actionsForZoneByDomain(zoneConfigs)
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Updating worker %s version %s", m.Worker.ScriptName, WorkerScriptVersion())
+	worker, err := m.api.UploadWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.CreateWorkerParams(workerScript, m.NamespaceID, varActionsForZoneByDomain, m.DatabaseID))
+	if err != nil {
+		return err
+	}
+	m.workerUploaded(worker)
+	m.setKVPayloadBytes(cfg.VarNameForActionsByDomain, len(varActionsForZoneByDomain))
+	if m.Worker.DispatchNamespace != "" {
+		return nil
+	}
+
+	observerID := ""
+	for _, diff := range diffs {
+		if len(diff.addedObserveRoutes) > 0 {
+			if observerID, err = m.deployObserver(m.Ctx); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// the routes are bound before the removed ones are deleted, so that a route replaced by a broader
+	// pattern is never left unprotected. Patterns moved between routes_to_protect and observe_routes are
+	// deleted first, as a zone can't have two routes with the same pattern.
+	for _, diff := range diffs {
+		added := append(slices.Clone(diff.addedRoutes), diff.addedObserveRoutes...)
+		if err := m.deleteRemovedRoutes(diff, func(pattern string) bool { return slices.Contains(added, pattern) }); err != nil {
+			return err
+		}
+	}
+	zg := errgroup.Group{}
+	zg.SetLimit(max(m.routeConcurrency, 1))
+	for _, diff := range diffs {
+		m.bindWorkerRoutes(&zg, diff.zone, diff.addedRoutes, worker.ID)
+		if observerID != "" {
+			m.bindWorkerRoutes(&zg, diff.zone, diff.addedObserveRoutes, observerID)
+		}
+	}
+	if err := zg.Wait(); err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		added := append(slices.Clone(diff.addedRoutes), diff.addedObserveRoutes...)
+		if err := m.deleteRemovedRoutes(diff, func(pattern string) bool { return !slices.Contains(added, pattern) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRemovedRoutes deletes the routes removed from the zone matching filter, each from the worker it
+// was bound to.
+func (m *CloudflareAccountManager) deleteRemovedRoutes(diff routesDiff, filter func(string) bool) error {
+	removed := make(map[string]string)
+	for _, pattern := range diff.removedRoutes {
+		if filter(pattern) {
+			removed[pattern] = m.Worker.ScriptName
+		}
+	}
+	for _, pattern := range diff.removedObserveRoutes {
+		if filter(pattern) {
+			removed[pattern] = m.Worker.ObserverScriptName()
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return m.deleteWorkerRoutes(diff.zone, removed)
+}
+
+// deleteWorkerRoutes deletes the routes of the zone whose pattern is in scriptByPattern, when they are
+// bound to the script it maps to.
+func (m *CloudflareAccountManager) deleteWorkerRoutes(zone *cfg.ZoneConfig, scriptByPattern map[string]string) error {
+	zoneLogger := m.zoneLogger(zone)
+	routeResp, err := m.api.ListWorkerRoutes(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.ListWorkerRoutesParams{})
+	if err != nil {
+		return err
+	}
+	for _, route := range routeResp.Routes {
+		if script, ok := scriptByPattern[route.Pattern]; !ok || route.ScriptName != script {
+			continue
+		}
+		zoneLogger.Infof("Deleting worker route %s", route.Pattern)
+		if _, err := m.api.DeleteWorkerRoute(m.Ctx, cf.ZoneIdentifier(zone.ID), route.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package cf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// RouteResource is a worker route bound to one of the scripts of the bouncer.
+type RouteResource struct {
+	Zone    string `json:"zone"`
+	ID      string `json:"id"`
+	Pattern string `json:"pattern"`
+	Script  string `json:"script"`
+}
+
+// KVNamespaceResource is the KV namespace of the bouncer.
+type KVNamespaceResource struct {
+	ID   string `json:"id"`
+	Keys int    `json:"keys"`
+}
+
+// D1DatabaseResource is the D1 DB of the bouncer.
+type D1DatabaseResource struct {
+	ID string `json:"id"`
+}
+
+// WidgetResource is a turnstile widget created by the bouncer.
+type WidgetResource struct {
+	SiteKey string   `json:"site_key"`
+	Domains []string `json:"domains"`
+}
+
+// Resources are the Cloudflare resources of an account which the bouncer manages, as listed by the
+// list-resources command.
+type Resources struct {
+	Account     string               `json:"account"`
+	Scripts     []string             `json:"scripts"`
+	Routes      []RouteResource      `json:"routes"`
+	KVNamespace *KVNamespaceResource `json:"kv_namespace"`
+	D1Database  *D1DatabaseResource  `json:"d1_database"`
+	Widgets     []WidgetResource     `json:"widgets"`
+}
+
+// ListResources lists the resources the bouncer owns in the account, the same way CleanUpExistingWorkers
+// finds them, without changing anything. The routes of every zone of the account are listed, not only the
+// configured ones, to find those left behind. The token may lack the D1 permissions, so D1 listing errors
+// are only logged.
+func (m *CloudflareAccountManager) ListResources() (*Resources, error) {
+	resources := &Resources{
+		Account: m.AccountCfg.Name,
+		Scripts: make([]string, 0),
+		Routes:  make([]RouteResource, 0),
+		Widgets: make([]WidgetResource, 0),
+	}
+	scriptNames := []string{m.Worker.ScriptName, m.Worker.ObserverScriptName()}
+
+	// scripts of a dispatch namespace can't be listed this way
+	if m.Worker.DispatchNamespace == "" {
+		workers, _, err := m.api.ListWorkers(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListWorkersParams{})
+		if err != nil {
+			return nil, err
+		}
+		for _, worker := range workers.WorkerList {
+			if slices.Contains(scriptNames, worker.ID) {
+				resources.Scripts = append(resources.Scripts, worker.ID)
+			}
+		}
+	}
+
+	zones, err := m.api.ListZones(m.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	routesLock := sync.Mutex{}
+	g := errgroup.Group{}
+	g.SetLimit(max(m.cleanupConcurrency, 1))
+	for _, z := range zones {
+		if z.Account.ID != m.AccountCfg.ID {
+			continue
+		}
+		zone := z
+		g.Go(func() error {
+			routeResp, err := m.api.ListWorkerRoutes(m.Ctx, cf.ZoneIdentifier(zone.ID), cf.ListWorkerRoutesParams{})
+			if err != nil {
+				return err
+			}
+			routesLock.Lock()
+			defer routesLock.Unlock()
+			for _, route := range routeResp.Routes {
+				if slices.Contains(scriptNames, route.ScriptName) {
+					resources.Routes = append(resources.Routes, RouteResource{Zone: zone.Name, ID: route.ID, Pattern: route.Pattern, Script: route.ScriptName})
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(resources.Routes, func(a, b RouteResource) int {
+		if c := strings.Compare(a.Zone, b.Zone); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Pattern, b.Pattern)
+	})
+
+	kvNamespaces, err := m.listKVNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, kvNamespace := range kvNamespaces {
+		if kvNamespace.Title != m.Worker.KVNameSpaceName {
+			continue
+		}
+		m.NamespaceID = kvNamespace.ID
+		keys, err := m.listKVKeys()
+		if err != nil {
+			return nil, err
+		}
+		resources.KVNamespace = &KVNamespaceResource{ID: kvNamespace.ID, Keys: len(keys)}
+		break
+	}
+
+	if !m.d1Disabled() {
+		db, found, err := m.findD1Database()
+		if err != nil {
+			m.logger.Warnf("Unable to list D1 DBs, make sure your token has the proper permissions: %s", err)
+		} else if found {
+			resources.D1Database = &D1DatabaseResource{ID: db.UUID}
+		}
+	}
+
+	widgets, err := m.listTurnstileWidgets()
+	if err != nil {
+		return nil, err
+	}
+	for _, widget := range widgets {
+		if widget.Name == WidgetName {
+			resources.Widgets = append(resources.Widgets, WidgetResource{SiteKey: widget.SiteKey, Domains: widget.Domains})
+		}
+	}
+	return resources, nil
+}
+
+// ConfigDrift is what differs between the infra of an account in Cloudflare and the one its config
+// describes, as reported by the diff-config command.
+type ConfigDrift struct {
+	Account string `json:"account"`
+	// routes of the config not bound in Cloudflare, and routes bound to the scripts of the bouncer which
+	// the config doesn't have
+	MissingRoutes    []RouteResource `json:"missing_routes"`
+	UnexpectedRoutes []RouteResource `json:"unexpected_routes"`
+	// version of the deployed worker, empty if it isn't deployed, and of the embedded one
+	DeployedWorkerVersion string `json:"deployed_worker_version"`
+	WorkerVersion         string `json:"worker_version"`
+	// domains of the zones with turnstile enabled without a widget, and widgets of no such zone
+	MissingWidgets    []string         `json:"missing_widgets"`
+	UnexpectedWidgets []WidgetResource `json:"unexpected_widgets"`
+	// KV keys of the namespace of the bouncer, nil if it doesn't exist
+	KVKeys *int `json:"kv_keys"`
+}
+
+// Drifted tells whether the infra differs from the config. The worker isn't compared when the bouncer
+// doesn't manage it.
+func (d *ConfigDrift) Drifted() bool {
+	return len(d.MissingRoutes) > 0 || len(d.UnexpectedRoutes) > 0 || d.DeployedWorkerVersion != d.WorkerVersion ||
+		len(d.MissingWidgets) > 0 || len(d.UnexpectedWidgets) > 0 || d.KVKeys == nil
+}
+
+// DiffConfig compares the resources of the account in Cloudflare with the ones its config describes,
+// without changing anything.
+func (m *CloudflareAccountManager) DiffConfig() (*ConfigDrift, error) {
+	resources, err := m.ListResources()
+	if err != nil {
+		return nil, err
+	}
+	drift := &ConfigDrift{
+		Account:           m.AccountCfg.Name,
+		MissingRoutes:     make([]RouteResource, 0),
+		UnexpectedRoutes:  make([]RouteResource, 0),
+		MissingWidgets:    make([]string, 0),
+		UnexpectedWidgets: make([]WidgetResource, 0),
+	}
+	if resources.KVNamespace != nil {
+		drift.KVKeys = &resources.KVNamespace.Keys
+	}
+
+	// the worker and its routes are left to another tool without manage_worker, and scripts of a
+	// dispatch namespace are neither routed nor readable
+	if m.Worker.ManagesWorker() && m.Worker.DispatchNamespace == "" {
+		drift.WorkerVersion = WorkerScriptVersion()
+		deployed, err := m.api.GetWorker(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.ScriptName)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			sum := sha256.Sum256([]byte(deployed.Script))
+			drift.DeployedWorkerVersion = hex.EncodeToString(sum[:])[:12]
+		}
+
+		desired := make([]RouteResource, 0)
+		for _, zone := range m.zones() {
+			for _, pattern := range zone.RoutesToProtect {
+				desired = append(desired, RouteResource{Zone: zone.Domain, Pattern: pattern, Script: m.Worker.ScriptName})
+			}
+			for _, pattern := range zone.ObserveRoutes {
+				desired = append(desired, RouteResource{Zone: zone.Domain, Pattern: pattern, Script: m.Worker.ObserverScriptName()})
+			}
+		}
+		sameRoute := func(a RouteResource, b RouteResource) bool {
+			return a.Zone == b.Zone && a.Pattern == b.Pattern && a.Script == b.Script
+		}
+		for _, route := range desired {
+			if !slices.ContainsFunc(resources.Routes, func(existing RouteResource) bool { return sameRoute(existing, route) }) {
+				drift.MissingRoutes = append(drift.MissingRoutes, route)
+			}
+		}
+		for _, route := range resources.Routes {
+			if !slices.ContainsFunc(desired, func(wanted RouteResource) bool { return sameRoute(wanted, route) }) {
+				drift.UnexpectedRoutes = append(drift.UnexpectedRoutes, route)
+			}
+		}
+	}
+
+	turnstileDomains := make([]string, 0)
+	for _, zone := range m.zones() {
+		if zone.Turnstile.Enabled {
+			turnstileDomains = append(turnstileDomains, zone.Domain)
+		}
+	}
+	for _, domain := range turnstileDomains {
+		if !slices.ContainsFunc(resources.Widgets, func(widget WidgetResource) bool { return slices.Contains(widget.Domains, domain) }) {
+			drift.MissingWidgets = append(drift.MissingWidgets, domain)
+		}
+	}
+	for _, widget := range resources.Widgets {
+		if !slices.ContainsFunc(widget.Domains, func(domain string) bool { return slices.Contains(turnstileDomains, domain) }) {
+			drift.UnexpectedWidgets = append(drift.UnexpectedWidgets, widget)
+		}
+	}
+	return drift, nil
+}
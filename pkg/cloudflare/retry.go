@@ -0,0 +1,167 @@
+package cf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+const (
+	retryMaxAttempts = 3
+	retryMinDelay    = time.Second
+	retryMaxDelay    = 30 * time.Second
+)
+
+// retryPolicy decides which failed API calls are worth retrying. The zero value never retries.
+type retryPolicy struct {
+	maxRetries  int
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	statusCodes []int
+	cfCodes     []int
+}
+
+func newRetryPolicy(apiCfg *cfg.CloudflareAPIConfig) retryPolicy {
+	return retryPolicy{
+		maxRetries:  retryMaxAttempts,
+		minDelay:    retryMinDelay,
+		maxDelay:    retryMaxDelay,
+		statusCodes: apiCfg.RetryableStatusCodes,
+		cfCodes:     apiCfg.RetryableCFErrorCodes,
+	}
+}
+
+// Subset of the Cloudflare API response envelope carrying the errors.
+type apiResponseErrors struct {
+	Errors []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// retryable tells whether the outcome of an attempt should be retried. The body of the response is
+// restored after being read.
+func (p retryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	if slices.Contains(p.statusCodes, resp.StatusCode) {
+		return true
+	}
+	if len(p.cfCodes) == 0 || resp.StatusCode < 400 || resp.Body == nil ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	apiErrors := apiResponseErrors{}
+	if err := json.Unmarshal(body, &apiErrors); err != nil {
+		return false
+	}
+	for _, apiErr := range apiErrors.Errors {
+		if slices.Contains(p.cfCodes, apiErr.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry, doubling from minDelay up to maxDelay. A
+// Retry-After header sent with a 429 takes precedence.
+func (p retryPolicy) delay(retry int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			if delay := time.Duration(seconds) * time.Second; delay < p.maxDelay {
+				return delay
+			}
+			return p.maxDelay
+		}
+	}
+	delay := p.minDelay << (retry - 1)
+	if delay <= 0 || delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return delay
+}
+
+// roundTripWithRetries sends req with send, retrying the retryable failures. Requests with a body are
+// only retried if the body can be obtained again.
+func (p retryPolicy) roundTripWithRetries(req *http.Request, accountName string, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		attempt := req
+		if retry > 0 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt = req.Clone(req.Context())
+			attempt.Body = body
+		}
+		resp, err := send(attempt)
+		if retry >= p.maxRetries || !p.retryable(req, resp, err) ||
+			(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return resp, err
+		}
+		delay := p.delay(retry+1, resp)
+		if err != nil {
+			log.WithField("account", accountName).Debugf("Retrying %s %s in %s: %s", req.Method, req.URL.Path, delay, err)
+		} else {
+			log.WithField("account", accountName).Debugf("Retrying %s %s in %s: status %d", req.Method, req.URL.Path, delay, resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransient tells whether a failed API call may succeed if made again later: the API rate limited it or
+// failed on its side, or the network did.
+func isTransient(err error) bool {
+	var rateLimitErr *cf.RatelimitError
+	var serviceErr *cf.ServiceError
+	var netErr net.Error
+	return errors.As(err, &rateLimitErr) || errors.As(err, &serviceErr) || errors.As(err, &netErr)
+}
+
+// retryStep runs a step of the deployment, retrying it with an exponential backoff up to deploy_retries
+// times while it fails with a transient error. Retrying stops as soon as the context of the manager is done,
+// in which case the last error of the step is returned.
+func (m *CloudflareAccountManager) retryStep(name string, step func() error) error {
+	for retry := 0; ; retry++ {
+		err := step()
+		if err == nil || retry >= m.deployRetries || !isTransient(err) || m.Ctx.Err() != nil {
+			return err
+		}
+		delay := m.deployRetryDelay << retry
+		if delay <= 0 || delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		m.logger.Warnf("Unable to %s, retrying in %s: %s", name, delay, err)
+		select {
+		case <-m.Ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package cf
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+const (
+	// IPListName is the account IP list holding the banned IPs with the ruleset backend, and the banned IP
+	// ranges with use_ip_lists.
+	IPListName = "crowdsec_cloudflare_worker_bouncer"
+	// BlockRuleRef identifies the WAF custom rule of the zones blocking the IPs of the list.
+	BlockRuleRef = "crowdsec-cloudflare-worker-bouncer"
+	// customRulesPhase is the phase of the WAF custom rules, run before the workers.
+	customRulesPhase = "http_request_firewall_custom"
+	// maxIPListItems is the number of items a list can hold, the decisions beyond it are written to KV.
+	maxIPListItems = 10000
+)
+
+// enforcementScheduleInterval is how often the custom rules follow the enforcement schedules, whose
+// windows are set to the minute.
+var enforcementScheduleInterval = time.Minute
+
+// usesRuleset tells whether ban decisions are enforced by a WAF custom rule instead of the worker: the
+// ones of IPs with the ruleset backend, and the ones of IP ranges with use_ip_lists.
+func (m *CloudflareAccountManager) usesRuleset() bool {
+	return m.AccountCfg.Backend == cfg.BackendRuleset || m.AccountCfg.UseIPLists
+}
+
+// blocksWithRuleset tells whether the custom rule is added to the zone: it must enforce the decisions
+// and ban, the other zones let the banned IPs through like the worker would.
+func blocksWithRuleset(zone *cfg.ZoneConfig) bool {
+	return zone.Enforces() && slices.Contains(zone.Actions, "ban")
+}
+
+// deployRuleset creates the IP list of the account, adopting the one left by a previous run along with
+// its items, and adds the custom rule blocking its IPs to the zones.
+func (m *CloudflareAccountManager) deployRuleset() error {
+	if !m.usesRuleset() {
+		return nil
+	}
+	rc := cf.AccountIdentifier(m.AccountCfg.ID)
+	lists, err := m.api.ListLists(m.Ctx, rc, cf.ListListsParams{})
+	if err != nil {
+		return fmt.Errorf("unable to list the IP lists, make sure your token has the Account Rule Lists permission: %w", err)
+	}
+	m.ipListID = ""
+	m.ipListItemByIP = make(map[string]string)
+	for _, list := range lists {
+		if list.Name == IPListName {
+			m.ipListID = list.ID
+			break
+		}
+	}
+	if m.ipListID == "" {
+		m.logger.Infof("Creating IP list %s", IPListName)
+		list, err := m.api.CreateList(m.Ctx, rc, cf.ListCreateParams{
+			Name:        IPListName,
+			Description: "IPs banned by CrowdSec",
+			Kind:        cf.ListTypeIP,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create the IP list %s: %w", IPListName, err)
+		}
+		m.ipListID = list.ID
+	} else {
+		m.logger.Infof("Adopting IP list %s", IPListName)
+		items, err := m.api.ListListItems(m.Ctx, rc, cf.ListListItemsParams{ID: m.ipListID})
+		if err != nil {
+			return fmt.Errorf("unable to list the items of the IP list %s: %w", IPListName, err)
+		}
+		m.setIPListItems(items)
+	}
+
+	for _, zone := range m.zones() {
+		if err := m.addBlockRule(zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIPListItems replaces the cached items of the IP list.
+func (m *CloudflareAccountManager) setIPListItems(items []cf.ListItem) {
+	m.ipListItemByIP = make(map[string]string, len(items))
+	for _, item := range items {
+		if item.IP == nil {
+			continue
+		}
+		if ip, ok := ipListItem(*item.IP); ok {
+			m.ipListItemByIP[ip] = item.ID
+		}
+	}
+}
+
+// blockRuleEnabled tells whether the custom rule of the zone blocks the IPs at now: it's disabled while
+// the enforcement is paused and outside of the enforcement schedule of the zone, like the worker.
+func (m *CloudflareAccountManager) blockRuleEnabled(zone *cfg.ZoneConfig, now time.Time) bool {
+	return !m.EnforcementPaused() && (zone.Schedule == nil || zone.Schedule.Covers(now))
+}
+
+// addBlockRule adds the custom rule blocking the IPs of the list to the zone, or sets its enabled flag
+// when the zone already has it. The other custom rules of the zone are kept.
+func (m *CloudflareAccountManager) addBlockRule(zone *cfg.ZoneConfig) error {
+	if !m.usesRuleset() || !blocksWithRuleset(zone) {
+		return nil
+	}
+	m.blockRuleLock.Lock()
+	defer m.blockRuleLock.Unlock()
+	if m.blockRuleEnabledByZone == nil {
+		m.blockRuleEnabledByZone = make(map[string]bool)
+	}
+	enabled := m.blockRuleEnabled(zone, time.Now())
+	rc := cf.ZoneIdentifier(zone.ID)
+	ruleset, err := m.api.GetEntrypointRuleset(m.Ctx, rc, customRulesPhase)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("unable to read the custom rules of zone %s, make sure your token has the Zone WAF permission: %w", zone.Domain, err)
+	}
+	rules := slices.Clone(ruleset.Rules)
+	i := slices.IndexFunc(rules, func(rule cf.RulesetRule) bool { return rule.Ref == BlockRuleRef })
+	switch {
+	case i < 0:
+		m.zoneLogger(zone).Infof("Adding custom rule blocking the IPs of %s", IPListName)
+		rules = append(rules, cf.RulesetRule{
+			Action:      "block",
+			Expression:  "ip.src in $" + IPListName,
+			Description: "Block the IPs banned by CrowdSec",
+			Ref:         BlockRuleRef,
+			Enabled:     &enabled,
+		})
+	case rules[i].Enabled != nil && *rules[i].Enabled == enabled:
+		m.blockRuleEnabledByZone[zone.ID] = enabled
+		return nil
+	default:
+		if enabled {
+			m.zoneLogger(zone).Infof("Enabling custom rule %s", BlockRuleRef)
+		} else {
+			m.zoneLogger(zone).Infof("Disabling custom rule %s, the zone isn't enforced at this time", BlockRuleRef)
+		}
+		rules[i].Enabled = &enabled
+	}
+	_, err = m.api.UpdateEntrypointRuleset(m.Ctx, rc, cf.UpdateEntrypointRulesetParams{Phase: customRulesPhase, Rules: rules})
+	if err != nil {
+		return fmt.Errorf("unable to update the custom rule of zone %s: %w", zone.Domain, err)
+	}
+	m.blockRuleEnabledByZone[zone.ID] = enabled
+	return nil
+}
+
+// syncBlockRules enables or disables the custom rule of the zones whose enforcement changed since it was
+// last set.
+func (m *CloudflareAccountManager) syncBlockRules() error {
+	if !m.usesRuleset() {
+		return nil
+	}
+	now := time.Now()
+	for _, zone := range m.zones() {
+		m.blockRuleLock.Lock()
+		enabled, ok := m.blockRuleEnabledByZone[zone.ID]
+		m.blockRuleLock.Unlock()
+		if ok && enabled == m.blockRuleEnabled(zone, now) {
+			continue
+		}
+		if err := m.addBlockRule(zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FollowEnforcementSchedules enables and disables the custom rule of the zones as their enforcement
+// schedules open and close, the worker checking them on each request instead.
+func (m *CloudflareAccountManager) FollowEnforcementSchedules() error {
+	if !m.usesRuleset() {
+		return nil
+	}
+	ctx := m.Ctx
+	ticker := time.NewTicker(enforcementScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.syncBlockRules(); err != nil {
+				m.logger.Errorf("unable to follow the enforcement schedules, retrying in %s: %s", enforcementScheduleInterval, err)
+			}
+		}
+	}
+}
+
+// cleanUpRuleset removes the custom rule from the zones, and then the IP list it references.
+func (m *CloudflareAccountManager) cleanUpRuleset() error {
+	if !m.usesRuleset() {
+		return nil
+	}
+	for _, zone := range m.zones() {
+		rc := cf.ZoneIdentifier(zone.ID)
+		ruleset, err := m.api.GetEntrypointRuleset(m.Ctx, rc, customRulesPhase)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return err
+		}
+		rules := slices.DeleteFunc(slices.Clone(ruleset.Rules), func(rule cf.RulesetRule) bool { return rule.Ref == BlockRuleRef })
+		if len(rules) == len(ruleset.Rules) {
+			continue
+		}
+		m.zoneLogger(zone).Debugf("Deleting custom rule %s", BlockRuleRef)
+		if _, err := m.api.UpdateEntrypointRuleset(m.Ctx, rc, cf.UpdateEntrypointRulesetParams{Phase: customRulesPhase, Rules: rules}); err != nil {
+			return err
+		}
+	}
+
+	rc := cf.AccountIdentifier(m.AccountCfg.ID)
+	lists, err := m.api.ListLists(m.Ctx, rc, cf.ListListsParams{})
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		if list.Name != IPListName {
+			continue
+		}
+		m.logger.Debugf("Deleting IP list %s", IPListName)
+		if _, err := m.api.DeleteList(m.Ctx, rc, list.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	m.ipListID = ""
+	m.ipListItemByIP = nil
+	m.blockRuleLock.Lock()
+	m.blockRuleEnabledByZone = nil
+	m.blockRuleLock.Unlock()
+	return nil
+}
+
+// bannedWithRuleset tells whether a decision of the scope and action is enforced by the IP list rather
+// than by the worker.
+func (m *CloudflareAccountManager) bannedWithRuleset(scope string, action string) bool {
+	if action != "ban" {
+		return false
+	}
+	switch scope {
+	case "ip":
+		return m.AccountCfg.Backend == cfg.BackendRuleset
+	case "range":
+		return m.AccountCfg.UseIPLists
+	}
+	return false
+}
+
+// ipListHasRoom tells whether the IP list can hold one more item on top of its items and the pending
+// ones, the decisions which don't fit being enforced by the worker instead.
+func (m *CloudflareAccountManager) ipListHasRoom(pending []string) bool {
+	return len(m.ipListItemByIP)+len(pending)+1 <= maxIPListItems
+}
+
+// ipListItem returns the item of the IP list holding the IP or range, in the form Cloudflare returns it:
+// the IPv6 addresses are stored as their /64, and the ranges must be IPv4 /8 to /32 or IPv6 /12 to /64.
+// The values the list can't hold are enforced by the worker instead.
+func ipListItem(value string) (string, bool) {
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return "", false
+		}
+		if addr.Is4() || addr.Is4In6() {
+			return addr.Unmap().String(), true
+		}
+		prefix = netip.PrefixFrom(addr, 64)
+	}
+	bits := prefix.Bits()
+	switch {
+	case prefix.Addr().Is4() && bits == 32:
+		return prefix.Addr().String(), true
+	case prefix.Addr().Is4() && bits >= 8:
+		return prefix.Masked().String(), true
+	case prefix.Addr().Is6() && bits >= 12 && bits <= 64:
+		return prefix.Masked().String(), true
+	}
+	return "", false
+}
+
+// addIPListItems adds the IPs and ranges to the list, and caches the items of the list it returns.
+func (m *CloudflareAccountManager) addIPListItems(ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	items := make([]cf.ListItemCreateRequest, 0, len(ips))
+	for _, ip := range ips {
+		items = append(items, cf.ListItemCreateRequest{IP: &ip, Comment: "crowdsec"})
+	}
+	m.decisionsLogger().Infof("Adding %d IPs to the IP list", len(ips))
+	listItems, err := m.api.CreateListItems(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListCreateItemsParams{ID: m.ipListID, Items: items})
+	if err != nil {
+		return fmt.Errorf("error while adding IPs to the IP list: %w", err)
+	}
+	m.setIPListItems(listItems)
+	return nil
+}
+
+// deleteIPListItems removes the IPs and ranges from the list, skipping the ones it doesn't hold.
+func (m *CloudflareAccountManager) deleteIPListItems(ips []string) error {
+	items := make([]cf.ListItemDeleteItemRequest, 0, len(ips))
+	for _, ip := range ips {
+		if id, ok := m.ipListItemByIP[ip]; ok {
+			items = append(items, cf.ListItemDeleteItemRequest{ID: id})
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	m.decisionsLogger().Infof("Deleting %d IPs from the IP list", len(items))
+	_, err := m.api.DeleteListItems(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.ListDeleteItemsParams{
+		ID:    m.ipListID,
+		Items: cf.ListItemDeleteRequest{Items: items},
+	})
+	if err != nil {
+		return fmt.Errorf("error while deleting IPs from the IP list: %w", err)
+	}
+	for _, ip := range ips {
+		delete(m.ipListItemByIP, ip)
+	}
+	return nil
+}
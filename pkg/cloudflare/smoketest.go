@@ -0,0 +1,159 @@
+package cf
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+const (
+	// SmokeTestHeader carries the token of the smoke test. The worker enforces the action of the
+	// SMOKE_TEST key on the requests with the same token, whatever their IP.
+	SmokeTestHeader = "X-CrowdSec-Smoke-Test"
+	// SmokeTestRemediationHeader is set by the worker on the smoke test requests it enforced, to the
+	// remediation applied.
+	SmokeTestRemediationHeader = "X-CrowdSec-Remediation"
+	// DefaultSmokeTestTimeout leaves time to the test key to reach every Cloudflare location, KV being
+	// eventually consistent.
+	DefaultSmokeTestTimeout = 90 * time.Second
+	smokeTestInterval       = 5 * time.Second
+	smokeTestAction         = "ban"
+)
+
+// smokeTest is the value of the SMOKE_TEST key read by the worker.
+type smokeTest struct {
+	Token  string `json:"token"`
+	Action string `json:"action"`
+}
+
+// SmokeTestResult is the outcome of the smoke test of a zone.
+type SmokeTestResult struct {
+	Account string `json:"account"`
+	Zone    string `json:"zone"`
+	URL     string `json:"url"`
+	// Remediation is the remediation applied by the worker, empty if it let the request through
+	Remediation string `json:"remediation"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Passed tells whether the worker enforced the test decision.
+func (r SmokeTestResult) Passed() bool {
+	return r.Error == ""
+}
+
+// smokeTestURL returns the URL probed for a route pattern: a leading *. wildcard matches the www
+// subdomain and the other wildcards match nothing.
+func smokeTestURL(route string) string {
+	route = strings.TrimPrefix(strings.TrimPrefix(route, "https://"), "http://")
+	if strings.HasPrefix(route, "*.") {
+		route = "www." + route[2:]
+	}
+	route = strings.ReplaceAll(route, "*", "")
+	if !strings.Contains(route, "/") {
+		route += "/"
+	}
+	return "https://" + route
+}
+
+// SmokeTest checks that the deployed worker enforces decisions: it writes a temporary test decision to
+// KV, requests the first route of every zone with its token until the worker applies it or the timeout
+// elapses, and removes the decision. The zones without routes are skipped.
+func (m *CloudflareAccountManager) SmokeTest(client *http.Client, timeout time.Duration) ([]SmokeTestResult, error) {
+	found, err := m.findKVNamespace()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("KV namespace %s not found, the worker isn't deployed", m.Worker.KVNameSpaceName)
+	}
+
+	rawToken := make([]byte, 16)
+	if _, err := rand.Read(rawToken); err != nil {
+		return nil, fmt.Errorf("unable to generate smoke test token: %w", err)
+	}
+	token := hex.EncodeToString(rawToken)
+	value, err := json.Marshal(smokeTest{Token: token, Action: smokeTestAction})
+	if err != nil {
+		return nil, err
+	}
+	// the key expires on its own if it can't be deleted
+	_, err = m.api.WriteWorkersKVEntries(m.Ctx, cf.AccountIdentifier(m.AccountCfg.ID), cf.WriteWorkersKVEntriesParams{
+		NamespaceID: m.NamespaceID,
+		KVs: []*cf.WorkersKVPair{{
+			Key:           SmokeTestKeyName,
+			Value:         string(value),
+			ExpirationTTL: int((timeout + minKVExpirationTTL).Seconds()),
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to write smoke test key: %w", err)
+	}
+	defer func() {
+		if err := m.deleteKVKeys([]string{SmokeTestKeyName}); err != nil {
+			m.logger.Warnf("Unable to delete smoke test key, it expires on its own: %s", err)
+		}
+	}()
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// the ban redirect is the response to check, not the page it redirects to
+	probeClient := *client
+	probeClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	deadline := time.Now().Add(timeout)
+	results := make([]SmokeTestResult, 0)
+	for _, zone := range m.zones() {
+		if len(zone.RoutesToProtect) == 0 {
+			continue
+		}
+		result := SmokeTestResult{Account: m.AccountCfg.Name, Zone: zone.Domain, URL: smokeTestURL(zone.RoutesToProtect[0])}
+		m.zoneLogger(zone).Infof("Probing %s", result.URL)
+		for {
+			remediation, err := m.probeSmokeTest(&probeClient, result.URL, token)
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case remediation == "":
+				result.Error = "the worker let the request through, check its route, log_only and the zone schedule"
+			default:
+				result.Remediation = remediation
+				result.Error = ""
+			}
+			if result.Passed() || time.Now().Add(smokeTestInterval).After(deadline) {
+				break
+			}
+			select {
+			case <-m.Ctx.Done():
+				return nil, m.Ctx.Err()
+			case <-time.After(smokeTestInterval):
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// probeSmokeTest requests url with the smoke test token and returns the remediation the worker applied.
+func (m *CloudflareAccountManager) probeSmokeTest(client *http.Client, url string, token string) (string, error) {
+	req, err := http.NewRequestWithContext(m.Ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(SmokeTestHeader, token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Header.Get(SmokeTestRemediationHeader), nil
+}
@@ -0,0 +1,197 @@
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/metrics"
+)
+
+const (
+	tailProtocol = "trace-v1"
+	// delay before recreating a tail, doubled after each consecutive failure
+	tailMinBackoff = time.Second
+	tailMaxBackoff = 5 * time.Minute
+)
+
+// workerTail is a tail session of the worker, created through the Cloudflare API.
+type workerTail struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tailEvent is a trace of one worker invocation, as streamed on the tail websocket.
+type tailEvent struct {
+	Outcome string `json:"outcome"`
+	Event   *struct {
+		Request *struct {
+			URL    string `json:"url"`
+			Method string `json:"method"`
+		} `json:"request"`
+	} `json:"event"`
+	Logs []struct {
+		Level   string `json:"level"`
+		Message []any  `json:"message"`
+	} `json:"logs"`
+	Exceptions []struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+	} `json:"exceptions"`
+}
+
+// TailWorker streams the logs and exceptions of the deployed worker into the bouncer logs until the
+// manager context is done. Tails expire after a few hours and may be closed by Cloudflare at any time,
+// they are then recreated with an exponential backoff. Events wait in a bounded buffer to be logged,
+// and events received while it's full are dropped so that a slow logger never stalls the websocket.
+func (m *CloudflareAccountManager) TailWorker() error {
+	if !m.Worker.Tail.Enabled {
+		return nil
+	}
+	events := make(chan tailEvent, m.Worker.Tail.BufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			m.logTailEvent(event)
+		}
+	}()
+	defer func() {
+		close(events)
+		<-done
+	}()
+
+	backoff := tailMinBackoff
+	for {
+		start := time.Now()
+		err := m.tailWorker(m.Ctx, events)
+		if m.Ctx.Err() != nil {
+			m.logger.Warn("Stopping worker tail")
+			return nil
+		}
+		// the tail was up for a while, this isn't a consecutive failure
+		if time.Since(start) > tailMaxBackoff {
+			backoff = tailMinBackoff
+		}
+		m.logger.Warnf("Worker tail closed, reconnecting in %s: %s", backoff, err)
+		select {
+		case <-m.Ctx.Done():
+			m.logger.Warn("Stopping worker tail")
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > tailMaxBackoff {
+			backoff = tailMaxBackoff
+		}
+	}
+}
+
+// tailWorker runs a single tail session, pushing its events to events. It always returns an error
+// explaining why the session ended.
+func (m *CloudflareAccountManager) tailWorker(ctx context.Context, events chan<- tailEvent) error {
+	tail, err := m.createTail(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create worker tail: %w", err)
+	}
+	defer m.deleteTail(tail.ID)
+
+	wsCfg, err := websocket.NewConfig(tail.URL, "http://localhost/")
+	if err != nil {
+		return err
+	}
+	wsCfg.Protocol = []string{tailProtocol}
+	conn, err := wsCfg.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// unblock the receive below when the bouncer stops
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// events are only streamed once the filters are sent
+	if err := websocket.JSON.Send(conn, map[string]any{"filters": []any{}}); err != nil {
+		return err
+	}
+	m.logger.Infof("Tailing worker %s until %s", m.Worker.ScriptName, tail.ExpiresAt.Format(time.RFC3339))
+
+	dropped := 0
+	defer func() {
+		if dropped > 0 {
+			m.logger.Warnf("Dropped %d worker tail events, consider increasing the tail buffer_size", dropped)
+		}
+	}()
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return err
+		}
+		var event tailEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			m.logger.Debugf("Ignoring invalid worker tail event: %s", err)
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			dropped++
+			metrics.DroppedWorkerTailEvents.With(prometheus.Labels{"account": m.AccountCfg.Name}).Inc()
+		}
+	}
+}
+
+func (m *CloudflareAccountManager) createTail(ctx context.Context) (workerTail, error) {
+	var tail workerTail
+	resp, err := m.api.Raw(ctx, http.MethodPost, fmt.Sprintf("/accounts/%s/workers/scripts/%s/tails", m.AccountCfg.ID, m.Worker.ScriptName), nil, nil)
+	if err != nil {
+		return tail, err
+	}
+	if err := json.Unmarshal(resp.Result, &tail); err != nil {
+		return tail, err
+	}
+	return tail, nil
+}
+
+// deleteTail releases the tail, the manager context may already be done at this point.
+func (m *CloudflareAccountManager) deleteTail(tailID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := m.api.Raw(ctx, http.MethodDelete, fmt.Sprintf("/accounts/%s/workers/scripts/%s/tails/%s", m.AccountCfg.ID, m.Worker.ScriptName, tailID), nil, nil); err != nil {
+		m.logger.Debugf("unable to delete worker tail %s: %s", tailID, err)
+	}
+}
+
+func (m *CloudflareAccountManager) logTailEvent(event tailEvent) {
+	logger := m.logger.WithFields(log.Fields{"source": "worker", "outcome": event.Outcome})
+	if event.Event != nil && event.Event.Request != nil {
+		logger = logger.WithField("request", event.Event.Request.Method+" "+event.Event.Request.URL)
+	}
+	for _, line := range event.Logs {
+		parts := make([]string, 0, len(line.Message))
+		for _, part := range line.Message {
+			parts = append(parts, fmt.Sprint(part))
+		}
+		message := strings.Join(parts, " ")
+		switch line.Level {
+		case "error":
+			logger.Error(message)
+		case "warn":
+			logger.Warn(message)
+		case "debug":
+			logger.Debug(message)
+		default:
+			logger.Info(message)
+		}
+	}
+	for _, exception := range event.Exceptions {
+		logger.Errorf("%s: %s", exception.Name, exception.Message)
+	}
+}
@@ -0,0 +1,85 @@
+package cf
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// RequiredTokenPermissions are the permission groups a token needs for the bouncer to deploy and run
+// its infra.
+var RequiredTokenPermissions = []string{
+	"Workers Scripts Write",
+	"Workers KV Storage Write",
+	"D1 Write",
+	"Turnstile Sites Write",
+	"Workers Routes Write",
+}
+
+// RulesetTokenPermissions are the permission groups a token additionally needs for the ruleset backend
+// and use_ip_lists.
+var RulesetTokenPermissions = []string{
+	"Account Rule Lists Write",
+	"Zone WAF Write",
+}
+
+// requiredTokenPermissions returns the permissions required by the account, D1 Write not being required
+// when D1 is disabled, and the ones of the ruleset backend only when it or use_ip_lists is used.
+func requiredTokenPermissions(accountCfg cfg.AccountConfig, worker *cfg.CloudflareWorkerCreateParams) []string {
+	required := RequiredTokenPermissions
+	if accountCfg.DisableD1 || worker.DisableD1 {
+		required = slices.DeleteFunc(slices.Clone(required), func(permission string) bool {
+			return permission == "D1 Write"
+		})
+	}
+	if accountCfg.Backend == cfg.BackendRuleset || accountCfg.UseIPLists {
+		required = append(slices.Clone(required), RulesetTokenPermissions...)
+	}
+	return required
+}
+
+// missingTokenPermissions verifies the token used by api and returns the required permissions it
+// lacks. Permissions granted by a policy but denied by another one are considered missing.
+func missingTokenPermissions(ctx context.Context, api CloudflareAPI, required []string) ([]string, error) {
+	verified, err := api.VerifyAPIToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify token: %w", err)
+	}
+	if verified.Status != "active" {
+		return nil, fmt.Errorf("token is %s", verified.Status)
+	}
+	token, err := api.GetAPIToken(ctx, verified.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token permissions, make sure the token is allowed to read itself: %w", err)
+	}
+
+	allowed := make(map[string]bool)
+	denied := make(map[string]bool)
+	for _, policy := range token.Policies {
+		for _, group := range policy.PermissionGroups {
+			if policy.Effect == "deny" {
+				denied[group.Name] = true
+			} else {
+				allowed[group.Name] = true
+			}
+		}
+	}
+	missing := make([]string, 0)
+	for _, permission := range required {
+		if !allowed[permission] || denied[permission] {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// ValidateToken returns the required permissions missing from the token of the account.
+func ValidateToken(ctx context.Context, accountCfg cfg.AccountConfig, worker *cfg.CloudflareWorkerCreateParams, apiCfg *cfg.CloudflareAPIConfig) ([]string, error) {
+	api, err := NewCloudflareAPI(accountCfg, apiCfg)
+	if err != nil {
+		return nil, err
+	}
+	return missingTokenPermissions(ctx, api, requiredTokenPermissions(accountCfg, worker))
+}
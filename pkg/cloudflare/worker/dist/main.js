@@ -6526,13 +6526,121 @@ const getZoneFromReqURL = (reqURL, actionsByDomain) => {
   }
 }
 
+// Returns the KV key under which the decision for value, prefixed with its scope like ip:1.2.3.4, is stored.
+// When decision hashing is enabled this is the hex encoded HMAC-SHA256 of it, keyed with the salt shared by the bouncer.
+const decisionKey = async (value, salt) => {
+  if (salt === undefined) {
+    return value
+  }
+  const encoder = new TextEncoder()
+  const key = await crypto.subtle.importKey("raw", encoder.encode(salt), { name: "HMAC", hash: "SHA-256" }, false, ["sign"])
+  const signature = await crypto.subtle.sign("HMAC", key, encoder.encode(value))
+  return [...new Uint8Array(signature)].map((b) => b.toString(16).padStart(2, "0")).join("")
+}
+
+const isAllowlisted = (clientIP, allowlist) => {
+  const clientIPAddr = ipaddr.parse(clientIP);
+  for (const entry of allowlist) {
+    if (entry.includes("/")) {
+      const range = ipaddr.parseCIDR(entry);
+      if (clientIPAddr.kind() === range[0].kind() && clientIPAddr.match(range)) {
+        return true
+      }
+    } else {
+      const allowedIPAddr = ipaddr.parse(entry);
+      if (clientIPAddr.kind() === allowedIPAddr.kind() && clientIPAddr.toNormalizedString() === allowedIPAddr.toNormalizedString()) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
 const getSupportedActionForZone = (action, actionsForDomain) => {
   if (actionsForDomain["supported_actions"].includes(action)) {
     return action
   }
+  const actionFallback = actionsForDomain["action_fallback"] || {}
+  if (actionFallback[action]) {
+    return actionFallback[action]
+  }
   return actionsForDomain["default_action"]
 }
 
+// Returns the action of a decision KV value of scope, which is the bare action or, when the bouncer tags
+// the decisions with their scenario, a JSON {action, scenario}. The scenario_actions of the zone override
+// the action of the decisions of their scenarios, and then its scope_actions the one of their scope.
+const actionOfDecision = (value, scope, actionsForDomain) => {
+  const scopeActions = actionsForDomain["scope_actions"] || {}
+  if (!value.startsWith("{")) {
+    return scopeActions[scope] || value
+  }
+  const decision = JSON.parse(value)
+  const scenarioActions = actionsForDomain["scenario_actions"] || {}
+  return scenarioActions[decision["scenario"]] || scopeActions[scope] || decision["action"]
+}
+
+const weekdays = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"]
+
+// Returns the day of the week (0 being sunday) and the minutes since midnight of date in timeZone.
+const zonedClock = (date, timeZone) => {
+  const parts = new Intl.DateTimeFormat("en-US", {
+    timeZone: timeZone,
+    weekday: "short",
+    hour: "2-digit",
+    minute: "2-digit",
+    hourCycle: "h23",
+  }).formatToParts(date)
+  const part = (type) => parts.find((p) => p.type === type).value
+  return {
+    day: weekdays.indexOf(part("weekday")),
+    minutes: parseInt(part("hour"), 10) * 60 + parseInt(part("minute"), 10),
+  }
+}
+
+// A window starts on one of its days, and spans midnight when it ends before it starts.
+const isWithinSchedule = (date, schedule) => {
+  const { day, minutes } = zonedClock(date, schedule["timezone"])
+  const previousDay = (day + 6) % 7
+  return schedule["windows"].some((window) => {
+    const days = window["days"] || []
+    const startsOn = (d) => days.length === 0 || days.includes(d)
+    if (window["start"] < window["end"]) {
+      return startsOn(day) && minutes >= window["start"] && minutes < window["end"]
+    }
+    return (startsOn(day) && minutes >= window["start"]) || (startsOn(previousDay) && minutes < window["end"])
+  })
+}
+
+// Token bucket per IP and zone, stored in the cache API. The bucket holds at most
+// requests_per_minute tokens and is refilled continuously at the same rate.
+const isRateLimited = async (clientIP, zoneForThisRequest, rateLimit) => {
+  const capacity = rateLimit["requests_per_minute"]
+  const cache = caches.default
+  const cacheKey = new Request(`https://crowdsec-throttle.internal/${zoneForThisRequest}/${encodeURIComponent(clientIP)}`)
+  const now = Date.now()
+
+  let bucket = { tokens: capacity, last: now }
+  const cached = await cache.match(cacheKey)
+  if (cached !== undefined) {
+    bucket = await cached.json()
+  }
+
+  const elapsedMinutes = (now - bucket.last) / 60000
+  bucket.tokens = Math.min(capacity, bucket.tokens + elapsedMinutes * capacity)
+  bucket.last = now
+
+  const limited = bucket.tokens < 1
+  if (!limited) {
+    bucket.tokens -= 1
+  }
+
+  await cache.put(cacheKey, new Response(JSON.stringify(bucket), {
+    headers: { "Cache-Control": "max-age=60" }
+  }))
+  return limited
+}
+
 const handleTurnstilePost = async (request, body, turnstile_secret, zoneForThisRequest) => {
   const token = body.get('cf-turnstile-response');
   const ip = request.headers.get('CF-Connecting-IP');
@@ -6580,10 +6688,35 @@ const handleTurnstilePost = async (request, body, turnstile_secret, zoneForThisR
 /* harmony default export */ const __WEBPACK_DEFAULT_EXPORT__ = ({
   async fetch(request, env, ctx) {
 
-    const doBan = async () => {
-      return new Response(await env.CROWDSECCFBOUNCERNS.get("BAN_TEMPLATE"), {
-        status: 403,
-        headers: { "Content-Type": "text/html" }
+    // Returns the custom ban and captcha responses of the zone, an empty object if it has none.
+    const getResponseConfig = async (zoneForThisRequest) => {
+      const responseConfig = await env.CROWDSECCFBOUNCERNS.get("RESPONSE_CONFIG", { type: "json" });
+      if (responseConfig === null) {
+        return {}
+      }
+      return responseConfig[zoneForThisRequest] || {}
+    }
+
+    // Returns the ban template of the zone, the one of the account if the zone doesn't override it.
+    const getBanTemplate = async (zoneForThisRequest) => {
+      const banTemplateByDomain = await env.CROWDSECCFBOUNCERNS.get("BAN_TEMPLATE_BY_DOMAIN", { type: "json" });
+      if (banTemplateByDomain !== null && banTemplateByDomain[zoneForThisRequest]) {
+        return banTemplateByDomain[zoneForThisRequest]
+      }
+      return await env.CROWDSECCFBOUNCERNS.get("BAN_TEMPLATE")
+    }
+
+    const doBan = async (zoneForThisRequest) => {
+      const responseConfig = await getResponseConfig(zoneForThisRequest)
+      if (responseConfig["ban_redirect_url"]) {
+        return new Response(null, {
+          status: 302,
+          headers: { ...responseConfig["headers"], "Location": responseConfig["ban_redirect_url"] }
+        });
+      }
+      return new Response(await getBanTemplate(zoneForThisRequest), {
+        status: responseConfig["ban_status_code"] || 403,
+        headers: { ...responseConfig["headers"], "Content-Type": "text/html" }
       });
     }
 
@@ -6691,20 +6824,29 @@ const handleTurnstilePost = async (request, body, turnstile_secret, zoneForThisR
   
   </html>
       `
+      const responseConfig = await getResponseConfig(zoneForThisRequest)
       return new Response(captchaHTML, {
         headers: {
+          ...responseConfig["headers"],
           "content-type": "text/html;charset=UTF-8",
         },
-        status: 200
+        status: responseConfig["captcha_status_code"] || 200
       });
     }
 
-    const getRemediationForRequest = async (request, env) => {
-      console.log("Checking for decision against the IP")
+    const getRemediationForRequest = async (request, env, zoneForThisRequest) => {
       const clientIP = request.headers.get("CF-Connecting-IP");
-      let value = await env.CROWDSECCFBOUNCERNS.get(clientIP);
+      console.log("Checking if the IP is allowlisted")
+      const allowlist = await env.CROWDSECCFBOUNCERNS.get("ALLOWLIST", { type: "json" });
+      if (allowlist !== null && isAllowlisted(clientIP, allowlist)) {
+        console.log("IP is allowlisted")
+        return null
+      }
+
+      console.log("Checking for decision against the IP")
+      let value = await env.CROWDSECCFBOUNCERNS.get(await decisionKey(`ip:${clientIP.toLowerCase()}`, env.DECISION_HASH_SALT));
       if (value !== null) {
-        return value
+        return actionOfDecision(value, "ip", env.ACTIONS_BY_DOMAIN[zoneForThisRequest])
       }
 
       console.log("Checking for decision against the IP ranges")
@@ -6713,38 +6855,76 @@ const handleTurnstilePost = async (request, body, turnstile_secret, zoneForThisR
         actionByIPRange = JSON.parse(actionByIPRange)
       }
       if (actionByIPRange !== null) {
+        // the most specific range wins, the bouncer aggregates the ranges relying on it
         const clientIPAddr = ipaddr.parse(clientIP);
+        let matchedAction = null;
+        let matchedPrefixLength = -1;
         for (const [range, action] of Object.entries(actionByIPRange)) {
-          if (clientIPAddr.match(ipaddr.parseCIDR(range))) {
-            return action
+          const cidr = ipaddr.parseCIDR(range);
+          if (clientIPAddr.kind() === cidr[0].kind() && clientIPAddr.match(cidr) && cidr[1] > matchedPrefixLength) {
+            matchedAction = action
+            matchedPrefixLength = cidr[1]
           }
         }
+        if (matchedAction !== null) {
+          return actionOfDecision(matchedAction, "range", env.ACTIONS_BY_DOMAIN[zoneForThisRequest])
+        }
       }
-      // Check for decision against the AS
-      const clientASN = request.cf.asn.toString();
-      value = await env.CROWDSECCFBOUNCERNS.get(clientASN);
-      if (value !== null) {
-        return value
+      // Check for decision against the AS, which cloudflare resolves for the request
+      const actionByAS = await env.CROWDSECCFBOUNCERNS.get("AS_DECISIONS", { type: "json" });
+      if (actionByAS !== null && request.cf.asn !== undefined) {
+        value = actionByAS[request.cf.asn.toString()]
+        if (value !== undefined) {
+          return actionOfDecision(value, "as", env.ACTIONS_BY_DOMAIN[zoneForThisRequest])
+        }
       }
 
-      // Check for decision against the country of the request
+      // Check for decision against the country of the request, unless the zone allowlists it
       const clientCountry = request.cf.country.toLowerCase();
-      if (clientCountry !== null) {
-        value = await env.CROWDSECCFBOUNCERNS.get(clientCountry);
+      const countryAllowlist = await env.CROWDSECCFBOUNCERNS.get("COUNTRY_ALLOWLIST", { type: "json" });
+      if (countryAllowlist !== null && (countryAllowlist[zoneForThisRequest] || []).includes(clientCountry.toUpperCase())) {
+        console.log("Country is allowlisted")
+      } else if (clientCountry !== null) {
+        value = await env.CROWDSECCFBOUNCERNS.get(await decisionKey(`country:${clientCountry}`, env.DECISION_HASH_SALT));
         if (value !== null) {
-          return value
+          return actionOfDecision(value, "country", env.ACTIONS_BY_DOMAIN[zoneForThisRequest])
         }
       }
       return null
     }
 
+    // Returns the test decision of the bouncer smoke test if the request carries its token, null otherwise.
+    const getSmokeTest = async (request, env) => {
+      const token = request.headers.get("X-CrowdSec-Smoke-Test");
+      if (token === null) {
+        return null
+      }
+      const smokeTest = await env.CROWDSECCFBOUNCERNS.get("SMOKE_TEST", { type: "json" });
+      if (smokeTest === null || smokeTest["token"] !== token) {
+        return null
+      }
+      return smokeTest
+    }
+
+    // Tells the smoke test which remediation was applied.
+    const markSmokeTest = (response, remediation) => {
+      if (smokeTest === null) {
+        return response
+      }
+      response = new Response(response.body, response)
+      response.headers.set("X-CrowdSec-Remediation", remediation)
+      return response
+    }
+
     const incrementMetrics = async (metricName, ipType, origin, remediation_type) => {
-      if (env.CROWDSECCFBOUNCERDB !== undefined) {
-        let parameters = [metricName, origin || "", remediation_type || "", ipType]
+      // the smoke test requests aren't counted
+      if (env.CROWDSECCFBOUNCERDB !== undefined && smokeTest === null) {
+        // updated_at lets the bouncer delete the rows which stopped being updated
+        let parameters = [metricName, origin || "", remediation_type || "", ipType, Math.floor(Date.now() / 1000)]
         let query = `
-          INSERT INTO metrics (val, metric_name, origin, remediation_type, ip_type)
-          VALUES (1, ?, ?, ?, ?)
-          ON CONFLICT(metric_name, origin, remediation_type, ip_type) DO UPDATE SET val=val+1
+          INSERT INTO metrics (val, metric_name, origin, remediation_type, ip_type, updated_at)
+          VALUES (1, ?, ?, ?, ?, ?)
+          ON CONFLICT(metric_name, origin, remediation_type, ip_type) DO UPDATE SET val=val+1, updated_at=excluded.updated_at
         `;
 
         await env.CROWDSECCFBOUNCERDB
@@ -6757,29 +6937,53 @@ const handleTurnstilePost = async (request, body, turnstile_secret, zoneForThisR
 
     const clientIP = request.headers.get("CF-Connecting-IP");
     const ipType = ipaddr.parse(clientIP).kind();
+    const smokeTest = await getSmokeTest(request, env)
 
     await incrementMetrics("processed", ipType)
 
-
-    let remediation = await getRemediationForRequest(request, env)
-    if (remediation === null) {
-      console.log("No remediation found for request")
+    // the bouncer pauses the enforcement without tearing down the worker, smoke tests still get their action
+    if (smokeTest === null && await env.CROWDSECCFBOUNCERNS.get("ENFORCEMENT_ENABLED") === "false") {
+      console.log("Enforcement is paused, letting the request through")
       return fetch(request)
     }
+
     if (typeof env.ACTIONS_BY_DOMAIN === "string") {
       env.ACTIONS_BY_DOMAIN = JSON.parse(env.ACTIONS_BY_DOMAIN)
     }
     const zoneForThisRequest = getZoneFromReqURL(request.url, env.ACTIONS_BY_DOMAIN);
     console.log("Zone for this request is " + zoneForThisRequest)
+
+    let remediation = smokeTest !== null ? smokeTest["action"] : await getRemediationForRequest(request, env, zoneForThisRequest)
+    if (remediation === null) {
+      console.log("No remediation found for request")
+      return fetch(request)
+    }
+    const schedule = env.ACTIONS_BY_DOMAIN[zoneForThisRequest]["schedule"]
+    if (schedule && !isWithinSchedule(new Date(), schedule)) {
+      console.log("Decisions aren't enforced at this time for zone " + zoneForThisRequest)
+      return fetch(request)
+    }
     remediation = getSupportedActionForZone(remediation, env.ACTIONS_BY_DOMAIN[zoneForThisRequest])
     console.log("Remediation for request is " + remediation)
+    // the remediations of a log-only zone are only counted
+    const logOnly = env.LOG_ONLY === "true" || env.ACTIONS_BY_DOMAIN[zoneForThisRequest]["log_only"] === true
     switch (remediation) {
       case "ban":
         await incrementMetrics("dropped", ipType, "crowdsec", "ban")
-        return env.LOG_ONLY === "true" ? fetch(request) : await doBan()
+        return logOnly ? fetch(request) : markSmokeTest(await doBan(zoneForThisRequest), "ban")
       case "captcha":
         await incrementMetrics("dropped", ipType, "crowdsec", "captcha")
-        return env.LOG_ONLY === "true" ? fetch(request) : await doCaptcha(env, zoneForThisRequest)
+        return logOnly ? fetch(request) : markSmokeTest(await doCaptcha(env, zoneForThisRequest), "captcha")
+      case "throttle":
+        const rateLimit = env.ACTIONS_BY_DOMAIN[zoneForThisRequest]["rate_limit"]
+        if (!rateLimit || !(await isRateLimited(clientIP, zoneForThisRequest, rateLimit))) {
+          return fetch(request)
+        }
+        await incrementMetrics("dropped", ipType, "crowdsec", "throttle")
+        return logOnly ? fetch(request) : new Response("Too Many Requests", {
+          status: 429,
+          headers: { "Retry-After": "60" }
+        })
       default:
         return fetch(request)
     }
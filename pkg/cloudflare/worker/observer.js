@@ -0,0 +1,25 @@
+// Worker bound to the observe_routes of the zones. It never remediates the requests, it only counts
+// them in the D1 metrics of the bouncer. It has no dependency so it's uploaded as is, without bundling.
+
+const ipType = (clientIP) => (clientIP !== null && clientIP.includes(":") ? "ipv6" : "ipv4")
+
+export default {
+  async fetch(request, env, ctx) {
+    if (env.CROWDSECCFBOUNCERDB !== undefined) {
+      const query = `
+        INSERT INTO metrics (val, metric_name, origin, remediation_type, ip_type)
+        VALUES (1, ?, ?, ?, ?)
+        ON CONFLICT(metric_name, origin, remediation_type, ip_type) DO UPDATE SET val=val+1
+      `;
+      // the request isn't delayed by the metrics
+      ctx.waitUntil(
+        env.CROWDSECCFBOUNCERDB
+          .prepare(query)
+          .bind("processed", "", "", ipType(request.headers.get("CF-Connecting-IP")))
+          .run()
+          .catch((e) => console.error("Unable to update metrics: " + e))
+      )
+    }
+    return fetch(request)
+  }
+}
@@ -0,0 +1,142 @@
+package cf
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crowdsecurity/crowdsec-cloudflare-worker-bouncer/pkg/cfg"
+)
+
+// WatchZones periodically checks that the zones of the account still exist, every zone_check_interval.
+// The zones deleted from the account are no longer protected, instead of failing the calls made for them,
+// and are protected again if they reappear. It runs until the context is done.
+func (m *CloudflareAccountManager) WatchZones() error {
+	interval := m.AccountCfg.ZoneCheckInterval
+	if interval <= 0 {
+		return nil
+	}
+	m.logger.Debugf("Checking the zones of the account every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.Ctx.Done():
+			m.logger.Debug("Stopping zones watcher")
+			return nil
+		case <-ticker.C:
+			if err := m.reconcileZones(m.Ctx); err != nil {
+				m.logger.Errorf("unable to check the zones of the account: %s", err)
+			}
+		}
+	}
+}
+
+// isZoneRemoved tells whether the zone of the config was deleted from the account.
+func (m *CloudflareAccountManager) isZoneRemoved(zoneID string) bool {
+	m.zonesLock.RLock()
+	defer m.zonesLock.RUnlock()
+	_, ok := m.removedZones[zoneID]
+	return ok
+}
+
+// reconcileZones drops the zones deleted from the account from the protected ones, and protects again
+// the ones which reappeared. The worker is updated with the actions of the zones left, and the routes of
+// the zones which reappeared are bound again if they're missing. Their turnstile widget, kept in the
+// meantime, is reused.
+func (m *CloudflareAccountManager) reconcileZones(ctx context.Context) error {
+	zones, err := m.api.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		existing[zone.ID] = true
+	}
+
+	m.zonesLock.Lock()
+	active := make([]*cfg.ZoneConfig, 0, len(m.AccountCfg.ZoneConfigs))
+	removed := make([]*cfg.ZoneConfig, 0)
+	for _, zone := range m.AccountCfg.ZoneConfigs {
+		if existing[zone.ID] {
+			active = append(active, zone)
+		} else {
+			removed = append(removed, zone)
+		}
+	}
+	restored := make([]*cfg.ZoneConfig, 0)
+	for zoneID, zone := range m.removedZones {
+		if existing[zoneID] {
+			restored = append(restored, zone)
+			delete(m.removedZones, zoneID)
+		}
+	}
+	if m.removedZones == nil && len(removed) > 0 {
+		m.removedZones = make(map[string]*cfg.ZoneConfig)
+	}
+	for _, zone := range removed {
+		m.removedZones[zone.ID] = zone
+	}
+	m.AccountCfg.ZoneConfigs = append(active, restored...)
+	m.zonesLock.Unlock()
+
+	if len(removed) == 0 && len(restored) == 0 {
+		return nil
+	}
+	for _, zone := range removed {
+		m.zoneLogger(zone).Warnf("Zone %s was deleted from the account, it's no longer protected", zone.ID)
+	}
+	for _, zone := range restored {
+		m.zoneLogger(zone).Infof("Zone %s reappeared in the account, protecting it again", zone.ID)
+	}
+
+	varActionsForZoneByDomain, err := actionsForZoneByDomain(m.zones())
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Updating worker %s version %s", m.Worker.ScriptName, WorkerScriptVersion())
+	worker, err := m.api.UploadWorker(ctx, cf.AccountIdentifier(m.AccountCfg.ID), m.Worker.CreateWorkerParams(workerScript, m.NamespaceID, varActionsForZoneByDomain, m.DatabaseID))
+	if err != nil {
+		return err
+	}
+	m.workerUploaded(worker)
+	m.setKVPayloadBytes(cfg.VarNameForActionsByDomain, len(varActionsForZoneByDomain))
+	if m.Worker.DispatchNamespace != "" {
+		return nil
+	}
+	for _, zone := range restored {
+		if err := m.restoreWorkerRoutes(ctx, zone, worker.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreWorkerRoutes binds again the routes of a zone which reappeared in the account, the ones it
+// still has being left as is.
+func (m *CloudflareAccountManager) restoreWorkerRoutes(ctx context.Context, zone *cfg.ZoneConfig, scriptID string) error {
+	routeResp, err := m.api.ListWorkerRoutes(ctx, cf.ZoneIdentifier(zone.ID), cf.ListWorkerRoutesParams{})
+	if err != nil {
+		return err
+	}
+	missing := func(patterns []string) []string {
+		return slices.DeleteFunc(slices.Clone(patterns), func(pattern string) bool {
+			return slices.ContainsFunc(routeResp.Routes, func(route cf.WorkerRoute) bool { return route.Pattern == pattern })
+		})
+	}
+	observeRoutes := missing(zone.ObserveRoutes)
+	observerID := ""
+	if len(observeRoutes) > 0 {
+		if observerID, err = m.deployObserver(ctx); err != nil {
+			return err
+		}
+	}
+	zg := errgroup.Group{}
+	zg.SetLimit(max(m.routeConcurrency, 1))
+	m.bindWorkerRoutes(&zg, zone, missing(zone.RoutesToProtect), scriptID)
+	m.bindWorkerRoutes(&zg, zone, observeRoutes, observerID)
+	return zg.Wait()
+}
@@ -1,6 +1,20 @@
 package metrics
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Register registers the collectors to the default registry, the name of their metrics prefixed with
+// prefix. An empty prefix keeps the default names.
+func Register(prefix string, collectors ...prometheus.Collector) {
+	registerer := prometheus.DefaultRegisterer
+	if prefix != "" {
+		registerer = prometheus.WrapRegistererWithPrefix(prefix, registerer)
+	}
+	registerer.MustRegister(collectors...)
+}
 
 const (
 	BlockedRequestMetricName   = "crowdsec_cloudflare_worker_bouncer_blocked_requests"
@@ -16,6 +30,40 @@ var CloudflareAPICallsByAccount = prometheus.NewCounterVec(
 	[]string{"account"},
 )
 
+var CloudflareAPICallsByEndpoint = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudflare_api_calls_by_endpoint_total",
+		Help: "Number of api calls made to cloudflare by each account, by endpoint without the IDs",
+	},
+	[]string{"account", "endpoint"},
+)
+
+var CloudflareAPIDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "cloudflare_api_duration_seconds",
+		Help: "Duration of the api calls made to cloudflare by each account, by endpoint without the IDs",
+		// from fast reads to bulk KV writes and worker uploads
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"account", "endpoint"},
+)
+
+var CloudflareAPIRateRemaining = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cloudflare_api_rate_remaining",
+		Help: "Number of api calls left to each account before being rate limited, as last reported by cloudflare",
+	},
+	[]string{"account"},
+)
+
+var WorkerInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cloudflare_worker_info",
+		Help: "Version of the worker script deployed by each account, always 1",
+	},
+	[]string{"version", "account"},
+)
+
 var TotalKeysByAccount = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "cloudflare_keys_total",
@@ -24,6 +72,17 @@ var TotalKeysByAccount = prometheus.NewGaugeVec(
 	[]string{"account"},
 )
 
+// DecisionsPayloadKey is the key label of the payload size of all the decision keys of an account.
+const DecisionsPayloadKey = "decisions"
+
+var KVPayloadBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cloudflare_kv_payload_bytes",
+		Help: "Size in bytes of the values written to Worker KV by account and key, the decisions being counted together with their keys",
+	},
+	[]string{"account", "key"},
+)
+
 var TotalBlockedRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	Name: BlockedRequestMetricName,
 	Help: "Total number of blocked requests",
@@ -39,4 +98,110 @@ var LastProcessedRequestValue map[string]float64 = make(map[string]float64)
 var TotalActiveDecisions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	Name: ActiveDecisionsMetricName,
 	Help: "Total number of active decisions",
-}, []string{"origin", "ip_type", "scope", "account"})
+}, []string{"origin", "ip_type", "scope", "scenario", "account"})
+
+// OtherScenarioLabel is the scenario label of the decisions whose scenario is over the limit.
+const OtherScenarioLabel = "other"
+
+var scenarioLabels = struct {
+	lock  sync.Mutex
+	limit int
+	seen  map[string]struct{}
+}{seen: make(map[string]struct{})}
+
+// SetScenarioLabelLimit sets the number of distinct scenarios used as label of the active decisions
+// metric, to keep its cardinality bounded. 0 disables the label.
+func SetScenarioLabelLimit(limit int) {
+	scenarioLabels.lock.Lock()
+	defer scenarioLabels.lock.Unlock()
+	scenarioLabels.limit = limit
+	scenarioLabels.seen = make(map[string]struct{})
+}
+
+// ScenarioLabel returns the scenario label of a decision. The first scenarios seen, up to the limit,
+// keep their own label for the lifetime of the process and the next ones are labelled "other".
+func ScenarioLabel(scenario string) string {
+	scenarioLabels.lock.Lock()
+	defer scenarioLabels.lock.Unlock()
+	if scenarioLabels.limit == 0 {
+		return ""
+	}
+	if _, ok := scenarioLabels.seen[scenario]; ok {
+		return scenario
+	}
+	if len(scenarioLabels.seen) >= scenarioLabels.limit {
+		return OtherScenarioLabel
+	}
+	scenarioLabels.seen[scenario] = struct{}{}
+	return scenario
+}
+
+var SkippedAllowlistedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_allowlisted_decisions_skipped_total",
+	Help: "Total number of decisions skipped because their value is allowlisted",
+}, []string{"scope", "account"})
+
+var SkippedUnsupportedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_skipped_decisions_total",
+	Help: "Total number of decisions skipped because the worker can't enforce their scope",
+}, []string{"scope", "account"})
+
+var CloudflareAPIDeprecationWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_api_deprecation_warnings_total",
+	Help: "Total number of deprecation warnings returned by the Cloudflare API",
+}, []string{"account"})
+
+var LAPIReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "lapi_reconnects_total",
+	Help: "Total number of times a LAPI delivered decisions again after stream_timeout without any",
+}, []string{"source"})
+
+var ShedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_shed_decisions_total",
+	Help: "Total number of decisions not written to KV because the account reached its max_kv_keys",
+}, []string{"action", "account"})
+
+var ActionFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_action_fallbacks_total",
+	Help: "Total number of decisions whose action was replaced by the zones action_fallback",
+}, []string{"from", "to", "account"})
+
+var DroppedWorkerTailEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_worker_tail_dropped_events_total",
+	Help: "Total number of worker tail events dropped because the bouncer couldn't log them fast enough",
+}, []string{"account"})
+
+var WorkerD1Healthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_worker_d1_healthy",
+	Help: "Whether the D1 DB the worker of each account writes its metrics to can be queried, 0 when it or its metrics table is gone",
+}, []string{"account"})
+
+var OtherScopeDecisions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_other_scope_decisions",
+	Help: "Number of decisions of the pass-through scopes stored for the workers consuming them",
+}, []string{"scope", "account"})
+
+var CloudflareAuthFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_auth_failed",
+	Help: "Whether Cloudflare rejected the token of each account, 1 once it's revoked or expired and the account is no longer managed",
+}, []string{"account"})
+
+var EnforcementPaused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_enforcement_paused",
+	Help: "Whether the enforcement of the decisions is paused for each account, the worker then letting every request through",
+}, []string{"account"})
+
+var TurnstileRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_turnstile_rotations_total",
+	Help: "Total number of rotations of the turnstile secret key of each zone",
+}, []string{"account", "zone"})
+
+var TurnstileRotationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_turnstile_rotation_errors_total",
+	Help: "Total number of failed rotations of the turnstile secret key of each zone",
+}, []string{"account", "zone"})
+
+var TurnstileLastRotation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_turnstile_last_rotation_timestamp",
+	Help: "Unix timestamp of the last successful rotation of the turnstile secret key of each zone",
+}, []string{"account", "zone"})
@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lifecycle events sent to the webhook.
+const (
+	EventInfraDeployed    = "infra_deployed"
+	EventCleanupCompleted = "cleanup_completed"
+	EventAccountDegraded  = "account_degraded"
+	EventTurnstileRotated = "turnstile_rotated"
+)
+
+const (
+	queueSize       = 100
+	deliveryTimeout = 10 * time.Second
+	closeTimeout    = 5 * time.Second
+)
+
+// Event is the JSON body posted to the webhook.
+type Event struct {
+	Type      string    `json:"event"`
+	Account   string    `json:"account"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Notifier posts the lifecycle events of the bouncer to a webhook. The events are sent in the background,
+// so that a slow or failing webhook never holds the bouncer up: they are dropped when too many are waiting,
+// and delivery failures are only logged. A nil Notifier drops every event.
+type Notifier struct {
+	url    string
+	client *http.Client
+	events chan Event
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// New returns a Notifier posting to webhookURL, or nil if it's empty.
+func New(webhookURL string) *Notifier {
+	if webhookURL == "" {
+		return nil
+	}
+	n := &Notifier{
+		url:    webhookURL,
+		client: &http.Client{Timeout: deliveryTimeout},
+		events: make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event of the account, with the error which caused it if any.
+func (n *Notifier) Notify(eventType string, account string, err error) {
+	if n == nil {
+		return
+	}
+	event := Event{Type: eventType, Account: account, Timestamp: time.Now().UTC()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.events <- event:
+	default:
+		log.Warnf("Too many webhook events waiting, dropping the %s event of account %s", eventType, account)
+	}
+}
+
+// Close stops accepting events, and waits for the queued ones to be sent for at most closeTimeout.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.events)
+	}
+	n.lock.Unlock()
+	select {
+	case <-n.done:
+	case <-time.After(closeTimeout):
+		log.Warnf("Timed out sending the webhook events")
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for event := range n.events {
+		if err := n.send(event); err != nil {
+			log.Warnf("Unable to send the %s event of account %s to the webhook: %s", event.Type, event.Account, err)
+		}
+	}
+}
+
+func (n *Notifier) send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestNotifier(t *testing.T) {
+	lock := sync.Mutex{}
+	events := make([]Event, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := Event{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid event: %s", err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+		// a failed delivery doesn't stop the next ones
+		if event.Type == EventAccountDegraded {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	n := New(server.URL)
+	n.Notify(EventAccountDegraded, "account", errors.New("unable to deploy infra"))
+	n.Notify(EventInfraDeployed, "account", nil)
+	n.Close()
+	// events are dropped once closed
+	n.Notify(EventCleanupCompleted, "account", nil)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Type != EventAccountDegraded || events[0].Account != "account" || events[0].Error != "unable to deploy infra" || events[0].Timestamp.IsZero() {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+	if events[1].Type != EventInfraDeployed || events[1].Error != "" {
+		t.Fatalf("unexpected event %+v", events[1])
+	}
+
+	// without a webhook, events are dropped
+	disabled := New("")
+	if disabled != nil {
+		t.Fatalf("expected no notifier without a webhook")
+	}
+	disabled.Notify(EventInfraDeployed, "account", nil)
+	disabled.Close()
+}